@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mkmik/piggo/pigox"
+)
+
+// credentialsFile returns a verifier reading the credentials of users from a file whenever a client authenticates,
+// so that it can be edited without restarting. Each line of the file is
+//
+//	user secret [token]
+//
+// where secret is the password of the user, its MD5 hash or its SCRAM-SHA-256 verifier (see
+// pigox.StoredCredentials) and token is the IOx token of the user's queries. Empty lines and lines starting with #
+// are ignored.
+func credentialsFile(name string) (pigox.CredentialVerifier, error) {
+	if _, err := readCredentials(name); err != nil {
+		return nil, err
+	}
+	return func(user, database string) (pigox.StoredCredentials, error) {
+		creds, err := readCredentials(name)
+		if err != nil {
+			return pigox.StoredCredentials{}, err
+		}
+		c, ok := creds[user]
+		if !ok {
+			return pigox.StoredCredentials{}, fmt.Errorf("no such user in %s", name)
+		}
+		return c, nil
+	}, nil
+}
+
+func readCredentials(name string) (map[string]pigox.StoredCredentials, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	creds := map[string]pigox.StoredCredentials{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected user secret [token]", name, n)
+		}
+		c := pigox.StoredCredentials{Secret: fields[1]}
+		if len(fields) == 3 {
+			c.Token = fields[2]
+		}
+		creds[fields[0]] = c
+	}
+	return creds, sc.Err()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BenchCmd replays a query file over concurrent connections to a proxy and reports latencies and throughput.
+type BenchCmd struct {
+	QueryFile   string        `arg:"" type:"existingfile" help:"File with the queries to replay, one per line; blank lines and lines starting with -- are ignored."`
+	Address     string        `optional:"" default:"127.0.0.1:5432" env:"PIGOX_PING_ADDRESS"`
+	Database    string        `optional:"" env:"PGDATABASE"`
+	User        string        `optional:"" default:"piggo" env:"PGUSER"`
+	Password    string        `optional:"" env:"PGPASSWORD"`
+	Connections int           `optional:"" short:"c" default:"4" help:"Number of concurrent connections."`
+	Iterations  int           `optional:"" short:"n" default:"1" help:"Number of times each connection replays the query file."`
+	Duration    time.Duration `optional:"" short:"d" default:"0s" help:"Keep replaying the query file for this long; overrides --iterations."`
+	Timeout     time.Duration `optional:"" default:"30s" help:"Timeout of each query."`
+}
+
+// benchResult is the outcome of a single query.
+type benchResult struct {
+	latency time.Duration
+	rows    int
+	err     error
+}
+
+// Run executes the benchmark.
+func (cmd *BenchCmd) Run(cli *Context) error {
+	queries, err := readQueryFile(cmd.QueryFile)
+	if err != nil {
+		return err
+	}
+	if len(queries) == 0 {
+		return fmt.Errorf("no queries in %s", cmd.QueryFile)
+	}
+	if cmd.Connections < 1 {
+		return fmt.Errorf("--connections must be at least 1")
+	}
+
+	params := map[string]string{"database": cmd.Database, "user": cmd.User, "application_name": "piggo bench"}
+	conns := make([]*pgConn, cmd.Connections)
+	for i := range conns {
+		if conns[i], err = dialPG(cmd.Address, cmd.Timeout, params, cmd.Password); err != nil {
+			for _, c := range conns[:i] {
+				c.Close()
+			}
+			return err
+		}
+	}
+
+	var (
+		mu       sync.Mutex
+		results  []benchResult
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	start := time.Now()
+	deadline := start.Add(cmd.Duration)
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *pgConn) {
+			defer wg.Done()
+			defer c.Close()
+			var local []benchResult
+			for iter := 0; cmd.Duration > 0 || iter < cmd.Iterations; iter++ {
+				for _, q := range queries {
+					if cmd.Duration > 0 && time.Now().After(deadline) {
+						break
+					}
+					t := time.Now()
+					rows, err := c.query(q)
+					local = append(local, benchResult{latency: time.Since(t), rows: rows, err: err})
+				}
+				if cmd.Duration > 0 && time.Now().After(deadline) {
+					break
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, local...)
+			for _, r := range local {
+				if r.err != nil && firstErr == nil {
+					firstErr = r.err
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	printBenchReport(results, elapsed, cmd.Connections)
+	if firstErr != nil {
+		fmt.Printf("first error: %v\n", firstErr)
+	}
+	return nil
+}
+
+// readQueryFile reads one query per line.
+func readQueryFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var queries []string
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "--") {
+			continue
+		}
+		queries = append(queries, line)
+	}
+	return queries, s.Err()
+}
+
+func printBenchReport(results []benchResult, elapsed time.Duration, connections int) {
+	var (
+		latencies []time.Duration
+		rows      int
+		failed    int
+	)
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			continue
+		}
+		latencies = append(latencies, r.latency)
+		rows += r.rows
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Printf("connections: %d\n", connections)
+	fmt.Printf("queries:     %d (%d failed)\n", len(results), failed)
+	fmt.Printf("rows:        %d\n", rows)
+	fmt.Printf("duration:    %v\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("throughput:  %.1f queries/s, %.1f rows/s\n", float64(len(results))/elapsed.Seconds(), float64(rows)/elapsed.Seconds())
+	if len(latencies) == 0 {
+		return
+	}
+	percentile := func(p float64) time.Duration {
+		i := int(p/100*float64(len(latencies))+0.5) - 1
+		if i < 0 {
+			i = 0
+		} else if i >= len(latencies) {
+			i = len(latencies) - 1
+		}
+		return latencies[i]
+	}
+	fmt.Printf("latency:     min %v, p50 %v, p90 %v, p99 %v, max %v\n",
+		latencies[0].Round(time.Microsecond),
+		percentile(50).Round(time.Microsecond),
+		percentile(90).Round(time.Microsecond),
+		percentile(99).Round(time.Microsecond),
+		latencies[len(latencies)-1].Round(time.Microsecond))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow/array"
+	influxdbiox "github.com/influxdata/influxdb-iox-client-go"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// PingCmd checks that a proxy accepts connections, authenticates and answers queries.
+type PingCmd struct {
+	Address  string        `optional:"" default:"127.0.0.1:5432" env:"PIGOX_PING_ADDRESS"`
+	Database string        `optional:"" env:"PGDATABASE"`
+	User     string        `optional:"" default:"piggo" env:"PGUSER"`
+	Password string        `optional:"" env:"PGPASSWORD"`
+	Query    string        `optional:"" default:"select 1"`
+	Timeout  time.Duration `optional:"" default:"5s"`
+}
+
+// Run connects to the proxy over the PG wire protocol.
+func (cmd *PingCmd) Run(cli *Context) error {
+	start := time.Now()
+	c, err := dialPG(cmd.Address, cmd.Timeout, map[string]string{"database": cmd.Database, "user": cmd.User}, cmd.Password)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	rows, err := c.query(cmd.Query)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("ok: %d rows in %v\n", rows, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// CheckCmd checks that the IOx backend answers queries, bypassing the proxy.
+type CheckCmd struct {
+	IOxAddress string        `name:"iox-querier-grpc-address" optional:"" default:"localhost:8082" env:"PIGOX_IOX_QUERIER_GRPC_ADDRESS"`
+	Database   string        `required:"" env:"PGDATABASE"`
+	Query      string        `optional:"" default:"select 1"`
+	Timeout    time.Duration `optional:"" default:"5s"`
+}
+
+// Run queries IOx directly.
+func (cmd *CheckCmd) Run(cli *Context) error {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), cmd.Timeout)
+	defer cancel()
+
+	client, err := influxdbiox.NewClient(ctx, &influxdbiox.ClientConfig{
+		Address:  cmd.IOxAddress,
+		Database: cmd.Database,
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	q, err := client.PrepareQuery(ctx, cmd.Database, cmd.Query)
+	if err != nil {
+		return err
+	}
+	reader, err := q.Query(ctx)
+	if err != nil {
+		return err
+	}
+	defer reader.Release()
+
+	rows := 0
+	for {
+		var batch array.Record
+		batch, err = reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		rows += int(batch.NumRows())
+	}
+	fmt.Printf("ok: %d rows in %v\n", rows, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// pgConn is a minimal PG wire protocol client.
+type pgConn struct {
+	conn     net.Conn
+	frontend *pgproto3.Frontend
+	timeout  time.Duration
+}
+
+// dialPG connects to a postgres server and performs the startup handshake.
+func dialPG(address string, timeout time.Duration, params map[string]string, password string) (*pgConn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &pgConn{
+		conn:     conn,
+		frontend: pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn),
+		timeout:  timeout,
+	}
+	if err := c.startup(params, password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *pgConn) startup(params map[string]string, password string) error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := c.frontend.Send(&pgproto3.StartupMessage{ProtocolVersion: pgproto3.ProtocolVersionNumber, Parameters: params}); err != nil {
+		return err
+	}
+	for {
+		msg, err := c.frontend.Receive()
+		if err != nil {
+			return fmt.Errorf("error during startup: %w", err)
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.AuthenticationCleartextPassword:
+			if err := c.frontend.Send(&pgproto3.PasswordMessage{Password: password}); err != nil {
+				return err
+			}
+		case *pgproto3.ErrorResponse:
+			return errorResponseError(msg)
+		case *pgproto3.ReadyForQuery:
+			return nil
+		case *pgproto3.AuthenticationOk, *pgproto3.ParameterStatus, *pgproto3.BackendKeyData, *pgproto3.NoticeResponse:
+		default:
+			return fmt.Errorf("unsupported startup message %T", msg)
+		}
+	}
+}
+
+// query runs a simple query and returns the number of data rows received.
+func (c *pgConn) query(sql string) (int, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := c.frontend.Send(&pgproto3.Query{String: sql}); err != nil {
+		return 0, err
+	}
+	var (
+		rows     int
+		queryErr error
+	)
+	for {
+		msg, err := c.frontend.Receive()
+		if err != nil {
+			return 0, err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.DataRow:
+			rows++
+		case *pgproto3.ErrorResponse:
+			queryErr = errorResponseError(msg)
+		case *pgproto3.ReadyForQuery:
+			return rows, queryErr
+		}
+	}
+}
+
+func (c *pgConn) Close() error {
+	c.frontend.Send(&pgproto3.Terminate{})
+	return c.conn.Close()
+}
+
+func errorResponseError(msg *pgproto3.ErrorResponse) error {
+	if msg.Code == "" {
+		return errors.New(msg.Message)
+	}
+	return fmt.Errorf("%s (SQLSTATE %s)", msg.Message, msg.Code)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mkmik/piggo/pigox"
+)
+
+// LogFlags contains the CLI parameters controlling where logs are written.
+type LogFlags struct {
+	LogStderr     bool          `name:"log-stderr" optional:"" default:"true" negatable:"" env:"PIGOX_LOG_STDERR"`
+	LogFile       string        `name:"log-file" optional:"" type:"path" env:"PIGOX_LOG_FILE"`
+	LogMaxSize    int64         `name:"log-max-size" optional:"" default:"100" env:"PIGOX_LOG_MAX_SIZE" help:"Rotate the log file when it exceeds this size in MiB (0 disables)."`
+	LogMaxAge     time.Duration `name:"log-max-age" optional:"" default:"24h" env:"PIGOX_LOG_MAX_AGE" help:"Rotate the log file when it is older than this (0 disables)."`
+	LogMaxBackups int           `name:"log-max-backups" optional:"" default:"7" env:"PIGOX_LOG_MAX_BACKUPS" help:"Number of rotated log files to keep (0 keeps all)."`
+	LogSyslog     bool          `name:"log-syslog" optional:"" env:"PIGOX_LOG_SYSLOG" help:"Send logs to the local syslog daemon (or journald)."`
+
+	LogLevel       string `name:"log-level" optional:"" default:"info" enum:"debug,info,warn,error" env:"PIGOX_LOG_LEVEL" help:"Minimum level of the messages logged; debug logs every query."`
+	LogFormat      string `name:"log-format" optional:"" default:"text" enum:"text,json" env:"PIGOX_LOG_FORMAT" help:"Log as logfmt-style text or as JSON lines."`
+	LogQueries     string `name:"log-queries" optional:"" default:"full" enum:"full,truncate,omit" env:"PIGOX_LOG_QUERIES" help:"Log the full text of queries, truncate it to --log-query-length bytes, or omit it."`
+	LogQueryLength int    `name:"log-query-length" optional:"" default:"256" env:"PIGOX_LOG_QUERY_LENGTH" help:"Length in bytes queries are truncated to with --log-queries=truncate."`
+
+	AuditLog string `name:"audit-log" optional:"" env:"PIGOX_AUDIT_LOG" help:"Record every login attempt and query as JSON lines in this file, rotated like the log file, or on stdout with -."`
+
+	file      *rotatingFile
+	auditFile *rotatingFile
+	logger    *slog.Logger
+}
+
+// setupLogging redirects the standard logger to the configured sinks, and makes the structured logger writing to
+// them with the configured level and format the default one.
+func (f *LogFlags) setupLogging() error {
+	var sinks []io.Writer
+	if f.LogStderr {
+		sinks = append(sinks, os.Stderr)
+	}
+	if f.LogFile != "" {
+		rf, err := openRotatingFile(f.LogFile, f.LogMaxSize<<20, f.LogMaxAge, f.LogMaxBackups)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, rf)
+		f.file = rf
+	}
+	if f.LogSyslog {
+		w, err := newSyslogWriter("piggo")
+		if err != nil {
+			return fmt.Errorf("cannot connect to syslog: %w", err)
+		}
+		sinks = append(sinks, w)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(f.LogLevel)); err != nil {
+		return err
+	}
+	w := io.MultiWriter(sinks...)
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewTextHandler(w, opts)
+	if f.LogFormat == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	f.logger = slog.New(h)
+	// SetDefault also sends the output of the standard logger to the handler.
+	slog.SetDefault(f.logger)
+	return nil
+}
+
+// proxyLoggingOptions returns the options making the proxy log as configured.
+func (f *LogFlags) proxyLoggingOptions() ([]pigox.ProxyOption, error) {
+	mode, err := pigox.ParseQueryLogMode(f.LogQueries)
+	if err != nil {
+		return nil, err
+	}
+	opts := []pigox.ProxyOption{pigox.WithLogger(f.logger), pigox.WithQueryLogging(mode, f.LogQueryLength)}
+	switch f.AuditLog {
+	case "":
+	case "-":
+		opts = append(opts, pigox.WithAuditSink(pigox.NewJSONAuditSink(os.Stdout)))
+	default:
+		rf, err := openRotatingFile(f.AuditLog, f.LogMaxSize<<20, f.LogMaxAge, f.LogMaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open audit log: %w", err)
+		}
+		f.auditFile = rf
+		opts = append(opts, pigox.WithAuditSink(pigox.NewJSONAuditSink(rf)))
+	}
+	return opts, nil
+}
+
+// reopenLogs reopens the log and audit files, e.g. after an external tool like logrotate moved them away.
+func (f *LogFlags) reopenLogs() error {
+	for _, rf := range []*rotatingFile{f.file, f.auditFile} {
+		if rf == nil {
+			continue
+		}
+		if err := rf.reopen(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotatingFile is a log file that is rotated when it grows past a maximum size or age.
+// Rotated files are renamed with a timestamp suffix and the oldest are pruned.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size, r.created = f, fi.Size(), fi.ModTime()
+	if r.size == 0 {
+		r.created = time.Now()
+	}
+	return nil
+}
+
+func (r *rotatingFile) reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && ((r.maxSize > 0 && r.size+int64(len(b)) > r.maxSize) || (r.maxAge > 0 && time.Since(r.created) > r.maxAge)) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot rotate log file: %v\n", err)
+		}
+	}
+	n, err := r.file.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(r.path)
+	backup := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(r.path, ext), time.Now().UTC().Format("20060102T150405.000"), ext)
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	return r.prune()
+}
+
+// prune removes the oldest rotated files in excess of maxBackups.
+func (r *rotatingFile) prune() error {
+	if r.maxBackups <= 0 {
+		return nil
+	}
+	ext := filepath.Ext(r.path)
+	backups, err := filepath.Glob(strings.TrimSuffix(r.path, ext) + "-*" + ext)
+	if err != nil {
+		return err
+	}
+	// timestamp suffixes sort chronologically.
+	sort.Strings(backups)
+	for len(backups) > r.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package pigox
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig configures the automatic provisioning of the listener certificate via ACME (e.g. Let's Encrypt).
+type ACMEConfig struct {
+	// Domains is the list of host names certificates are obtained for.
+	Domains []string
+	// Email is the optional contact address of the ACME account.
+	Email string
+	// CacheDir is the directory where account keys and certificates are persisted across restarts.
+	CacheDir string
+	// DirectoryURL is the ACME directory endpoint. Defaults to Let's Encrypt production.
+	DirectoryURL string
+}
+
+// NewACMECertManager returns a certificate manager that obtains and renews certificates on demand.
+//
+// Its GetCertificate method can be used as tls.Config.GetCertificate.
+// Domain ownership is proven with the TLS-ALPN-01 challenge, which must be answered on port 443 by
+// ServeACMEChallenges: the PG protocol wraps TLS in an SSLRequest exchange, so the postgres listener itself
+// cannot answer challenges. DNS-01 is not supported.
+func NewACMECertManager(cfg ACMEConfig) (*autocert.Manager, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, errors.New("ACME requires at least one domain")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Email:      cfg.Email,
+	}
+	if cfg.CacheDir != "" {
+		m.Cache = autocert.DirCache(cfg.CacheDir)
+	}
+	if cfg.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	}
+	return m, nil
+}
+
+// ServeACMEChallenges answers TLS-ALPN-01 challenges on ln until ln is closed.
+// Regular TLS connections are accepted and closed immediately after the handshake.
+func ServeACMEChallenges(ln net.Listener, m *autocert.Manager) error {
+	cfg := m.TLSConfig()
+	cfg.NextProtos = []string{acme.ALPNProto}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			tconn := tls.Server(conn, cfg)
+			tconn.Handshake()
+			tconn.Close()
+		}()
+	}
+}
@@ -0,0 +1,81 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/apache/arrow/go/v7/arrow/ipc"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// writeArrowCopy writes the COPY data of a `FORMAT arrow` copy: the query results as an Arrow IPC stream,
+// without converting them to postgres values. Each record batch is sent in its own CopyData message.
+// buf holds messages to send before the stream.
+func writeArrowCopy(ctx context.Context, w io.Writer, buf []byte, reader recordReader, t *throttle, mem *resultMemory) (totalRows int, err error) {
+	cw := &copyDataWriter{w: w, buf: buf}
+	iw := ipc.NewWriter(cw, ipc.WithSchema(reader.Schema()))
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if err := iw.Write(rec); err != nil {
+			return 0, err
+		}
+		totalRows += int(rec.NumRows())
+		mem.hold(recordSize(rec) + int64(cw.pending()))
+		if err := t.wait(ctx, int(rec.NumRows()), cw.pending()); err != nil {
+			return 0, err
+		}
+		if err := cw.flush(); err != nil {
+			return 0, err
+		}
+	}
+	if err := iw.Close(); err != nil {
+		return 0, err
+	}
+	if err := cw.flush(); err != nil {
+		return 0, err
+	}
+	return totalRows, writeMessages(w, &pgproto3.CopyDone{})
+}
+
+// copyDataWriter collects the bytes written to it and sends them as a CopyData message when flushed.
+type copyDataWriter struct {
+	w io.Writer
+	// buf holds already encoded messages, followed by the pending data.
+	buf  []byte
+	data []byte
+}
+
+func (c *copyDataWriter) Write(b []byte) (int, error) {
+	c.data = append(c.data, b...)
+	return len(b), nil
+}
+
+// pending returns the number of bytes that the next flush sends.
+func (c *copyDataWriter) pending() int {
+	n := len(c.buf)
+	if len(c.data) > 0 {
+		n += 5 + len(c.data)
+	}
+	return n
+}
+
+func (c *copyDataWriter) flush() error {
+	if len(c.data) > 0 {
+		c.buf = (&pgproto3.CopyData{Data: c.data}).Encode(c.buf)
+		c.data = c.data[:0]
+	}
+	if len(c.buf) == 0 {
+		return nil
+	}
+	if _, err := c.w.Write(c.buf); err != nil {
+		return fmt.Errorf("error writing copy data: %w", err)
+	}
+	c.buf = c.buf[:0]
+	return nil
+}
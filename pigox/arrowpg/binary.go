@@ -0,0 +1,88 @@
+package arrowpg
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/jackc/pgtype"
+)
+
+// Binary renders a value in the postgres binary format of the type FieldDescription reports for its column.
+// Columns reported as text are rendered as their text representation. A nil result denotes NULL.
+func Binary(column arrow.Array, row int, opts Options) ([]byte, error) {
+	if column.IsNull(row) {
+		return nil, nil
+	}
+	var v pgtype.BinaryEncoder
+	switch c := column.(type) {
+	case *array.Timestamp:
+		t := c.Value(row).ToTime(c.DataType().(*arrow.TimestampType).Unit)
+		if opts.ToChar != "" {
+			return []byte(opts.FormatTimestamp(t)), nil
+		}
+		if opts.TimestampFormat != TextTimestamps {
+			n, err := strconv.ParseInt(opts.FormatTimestamp(t), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			v = &pgtype.Int8{Int: n, Status: pgtype.Present}
+			break
+		}
+		if opts.Location != nil {
+			t = t.In(opts.Location)
+		}
+		if opts.TimestampRounding == RoundTimestamps {
+			t = t.Round(time.Microsecond)
+		}
+		// timestamp (without time zone) values carry the wall clock time.
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+		v = &pgtype.Timestamp{Time: t, Status: pgtype.Present}
+	case *array.Int8:
+		v = &pgtype.Int2{Int: int16(c.Value(row)), Status: pgtype.Present}
+	case *array.Uint8:
+		v = &pgtype.Int2{Int: int16(c.Value(row)), Status: pgtype.Present}
+	case *array.Int16:
+		v = &pgtype.Int2{Int: c.Value(row), Status: pgtype.Present}
+	case *array.Uint16:
+		v = &pgtype.Int4{Int: int32(c.Value(row)), Status: pgtype.Present}
+	case *array.Int32:
+		v = &pgtype.Int4{Int: c.Value(row), Status: pgtype.Present}
+	case *array.Uint32:
+		v = &pgtype.Int8{Int: int64(c.Value(row)), Status: pgtype.Present}
+	case *array.Int64:
+		v = &pgtype.Int8{Int: c.Value(row), Status: pgtype.Present}
+	case *array.Uint64:
+		var n pgtype.Numeric
+		if err := n.Set(c.Value(row)); err != nil {
+			return nil, err
+		}
+		v = &n
+	case *array.Float16:
+		v = &pgtype.Float4{Float: c.Value(row).Float32(), Status: pgtype.Present}
+	case *array.Float32:
+		v = &pgtype.Float4{Float: c.Value(row), Status: pgtype.Present}
+	case *array.Float64:
+		v = &pgtype.Float8{Float: c.Value(row), Status: pgtype.Present}
+	case *array.Boolean:
+		v = &pgtype.Bool{Bool: c.Value(row), Status: pgtype.Present}
+	case *array.Decimal128:
+		v = decimalNumeric(c.Value(row), c.DataType().(*arrow.Decimal128Type).Scale)
+	case *array.List, *array.FixedSizeList:
+		if typ := FieldDescription(arrow.Field{Type: c.DataType()}, opts).DataTypeOID; typ != pgtype.TextOID {
+			return listBinary(column, row, opts)
+		}
+		s, err := Text(column, row, opts)
+		return []byte(s), err
+	case *array.Struct:
+		return structBinary(c, row, opts)
+	case *array.String:
+		// the binary format of text is the text itself.
+		return []byte(c.Value(row)), nil
+	default:
+		s, err := Text(column, row, opts)
+		return []byte(s), err
+	}
+	return v.EncodeBinary(nil, []byte{})
+}
@@ -0,0 +1,122 @@
+package arrowpg
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/array"
+)
+
+// AppendJSON appends a value in JSON, formatted like postgres' to_json. Lists are JSON arrays, structs and maps
+// JSON objects.
+func AppendJSON(buf []byte, column arrow.Array, row int, opts Options) ([]byte, error) {
+	if column.IsNull(row) {
+		return append(buf, "null"...), nil
+	}
+	switch c := column.(type) {
+	case *array.Boolean:
+		return strconv.AppendBool(buf, c.Value(row)), nil
+	case *array.Int8, *array.Int16, *array.Int32, *array.Int64,
+		*array.Uint8, *array.Uint16, *array.Uint32, *array.Uint64, *array.Decimal128:
+		s, err := Text(column, row, opts)
+		return append(buf, s...), err
+	case *array.Float16, *array.Float32, *array.Float64:
+		s, err := Text(column, row, opts)
+		if f, perr := strconv.ParseFloat(s, 64); perr != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			// postgres renders non finite numbers as strings.
+			return AppendJSONString(buf, s), err
+		}
+		return append(buf, s...), err
+	case *array.Timestamp:
+		s, err := Text(column, row, opts)
+		if err != nil {
+			return nil, err
+		}
+		if opts.ToChar != "" {
+			return AppendJSONString(buf, s), nil
+		}
+		if opts.TimestampFormat != TextTimestamps {
+			return append(buf, s...), nil
+		}
+		// json timestamps are in ISO 8601 format.
+		return AppendJSONString(buf, strings.Replace(s, " ", "T", 1)), nil
+	case *array.Map:
+		keys, items := c.Keys(), c.Items()
+		_, start, end := listElements(c, row)
+		buf = append(buf, '{')
+		for i := start; i < end; i++ {
+			if i > start {
+				buf = append(buf, ", "...)
+			}
+			k, err := Text(keys, i, opts)
+			if err != nil {
+				return nil, err
+			}
+			buf = append(AppendJSONString(buf, k), " : "...)
+			if buf, err = AppendJSON(buf, items, i, opts); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, '}'), nil
+	case *array.List, *array.FixedSizeList:
+		values, start, end := listElements(c, row)
+		buf = append(buf, '[')
+		for i := start; i < end; i++ {
+			if i > start {
+				buf = append(buf, ',')
+			}
+			var err error
+			if buf, err = AppendJSON(buf, values, i, opts); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, ']'), nil
+	case *array.Struct:
+		fields := c.DataType().(*arrow.StructType).Fields()
+		buf = append(buf, '{')
+		for f, field := range fields {
+			if f > 0 {
+				buf = append(buf, ',')
+			}
+			buf = append(AppendJSONString(buf, field.Name), ':')
+			var err error
+			if buf, err = AppendJSON(buf, c.Field(f), row, opts); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, '}'), nil
+	}
+	s, err := Text(column, row, opts)
+	return AppendJSONString(buf, s), err
+}
+
+// AppendJSONString appends s as a JSON string, escaped like postgres does.
+func AppendJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			buf = append(buf, '\\', c)
+		case '\n':
+			buf = append(buf, `\n`...)
+		case '\r':
+			buf = append(buf, `\r`...)
+		case '\t':
+			buf = append(buf, `\t`...)
+		case '\b':
+			buf = append(buf, `\b`...)
+		case '\f':
+			buf = append(buf, `\f`...)
+		default:
+			if c < 0x20 {
+				buf = append(buf, fmt.Sprintf(`\u%04x`, c)...)
+			} else {
+				buf = append(buf, c)
+			}
+		}
+	}
+	return append(buf, '"')
+}
@@ -0,0 +1,84 @@
+package arrowpg
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/apache/arrow/go/v7/arrow/memory"
+)
+
+func TestAppendJSONString(t *testing.T) {
+	got := string(AppendJSONString(nil, "a\"b\\c\nd\te\x01"))
+	if want := `"a\"b\\c\nd\te\u0001"`; got != want {
+		t.Errorf("AppendJSONString = %s, want %s", got, want)
+	}
+}
+
+func TestAppendJSON(t *testing.T) {
+	mem := memory.DefaultAllocator
+
+	floats := array.NewFloat64Builder(mem)
+	defer floats.Release()
+	floats.AppendValues([]float64{1.5, math.Inf(1), math.NaN()}, nil)
+	floats.AppendNull()
+	f := floats.NewArray()
+	defer f.Release()
+
+	ts := array.NewTimestampBuilder(mem, &arrow.TimestampType{Unit: arrow.Nanosecond})
+	defer ts.Release()
+	ts.Append(arrow.Timestamp(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).UnixNano()))
+	tsa := ts.NewArray()
+	defer tsa.Release()
+
+	m := array.NewMapBuilder(mem, arrow.BinaryTypes.String, arrow.PrimitiveTypes.Int64, false)
+	defer m.Release()
+	keys, items := m.KeyBuilder().(*array.StringBuilder), m.ItemBuilder().(*array.Int64Builder)
+	m.Append(true)
+	keys.Append("a")
+	items.Append(1)
+	keys.Append("b")
+	items.AppendNull()
+	ma := m.NewArray()
+	defer ma.Release()
+
+	typ := arrow.StructOf(
+		arrow.Field{Name: "ok", Type: arrow.FixedWidthTypes.Boolean},
+		arrow.Field{Name: "tags", Type: arrow.ListOf(arrow.BinaryTypes.String)},
+	)
+	s := array.NewStructBuilder(mem, typ)
+	defer s.Release()
+	ok, tags := s.FieldBuilder(0).(*array.BooleanBuilder), s.FieldBuilder(1).(*array.ListBuilder)
+	s.Append(true)
+	ok.Append(true)
+	tags.Append(true)
+	tags.ValueBuilder().(*array.StringBuilder).AppendValues([]string{"x", `"y"`}, nil)
+	sa := s.NewArray()
+	defer sa.Release()
+
+	tests := []struct {
+		name   string
+		column arrow.Array
+		row    int
+		opts   Options
+		want   string
+	}{
+		{"float", f, 0, Options{}, `1.5`},
+		{"infinity", f, 1, Options{}, `"+Inf"`},
+		{"nan", f, 2, Options{}, `"NaN"`},
+		{"null", f, 3, Options{}, `null`},
+		{"timestamp", tsa, 0, Options{}, `"2024-01-02T03:04:05"`},
+		{"epoch timestamp", tsa, 0, Options{TimestampFormat: EpochSeconds}, `1704164645`},
+		{"to_char timestamp", tsa, 0, Options{ToChar: "YYYY"}, `"2024"`},
+		{"map", ma, 0, Options{}, `{"a" : 1, "b" : null}`},
+		{"struct", sa, 0, Options{}, `{"ok":true,"tags":["x","\"y\""]}`},
+	}
+	for _, tt := range tests {
+		got, err := AppendJSON(nil, tt.column, tt.row, tt.opts)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: got %s, %v; want %s", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package arrowpg
+
+import (
+	"encoding/binary"
+	"math/big"
+	"strings"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/apache/arrow/go/v7/arrow/decimal128"
+	"github.com/jackc/pgtype"
+)
+
+// arrayOIDs maps the element types of the lists rendered as postgres arrays to the array type.
+var arrayOIDs = map[uint32]uint32{
+	pgtype.BoolOID:      pgtype.BoolArrayOID,
+	pgtype.Int2OID:      pgtype.Int2ArrayOID,
+	pgtype.Int4OID:      pgtype.Int4ArrayOID,
+	pgtype.Int8OID:      pgtype.Int8ArrayOID,
+	pgtype.Float4OID:    pgtype.Float4ArrayOID,
+	pgtype.Float8OID:    pgtype.Float8ArrayOID,
+	pgtype.NumericOID:   pgtype.NumericArrayOID,
+	pgtype.TextOID:      pgtype.TextArrayOID,
+	pgtype.TimestampOID: pgtype.TimestampArrayOID,
+}
+
+// ArrayOID returns the OID of the postgres array type with elements of type elem, if lists of elem are rendered
+// as arrays.
+func ArrayOID(elem uint32) (uint32, bool) {
+	oid, ok := arrayOIDs[elem]
+	return oid, ok
+}
+
+// listOID returns the type of the postgres values lists with elements of type elem are rendered as. Lists of
+// lists are rendered as text: unlike postgres multidimensional arrays, they can be ragged.
+func listOID(elem arrow.DataType, opts Options) uint32 {
+	if id := elem.ID(); id == arrow.LIST || id == arrow.FIXED_SIZE_LIST {
+		return pgtype.TextOID
+	}
+	if oid, ok := ArrayOID(elementOID(elem, opts)); ok {
+		return oid
+	}
+	return pgtype.TextOID
+}
+
+func elementOID(elem arrow.DataType, opts Options) uint32 {
+	return FieldDescription(arrow.Field{Type: elem}, opts).DataTypeOID
+}
+
+// listElements returns the array holding the elements of a list value, and their range in it.
+func listElements(column arrow.Array, row int) (values arrow.Array, start, end int) {
+	switch c := column.(type) {
+	case *array.Map:
+		offsets := c.Offsets()
+		j := row + c.Data().Offset()
+		return c.ListValues(), int(offsets[j]), int(offsets[j+1])
+	case *array.List:
+		offsets := c.Offsets()
+		j := row + c.Data().Offset()
+		return c.ListValues(), int(offsets[j]), int(offsets[j+1])
+	case *array.FixedSizeList:
+		n := int(c.DataType().(*arrow.FixedSizeListType).Len())
+		j := row + c.Data().Offset()
+		return c.ListValues(), j * n, (j + 1) * n
+	}
+	panic("not a list")
+}
+
+// decimalText renders a decimal the way postgres renders numeric values.
+func decimalText(n decimal128.Num, scale int32) string {
+	s := n.BigInt().String()
+	if scale <= 0 {
+		return s + strings.Repeat("0", int(-scale))
+	}
+	sign := ""
+	if s[0] == '-' {
+		sign, s = "-", s[1:]
+	}
+	if pad := int(scale) + 1 - len(s); pad > 0 {
+		s = strings.Repeat("0", pad) + s
+	}
+	return sign + s[:len(s)-int(scale)] + "." + s[len(s)-int(scale):]
+}
+
+func decimalNumeric(n decimal128.Num, scale int32) *pgtype.Numeric {
+	return &pgtype.Numeric{Int: new(big.Int).Set(n.BigInt()), Exp: -scale, Status: pgtype.Present}
+}
+
+// listText renders a list as a postgres array, e.g. {1,2,NULL}.
+func listText(column arrow.Array, row int, opts Options) (string, error) {
+	values, start, end := listElements(column, row)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := start; i < end; i++ {
+		if i > start {
+			b.WriteByte(',')
+		}
+		if values.IsNull(i) {
+			b.WriteString("NULL")
+			continue
+		}
+		s, err := Text(values, i, opts)
+		if err != nil {
+			return "", err
+		}
+		switch values.(type) {
+		case *array.List, *array.FixedSizeList:
+			// nested arrays are not quoted.
+			b.WriteString(s)
+			continue
+		}
+		if needsArrayQuotes(s) {
+			s = quoteElement(s)
+		}
+		b.WriteString(s)
+	}
+	b.WriteByte('}')
+	return b.String(), nil
+}
+
+func needsArrayQuotes(s string) bool {
+	return s == "" || strings.EqualFold(s, "NULL") || strings.ContainsAny(s, "{},\"\\ \t\n\r\v\f")
+}
+
+// quoteElement quotes an array element, escaping quotes and backslashes.
+func quoteElement(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		if r == '"' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// structText renders a struct as a postgres record, e.g. (1,abc,); NULL fields are empty.
+func structText(column *array.Struct, row int, opts Options) (string, error) {
+	var b strings.Builder
+	b.WriteByte('(')
+	for f := 0; f < column.NumField(); f++ {
+		if f > 0 {
+			b.WriteByte(',')
+		}
+		field := column.Field(f)
+		if field.IsNull(row) {
+			continue
+		}
+		s, err := Text(field, row, opts)
+		if err != nil {
+			return "", err
+		}
+		if s == "" || strings.ContainsAny(s, "(),\"\\ \t\n\r\v\f") {
+			// records double quotes and backslashes instead of escaping them.
+			s = `"` + strings.NewReplacer(`"`, `""`, `\`, `\\`).Replace(s) + `"`
+		}
+		b.WriteString(s)
+	}
+	b.WriteByte(')')
+	return b.String(), nil
+}
+
+// listBinary renders a list in the binary format of one dimensional postgres arrays.
+func listBinary(column arrow.Array, row int, opts Options) ([]byte, error) {
+	values, start, end := listElements(column, row)
+	hasNull := int32(0)
+	for i := start; i < end; i++ {
+		if values.IsNull(i) {
+			hasNull = 1
+		}
+	}
+	// empty arrays have no dimensions.
+	ndim := int32(1)
+	if start == end {
+		ndim = 0
+	}
+	buf := appendInt32(nil, ndim)
+	buf = appendInt32(buf, hasNull)
+	buf = appendInt32(buf, int32(elementOID(values.DataType(), opts)))
+	if ndim > 0 {
+		buf = appendInt32(buf, int32(end-start))
+		buf = appendInt32(buf, 1)
+	}
+	for i := start; i < end; i++ {
+		var err error
+		if buf, err = appendBinaryValue(buf, values, i, opts); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// structBinary renders a struct in the binary format of postgres records.
+func structBinary(column *array.Struct, row int, opts Options) ([]byte, error) {
+	fields := column.DataType().(*arrow.StructType).Fields()
+	buf := appendInt32(nil, int32(len(fields)))
+	for f, field := range fields {
+		buf = appendInt32(buf, int32(FieldDescription(field, opts).DataTypeOID))
+		var err error
+		if buf, err = appendBinaryValue(buf, column.Field(f), row, opts); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// appendBinaryValue appends a value in binary format, prefixed by its length; -1 is NULL.
+func appendBinaryValue(buf []byte, column arrow.Array, row int, opts Options) ([]byte, error) {
+	if column.IsNull(row) {
+		return appendInt32(buf, -1), nil
+	}
+	b, err := Binary(column, row, opts)
+	if err != nil {
+		return nil, err
+	}
+	return append(appendInt32(buf, int32(len(b))), b...), nil
+}
+
+func appendInt32(buf []byte, n int32) []byte {
+	return binary.BigEndian.AppendUint32(buf, uint32(n))
+}
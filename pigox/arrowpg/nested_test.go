@@ -0,0 +1,153 @@
+package arrowpg
+
+import (
+	"testing"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/apache/arrow/go/v7/arrow/decimal128"
+	"github.com/apache/arrow/go/v7/arrow/memory"
+	"github.com/jackc/pgtype"
+)
+
+func TestArrayOID(t *testing.T) {
+	if oid, ok := ArrayOID(pgtype.Int8OID); !ok || oid != pgtype.Int8ArrayOID {
+		t.Errorf("ArrayOID(int8) = %d, %v", oid, ok)
+	}
+	if oid, ok := ArrayOID(pgtype.JSONOID); ok {
+		t.Errorf("ArrayOID(json) = %d, want no array type", oid)
+	}
+}
+
+func TestListText(t *testing.T) {
+	b := array.NewListBuilder(memory.DefaultAllocator, arrow.BinaryTypes.String)
+	defer b.Release()
+	values := b.ValueBuilder().(*array.StringBuilder)
+	b.Append(true)
+	values.Append("a")
+	values.AppendNull()
+	values.Append("")
+	values.Append("NULL")
+	values.Append(`say "hi"`)
+	values.Append(`a\b`)
+	values.Append("x,y")
+	b.Append(true)
+	list := b.NewListArray()
+	defer list.Release()
+
+	s, err := listText(list, 0, Options{})
+	if want := `{a,NULL,"","NULL","say \"hi\"","a\\b","x,y"}`; err != nil || s != want {
+		t.Errorf("listText = %s, %v; want %s", s, err, want)
+	}
+	if s, err := listText(list, 1, Options{}); err != nil || s != "{}" {
+		t.Errorf("listText of empty list = %s, %v", s, err)
+	}
+}
+
+func TestNestedListText(t *testing.T) {
+	b := array.NewListBuilder(memory.DefaultAllocator, arrow.ListOf(arrow.PrimitiveTypes.Int64))
+	defer b.Release()
+	inner := b.ValueBuilder().(*array.ListBuilder)
+	values := inner.ValueBuilder().(*array.Int64Builder)
+	b.Append(true)
+	inner.Append(true)
+	values.AppendValues([]int64{1, 2}, nil)
+	inner.Append(true)
+	values.Append(3)
+	list := b.NewListArray()
+	defer list.Release()
+
+	if s, err := listText(list, 0, Options{}); err != nil || s != "{{1,2},{3}}" {
+		t.Errorf("listText = %s, %v", s, err)
+	}
+	// ragged lists of lists can't be postgres arrays.
+	if oid := FieldDescription(arrow.Field{Type: list.DataType()}, Options{}).DataTypeOID; oid != pgtype.TextOID {
+		t.Errorf("list of lists is rendered as %d, want text", oid)
+	}
+}
+
+func TestStructText(t *testing.T) {
+	typ := arrow.StructOf(
+		arrow.Field{Name: "n", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+		arrow.Field{Name: "s", Type: arrow.BinaryTypes.String, Nullable: true},
+	)
+	b := array.NewStructBuilder(memory.DefaultAllocator, typ)
+	defer b.Release()
+	n, s := b.FieldBuilder(0).(*array.Int64Builder), b.FieldBuilder(1).(*array.StringBuilder)
+	b.Append(true)
+	n.Append(1)
+	s.Append("abc")
+	b.Append(true)
+	n.AppendNull()
+	s.Append(`a "b", \c`)
+	b.Append(true)
+	n.Append(2)
+	s.Append("")
+	st := b.NewStructArray()
+	defer st.Release()
+
+	for row, want := range []string{`(1,abc)`, `(,"a ""b"", \\c")`, `(2,"")`} {
+		if got, err := structText(st, row, Options{}); err != nil || got != want {
+			t.Errorf("structText of row %d = %s, %v; want %s", row, got, err, want)
+		}
+	}
+}
+
+func TestDecimalText(t *testing.T) {
+	tests := []struct {
+		n     int64
+		scale int32
+		want  string
+	}{
+		{12345, 2, "123.45"},
+		{-12345, 2, "-123.45"},
+		{5, 3, "0.005"},
+		{-5, 3, "-0.005"},
+		{12, 0, "12"},
+		{12, -2, "1200"},
+		{0, 2, "0.00"},
+	}
+	for _, tt := range tests {
+		if got := decimalText(decimal128.FromI64(tt.n), tt.scale); got != tt.want {
+			t.Errorf("decimalText(%d, %d) = %s, want %s", tt.n, tt.scale, got, tt.want)
+		}
+	}
+}
+
+func TestListBinary(t *testing.T) {
+	b := array.NewListBuilder(memory.DefaultAllocator, arrow.PrimitiveTypes.Int64)
+	defer b.Release()
+	values := b.ValueBuilder().(*array.Int64Builder)
+	b.Append(true)
+	values.AppendValues([]int64{1, 0, 3}, []bool{true, false, true})
+	b.Append(true)
+	list := b.NewListArray()
+	defer list.Release()
+
+	buf, err := listBinary(list, 0, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got pgtype.Int8Array
+	if err := got.DecodeBinary(nil, buf); err != nil {
+		t.Fatal(err)
+	}
+	want := []pgtype.Int8{{Int: 1, Status: pgtype.Present}, {Status: pgtype.Null}, {Int: 3, Status: pgtype.Present}}
+	if len(got.Elements) != len(want) {
+		t.Fatalf("got %d elements, want %d", len(got.Elements), len(want))
+	}
+	for i := range want {
+		if got.Elements[i] != want[i] {
+			t.Errorf("element %d = %v, want %v", i, got.Elements[i], want[i])
+		}
+	}
+
+	buf, err = listBinary(list, 1, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = pgtype.Int8Array{}
+	if err := got.DecodeBinary(nil, buf); err != nil || len(got.Elements) != 0 || len(got.Dimensions) != 0 {
+		t.Errorf("empty list decodes to %v, %v", got, err)
+	}
+}
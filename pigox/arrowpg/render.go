@@ -0,0 +1,167 @@
+// Package arrowpg renders Arrow values as PostgreSQL wire protocol values.
+package arrowpg
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+)
+
+// ErrUnsupportedType is returned when rendering values of arrow types that have no postgres equivalent.
+var ErrUnsupportedType = errors.New("unsupported arrow type")
+
+// FieldDescription returns the description of the postgres column values of field are rendered as.
+func FieldDescription(f arrow.Field, opts Options) pgproto3.FieldDescription {
+	var typ uint32 = pgtype.TextOID
+	switch t := f.Type.ID(); t {
+	case arrow.TIMESTAMP:
+		typ = pgtype.TimestampOID
+		if opts.ToChar != "" {
+			typ = pgtype.TextOID
+		} else if opts.TimestampFormat != TextTimestamps {
+			typ = pgtype.Int8OID
+		}
+		// postgres has only signed integers of 2, 4, 8 bytes respectively/
+		// arrow names the types in bit widths, and supports unsigned types.
+		// Map arrow types to postgres types that can fit it.
+	case arrow.INT8, arrow.UINT8, arrow.INT16:
+		typ = pgtype.Int2OID
+	case arrow.UINT16, arrow.INT32:
+		typ = pgtype.Int4OID
+	case arrow.UINT32, arrow.INT64:
+		typ = pgtype.Int8OID
+	case arrow.UINT64:
+		typ = pgtype.NumericOID // I _think_ this means bigint.
+	case arrow.FLOAT16, arrow.FLOAT32:
+		typ = pgtype.Float4OID
+	case arrow.FLOAT64:
+		typ = pgtype.Float8OID
+	case arrow.BOOL:
+		typ = pgtype.BoolOID
+	case arrow.DECIMAL128:
+		typ = pgtype.NumericOID
+	case arrow.LIST:
+		typ = listOID(f.Type.(*arrow.ListType).Elem(), opts)
+	case arrow.FIXED_SIZE_LIST:
+		typ = listOID(f.Type.(*arrow.FixedSizeListType).Elem(), opts)
+	case arrow.STRUCT:
+		typ = pgtype.RecordOID
+	case arrow.MAP:
+		// postgres has no map type; like hstore values, maps are rendered as json objects.
+		typ = pgtype.JSONOID
+	}
+	return pgproto3.FieldDescription{
+		Name:                 []byte(f.Name),
+		TableOID:             0,
+		TableAttributeNumber: 0,
+		DataTypeOID:          typ,
+		DataTypeSize:         TypeSize(typ),
+		TypeModifier:         -1,
+		Format:               0,
+	}
+}
+
+// typeSizes are the sizes in bytes of the fixed size postgres types, as reported in RowDescriptions and typlen.
+var typeSizes = map[uint32]int16{
+	pgtype.BoolOID:        1,
+	pgtype.Int2OID:        2,
+	pgtype.Int4OID:        4,
+	pgtype.Int8OID:        8,
+	pgtype.OIDOID:         4,
+	pgtype.Float4OID:      4,
+	pgtype.Float8OID:      8,
+	pgtype.DateOID:        4,
+	pgtype.TimestampOID:   8,
+	pgtype.TimestamptzOID: 8,
+}
+
+// TypeSize returns the size of the values of a postgres type, -1 for variable size types.
+func TypeSize(oid uint32) int16 {
+	if n, ok := typeSizes[oid]; ok {
+		return n
+	}
+	return -1
+}
+
+// Text renders a value in the postgres text format. NULL is rendered as an empty string; Bytes tells them apart.
+func Text(column arrow.Array, row int, opts Options) (string, error) {
+	if column.IsNull(row) {
+		return "", nil
+	}
+	switch typedColumn := column.(type) {
+	case *array.Timestamp:
+		unit := typedColumn.DataType().(*arrow.TimestampType).Unit
+		return opts.FormatTimestamp(typedColumn.Value(row).ToTime(unit)), nil
+	case *array.Time32:
+		unit := typedColumn.DataType().(*arrow.Time32Type).Unit
+		return opts.FormatTime(typedColumn.Value(row).ToTime(unit)), nil
+	case *array.Time64:
+		unit := typedColumn.DataType().(*arrow.Time64Type).Unit
+		return opts.FormatTime(typedColumn.Value(row).ToTime(unit)), nil
+	case *array.Date32:
+		return opts.FormatTime(typedColumn.Value(row).ToTime()), nil
+	case *array.Date64:
+		return opts.FormatTime(typedColumn.Value(row).ToTime()), nil
+	case *array.Duration:
+		m := typedColumn.DataType().(*arrow.DurationType).Unit.Multiplier()
+		return (time.Duration(typedColumn.Value(row)) * m).String(), nil
+	case *array.Float16:
+		return fmt.Sprint(typedColumn.Value(row)), nil
+	case *array.Float32:
+		return fmt.Sprint(typedColumn.Value(row)), nil
+	case *array.Float64:
+		return fmt.Sprint(typedColumn.Value(row)), nil
+	case *array.Uint8:
+		return fmt.Sprint(typedColumn.Value(row)), nil
+	case *array.Uint16:
+		return fmt.Sprint(typedColumn.Value(row)), nil
+	case *array.Uint32:
+		return fmt.Sprint(typedColumn.Value(row)), nil
+	case *array.Uint64:
+		return fmt.Sprint(typedColumn.Value(row)), nil
+	case *array.Int8:
+		return fmt.Sprint(typedColumn.Value(row)), nil
+	case *array.Int16:
+		return fmt.Sprint(typedColumn.Value(row)), nil
+	case *array.Int32:
+		return fmt.Sprint(typedColumn.Value(row)), nil
+	case *array.Int64:
+		return fmt.Sprint(typedColumn.Value(row)), nil
+	case *array.String:
+		return typedColumn.Value(row), nil
+	case *array.Binary:
+		return fmt.Sprint(typedColumn.Value(row)), nil
+	case *array.Decimal128:
+		return decimalText(typedColumn.Value(row), typedColumn.DataType().(*arrow.Decimal128Type).Scale), nil
+	case *array.Map:
+		b, err := AppendJSON(nil, column, row, opts)
+		return string(b), err
+	case *array.List, *array.FixedSizeList:
+		return listText(column, row, opts)
+	case *array.Struct:
+		return structText(typedColumn, row, opts)
+	case *array.Boolean:
+		if typedColumn.Value(row) {
+			return "t", nil
+		} else {
+			return "f", nil
+		}
+	default:
+		return "", fmt.Errorf("%w %q", ErrUnsupportedType, column.DataType().Name())
+	}
+}
+
+// Bytes is like Text, but returns the rendered value as bytes. A nil result denotes NULL, which DataRow messages
+// encode as a value of length -1.
+func Bytes(column arrow.Array, row int, opts Options) ([]byte, error) {
+	if column.IsNull(row) {
+		return nil, nil
+	}
+	s, err := Text(column, row, opts)
+	return []byte(s), err
+}
@@ -0,0 +1,219 @@
+package arrowpg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/apache/arrow/go/v7/arrow/memory"
+	"github.com/jackc/pgtype"
+)
+
+// renderTests are the supported arrow types, with a value rendered in the text format and as the text of the value
+// the binary format decodes to.
+var renderTests = []struct {
+	name string
+	typ  arrow.DataType
+	// value is the JSON of the arrow value.
+	value string
+	oid   uint32
+	text  string
+	// binary is the value the binary format decodes to, as pgtype renders it in the text format; values rendered
+	// as text in the binary format too decode to text.
+	binary string
+}{
+	{"int8", arrow.PrimitiveTypes.Int8, `-8`, pgtype.Int2OID, "-8", "-8"},
+	{"uint8", arrow.PrimitiveTypes.Uint8, `255`, pgtype.Int2OID, "255", "255"},
+	{"int16", arrow.PrimitiveTypes.Int16, `-16`, pgtype.Int2OID, "-16", "-16"},
+	{"uint16", arrow.PrimitiveTypes.Uint16, `65535`, pgtype.Int4OID, "65535", "65535"},
+	{"int32", arrow.PrimitiveTypes.Int32, `-32`, pgtype.Int4OID, "-32", "-32"},
+	{"uint32", arrow.PrimitiveTypes.Uint32, `4294967295`, pgtype.Int8OID, "4294967295", "4294967295"},
+	{"int64", arrow.PrimitiveTypes.Int64, `-9223372036854775808`, pgtype.Int8OID, "-9223372036854775808", "-9223372036854775808"},
+	{"uint64", arrow.PrimitiveTypes.Uint64, `9223372036854775808`, pgtype.NumericOID, "9223372036854775808", "9223372036854775808e0"},
+	{"float16", arrow.FixedWidthTypes.Float16, `1.5`, pgtype.Float4OID, "1.5", "1.5"},
+	{"float32", arrow.PrimitiveTypes.Float32, `-2.25`, pgtype.Float4OID, "-2.25", "-2.25"},
+	{"float64", arrow.PrimitiveTypes.Float64, `0.1`, pgtype.Float8OID, "0.1", "0.1"},
+	{"bool", arrow.FixedWidthTypes.Boolean, `true`, pgtype.BoolOID, "t", "t"},
+	{"string", arrow.BinaryTypes.String, `"a b"`, pgtype.TextOID, "a b", "a b"},
+	{"empty string", arrow.BinaryTypes.String, `""`, pgtype.TextOID, "", ""},
+	{"decimal", &arrow.Decimal128Type{Precision: 10, Scale: 2}, `"-123.45"`, pgtype.NumericOID, "-123.45", "-12345e-2"},
+	{"timestamp", &arrow.TimestampType{Unit: arrow.Nanosecond}, `"2024-01-02 03:04:05.123456789"`, pgtype.TimestampOID,
+		"2024-01-02 03:04:05.123456789", "2024-01-02 03:04:05.123456"},
+	{"timestamp seconds", &arrow.TimestampType{Unit: arrow.Second}, `"2024-01-02 03:04:05"`, pgtype.TimestampOID,
+		"2024-01-02 03:04:05", "2024-01-02 03:04:05"},
+	{"date32", arrow.FixedWidthTypes.Date32, `"2024-01-02"`, pgtype.TextOID, "2024-01-02 00:00:00", "2024-01-02 00:00:00"},
+	{"time64", arrow.FixedWidthTypes.Time64us, `"03:04:05.5"`, pgtype.TextOID, "1970-01-01 03:04:05.5", "1970-01-01 03:04:05.5"},
+	{"duration", arrow.FixedWidthTypes.Duration_ms, `"1.5s"`, pgtype.TextOID, "1.5s", "1.5s"},
+	{"list", arrow.ListOf(arrow.PrimitiveTypes.Int64), `[1, null, 3]`, pgtype.Int8ArrayOID, "{1,NULL,3}", "{1,NULL,3}"},
+	{"string list", arrow.ListOf(arrow.BinaryTypes.String), `["a", "b c"]`, pgtype.TextArrayOID, `{a,"b c"}`, `{a,b c}`},
+	{"empty list", arrow.ListOf(arrow.PrimitiveTypes.Float64), `[]`, pgtype.Float8ArrayOID, "{}", "{}"},
+	{"fixed size list", arrow.FixedSizeListOf(2, arrow.FixedWidthTypes.Boolean), `[true, false]`, pgtype.BoolArrayOID, "{t,f}", "{t,f}"},
+	{"timestamp list", arrow.ListOf(&arrow.TimestampType{Unit: arrow.Microsecond}), `["2024-01-02 03:04:05"]`, pgtype.TimestampArrayOID,
+		`{"2024-01-02 03:04:05"}`, `{2024-01-02 03:04:05}`},
+	{"list of lists", arrow.ListOf(arrow.ListOf(arrow.PrimitiveTypes.Int32)), `[[1, 2], [3]]`, pgtype.TextOID, "{{1,2},{3}}", "{{1,2},{3}}"},
+	{"map", arrow.MapOf(arrow.BinaryTypes.String, arrow.PrimitiveTypes.Int64), `[{"key": "a", "value": 1}]`, pgtype.JSONOID,
+		`{"a" : 1}`, `{"a" : 1}`},
+}
+
+// column returns a column with the value of a render test in row 0 and NULL in row 1.
+func column(t *testing.T, typ arrow.DataType, value string) arrow.Array {
+	t.Helper()
+	c, _, err := array.FromJSON(memory.DefaultAllocator, typ, strings.NewReader("["+value+", null]"))
+	if err != nil {
+		t.Fatalf("cannot build %s column: %v", typ, err)
+	}
+	t.Cleanup(c.Release)
+	return c
+}
+
+// decodeBinary returns the text of the value of type oid encoded in the binary format by b.
+func decodeBinary(t *testing.T, oid uint32, b []byte) string {
+	t.Helper()
+	dt, ok := pgtype.NewConnInfo().DataTypeForOID(oid)
+	if !ok {
+		t.Fatalf("unknown type %d", oid)
+	}
+	v := pgtype.NewValue(dt.Value)
+	if err := v.(pgtype.BinaryDecoder).DecodeBinary(nil, b); err != nil {
+		t.Fatalf("cannot decode %s: %v", dt.Name, err)
+	}
+	text, err := v.(pgtype.TextEncoder).EncodeText(nil, nil)
+	if err != nil {
+		t.Fatalf("cannot encode %s as text: %v", dt.Name, err)
+	}
+	return string(text)
+}
+
+func TestRender(t *testing.T) {
+	for _, tt := range renderTests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := column(t, tt.typ, tt.value)
+			if oid := FieldDescription(arrow.Field{Type: tt.typ}, Options{}).DataTypeOID; oid != tt.oid {
+				t.Errorf("type = %d, want %d", oid, tt.oid)
+			}
+
+			text, err := Text(c, 0, Options{})
+			if err != nil || text != tt.text {
+				t.Errorf("Text = %q, %v; want %q", text, err, tt.text)
+			}
+			b, err := Bytes(c, 0, Options{})
+			if err != nil || b == nil || string(b) != tt.text {
+				t.Errorf("Bytes = %q, %v; want %q", b, err, tt.text)
+			}
+			b, err = Binary(c, 0, Options{})
+			if err != nil || b == nil {
+				t.Fatalf("Binary = %q, %v", b, err)
+			}
+			if got := decodeBinary(t, tt.oid, b); got != tt.binary {
+				t.Errorf("Binary decodes to %q, want %q", got, tt.binary)
+			}
+		})
+	}
+}
+
+// TestRenderNull checks that NULL is told apart from empty values: Text renders both as "" but Bytes and Binary
+// render NULL as nil, which DataRow messages send as a NULL.
+func TestRenderNull(t *testing.T) {
+	for _, tt := range renderTests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := column(t, tt.typ, tt.value)
+			if s, err := Text(c, 1, Options{}); err != nil || s != "" {
+				t.Errorf("Text of NULL = %q, %v", s, err)
+			}
+			if b, err := Bytes(c, 1, Options{}); err != nil || b != nil {
+				t.Errorf("Bytes of NULL = %q, %v", b, err)
+			}
+			if b, err := Binary(c, 1, Options{}); err != nil || b != nil {
+				t.Errorf("Binary of NULL = %q, %v", b, err)
+			}
+			if b, err := Bytes(c, 0, Options{}); err != nil || b == nil {
+				t.Errorf("Bytes of %s = nil, %v", tt.value, err)
+			}
+		})
+	}
+}
+
+func TestRenderTimestampOptions(t *testing.T) {
+	typ := &arrow.TimestampType{Unit: arrow.Nanosecond}
+	c := column(t, typ, `"2024-01-02 03:04:05.1234567"`)
+	tests := []struct {
+		name         string
+		opts         Options
+		oid          uint32
+		text, binary string
+	}{
+		{"microseconds", Options{TimestampPrecision: MicrosecondPrecision}, pgtype.TimestampOID,
+			"2024-01-02 03:04:05.123456", "2024-01-02 03:04:05.123456"},
+		{"rounded", Options{TimestampPrecision: MicrosecondPrecision, TimestampRounding: RoundTimestamps}, pgtype.TimestampOID,
+			"2024-01-02 03:04:05.123457", "2024-01-02 03:04:05.123457"},
+		{"epoch", Options{TimestampFormat: EpochMilliseconds}, pgtype.Int8OID, "1704164645123", "1704164645123"},
+		{"to_char", Options{ToChar: "HH24:MI"}, pgtype.TextOID, "03:04", "03:04"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if oid := FieldDescription(arrow.Field{Type: typ}, tt.opts).DataTypeOID; oid != tt.oid {
+				t.Errorf("type = %d, want %d", oid, tt.oid)
+			}
+			if s, err := Text(c, 0, tt.opts); err != nil || s != tt.text {
+				t.Errorf("Text = %q, %v; want %q", s, err, tt.text)
+			}
+			b, err := Binary(c, 0, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := decodeBinary(t, tt.oid, b); got != tt.binary {
+				t.Errorf("Binary decodes to %q, want %q", got, tt.binary)
+			}
+		})
+	}
+}
+
+func TestRenderStruct(t *testing.T) {
+	typ := arrow.StructOf(
+		arrow.Field{Name: "n", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+		arrow.Field{Name: "tags", Type: arrow.ListOf(arrow.BinaryTypes.String), Nullable: true},
+	)
+	c := column(t, typ, `{"n": 1, "tags": ["a", "b"]}, {"n": null, "tags": null}`)
+	if oid := FieldDescription(arrow.Field{Type: typ}, Options{}).DataTypeOID; oid != pgtype.RecordOID {
+		t.Errorf("type = %d, want record", oid)
+	}
+	for row, want := range []string{`(1,"{a,b}")`, "(,)"} {
+		if s, err := Text(c, row, Options{}); err != nil || s != want {
+			t.Errorf("Text of row %d = %q, %v; want %q", row, s, err, want)
+		}
+	}
+	if b, err := Binary(c, 2, Options{}); err != nil || b != nil {
+		t.Errorf("Binary of NULL = %q, %v", b, err)
+	}
+
+	b, err := Binary(c, 0, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r pgtype.Record
+	if err := r.DecodeBinary(pgtype.NewConnInfo(), b); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Fields) != 2 {
+		t.Fatalf("got %d fields, want 2", len(r.Fields))
+	}
+	if n, ok := r.Fields[0].(*pgtype.Int8); !ok || n.Int != 1 {
+		t.Errorf("field n = %#v", r.Fields[0])
+	}
+	tags, ok := r.Fields[1].(*pgtype.TextArray)
+	if !ok || len(tags.Elements) != 2 || tags.Elements[1].String != "b" {
+		t.Errorf("field tags = %#v", r.Fields[1])
+	}
+
+	b, err = Binary(c, 1, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// both fields are NULL: a field count, then an OID and a length of -1 per field.
+	want := []byte{0, 0, 0, 2, 0, 0, 0, 20, 0xff, 0xff, 0xff, 0xff, 0, 0, 3, 0xf1, 0xff, 0xff, 0xff, 0xff}
+	if !bytes.Equal(b, want) {
+		t.Errorf("Binary of NULL fields = %v, want %v", b, want)
+	}
+}
@@ -0,0 +1,160 @@
+package arrowpg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TimestampFormatLayout is the time layout of postgres timestamp values, with nanosecond precision.
+	TimestampFormatLayout = "2006-01-02 15:04:05.999999999"
+	// TimestampMicrosFormatLayout is the time layout of postgres timestamp values.
+	TimestampMicrosFormatLayout = "2006-01-02 15:04:05.999999"
+)
+
+// TimestampPrecision selects how many fractional second digits are rendered for timestamps.
+type TimestampPrecision int
+
+const (
+	// NanosecondPrecision renders up to 9 fractional digits, preserving the full resolution of Arrow timestamps.
+	NanosecondPrecision TimestampPrecision = iota
+	// MicrosecondPrecision renders up to 6 fractional digits, which is what PostgreSQL itself emits.
+	MicrosecondPrecision
+)
+
+// ParseTimestampPrecision parses "ns" or "us" into a TimestampPrecision.
+func ParseTimestampPrecision(s string) (TimestampPrecision, error) {
+	switch s {
+	case "ns":
+		return NanosecondPrecision, nil
+	case "us":
+		return MicrosecondPrecision, nil
+	default:
+		return 0, fmt.Errorf("invalid timestamp precision %q (expected \"ns\" or \"us\")", s)
+	}
+}
+
+func (p TimestampPrecision) String() string {
+	if p == MicrosecondPrecision {
+		return "us"
+	}
+	return "ns"
+}
+
+// TimestampRounding selects how digits beyond the configured TimestampPrecision are dropped.
+type TimestampRounding int
+
+const (
+	// TruncateTimestamps drops the extra digits.
+	TruncateTimestamps TimestampRounding = iota
+	// RoundTimestamps rounds half away from zero.
+	RoundTimestamps
+)
+
+// ParseTimestampRounding parses "truncate" or "round" into a TimestampRounding.
+func ParseTimestampRounding(s string) (TimestampRounding, error) {
+	switch s {
+	case "truncate":
+		return TruncateTimestamps, nil
+	case "round":
+		return RoundTimestamps, nil
+	default:
+		return 0, fmt.Errorf("invalid timestamp rounding %q (expected \"truncate\" or \"round\")", s)
+	}
+}
+
+func (r TimestampRounding) String() string {
+	if r == RoundTimestamps {
+		return "round"
+	}
+	return "truncate"
+}
+
+// TimestampFormat selects whether timestamps are rendered as text or as integers counting from the Unix epoch.
+type TimestampFormat int
+
+const (
+	// TextTimestamps renders timestamps as postgres timestamp values.
+	TextTimestamps TimestampFormat = iota
+	// EpochSeconds renders timestamps as bigint seconds since the Unix epoch.
+	EpochSeconds
+	// EpochMilliseconds renders timestamps as bigint milliseconds since the Unix epoch.
+	EpochMilliseconds
+	// EpochMicroseconds renders timestamps as bigint microseconds since the Unix epoch.
+	EpochMicroseconds
+	// EpochNanoseconds renders timestamps as bigint nanoseconds since the Unix epoch.
+	EpochNanoseconds
+)
+
+var timestampFormatNames = []string{"text", "epoch_s", "epoch_ms", "epoch_us", "epoch_ns"}
+
+// ParseTimestampFormat parses "text", "epoch_s", "epoch_ms", "epoch_us" or "epoch_ns" into a TimestampFormat.
+func ParseTimestampFormat(s string) (TimestampFormat, error) {
+	for i, name := range timestampFormatNames {
+		if s == name {
+			return TimestampFormat(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid timestamp format %q (expected one of %s)", s, strings.Join(timestampFormatNames, ", "))
+}
+
+func (f TimestampFormat) String() string {
+	return timestampFormatNames[f]
+}
+
+// Options controls how arrow values are rendered into postgres values.
+type Options struct {
+	TimestampPrecision TimestampPrecision
+	TimestampRounding  TimestampRounding
+	TimestampFormat    TimestampFormat
+	// Location, if set, renders timestamps as wall clock time in the given time zone.
+	Location *time.Location
+	// ToChar, if set, renders timestamps as text formatted with the given to_char pattern.
+	ToChar string
+}
+
+// FormatTime renders a time of day, date or timestamp as postgres text.
+func (o Options) FormatTime(t time.Time) string {
+	if o.Location != nil {
+		t = t.In(o.Location)
+	}
+	if o.TimestampPrecision != MicrosecondPrecision {
+		return t.Format(TimestampFormatLayout)
+	}
+	if o.TimestampRounding == RoundTimestamps {
+		t = t.Round(time.Microsecond)
+	} else {
+		t = t.Truncate(time.Microsecond)
+	}
+	return t.Format(TimestampMicrosFormatLayout)
+}
+
+// FormatTimestamp renders a timestamp in the configured format.
+func (o Options) FormatTimestamp(t time.Time) string {
+	var unit time.Duration
+	if o.ToChar != "" {
+		if o.Location != nil {
+			t = t.In(o.Location)
+		}
+		return FormatToChar(t, o.ToChar)
+	}
+	switch o.TimestampFormat {
+	case TextTimestamps:
+		return o.FormatTime(t)
+	case EpochSeconds:
+		unit = time.Second
+	case EpochMilliseconds:
+		unit = time.Millisecond
+	case EpochMicroseconds:
+		unit = time.Microsecond
+	default:
+		return strconv.FormatInt(t.UnixNano(), 10)
+	}
+	if o.TimestampRounding == RoundTimestamps {
+		t = t.Round(unit)
+	}
+	sec, nsec := t.Unix(), int64(t.Nanosecond())
+	return strconv.FormatInt(sec*int64(time.Second/unit)+nsec/int64(unit), 10)
+}
@@ -0,0 +1,71 @@
+package arrowpg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestampOptions(t *testing.T) {
+	for _, s := range []string{"ns", "us"} {
+		p, err := ParseTimestampPrecision(s)
+		if err != nil || p.String() != s {
+			t.Errorf("ParseTimestampPrecision(%q) = %v, %v", s, p, err)
+		}
+	}
+	for _, s := range []string{"truncate", "round"} {
+		r, err := ParseTimestampRounding(s)
+		if err != nil || r.String() != s {
+			t.Errorf("ParseTimestampRounding(%q) = %v, %v", s, r, err)
+		}
+	}
+	for _, s := range timestampFormatNames {
+		f, err := ParseTimestampFormat(s)
+		if err != nil || f.String() != s {
+			t.Errorf("ParseTimestampFormat(%q) = %v, %v", s, f, err)
+		}
+	}
+	if _, err := ParseTimestampPrecision("ms"); err == nil {
+		t.Errorf("ParseTimestampPrecision(\"ms\") succeeded")
+	}
+	if _, err := ParseTimestampRounding("ceil"); err == nil {
+		t.Errorf("ParseTimestampRounding(\"ceil\") succeeded")
+	}
+	if _, err := ParseTimestampFormat("epoch"); err == nil {
+		t.Errorf("ParseTimestampFormat(\"epoch\") succeeded")
+	}
+}
+
+func TestFormatTimestamp(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		name string
+		opts Options
+		t    time.Time
+		want string
+	}{
+		{"nanoseconds", Options{}, ts, "2024-01-02 03:04:05.123456789"},
+		{"whole seconds", Options{}, ts.Truncate(time.Second), "2024-01-02 03:04:05"},
+		{"trailing zeros", Options{}, ts.Truncate(time.Millisecond), "2024-01-02 03:04:05.123"},
+		{"truncated microseconds", Options{TimestampPrecision: MicrosecondPrecision}, ts, "2024-01-02 03:04:05.123456"},
+		{"rounded microseconds", Options{TimestampPrecision: MicrosecondPrecision, TimestampRounding: RoundTimestamps}, ts, "2024-01-02 03:04:05.123457"},
+		{"location", Options{Location: paris}, ts, "2024-01-02 04:04:05.123456789"},
+		{"epoch seconds", Options{TimestampFormat: EpochSeconds}, ts, "1704164645"},
+		{"rounded epoch seconds", Options{TimestampFormat: EpochSeconds, TimestampRounding: RoundTimestamps}, ts.Add(400 * time.Millisecond), "1704164646"},
+		{"epoch milliseconds", Options{TimestampFormat: EpochMilliseconds}, ts, "1704164645123"},
+		{"epoch microseconds", Options{TimestampFormat: EpochMicroseconds}, ts, "1704164645123456"},
+		{"epoch nanoseconds", Options{TimestampFormat: EpochNanoseconds}, ts, "1704164645123456789"},
+		{"epoch ignores location", Options{TimestampFormat: EpochSeconds, Location: paris}, ts, "1704164645"},
+		{"before the epoch", Options{TimestampFormat: EpochMilliseconds}, time.Unix(-1, 0), "-1000"},
+		{"to_char", Options{ToChar: "YYYY-MM-DD HH24:MI"}, ts, "2024-01-02 03:04"},
+		{"to_char location", Options{ToChar: "HH24:MI TZ", Location: paris}, ts, "04:04 CET"},
+	}
+	for _, tt := range tests {
+		if got := tt.opts.FormatTimestamp(tt.t); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
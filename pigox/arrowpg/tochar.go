@@ -0,0 +1,158 @@
+package arrowpg
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// toCharFields are the template patterns of to_char, longest first so that e.g. HH24 wins over HH.
+var toCharFields = []string{
+	"A.M.", "P.M.", "HH24", "HH12", "YYYY", "MONTH", "DAY",
+	"YYY", "MON", "DDD", "HH", "MI", "SS", "MS", "US", "AM", "PM",
+	"YY", "MM", "DD", "DY", "WW", "IW", "TZ", "OF",
+	"Y", "D", "Q",
+}
+
+// FormatToChar formats a time like postgres' to_char with a template pattern such as 'YYYY-MM-DD HH24:MI:SS'.
+// The FM prefix suppresses padding, double quoted text is copied verbatim and unknown characters are kept.
+func FormatToChar(t time.Time, pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); {
+		fill := true
+		if strings.HasPrefix(strings.ToUpper(pattern[i:]), "FM") {
+			fill = false
+			i += 2
+		}
+		switch {
+		case i >= len(pattern):
+			continue
+		case pattern[i] == '"':
+			end := strings.IndexByte(pattern[i+1:], '"')
+			if end < 0 {
+				end = len(pattern) - i - 1
+			}
+			b.WriteString(pattern[i+1 : i+1+end])
+			i += end + 2
+			continue
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			b.WriteByte(pattern[i+1])
+			i += 2
+			continue
+		}
+		field := ""
+		for _, f := range toCharFields {
+			if strings.HasPrefix(strings.ToUpper(pattern[i:]), f) {
+				field = f
+				break
+			}
+		}
+		if field == "" {
+			b.WriteByte(pattern[i])
+			i++
+			continue
+		}
+		b.WriteString(toCharField(t, field, pattern[i:i+len(field)], fill))
+		i += len(field)
+	}
+	return b.String()
+}
+
+func toCharField(t time.Time, field, verbatim string, fill bool) string {
+	num := func(n, width int) string {
+		if !fill {
+			return fmt.Sprint(n)
+		}
+		return fmt.Sprintf("%0*d", width, n)
+	}
+	name := func(s string, width int) string {
+		switch {
+		case verbatim == strings.ToUpper(verbatim):
+			s = strings.ToUpper(s)
+		case verbatim == strings.ToLower(verbatim):
+			s = strings.ToLower(s)
+		}
+		if fill {
+			s = fmt.Sprintf("%-*s", width, s)
+		}
+		return s
+	}
+	hour12 := t.Hour() % 12
+	if hour12 == 0 {
+		hour12 = 12
+	}
+	switch field {
+	case "YYYY":
+		return num(t.Year(), 4)
+	case "YYY":
+		return num(t.Year()%1000, 3)
+	case "YY":
+		return num(t.Year()%100, 2)
+	case "Y":
+		return num(t.Year()%10, 1)
+	case "MONTH":
+		return name(t.Month().String(), 9)
+	case "MON":
+		return name(t.Month().String()[:3], 3)
+	case "MM":
+		return num(int(t.Month()), 2)
+	case "DAY":
+		return name(t.Weekday().String(), 9)
+	case "DY":
+		return name(t.Weekday().String()[:3], 3)
+	case "DDD":
+		return num(t.YearDay(), 3)
+	case "DD":
+		return num(t.Day(), 2)
+	case "D":
+		return num(int(t.Weekday())+1, 1)
+	case "WW":
+		return num((t.YearDay()-1)/7+1, 2)
+	case "IW":
+		_, w := t.ISOWeek()
+		return num(w, 2)
+	case "Q":
+		return num((int(t.Month())-1)/3+1, 1)
+	case "HH", "HH12":
+		return num(hour12, 2)
+	case "HH24":
+		return num(t.Hour(), 2)
+	case "MI":
+		return num(t.Minute(), 2)
+	case "SS":
+		return num(t.Second(), 2)
+	case "MS":
+		return num(t.Nanosecond()/int(time.Millisecond), 3)
+	case "US":
+		return num(t.Nanosecond()/int(time.Microsecond), 6)
+	case "AM", "PM", "A.M.", "P.M.":
+		s := "AM"
+		if t.Hour() >= 12 {
+			s = "PM"
+		}
+		if strings.Contains(field, ".") {
+			s = s[:1] + "." + s[1:] + "."
+		}
+		if verbatim == strings.ToLower(verbatim) {
+			s = strings.ToLower(s)
+		}
+		return s
+	case "TZ":
+		zone, _ := t.Zone()
+		if verbatim == strings.ToLower(verbatim) {
+			return strings.ToLower(zone)
+		}
+		return zone
+	case "OF":
+		_, offset := t.Zone()
+		s := fmt.Sprintf("%+03d", offset/3600)
+		if m := offset % 3600 / 60; m != 0 {
+			if m < 0 {
+				m = -m
+			}
+			s += fmt.Sprintf(":%02d", m)
+		}
+		return s
+	}
+	return verbatim
+}
@@ -0,0 +1,40 @@
+package arrowpg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatToChar(t *testing.T) {
+	ts := time.Date(2024, 3, 5, 15, 4, 5, 123456789, time.UTC)
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"YYYY-MM-DD HH24:MI:SS", "2024-03-05 15:04:05"},
+		{"YYYY-MM-DD HH24:MI:SS.MS", "2024-03-05 15:04:05.123"},
+		{"HH24:MI:SS.US", "15:04:05.123456"},
+		{"HH12:MI AM", "03:04 PM"},
+		{"HH:MI p.m.", "03:04 p.m."},
+		{"FMHH12:MI", "3:04"},
+		{"YYY YY Y", "024 24 4"},
+		{"Month|Mon|MONTH|mon", "March    |Mar|MARCH    |mar"},
+		{"FMMonth FMDD", "March 5"},
+		{"Day Dy DY", "Tuesday   Tue TUE"},
+		{"DDD D Q WW IW", "065 3 1 10 10"},
+		{"TZ tz OF", "UTC utc +00"},
+		{`YYYY"YYYY"`, "2024YYYY"},
+		{`\YYYY`, "Y024"},
+		{"YYYY/MM/DD!", "2024/03/05!"},
+	}
+	for _, tt := range tests {
+		if got := FormatToChar(ts, tt.pattern); got != tt.want {
+			t.Errorf("FormatToChar(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+
+	india := time.FixedZone("IST", 5*3600+30*60)
+	if got := FormatToChar(ts.In(india), "TZ OF"); got != "IST +05:30" {
+		t.Errorf("FormatToChar of IST = %q", got)
+	}
+}
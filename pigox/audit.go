@@ -0,0 +1,108 @@
+package pigox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// AuditSink records the audit events of the proxy, e.g. to keep a record of who ran what; see NewJSONAuditSink.
+// Audit is called concurrently by all connections, once per login attempt and query; errors are logged.
+type AuditSink interface {
+	Audit(e AuditEvent) error
+}
+
+// Kinds of audit events.
+const (
+	AuditLogin = "login"
+	AuditQuery = "query"
+)
+
+// AuditEvent is a login attempt or a query of a session.
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	// Kind is AuditLogin or AuditQuery.
+	Kind string `json:"kind"`
+	// SessionID is the process ID of the session; zero for the login attempts failing before it is assigned.
+	SessionID   int32  `json:"session_id,omitempty"`
+	RemoteAddr  string `json:"remote_addr,omitempty"`
+	User        string `json:"user"`
+	Database    string `json:"database"`
+	Application string `json:"application,omitempty"`
+	// Query is the query as sent by the client and RewrittenQuery the query sent to IOx, if different.
+	Query          string `json:"query,omitempty"`
+	RewrittenQuery string `json:"rewritten_query,omitempty"`
+	Rows           int    `json:"rows,omitempty"`
+	// Duration is the time the query took to run; zero for login attempts.
+	Duration time.Duration `json:"duration_ns,omitempty"`
+	// ErrorCode is the SQLSTATE code of the error the login attempt or query failed with, empty if it succeeded.
+	ErrorCode string `json:"error_code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// WithAuditSink records every login attempt and query in s. Proxies created by a Server share s.
+func WithAuditSink(s AuditSink) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.auditSink = s
+	}
+}
+
+// JSONAuditSink is an AuditSink writing the events as JSON lines, e.g. to a file or to os.Stdout.
+type JSONAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONAuditSink returns a sink writing one JSON object per event to w.
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{w: w}
+}
+
+// Audit writes an event with a single Write call, so that concurrent events are not interleaved.
+func (s *JSONAuditSink) Audit(e AuditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("cannot write audit event: %w", err)
+	}
+	return nil
+}
+
+// audit records an event of a session.
+func (p *Proxy) audit(s *session, e AuditEvent, err error) {
+	if p.auditSink == nil {
+		return
+	}
+	e.Time = time.Now()
+	if addr := p.conn.RemoteAddr(); addr != nil {
+		e.RemoteAddr = addr.String()
+	}
+	e.SessionID, e.User, e.Database, e.Application = s.pid, s.userName, s.databaseName, s.applicationName
+	if err != nil {
+		e.ErrorCode, e.Error = errorCode(err), err.Error()
+	}
+	if err := p.auditSink.Audit(e); err != nil {
+		p.log.Error("cannot record audit event", "kind", e.Kind, "err", err)
+	}
+}
+
+// auditLogin records a login attempt of a session; err is the error it failed with, nil if it succeeded.
+func (p *Proxy) auditLogin(s *session, err error) {
+	p.audit(s, AuditEvent{Kind: AuditLogin}, err)
+}
+
+// auditQuery records a query of a session; source is the query as sent by the client and query the query sent
+// to IOx.
+func (p *Proxy) auditQuery(s *session, source, query string, start time.Time, rows int, err error) {
+	e := AuditEvent{Kind: AuditQuery, Query: source, Rows: rows, Duration: time.Since(start)}
+	if query != source {
+		e.RewrittenQuery = query
+	}
+	p.audit(s, e, err)
+}
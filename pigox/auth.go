@@ -0,0 +1,428 @@
+package pigox
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// AuthMethod is a password authentication method, named like in pg_hba.conf.
+type AuthMethod string
+
+const (
+	// AuthPassword asks clients for their password in clear text.
+	AuthPassword AuthMethod = "password"
+	// AuthMD5 asks clients for the MD5 hash of their password, salted with a random salt.
+	AuthMD5 AuthMethod = "md5"
+	// AuthSCRAMSHA256 authenticates clients with the SCRAM-SHA-256 SASL mechanism; it proves the client knows
+	// the password without sending it, nor a hash the client could be impersonated with.
+	AuthSCRAMSHA256 AuthMethod = "scram-sha-256"
+)
+
+// ParseAuthMethod parses an authentication method: password, md5 or scram-sha-256.
+func ParseAuthMethod(s string) (AuthMethod, error) {
+	switch m := AuthMethod(strings.ToLower(s)); m {
+	case AuthPassword, AuthMD5, AuthSCRAMSHA256:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid authentication method %q (expected password, md5 or scram-sha-256)", s)
+}
+
+// StoredCredentials are the credentials a user is authenticated against.
+type StoredCredentials struct {
+	// Secret is the password of the user, in clear text or hashed like postgres stores it in pg_authid: an MD5
+	// hash, "md5" followed by the hex MD5 of the password and the user name, or a SCRAM-SHA-256 verifier,
+	// "SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>". MD5 authentication needs the password or its
+	// MD5 hash, SCRAM-SHA-256 authentication the password or its verifier.
+	Secret string
+	// Token is the IOx token the queries of the user are authorized with; empty means none.
+	Token string
+}
+
+// CredentialVerifier returns the credentials of a user connecting to a database. Errors fail the authentication.
+type CredentialVerifier func(user, database string) (StoredCredentials, error)
+
+// WithAuthMethod asks clients for a password with method and checks it against the credentials returned by
+// credentials; the queries of the session are then authorized with the token of the credentials. With a nil
+// credentials, the AuthPassword method passes the password to IOx as the token of the session, like
+// WithRequireAuth, and the other methods reject every client.
+func WithAuthMethod(method AuthMethod, credentials CredentialVerifier) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.authMethod = method
+		opts.credentials = credentials
+	}
+}
+
+// Identity is a user authenticated by an Authenticator.
+type Identity struct {
+	// User is the name of the user.
+	User string
+	// Database is the database the user connected to. Authorize is called with the database the query runs on,
+	// which differs for federated queries and rerouted ones.
+	Database string
+	// Token is the IOx token the queries of the session are authorized with; empty means none.
+	Token string
+	// Attributes are whatever the authenticator knows of the user that Authorize needs, e.g. LDAP groups or the
+	// claims of an OIDC token.
+	Attributes map[string]string
+}
+
+// Authenticator authenticates the clients connecting to the proxy, e.g. against LDAP or by validating OIDC tokens.
+// Authenticate is called with the password sent by the client, or the token of its stored credentials if
+// WithAuthMethod is also used; errors fail the authentication, like wrong passwords.
+//
+// If the Authenticator also implements Authorizer, it authorizes every query sent to IOx on behalf of the
+// session.
+type Authenticator interface {
+	Authenticate(ctx context.Context, user, database, token string) (Identity, error)
+}
+
+// Authorizer authorizes the queries of the identities authenticated by an Authenticator, e.g. to enforce per
+// database access control. The queries are the ones sent to IOx, after rewriting, including those the proxy runs
+// on its own on behalf of the session, e.g. to list tables for the emulated catalogs. Errors are reported to the
+// client as insufficient_privilege errors.
+type Authorizer interface {
+	Authorize(ctx context.Context, id Identity, query string) error
+}
+
+// WithAuthenticator authenticates clients with a, which asks them for a password unless WithAuthMethod is used.
+func WithAuthenticator(a Authenticator) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.authenticator = a
+	}
+}
+
+// identify authenticates a client with the Authenticator, if any, and returns its identity, nil without an
+// Authenticator.
+func (p *Proxy) identify(user, database, token string) (*Identity, error) {
+	if p.authenticator == nil {
+		return nil, nil
+	}
+	ctx := context.Background()
+	if p.startupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.startupTimeout)
+		defer cancel()
+	}
+	id, err := p.authenticator.Authenticate(ctx, user, database, token)
+	if err != nil {
+		p.log.Warn("cannot authenticate user", "user", user, "err", err)
+		return nil, errPasswordAuthentication(user)
+	}
+	return &id, nil
+}
+
+// authorize authorizes a query of the session with the Authorizer, if any.
+func (p *Proxy) authorize(ctx context.Context, session *session, query string) error {
+	a, ok := p.authenticator.(Authorizer)
+	if !ok || session.identity == nil {
+		return nil
+	}
+	id := *session.identity
+	id.Database = session.databaseName
+	if err := a.Authorize(ctx, id, query); err != nil {
+		return newPGError(pgerrcode.InsufficientPrivilege, err)
+	}
+	return nil
+}
+
+// errPasswordAuthentication is the error of failed authentications; like postgres, it doesn't tell why.
+func errPasswordAuthentication(user string) error {
+	return newPGError(pgerrcode.InvalidPassword, fmt.Errorf("password authentication failed for user %q", user))
+}
+
+// authenticate authenticates the user of a connection, if required, and returns the IOx token of the session.
+func (p *Proxy) authenticate(user, database string) (string, error) {
+	method := p.authMethod
+	if method == "" {
+		if !p.requireAuth && p.authenticator == nil {
+			return "", nil
+		}
+		method = AuthPassword
+	}
+	if p.credentials == nil {
+		if method != AuthPassword {
+			p.log.Error("cannot authenticate user: no credentials are configured", "user", user, "method", string(method))
+			return "", errPasswordAuthentication(user)
+		}
+		return p.receivePassword(&pgproto3.AuthenticationCleartextPassword{})
+	}
+	creds, err := p.credentials(user, database)
+	if err != nil {
+		p.log.Warn("cannot get the credentials of user", "user", user, "err", err)
+		return "", errPasswordAuthentication(user)
+	}
+
+	var ok bool
+	switch method {
+	case AuthPassword:
+		password, err := p.receivePassword(&pgproto3.AuthenticationCleartextPassword{})
+		if err != nil {
+			return "", err
+		}
+		ok = p.checkPassword(creds.Secret, user, password)
+	case AuthMD5:
+		var salt [4]byte
+		if _, err := rand.Read(salt[:]); err != nil {
+			return "", err
+		}
+		response, err := p.receivePassword(&pgproto3.AuthenticationMD5Password{Salt: salt})
+		if err != nil {
+			return "", err
+		}
+		ok = p.checkMD5Response(creds.Secret, user, salt, response)
+	case AuthSCRAMSHA256:
+		if ok, err = p.scramAuthenticate(creds.Secret); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported authentication method %q", method)
+	}
+	if !ok {
+		return "", errPasswordAuthentication(user)
+	}
+	return creds.Token, nil
+}
+
+// receivePassword sends an authentication request and returns the password message the client answers with.
+func (p *Proxy) receivePassword(request pgproto3.BackendMessage) (string, error) {
+	if err := writeMessages(p.conn, request); err != nil {
+		return "", fmt.Errorf("error sending request for password: %w", err)
+	}
+	msg, err := p.receive()
+	if err != nil {
+		return "", fmt.Errorf("error receiving password: %w", protocolError(err))
+	}
+	password, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return "", newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("unexpected message %T", msg))
+	}
+	return password.Password, nil
+}
+
+// md5Hash returns the MD5 hash postgres stores passwords as.
+func md5Hash(user, password string) string {
+	sum := md5.Sum([]byte(password + user))
+	return "md5" + hex.EncodeToString(sum[:])
+}
+
+func isMD5Hash(secret string) bool {
+	return len(secret) == 35 && strings.HasPrefix(secret, "md5")
+}
+
+// checkPassword reports whether a password in clear text matches a secret.
+func (p *Proxy) checkPassword(secret, user, password string) bool {
+	switch {
+	case isMD5Hash(secret):
+		return subtle.ConstantTimeCompare([]byte(secret), []byte(md5Hash(user, password))) == 1
+	case strings.HasPrefix(secret, scramPrefix):
+		v, err := parseSCRAMVerifier(secret)
+		if err != nil {
+			p.log.Error("invalid SCRAM-SHA-256 verifier", "user", user, "err", err)
+			return false
+		}
+		return hmac.Equal(v.storedKey, newSCRAMVerifier(password, v.salt, v.iterations).storedKey)
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(password)) == 1
+}
+
+// checkMD5Response reports whether the response to an MD5 password request with salt matches a secret.
+func (p *Proxy) checkMD5Response(secret, user string, salt [4]byte, response string) bool {
+	hash := secret
+	switch {
+	case strings.HasPrefix(secret, scramPrefix):
+		p.log.Error("cannot authenticate user with md5: only a SCRAM-SHA-256 verifier is known", "user", user)
+		return false
+	case !isMD5Hash(secret):
+		hash = md5Hash(user, secret)
+	}
+	sum := md5.Sum(append([]byte(hash[3:]), salt[:]...))
+	return subtle.ConstantTimeCompare([]byte(response), []byte("md5"+hex.EncodeToString(sum[:]))) == 1
+}
+
+const (
+	scramMechanism = "SCRAM-SHA-256"
+	scramPrefix    = scramMechanism + "$"
+	// scramIterations is the iteration count of the verifiers computed from passwords in clear text, the default of
+	// postgres.
+	scramIterations = 4096
+)
+
+// scramVerifier holds what the server needs to know of a password to authenticate clients with SCRAM-SHA-256.
+type scramVerifier struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+func newSCRAMVerifier(password string, salt []byte, iterations int) scramVerifier {
+	salted := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return scramVerifier{iterations: iterations, salt: salt, storedKey: storedKey[:], serverKey: hmacSHA256(salted, "Server Key")}
+}
+
+// parseSCRAMVerifier parses a verifier formatted like postgres stores them in pg_authid.
+func parseSCRAMVerifier(s string) (scramVerifier, error) {
+	var v scramVerifier
+	params, keys, ok := strings.Cut(strings.TrimPrefix(s, scramPrefix), "$")
+	iterations, salt, ok1 := strings.Cut(params, ":")
+	storedKey, serverKey, ok2 := strings.Cut(keys, ":")
+	if !ok || !ok1 || !ok2 {
+		return v, fmt.Errorf("expected %s<iterations>:<salt>$<StoredKey>:<ServerKey>", scramPrefix)
+	}
+	var err error
+	if v.iterations, err = strconv.Atoi(iterations); err != nil || v.iterations <= 0 {
+		return v, fmt.Errorf("invalid iteration count %q", iterations)
+	}
+	for _, f := range []struct {
+		dst   *[]byte
+		value string
+	}{{&v.salt, salt}, {&v.storedKey, storedKey}, {&v.serverKey, serverKey}} {
+		if *f.dst, err = base64.StdEncoding.DecodeString(f.value); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// scramAuthenticate runs a SCRAM-SHA-256 exchange (RFC 5802 and 7677) without channel binding and reports whether
+// the client proved it knows the password of secret.
+func (p *Proxy) scramAuthenticate(secret string) (bool, error) {
+	var v scramVerifier
+	if strings.HasPrefix(secret, scramPrefix) {
+		var err error
+		if v, err = parseSCRAMVerifier(secret); err != nil {
+			p.log.Error("invalid SCRAM-SHA-256 verifier", "err", err)
+			return false, nil
+		}
+	} else {
+		if isMD5Hash(secret) {
+			p.log.Error("cannot authenticate with scram-sha-256: only an MD5 hash of the password is known")
+			return false, nil
+		}
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return false, err
+		}
+		v = newSCRAMVerifier(secret, salt, scramIterations)
+	}
+	defer p.backend.SetAuthType(pgproto3.AuthTypeOk)
+
+	// client-first-message: gs2-header client-first-message-bare, e.g. "n,,n=,r=<client nonce>".
+	p.backend.SetAuthType(pgproto3.AuthTypeSASL)
+	msg, err := p.sendSASL(&pgproto3.AuthenticationSASL{AuthMechanisms: []string{scramMechanism}})
+	if err != nil {
+		return false, err
+	}
+	initial, ok := msg.(*pgproto3.SASLInitialResponse)
+	if !ok {
+		return false, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("unexpected message %T", msg))
+	}
+	if initial.AuthMechanism != scramMechanism {
+		return false, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("client selected an invalid SASL authentication mechanism %q", initial.AuthMechanism))
+	}
+	clientFirst := string(initial.Data)
+	var gs2Header string
+	switch {
+	case strings.HasPrefix(clientFirst, "n,,"), strings.HasPrefix(clientFirst, "y,,"):
+		gs2Header = clientFirst[:3]
+	case strings.HasPrefix(clientFirst, "p="):
+		return false, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("SCRAM channel binding is not supported"))
+	default:
+		return false, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("malformed SCRAM message"))
+	}
+	clientFirstBare := clientFirst[len(gs2Header):]
+	clientNonce := scramAttribute(clientFirstBare, 'r')
+	if clientNonce == "" {
+		return false, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("malformed SCRAM message: no nonce"))
+	}
+
+	// server-first-message: "r=<client nonce><server nonce>,s=<salt>,i=<iterations>".
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return false, err
+	}
+	nonce := clientNonce + base64.StdEncoding.EncodeToString(serverNonce)
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce, base64.StdEncoding.EncodeToString(v.salt), v.iterations)
+	p.backend.SetAuthType(pgproto3.AuthTypeSASLContinue)
+	msg, err = p.sendSASL(&pgproto3.AuthenticationSASLContinue{Data: []byte(serverFirst)})
+	if err != nil {
+		return false, err
+	}
+	response, ok := msg.(*pgproto3.SASLResponse)
+	if !ok {
+		return false, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("unexpected message %T", msg))
+	}
+
+	// client-final-message: "c=<gs2-header>,r=<nonce>,p=<proof>".
+	clientFinal := string(response.Data)
+	i := strings.LastIndex(clientFinal, ",p=")
+	if i < 0 {
+		return false, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("malformed SCRAM message: no proof"))
+	}
+	if scramAttribute(clientFinal, 'c') != base64.StdEncoding.EncodeToString([]byte(gs2Header)) || scramAttribute(clientFinal, 'r') != nonce {
+		return false, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("SCRAM channel binding or nonce mismatch"))
+	}
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return false, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("malformed SCRAM message: invalid proof"))
+	}
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinal[:i]
+	// ClientKey is ClientProof XOR HMAC(StoredKey, AuthMessage), and StoredKey its SHA-256.
+	clientKey := hmacSHA256(v.storedKey, authMessage)
+	for j := range clientKey {
+		clientKey[j] ^= proof[j]
+	}
+	if storedKey := sha256.Sum256(clientKey); !hmac.Equal(storedKey[:], v.storedKey) {
+		return false, nil
+	}
+
+	// server-final-message: "v=<server signature>".
+	signature := base64.StdEncoding.EncodeToString(hmacSHA256(v.serverKey, authMessage))
+	if err := writeMessages(p.conn, &pgproto3.AuthenticationSASLFinal{Data: []byte("v=" + signature)}); err != nil {
+		return false, fmt.Errorf("error sending SASL final message: %w", err)
+	}
+	return true, nil
+}
+
+// sendSASL sends a SASL authentication message and returns the client's response.
+func (p *Proxy) sendSASL(msg pgproto3.BackendMessage) (pgproto3.FrontendMessage, error) {
+	if err := writeMessages(p.conn, msg); err != nil {
+		return nil, fmt.Errorf("error sending SASL message: %w", err)
+	}
+	resp, err := p.receive()
+	if err != nil {
+		return nil, fmt.Errorf("error receiving SASL response: %w", protocolError(err))
+	}
+	return resp, nil
+}
+
+// scramAttribute returns the value of an attribute of a SCRAM message, e.g. the nonce r=...
+func scramAttribute(msg string, name byte) string {
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) >= 2 && attr[0] == name && attr[1] == '=' {
+			return attr[2:]
+		}
+	}
+	return ""
+}
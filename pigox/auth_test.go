@@ -0,0 +1,310 @@
+package pigox
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// testAuthenticate authenticates user with method against secret, with a client answering the authentication
+// requests of the proxy with respond; nil responses send nothing. It returns the token of the session,
+// the messages the client received, and the error of the authentication.
+func testAuthenticate(t *testing.T, method AuthMethod, secret string, respond func(pgproto3.BackendMessage) pgproto3.FrontendMessage) (string, []pgproto3.BackendMessage, error) {
+	t.Helper()
+	server, client := net.Pipe()
+	credentials := func(user, database string) (StoredCredentials, error) {
+		return StoredCredentials{Secret: secret, Token: "token"}, nil
+	}
+	p := NewProxy(server, "localhost:0", WithAuthMethod(method, credentials))
+
+	received := make(chan []pgproto3.BackendMessage, 1)
+	go func() {
+		var msgs []pgproto3.BackendMessage
+		frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(client), client)
+		for {
+			msg, err := frontend.Receive()
+			if err != nil {
+				break
+			}
+			msgs = append(msgs, msg)
+			if resp := respond(msg); resp != nil {
+				if err := frontend.Send(resp); err != nil {
+					break
+				}
+			}
+		}
+		received <- msgs
+	}()
+	token, err := p.authenticate("user", "db")
+	server.Close()
+	msgs := <-received
+	client.Close()
+	return token, msgs, err
+}
+
+// scramClient answers SCRAM-SHA-256 requests like libpq and pgx do, e.g. with an empty user name in the
+// client-first-message, so that the tests can tamper with its messages.
+type scramClient struct {
+	password    string
+	clientNonce string
+	// clientFirst and clientFinal, if set, replace the messages the client sends; the argument is the message
+	// the client would send otherwise.
+	clientFirst func(string) string
+	clientFinal func(string) string
+
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+func (c *scramClient) respond(msg pgproto3.BackendMessage) pgproto3.FrontendMessage {
+	switch msg := msg.(type) {
+	case *pgproto3.AuthenticationSASL:
+		c.clientFirstBare = "n=,r=" + c.clientNonce
+		first := "n,," + c.clientFirstBare
+		if c.clientFirst != nil {
+			first = c.clientFirst(first)
+		}
+		return &pgproto3.SASLInitialResponse{AuthMechanism: scramMechanism, Data: []byte(first)}
+	case *pgproto3.AuthenticationSASLContinue:
+		serverFirst := string(msg.Data)
+		salt, _ := base64.StdEncoding.DecodeString(scramAttribute(serverFirst, 's'))
+		iterations, _ := strconv.Atoi(scramAttribute(serverFirst, 'i'))
+		withoutProof := "c=biws,r=" + scramAttribute(serverFirst, 'r')
+		c.authMessage = c.clientFirstBare + "," + serverFirst + "," + withoutProof
+		var proof []byte
+		proof, c.saltedPassword = scramClientProof(c.password, salt, iterations, c.authMessage)
+		final := withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+		if c.clientFinal != nil {
+			final = c.clientFinal(final)
+		}
+		return &pgproto3.SASLResponse{Data: []byte(final)}
+	}
+	return nil
+}
+
+// serverSignature returns the signature the server must send in its server-final-message.
+func (c *scramClient) serverSignature() string {
+	return "v=" + base64.StdEncoding.EncodeToString(hmacSHA256(hmacSHA256(c.saltedPassword, "Server Key"), c.authMessage))
+}
+
+// scramClientProof computes the ClientProof of RFC 5802, and the SaltedPassword it is derived from.
+func scramClientProof(password string, salt []byte, iterations int, authMessage string) ([]byte, []byte) {
+	salted := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	return proof, salted
+}
+
+// The example exchange of RFC 7677, section 3: user "user", password "pencil".
+const (
+	rfc7677Salt        = "W22ZaJ0SNY7soEsUEjb6gQ=="
+	rfc7677AuthMessage = "n=user,r=rOprNGfwEbeRWgbNEkqO," +
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096," +
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	rfc7677Proof     = "dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfc7677Signature = "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func TestSCRAMVerifierRFC7677(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString(rfc7677Salt)
+	if proof, _ := scramClientProof("pencil", salt, 4096, rfc7677AuthMessage); base64.StdEncoding.EncodeToString(proof) != rfc7677Proof {
+		t.Fatalf("test client computes proof %s, want %s", base64.StdEncoding.EncodeToString(proof), rfc7677Proof)
+	}
+
+	v := newSCRAMVerifier("pencil", salt, 4096)
+	// the verifier recovers the ClientKey of the proof, whose hash is StoredKey.
+	proof, _ := base64.StdEncoding.DecodeString(rfc7677Proof)
+	clientKey := hmacSHA256(v.storedKey, rfc7677AuthMessage)
+	for i := range clientKey {
+		clientKey[i] ^= proof[i]
+	}
+	if storedKey := sha256.Sum256(clientKey); !hmac.Equal(storedKey[:], v.storedKey) {
+		t.Errorf("verifier doesn't accept the RFC 7677 proof")
+	}
+	if got := base64.StdEncoding.EncodeToString(hmacSHA256(v.serverKey, rfc7677AuthMessage)); got != rfc7677Signature {
+		t.Errorf("got server signature %s, want %s", got, rfc7677Signature)
+	}
+
+	// verifiers round trip through the pg_authid format.
+	stored := fmt.Sprintf("%s%d:%s$%s:%s", scramPrefix, v.iterations, rfc7677Salt,
+		base64.StdEncoding.EncodeToString(v.storedKey), base64.StdEncoding.EncodeToString(v.serverKey))
+	parsed, err := parseSCRAMVerifier(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.iterations != 4096 || !hmac.Equal(parsed.salt, salt) || !hmac.Equal(parsed.storedKey, v.storedKey) || !hmac.Equal(parsed.serverKey, v.serverKey) {
+		t.Errorf("got verifier %+v, want %+v", parsed, v)
+	}
+	for _, s := range []string{scramPrefix + "4096:salt", scramPrefix + "x:c2FsdA==$a2V5:a2V5", scramPrefix + "4096:!$a2V5:a2V5"} {
+		if _, err := parseSCRAMVerifier(s); err == nil {
+			t.Errorf("%s: parsed invalid verifier", s)
+		}
+	}
+}
+
+func TestSCRAMAuthentication(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString(rfc7677Salt)
+	v := newSCRAMVerifier("pencil", salt, 4096)
+	verifier := fmt.Sprintf("%s4096:%s$%s:%s", scramPrefix, rfc7677Salt,
+		base64.StdEncoding.EncodeToString(v.storedKey), base64.StdEncoding.EncodeToString(v.serverKey))
+
+	tests := []struct {
+		name        string
+		secret      string
+		password    string
+		clientFirst func(string) string
+		clientFinal func(string) string
+		// code is the SQLSTATE of the error, if any.
+		code string
+	}{
+		{name: "password", secret: "pencil", password: "pencil"},
+		{name: "verifier", secret: verifier, password: "pencil"},
+		{name: "wrong password", secret: "pencil", password: "pen", code: pgerrcode.InvalidPassword},
+		{name: "wrong password for verifier", secret: verifier, password: "pen", code: pgerrcode.InvalidPassword},
+		{name: "md5 hash secret", secret: md5Hash("user", "pencil"), password: "pencil", code: pgerrcode.InvalidPassword},
+		{
+			name:        "malformed gs2 header",
+			clientFirst: func(string) string { return "x,,n=,r=abc" },
+			code:        pgerrcode.ProtocolViolation,
+		},
+		{
+			name:        "channel binding",
+			clientFirst: func(string) string { return "p=tls-server-end-point,,n=,r=abc" },
+			code:        pgerrcode.ProtocolViolation,
+		},
+		{
+			name:        "client-first without nonce",
+			clientFirst: func(string) string { return "n,,n=" },
+			code:        pgerrcode.ProtocolViolation,
+		},
+		{
+			name:        "client-final without proof",
+			clientFinal: func(s string) string { return s[:strings.LastIndex(s, ",p=")] },
+			code:        pgerrcode.ProtocolViolation,
+		},
+		{
+			name:        "client-final with invalid proof",
+			clientFinal: func(s string) string { return s[:strings.LastIndex(s, ",p=")] + ",p=!!!" },
+			code:        pgerrcode.ProtocolViolation,
+		},
+		{
+			name:        "client-final with short proof",
+			clientFinal: func(s string) string { return s[:strings.LastIndex(s, ",p=")] + ",p=AAAA" },
+			code:        pgerrcode.ProtocolViolation,
+		},
+		{
+			name:        "channel binding mismatch",
+			clientFinal: func(s string) string { return strings.Replace(s, "c=biws", "c=eSws", 1) },
+			code:        pgerrcode.ProtocolViolation,
+		},
+		{
+			name: "nonce mismatch",
+			// the client drops the server nonce.
+			clientFinal: func(s string) string {
+				return strings.Replace(s, scramAttribute(s, 'r'), "fyko+d2lbbFgONRv9qkxdawL", 1)
+			},
+			code: pgerrcode.ProtocolViolation,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.secret == "" {
+				tt.secret, tt.password = "pencil", "pencil"
+			}
+			c := &scramClient{password: tt.password, clientNonce: "fyko+d2lbbFgONRv9qkxdawL", clientFirst: tt.clientFirst, clientFinal: tt.clientFinal}
+			token, msgs, err := testAuthenticate(t, AuthSCRAMSHA256, tt.secret, c.respond)
+			if tt.code != "" {
+				if code := errorCode(err); code != tt.code {
+					t.Fatalf("got %q, %v (code %s); want code %s", token, err, code, tt.code)
+				}
+				for _, msg := range msgs {
+					if _, ok := msg.(*pgproto3.AuthenticationSASLFinal); ok {
+						t.Errorf("server sent its signature to an unauthenticated client")
+					}
+				}
+				return
+			}
+			if err != nil || token != "token" {
+				t.Fatalf("got %q, %v; want token", token, err)
+			}
+			if len(msgs) != 3 {
+				t.Fatalf("client received %d messages, want 3: %#v", len(msgs), msgs)
+			}
+			if mechs := msgs[0].(*pgproto3.AuthenticationSASL).AuthMechanisms; len(mechs) != 1 || mechs[0] != scramMechanism {
+				t.Errorf("got mechanisms %q, want %s", mechs, scramMechanism)
+			}
+			serverFirst := string(msgs[1].(*pgproto3.AuthenticationSASLContinue).Data)
+			if nonce := scramAttribute(serverFirst, 'r'); !strings.HasPrefix(nonce, c.clientNonce) || nonce == c.clientNonce {
+				t.Errorf("server nonce %q doesn't extend the client nonce", nonce)
+			}
+			if final := string(msgs[2].(*pgproto3.AuthenticationSASLFinal).Data); final != c.serverSignature() {
+				t.Errorf("got server-final-message %q, want %q", final, c.serverSignature())
+			}
+		})
+	}
+}
+
+func TestMD5Authentication(t *testing.T) {
+	// the hash postgres stores for the password "postgres" of the user "postgres".
+	if got := md5Hash("postgres", "postgres"); got != "md53175bce1d3201d16594cebf9d7eb3f9d" {
+		t.Errorf("got hash %s", got)
+	}
+
+	// respond answers like libpq: md5(md5(password + user) + salt).
+	respond := func(password string) func(pgproto3.BackendMessage) pgproto3.FrontendMessage {
+		return func(msg pgproto3.BackendMessage) pgproto3.FrontendMessage {
+			req, ok := msg.(*pgproto3.AuthenticationMD5Password)
+			if !ok {
+				return nil
+			}
+			inner := md5.Sum([]byte(password + "user"))
+			outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), req.Salt[:]...))
+			return &pgproto3.PasswordMessage{Password: "md5" + hex.EncodeToString(outer[:])}
+		}
+	}
+	salt, _ := base64.StdEncoding.DecodeString(rfc7677Salt)
+	tests := []struct {
+		name     string
+		secret   string
+		response func(pgproto3.BackendMessage) pgproto3.FrontendMessage
+		ok       bool
+	}{
+		{"password", "secret", respond("secret"), true},
+		{"hash", md5Hash("user", "secret"), respond("secret"), true},
+		{"wrong password", "secret", respond("Secret"), false},
+		{"wrong password for hash", md5Hash("user", "secret"), respond("Secret"), false},
+		{"clear text response", "secret", func(msg pgproto3.BackendMessage) pgproto3.FrontendMessage {
+			return &pgproto3.PasswordMessage{Password: "secret"}
+		}, false},
+		{"scram verifier secret", fmt.Sprintf("%s4096:%s$%s:%s", scramPrefix, rfc7677Salt,
+			base64.StdEncoding.EncodeToString(newSCRAMVerifier("secret", salt, 4096).storedKey), "a2V5"), respond("secret"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _, err := testAuthenticate(t, AuthMD5, tt.secret, tt.response)
+			if tt.ok {
+				if err != nil || token != "token" {
+					t.Errorf("got %q, %v; want token", token, err)
+				}
+			} else if code := errorCode(err); code != pgerrcode.InvalidPassword {
+				t.Errorf("got %q, %v (code %s); want code %s", token, err, code, pgerrcode.InvalidPassword)
+			}
+		})
+	}
+}
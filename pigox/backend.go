@@ -0,0 +1,377 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/flight"
+	"github.com/apache/arrow/go/v7/arrow/ipc"
+	"github.com/apache/arrow/go/v7/arrow/memory"
+	influxdbiox "github.com/influxdata/influxdb-iox-client-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// BackendKind is the API the proxy queries the backend with.
+type BackendKind string
+
+const (
+	// BackendKindIOx queries the native IOx Flight API, whose tickets carry the database and the query.
+	BackendKindIOx BackendKind = "iox"
+	// BackendKindFlightSQL queries the Arrow Flight SQL API of newer IOx and InfluxDB 3 builds. The database is
+	// sent in the database header, and read-your-writes is not supported. The parameters of prepared statements
+	// are bound by Flight SQL prepared statements rather than substituted into the query.
+	BackendKindFlightSQL BackendKind = "flight-sql"
+)
+
+// ParseBackendKind parses a backend kind: iox or flight-sql.
+func ParseBackendKind(s string) (BackendKind, error) {
+	switch k := BackendKind(strings.ToLower(s)); k {
+	case BackendKindIOx, BackendKindFlightSQL:
+		return k, nil
+	}
+	return "", fmt.Errorf("invalid backend %q (expected iox or flight-sql)", s)
+}
+
+// WithBackend sets the API the backend is queried with. Defaults to BackendKindIOx.
+func WithBackend(kind BackendKind) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.backendKind = kind
+	}
+}
+
+// backend is a client of the backend the queries of a session run on.
+type backend interface {
+	// PrepareQuery prepares a query on a database; it is run by the Query method of the result.
+	PrepareQuery(ctx context.Context, database, query string) (preparedQuery, error)
+	// WaitForReadable waits until the write with the given write token is readable.
+	WaitForReadable(ctx context.Context, token string) error
+	// GetState returns the state of the connection to the backend.
+	GetState() connectivity.State
+	// Reconnect re-establishes the connection to the backend.
+	Reconnect(ctx context.Context) error
+	Close() error
+}
+
+type preparedQuery interface {
+	Query(ctx context.Context) (recordReader, error)
+}
+
+// statementPreparer is implemented by the backends that bind the parameters of prepared statements themselves,
+// rather than having them substituted into the text of the query.
+type statementPreparer interface {
+	// PrepareStatement prepares a query with $n placeholders on a database.
+	PrepareStatement(ctx context.Context, database, query string) (serverStatement, error)
+}
+
+// serverStatement is a statement prepared by the backend, which can run many times with different parameters.
+type serverStatement interface {
+	// Query runs the statement with params, a record with a row and a column per placeholder; nil if there are
+	// no placeholders.
+	Query(ctx context.Context, params arrow.Record) (recordReader, error)
+	// Schema returns the schema of the result of the statement, nil if the backend didn't tell.
+	Schema() *arrow.Schema
+	Close(ctx context.Context) error
+}
+
+// backendConfig is the configuration of the clients of a backend.
+type backendConfig struct {
+	influxdbiox.ClientConfig
+	kind BackendKind
+	// dialer, if not nil, connects to the locations of Flight SQL results.
+	dialer Dialer
+}
+
+// dial returns a new client of the backend.
+func (c backendConfig) dial(ctx context.Context) (backend, error) {
+	if c.kind == BackendKindFlightSQL {
+		return newFlightSQLBackend(ctx, c)
+	}
+	client, err := influxdbiox.NewClient(ctx, &c.ClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	return ioxBackend{client}, nil
+}
+
+// ioxBackend queries the native IOx Flight API.
+type ioxBackend struct {
+	*influxdbiox.Client
+}
+
+func (b ioxBackend) PrepareQuery(ctx context.Context, database, query string) (preparedQuery, error) {
+	q, err := b.Client.PrepareQuery(ctx, database, query)
+	if err != nil {
+		return nil, err
+	}
+	return ioxQuery{q}, nil
+}
+
+type ioxQuery struct {
+	*influxdbiox.QueryRequest
+}
+
+func (q ioxQuery) Query(ctx context.Context) (recordReader, error) {
+	reader, err := q.QueryRequest.Query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// flightSQLBackend queries the Arrow Flight SQL API: queries are CommandStatementQuery commands, whose FlightInfo
+// lists the endpoints serving the result.
+type flightSQLBackend struct {
+	config influxdbiox.ClientConfig
+	// opts holds the dialer used to connect to the locations of the results.
+	opts proxyOptions
+
+	mu     sync.Mutex
+	conn   *grpc.ClientConn
+	client flight.FlightServiceClient
+}
+
+func newFlightSQLBackend(ctx context.Context, config backendConfig) (*flightSQLBackend, error) {
+	b := &flightSQLBackend{config: config.ClientConfig, opts: proxyOptions{upstreamDialer: config.dialer}}
+	if err := b.Reconnect(ctx); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *flightSQLBackend) PrepareQuery(ctx context.Context, database, query string) (preparedQuery, error) {
+	return &flightSQLQuery{b: b, database: database, query: query}, nil
+}
+
+// WaitForReadable returns right away: Flight SQL has no write tokens.
+func (b *flightSQLBackend) WaitForReadable(ctx context.Context, token string) error {
+	return nil
+}
+
+func (b *flightSQLBackend) GetState() connectivity.State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conn.GetState()
+}
+
+// Reconnect dials the backend again, like the IOx client does.
+func (b *flightSQLBackend) Reconnect(ctx context.Context) error {
+	creds := insecure.NewCredentials()
+	if b.config.TLSConfig != nil {
+		creds = credentials.NewTLS(b.config.TLSConfig)
+	}
+	dialOptions := append([]grpc.DialOption{grpc.WithTransportCredentials(creds)}, b.config.DialOptions...)
+	conn, err := grpc.DialContext(ctx, b.config.Address, dialOptions...)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		b.conn.Close()
+	}
+	b.conn, b.client = conn, flight.NewFlightServiceClient(conn)
+	return nil
+}
+
+func (b *flightSQLBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conn.Close()
+}
+
+type flightSQLQuery struct {
+	b               *flightSQLBackend
+	database, query string
+}
+
+func (q *flightSQLQuery) Query(ctx context.Context) (recordReader, error) {
+	q.b.mu.Lock()
+	client := q.b.client
+	q.b.mu.Unlock()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, flightSQLDatabaseHeader, q.database)
+	// field 1 of CommandStatementQuery is the query.
+	cmd := flightSQLMessage("CommandStatementQuery", protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), q.query))
+	info, err := client.GetFlightInfo(ctx, &flight.FlightDescriptor{Type: flight.FlightDescriptor_CMD, Cmd: cmd})
+	if err != nil {
+		return nil, err
+	}
+	return q.b.opts.readEndpoints(ctx, client, info)
+}
+
+// flightSQLMessage returns the google.protobuf.Any holding the encoded Flight SQL message of the given type.
+func flightSQLMessage(typ string, msg []byte) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	b = protowire.AppendString(b, flightSQLTypeURLPrefix+typ)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// bytesField returns the value of a bytes field of an encoded protobuf message, nil if it is not set.
+func bytesField(msg []byte, field protowire.Number) ([]byte, error) {
+	var value []byte
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if num == field && typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(msg)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			value, msg = v, msg[n:]
+			continue
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, msg); n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	return value, nil
+}
+
+// PrepareStatement creates a Flight SQL prepared statement.
+func (b *flightSQLBackend) PrepareStatement(ctx context.Context, database, query string) (serverStatement, error) {
+	b.mu.Lock()
+	client := b.client
+	b.mu.Unlock()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, flightSQLDatabaseHeader, database)
+	// field 1 of ActionCreatePreparedStatementRequest is the query.
+	body := flightSQLMessage("ActionCreatePreparedStatementRequest", protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), query))
+	results, err := doAction(ctx, client, "CreatePreparedStatement", body)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("CreatePreparedStatement returned no result")
+	}
+	// the result is an Any holding an ActionCreatePreparedStatementResult: the handle, and the IPC encoded
+	// schemas of the result and of the parameters.
+	result, err := bytesField(results[0], 2)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CreatePreparedStatement result: %w", err)
+	}
+	s := &flightSQLStatement{b: b, database: database}
+	if s.handle, err = bytesField(result, 1); err != nil {
+		return nil, fmt.Errorf("invalid CreatePreparedStatement result: %w", err)
+	}
+	if schema, err := bytesField(result, 2); err != nil {
+		return nil, fmt.Errorf("invalid CreatePreparedStatement result: %w", err)
+	} else if len(schema) > 0 {
+		if s.schema, err = flight.DeserializeSchema(schema, memory.DefaultAllocator); err != nil {
+			return nil, fmt.Errorf("invalid prepared statement schema: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// doAction runs an action and returns the bodies of its results.
+func doAction(ctx context.Context, client flight.FlightServiceClient, typ string, body []byte) ([][]byte, error) {
+	stream, err := client.DoAction(ctx, &flight.Action{Type: typ, Body: body})
+	if err != nil {
+		return nil, err
+	}
+	var results [][]byte
+	for {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			return results, nil
+		} else if err != nil {
+			return nil, err
+		}
+		results = append(results, r.Body)
+	}
+}
+
+// flightSQLStatement is a Flight SQL prepared statement: parameters are bound by DoPut, and the statement is run
+// like a query, by GetFlightInfo.
+type flightSQLStatement struct {
+	b        *flightSQLBackend
+	database string
+	handle   []byte
+	schema   *arrow.Schema
+}
+
+func (s *flightSQLStatement) Schema() *arrow.Schema {
+	return s.schema
+}
+
+// command returns the CommandPreparedStatementQuery of the statement, whose field 1 is the handle.
+func (s *flightSQLStatement) command() []byte {
+	return flightSQLMessage("CommandPreparedStatementQuery", protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), s.handle))
+}
+
+func (s *flightSQLStatement) Query(ctx context.Context, params arrow.Record) (recordReader, error) {
+	s.b.mu.Lock()
+	client := s.b.client
+	s.b.mu.Unlock()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, flightSQLDatabaseHeader, s.database)
+	if params != nil {
+		if err := s.bind(ctx, client, params); err != nil {
+			return nil, err
+		}
+	}
+	info, err := client.GetFlightInfo(ctx, &flight.FlightDescriptor{Type: flight.FlightDescriptor_CMD, Cmd: s.command()})
+	if err != nil {
+		return nil, err
+	}
+	return s.b.opts.readEndpoints(ctx, client, info)
+}
+
+// bind sends the parameters of the statement. Servers that don't keep state may answer with a new handle, which
+// identifies the statement bound to the parameters.
+func (s *flightSQLStatement) bind(ctx context.Context, client flight.FlightServiceClient, params arrow.Record) error {
+	stream, err := client.DoPut(ctx)
+	if err != nil {
+		return err
+	}
+	w := flight.NewRecordWriter(stream, ipc.WithSchema(params.Schema()))
+	w.SetFlightDescriptor(&flight.FlightDescriptor{Type: flight.FlightDescriptor_CMD, Cmd: s.command()})
+	if err := w.Write(params); err != nil {
+		return fmt.Errorf("cannot bind parameters: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("cannot bind parameters: %w", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return fmt.Errorf("cannot bind parameters: %w", err)
+	}
+	for {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// the metadata is a DoPutPreparedStatementResult, whose field 1 is the new handle.
+		if handle, err := bytesField(r.AppMetadata, 1); err == nil && len(handle) > 0 {
+			s.handle = handle
+		}
+	}
+}
+
+// Close closes the prepared statement on the server.
+func (s *flightSQLStatement) Close(ctx context.Context) error {
+	s.b.mu.Lock()
+	client := s.b.client
+	s.b.mu.Unlock()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, flightSQLDatabaseHeader, s.database)
+	// field 1 of ActionClosePreparedStatementRequest is the handle.
+	body := flightSQLMessage("ActionClosePreparedStatementRequest", protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), s.handle))
+	_, err := doAction(ctx, client, "ClosePreparedStatement", body)
+	return err
+}
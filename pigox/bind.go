@@ -0,0 +1,291 @@
+package pigox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/apache/arrow/go/v7/arrow/memory"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+)
+
+// closeStatementTimeout bounds the time spent closing a statement prepared by the backend.
+const closeStatementTimeout = 5 * time.Second
+
+// boundParams are the parameters of a portal, bound by the backend if it can (see statementPreparer).
+//
+// The query of the portal, with the parameters substituted, is what the proxy caches, logs and authorizes, and
+// what runs on backends that can't bind parameters. The backend statement only runs if that query reaches the
+// backend unchanged, e.g. not split by time fanout.
+type boundParams struct {
+	// query is the query of the portal, with the parameters substituted.
+	query  string
+	stmt   *preparedStatement
+	values []interface{}
+}
+
+type boundParamsKey struct{}
+
+// withBoundParams returns a context whose queries run with the parameters of a portal; b may be nil.
+func withBoundParams(ctx context.Context, b *boundParams) context.Context {
+	if b == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, boundParamsKey{}, b)
+}
+
+// backendStatement caches the statement a prepared statement is prepared as by the backend, so that executing
+// it again skips the prepare round trip.
+type backendStatement struct {
+	mu       sync.Mutex
+	client   backend
+	database string
+	stmt     serverStatement
+}
+
+// get returns the statement prepared on database by client, preparing it if needed.
+func (s *backendStatement) get(ctx context.Context, client backend, database, query string) (serverStatement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stmt != nil && s.client == client && s.database == database {
+		return s.stmt, nil
+	}
+	s.closeLocked()
+	stmt, err := client.(statementPreparer).PrepareStatement(ctx, database, query)
+	if err != nil {
+		return nil, err
+	}
+	s.client, s.database, s.stmt = client, database, stmt
+	return stmt, nil
+}
+
+// close closes the backend statement, if any.
+func (s *backendStatement) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked()
+}
+
+func (s *backendStatement) closeLocked() {
+	if s.stmt == nil {
+		return
+	}
+	stmt := s.stmt
+	s.client, s.stmt = nil, nil
+	closeServerStatement(stmt)
+}
+
+// closeServerStatement closes a statement prepared by the backend in the background: the statement is gone with
+// the connection anyway, so closing it must not hold up the session.
+func closeServerStatement(stmt serverStatement) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), closeStatementTimeout)
+		defer cancel()
+		stmt.Close(ctx)
+	}()
+}
+
+// queryBound runs a query on client with the parameters bound by the backend statement of its prepared statement,
+// which is shared with the other sessions if the statement cache is enabled.
+func (p *Proxy) queryBound(ctx context.Context, session *session, client backend, b *boundParams) (recordReader, error) {
+	params, err := paramRecord(b.stmt.paramOIDs, b.values)
+	if err != nil {
+		return nil, err
+	}
+	if params != nil {
+		defer params.Release()
+	}
+	if p.stmtCache != nil {
+		cp, err := p.prepareStatement(ctx, session, client, trimStatement(b.stmt.query))
+		if err != nil {
+			return nil, err
+		}
+		qctx, span := p.startClientSpan(ctx, "iox.Query")
+		reader, err := cp.stmt.Query(p.withTraceContext(qctx), params)
+		endSpan(span, err)
+		p.stmtCache.release(cp, err != nil)
+		return reader, err
+	}
+	pctx, span := p.startClientSpan(ctx, "iox.PrepareStatement")
+	stmt, err := b.stmt.backend.get(p.withTraceContext(pctx), client, session.databaseName, trimStatement(b.stmt.query))
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	qctx, span := p.startClientSpan(ctx, "iox.Query")
+	reader, err := stmt.Query(p.withTraceContext(qctx), params)
+	endSpan(span, err)
+	if err != nil {
+		// the statement is prepared again by the next attempt, in case the backend forgot it.
+		b.stmt.backend.close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// bindParams returns the parameters of a Bind message of ps for the backend to bind, or nil if the backend
+// can't bind them and they are substituted into the query instead.
+func (p *Proxy) bindParams(msg *pgproto3.Bind, ps *preparedStatement, query string) (*boundParams, error) {
+	if _, ok := p.ioxClient().(statementPreparer); !ok || ps.setting != nil || ps.transaction != nil || ps.insert || ps.cursor != nil || ps.explain != nil || ps.hints.json != nil {
+		return nil, nil
+	}
+	if len(ps.paramOIDs) == 0 {
+		return &boundParams{query: query, stmt: ps}, nil
+	}
+	for _, oid := range ps.paramOIDs {
+		if paramType(oid) == nil {
+			return nil, nil
+		}
+	}
+	values := make([]interface{}, len(ps.paramOIDs))
+	for i, v := range msg.Parameters {
+		var err error
+		switch {
+		case v == nil:
+		case formatCode(msg.ParameterFormatCodes, i) == pgtype.BinaryFormatCode:
+			values[i], err = binaryParamValue(ps.paramOIDs[i], v)
+		default:
+			values[i], err = textParamValue(ps.paramOIDs[i], string(v))
+		}
+		if err != nil {
+			return nil, newPGError(pgerrcode.InvalidTextRepresentation, fmt.Errorf("invalid value of parameter $%d: %w", i+1, err))
+		}
+	}
+	return &boundParams{query: query, stmt: ps, values: values}, nil
+}
+
+// paramType returns the Arrow type parameters of a PG type are bound as, or nil if they can't be bound.
+func paramType(oid uint32) arrow.DataType {
+	switch oid {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.OIDOID:
+		return arrow.PrimitiveTypes.Int64
+	case pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		return arrow.PrimitiveTypes.Float64
+	case pgtype.BoolOID:
+		return arrow.FixedWidthTypes.Boolean
+	case pgtype.TimestampOID, pgtype.TimestamptzOID:
+		// the type of IOx time columns.
+		return &arrow.TimestampType{Unit: arrow.Nanosecond}
+	case pgtype.TextOID, pgtype.VarcharOID, pgtype.BPCharOID, pgtype.NameOID, pgtype.UnknownOID:
+		return arrow.BinaryTypes.String
+	}
+	return nil
+}
+
+// textParamValue parses a parameter value in the text format.
+func textParamValue(oid uint32, s string) (interface{}, error) {
+	switch oid {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.OIDOID:
+		return strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	case pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return nil, err
+		}
+		return f, nil
+	case pgtype.BoolOID:
+		return parseBool(strings.TrimSpace(s))
+	case pgtype.TimestampOID:
+		var ts pgtype.Timestamp
+		if err := ts.DecodeText(nil, []byte(s)); err != nil {
+			return nil, err
+		}
+		return timestampValue(ts.Time, ts.InfinityModifier)
+	case pgtype.TimestamptzOID:
+		var ts pgtype.Timestamptz
+		if err := ts.DecodeText(nil, []byte(s)); err != nil {
+			return nil, err
+		}
+		return timestampValue(ts.Time, ts.InfinityModifier)
+	}
+	return s, nil
+}
+
+// binaryParamValue decodes a parameter value in the binary format.
+func binaryParamValue(oid uint32, b []byte) (interface{}, error) {
+	switch oid {
+	case pgtype.TextOID, pgtype.VarcharOID, pgtype.BPCharOID, pgtype.NameOID, pgtype.UnknownOID:
+		return string(b), nil
+	}
+	dt, ok := pgtype.NewConnInfo().DataTypeForOID(oid)
+	if !ok {
+		return nil, fmt.Errorf("binary format of type %d is not supported", oid)
+	}
+	value := pgtype.NewValue(dt.Value)
+	decoder, ok := value.(pgtype.BinaryDecoder)
+	if !ok {
+		return nil, fmt.Errorf("binary format of type %s is not supported", dt.Name)
+	}
+	if err := decoder.DecodeBinary(nil, b); err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case *pgtype.Timestamp:
+		return timestampValue(v.Time, v.InfinityModifier)
+	case *pgtype.Timestamptz:
+		return timestampValue(v.Time, v.InfinityModifier)
+	case *pgtype.Bool:
+		return v.Bool, nil
+	}
+	switch oid {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.OIDOID:
+		var n int64
+		err := value.AssignTo(&n)
+		return n, err
+	case pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		var f float64
+		err := value.AssignTo(&f)
+		return f, err
+	}
+	return nil, fmt.Errorf("binary format of type %s is not supported", dt.Name)
+}
+
+func timestampValue(t time.Time, inf pgtype.InfinityModifier) (interface{}, error) {
+	if inf != pgtype.None {
+		return nil, fmt.Errorf("infinite timestamps are not supported")
+	}
+	return t, nil
+}
+
+// paramRecord returns the record of parameter values the backend binds: a row with a column per parameter named
+// after its placeholder, or nil if there are no parameters.
+func paramRecord(oids []uint32, values []interface{}) (arrow.Record, error) {
+	if len(oids) == 0 {
+		return nil, nil
+	}
+	fields := make([]arrow.Field, len(oids))
+	for i, oid := range oids {
+		fields[i] = arrow.Field{Name: "$" + strconv.Itoa(i+1), Type: paramType(oid), Nullable: true}
+	}
+	b := array.NewRecordBuilder(memory.DefaultAllocator, arrow.NewSchema(fields, nil))
+	defer b.Release()
+	for i, v := range values {
+		if v == nil {
+			b.Field(i).AppendNull()
+			continue
+		}
+		switch fb := b.Field(i).(type) {
+		case *array.Int64Builder:
+			fb.Append(v.(int64))
+		case *array.Float64Builder:
+			fb.Append(v.(float64))
+		case *array.BooleanBuilder:
+			fb.Append(v.(bool))
+		case *array.TimestampBuilder:
+			fb.Append(arrow.Timestamp(v.(time.Time).UnixNano()))
+		case *array.StringBuilder:
+			fb.Append(v.(string))
+		default:
+			return nil, fmt.Errorf("cannot bind parameter $%d of type %s", i+1, fields[i].Type)
+		}
+	}
+	return b.NewRecord(), nil
+}
@@ -0,0 +1,73 @@
+package pigox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+)
+
+func TestBindParams(t *testing.T) {
+	p := &Proxy{upstream: &upstreamClient{client: &flightSQLBackend{}}}
+	ps := &preparedStatement{
+		query:     "SELECT * FROM cpu WHERE host = $1 AND usage > $2 AND time > $3 AND up = $4 AND n < $5",
+		paramOIDs: []uint32{pgtype.TextOID, pgtype.Float8OID, pgtype.TimestamptzOID, pgtype.BoolOID, pgtype.Int8OID},
+	}
+	msg := &pgproto3.Bind{
+		ParameterFormatCodes: []int16{0, 1, 0, 0, 0},
+		Parameters: [][]byte{
+			[]byte("a'b"),
+			{0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, // 1.5
+			[]byte("2024-01-02 03:04:05+00"),
+			[]byte("yes"),
+			nil,
+		},
+	}
+	b, err := p.bindParams(msg, ps, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := paramRecord(ps.paramOIDs, b.values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Release()
+
+	if got := rec.Column(0).(*array.String).Value(0); got != "a'b" {
+		t.Errorf("$1 = %q", got)
+	}
+	if got := rec.Column(1).(*array.Float64).Value(0); got != 1.5 {
+		t.Errorf("$2 = %v", got)
+	}
+	want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).UnixNano()
+	if got := int64(rec.Column(2).(*array.Timestamp).Value(0)); got != want {
+		t.Errorf("$3 = %d, want %d", got, want)
+	}
+	if got := rec.Column(3).(*array.Boolean).Value(0); !got {
+		t.Errorf("$4 = %v", got)
+	}
+	if !rec.Column(4).IsNull(0) {
+		t.Errorf("$5 is not NULL")
+	}
+	if name := rec.Schema().Field(4).Name; name != "$5" {
+		t.Errorf("field 5 is named %q", name)
+	}
+}
+
+func TestBindParamsFallsBackToSubstitution(t *testing.T) {
+	ps := &preparedStatement{query: "SELECT * FROM cpu WHERE time > now() - $1", paramOIDs: []uint32{pgtype.IntervalOID}}
+	msg := &pgproto3.Bind{Parameters: [][]byte{[]byte("1 hour")}}
+
+	// the IOx API can't bind parameters.
+	p := &Proxy{upstream: &upstreamClient{client: ioxBackend{}}}
+	if b, err := p.bindParams(msg, ps, "q"); err != nil || b != nil {
+		t.Errorf("IOx backend: got %v, %v; want no bound parameters", b, err)
+	}
+	// intervals have no Arrow parameter type.
+	p.upstream.set(nil, &flightSQLBackend{})
+	if b, err := p.bindParams(msg, ps, "q"); err != nil || b != nil {
+		t.Errorf("interval parameter: got %v, %v; want no bound parameters", b, err)
+	}
+}
@@ -0,0 +1,114 @@
+package pigox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// errQueryCanceled is reported to clients whose query was canceled by a CancelRequest.
+var errQueryCanceled = newPGError(pgerrcode.QueryCanceled, errors.New("canceling statement due to user request"))
+
+// errStatementTimeout is reported to clients whose query ran longer than their statement_timeout.
+var errStatementTimeout = newPGError(pgerrcode.QueryCanceled, errors.New("canceling statement due to statement timeout"))
+
+// cancelTargets holds the sessions CancelRequests can cancel the queries of, by pid. Like pids, it is process wide:
+// CancelRequests arrive on a new connection, possibly accepted by a different listener.
+var cancelTargets = &cancelRegistry{targets: map[int32]*cancelTarget{}}
+
+type cancelRegistry struct {
+	mu      sync.Mutex
+	targets map[int32]*cancelTarget
+}
+
+// cancelTarget is the running request of a session, which a CancelRequest with the session's pid and secret key
+// cancels.
+type cancelTarget struct {
+	secretKey uint32
+
+	mu sync.Mutex
+	// cancel cancels the running request, if any.
+	cancel context.CancelFunc
+}
+
+// register makes the queries of a session cancelable, generating its secret key; unregister must be called when
+// the session ends.
+func (r *cancelRegistry) register(session *session) (*cancelTarget, error) {
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	t := &cancelTarget{secretKey: binary.BigEndian.Uint32(key[:])}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.targets[session.pid] = t
+	return t, nil
+}
+
+func (r *cancelRegistry) unregister(session *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.targets, session.pid)
+}
+
+// cancel cancels the running request of session pid if secretKey is its secret key; like postgres, it does nothing
+// otherwise, and if the session is idle. The outcome is logged to logger.
+func (r *cancelRegistry) cancel(logger *slog.Logger, pid int32, secretKey uint32) {
+	r.mu.Lock()
+	t, ok := r.targets[pid]
+	r.mu.Unlock()
+	if !ok || t.secretKey != secretKey {
+		logger.Warn("ignoring cancel request for unknown session", "target", pid)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cancel != nil {
+		logger.Info("canceling the running query of session", "target", pid)
+		t.cancel()
+	}
+}
+
+// begin returns the context of a request of the session, which is canceled by CancelRequests until end is called,
+// and after timeout if not zero.
+func (t *cancelTarget) begin(ctx context.Context, timeout time.Duration) (_ context.Context, end func()) {
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	if t == nil {
+		return ctx, cancel
+	}
+	t.mu.Lock()
+	t.cancel = cancel
+	t.mu.Unlock()
+	return ctx, func() {
+		t.mu.Lock()
+		t.cancel = nil
+		t.mu.Unlock()
+		cancel()
+	}
+}
+
+// canceledError returns errQueryCanceled or errStatementTimeout if a request failed with err because it was
+// canceled or timed out, err otherwise.
+func canceledError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return errStatementTimeout
+	case errors.Is(ctx.Err(), context.Canceled):
+		return errQueryCanceled
+	}
+	return err
+}
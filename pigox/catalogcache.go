@@ -0,0 +1,195 @@
+package pigox
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+)
+
+// catalogCache caches the results of queries on the IOx information_schema, which clients and IDEs run over
+// and over to introspect tables and columns, for ttl. Entries of a database are dropped early by
+// `SELECT piggo.invalidate_catalog()` or Server.InvalidateCatalog, e.g. after creating tables.
+type catalogCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[catalogKey]*catalogEntry
+}
+
+type catalogKey struct {
+	// address is the IOx endpoint the session is routed to; see WithRouter.
+	address  string
+	database string
+	query    string
+	// token and identity keep sessions from reading catalogs they may not be authorized to read.
+	token    string
+	identity string
+}
+
+type catalogEntry struct {
+	schema  *arrow.Schema
+	records []arrow.Record
+	expires time.Time
+}
+
+func newCatalogCache(ttl time.Duration) *catalogCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &catalogCache{ttl: ttl, entries: map[catalogKey]*catalogEntry{}}
+}
+
+// get returns a reader over the cached result of a query, if any.
+func (c *catalogCache) get(key catalogKey, now time.Time) (recordReader, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if now.After(e.expires) {
+		c.remove(key)
+		return nil, false
+	}
+	// readers hold the records, so that evictions don't release them while they are read.
+	for _, rec := range e.records {
+		rec.Retain()
+	}
+	return &recordsReader{schema: e.schema, records: e.records}, true
+}
+
+// put caches the result of a query; the cache takes ownership of records.
+func (c *catalogCache) put(key catalogKey, schema *arrow.Schema, records []arrow.Record, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			c.remove(k)
+		}
+	}
+	c.remove(key)
+	c.entries[key] = &catalogEntry{schema: schema, records: records, expires: now.Add(c.ttl)}
+}
+
+// invalidate drops the cached results of database, or of all databases if database is empty.
+func (c *catalogCache) invalidate(database string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.entries {
+		if database == "" || k.database == database {
+			c.remove(k)
+		}
+	}
+}
+
+// len returns the number of cached results.
+func (c *catalogCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+func (c *catalogCache) remove(key catalogKey) {
+	if e, ok := c.entries[key]; ok {
+		for _, rec := range e.records {
+			rec.Release()
+		}
+		delete(c.entries, key)
+	}
+}
+
+// isCatalogQuery reports whether query is a SELECT reading the information_schema.
+func isCatalogQuery(query string) bool {
+	if !isSelect(query) {
+		return false
+	}
+	toks := significant(scanSQL(query))
+	for i := 0; i+1 < len(toks); i++ {
+		if toks[i].identName() == "information_schema" && toks[i+1].is(".") {
+			return true
+		}
+	}
+	return false
+}
+
+// isInvalidateCatalog reports whether query is `SELECT piggo.invalidate_catalog()`.
+func isInvalidateCatalog(query string) bool {
+	toks := significant(scanSQL(query))
+	if n := len(toks); n > 0 && toks[n-1].is(";") {
+		toks = toks[:n-1]
+	}
+	return len(toks) == 6 && toks[0].is("select") && toks[1].is("piggo") && toks[2].is(".") &&
+		toks[3].is("invalidate_catalog") && toks[4].is("(") && toks[5].is(")")
+}
+
+// runCatalogQuery runs a query on the information_schema, using the catalog cache.
+func (p *Proxy) runCatalogQuery(ctx context.Context, session *session, query string) (recordReader, error) {
+	// cached results are replayed without querying IOx, so they are authorized here.
+	if err := p.authorize(ctx, session, query); err != nil {
+		return nil, err
+	}
+	key := catalogKey{
+		address:  p.ioxAddress,
+		database: session.databaseName,
+		query:    normalizeQuery(query),
+		token:    session.token,
+		identity: identityKey(session),
+	}
+	if r, ok := p.catalog.get(key, time.Now()); ok {
+		return r, nil
+	}
+	reader, err := p.runQueryUpstream(ctx, session, query)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Release()
+	var records []arrow.Record
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			for _, rec := range records {
+				rec.Release()
+			}
+			return nil, err
+		}
+		rec.Retain()
+		records = append(records, rec)
+	}
+	for _, rec := range records {
+		rec.Retain()
+	}
+	p.catalog.put(key, reader.Schema(), records, time.Now())
+	return &recordsReader{schema: reader.Schema(), records: records}, nil
+}
+
+// recordsReader reads records held in memory; it releases them when released.
+type recordsReader struct {
+	schema  *arrow.Schema
+	records []arrow.Record
+	next    int
+}
+
+func (r *recordsReader) Schema() *arrow.Schema { return r.schema }
+
+func (r *recordsReader) Read() (arrow.Record, error) {
+	if r.next >= len(r.records) {
+		return nil, io.EOF
+	}
+	r.next++
+	return r.records[r.next-1], nil
+}
+
+func (r *recordsReader) Release() {
+	for _, rec := range r.records {
+		rec.Release()
+	}
+	r.records = nil
+}
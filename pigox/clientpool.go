@@ -0,0 +1,253 @@
+package pigox
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+// ClientPool shares IOx clients, and their gRPC channels, among the sessions with the same IOx address,
+// database and token, so that short lived client connections don't each dial IOx. It is safe for concurrent use
+// by the proxies it is passed to with WithClientPool.
+type ClientPool struct {
+	idleTimeout time.Duration
+	stop        chan struct{}
+	log         *slog.Logger
+
+	mu      sync.Mutex
+	clients map[clientPoolKey]*pooledClient
+	closed  bool
+}
+
+type clientPoolKey struct {
+	address, database, token string
+}
+
+// pooledClient is a client of a ClientPool, used by refs sessions.
+type pooledClient struct {
+	key    clientPoolKey
+	client backend
+	refs   int
+	// idleSince is when the last session using the client ended.
+	idleSince time.Time
+	// retired clients are no longer handed out, and are closed once unused.
+	retired bool
+}
+
+// NewClientPool returns a ClientPool closing the clients no session used for idleTimeout; zero keeps them open
+// until the pool is closed. The pool logs to logger, or to slog.Default() if nil.
+func NewClientPool(idleTimeout time.Duration, logger *slog.Logger) *ClientPool {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	cp := &ClientPool{
+		idleTimeout: idleTimeout,
+		stop:        make(chan struct{}),
+		log:         logger,
+		clients:     map[clientPoolKey]*pooledClient{},
+	}
+	if idleTimeout > 0 {
+		go cp.expire()
+	}
+	return cp
+}
+
+// WithClientPool takes the IOx clients of sessions from pool, instead of dialing a new one for each connection.
+// Warm connections are then not used.
+func WithClientPool(pool *ClientPool) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.clientPool = pool
+	}
+}
+
+// acquire returns a client for a session, dialing one with config if there is no healthy one to share.
+// The client must be released when the session ends.
+func (cp *ClientPool) acquire(ctx context.Context, config backendConfig, database, token string) (*pooledClient, error) {
+	key := clientPoolKey{address: config.Address, database: database, token: token}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if pc, ok := cp.clients[key]; ok {
+		if healthy(pc.client) {
+			pc.refs++
+			return pc, nil
+		}
+		cp.retireLocked(pc)
+	}
+	// the client connects in the background: dialing doesn't block.
+	c, err := config.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pc := &pooledClient{key: key, client: c, refs: 1}
+	if !cp.closed {
+		cp.clients[key] = pc
+	} else {
+		pc.retired = true
+	}
+	return pc, nil
+}
+
+// replace releases a client whose connection broke, and returns a new one for the session; pc is kept if
+// that fails. Sessions of pc that replace it later get the same new client.
+func (cp *ClientPool) replace(ctx context.Context, pc *pooledClient, config backendConfig) (*pooledClient, error) {
+	cp.mu.Lock()
+	if cp.clients[pc.key] == pc {
+		cp.retireLocked(pc)
+	}
+	cp.mu.Unlock()
+	npc, err := cp.acquire(ctx, config, pc.key.database, pc.key.token)
+	if err != nil {
+		return nil, err
+	}
+	cp.release(pc)
+	return npc, nil
+}
+
+func (cp *ClientPool) release(pc *pooledClient) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	pc.refs--
+	pc.idleSince = time.Now()
+	if pc.retired && pc.refs == 0 {
+		pc.client.Close()
+	}
+}
+
+// retireLocked stops handing out pc, closing it if unused; cp.mu must be held.
+func (cp *ClientPool) retireLocked(pc *pooledClient) {
+	delete(cp.clients, pc.key)
+	pc.retired = true
+	if pc.refs == 0 {
+		pc.client.Close()
+	}
+}
+
+// expire closes the clients idle for longer than the idle timeout, and the unused ones whose connection broke,
+// until the pool is closed.
+func (cp *ClientPool) expire() {
+	ticker := time.NewTicker(cp.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-cp.stop:
+			return
+		}
+		cp.mu.Lock()
+		for _, pc := range cp.clients {
+			if pc.refs > 0 {
+				continue
+			}
+			if time.Since(pc.idleSince) >= cp.idleTimeout || !healthy(pc.client) {
+				cp.log.Debug("closing pooled IOx client", "address", pc.key.address, "database", pc.key.database)
+				cp.retireLocked(pc)
+			}
+		}
+		cp.mu.Unlock()
+	}
+}
+
+// Close closes the clients of the pool; those still used by sessions are closed when the sessions end.
+func (cp *ClientPool) Close() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.closed {
+		return
+	}
+	cp.closed = true
+	close(cp.stop)
+	for _, pc := range cp.clients {
+		cp.retireLocked(pc)
+	}
+}
+
+// healthy reports whether the connection of a client is usable, or being established.
+func healthy(c backend) bool {
+	st := c.GetState()
+	return st != connectivity.TransientFailure && st != connectivity.Shutdown
+}
+
+// upstreamClient is the IOx client of a session. reconnect replaces it while queries of the session may be
+// running in other goroutines, e.g. those of time fanout or LISTEN, so it is read with current.
+type upstreamClient struct {
+	mu     sync.Mutex
+	client backend
+	// pooled is the entry of client in the client pool, if it is shared; see WithClientPool.
+	pooled *pooledClient
+}
+
+func (u *upstreamClient) current() backend {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.client
+}
+
+func (u *upstreamClient) set(pc *pooledClient, c backend) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pooled, u.client = pc, c
+}
+
+func (u *upstreamClient) get() (*pooledClient, backend) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.pooled, u.client
+}
+
+// ioxClient returns the IOx client of the session.
+func (p *Proxy) ioxClient() backend {
+	return p.upstream.current()
+}
+
+// connectUpstream sets the IOx client of a session: a shared one if the proxy has a client pool, otherwise a
+// warm one or a newly dialed one.
+func (p *Proxy) connectUpstream(ctx context.Context, session *session) error {
+	if p.clientPool != nil {
+		pc, err := p.clientPool.acquire(ctx, p.clientConfig(p.ioxAddress), session.databaseName, session.token)
+		if err != nil {
+			return err
+		}
+		p.upstream.set(pc, pc.client)
+		return nil
+	}
+	if c, ok := p.warmPool.get(); ok {
+		p.upstream.set(nil, c)
+		return nil
+	}
+	c, err := p.clientConfig(p.ioxAddress).dial(ctx)
+	if err != nil {
+		return err
+	}
+	p.upstream.set(nil, c)
+	return nil
+}
+
+// disconnectUpstream releases the IOx client of the session.
+func (p *Proxy) disconnectUpstream() {
+	pooled, client := p.upstream.get()
+	if pooled != nil {
+		p.clientPool.release(pooled)
+		return
+	}
+	client.Close()
+}
+
+// reconnect re-establishes the connection to IOx. Shared clients are replaced rather than reconnected, since
+// other sessions are using them. Queries of the session failing together reconnect one at a time, so that the
+// shared client is released once.
+func (p *Proxy) reconnect(ctx context.Context) error {
+	p.upstream.mu.Lock()
+	defer p.upstream.mu.Unlock()
+	if p.upstream.pooled == nil {
+		return p.upstream.client.Reconnect(ctx)
+	}
+	pc, err := p.clientPool.replace(ctx, p.upstream.pooled, p.clientConfig(p.ioxAddress))
+	if err != nil {
+		return err
+	}
+	p.upstream.pooled, p.upstream.client = pc, pc.client
+	return nil
+}
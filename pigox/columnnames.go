@@ -0,0 +1,41 @@
+package pigox
+
+import (
+	"fmt"
+
+	"github.com/apache/arrow/go/v7/arrow"
+)
+
+// resultFields returns the fields of a result as reported to the session's client. If the session has
+// piggo.unique_column_names on, duplicate column names (e.g. from joins) are renamed col, col_1, col_2, ...,
+// since some clients (e.g. pandas read_sql) silently drop all but one of the columns sharing a name.
+func resultFields(fields []arrow.Field, s *session) []arrow.Field {
+	if !s.uniqueColumnNames {
+		return fields
+	}
+	used := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		used[f.Name] = true
+	}
+	seen := make(map[string]bool, len(fields))
+	var renamed []arrow.Field
+	for i, f := range fields {
+		if !seen[f.Name] {
+			seen[f.Name] = true
+			continue
+		}
+		if renamed == nil {
+			renamed = append([]arrow.Field(nil), fields...)
+		}
+		name := f.Name
+		for n := 1; used[name]; n++ {
+			name = fmt.Sprintf("%s_%d", f.Name, n)
+		}
+		used[name] = true
+		renamed[i].Name = name
+	}
+	if renamed == nil {
+		return fields
+	}
+	return renamed
+}
@@ -0,0 +1,141 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// concurrencyLimiter bounds the number of queries executing at the same time for each key, e.g. each user.
+type concurrencyLimiter struct {
+	// scope describes the keys in error messages, e.g. "user".
+	scope string
+	limit int
+	// overrides are limits for specific keys; a limit of 0 means unlimited.
+	overrides map[string]int
+
+	mu    sync.Mutex
+	slots map[string]*slotGroup
+}
+
+type slotGroup struct {
+	sem chan struct{}
+	// refs counts the queries holding or waiting for a slot; the group is dropped when it reaches zero.
+	refs int
+}
+
+func newConcurrencyLimiter(scope string, limit int, overrides map[string]int) *concurrencyLimiter {
+	if limit <= 0 && len(overrides) == 0 {
+		return nil
+	}
+	return &concurrencyLimiter{scope: scope, limit: limit, overrides: overrides, slots: map[string]*slotGroup{}}
+}
+
+func (l *concurrencyLimiter) limitFor(key string) int {
+	if n, ok := l.overrides[key]; ok {
+		return n
+	}
+	return l.limit
+}
+
+// acquire takes a slot for key, waiting up to wait for one to be released. It returns a function releasing the slot.
+func (l *concurrencyLimiter) acquire(ctx context.Context, key string, wait time.Duration) (func(), error) {
+	limit := 0
+	if l != nil {
+		limit = l.limitFor(key)
+	}
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	g, ok := l.slots[key]
+	if !ok {
+		g = &slotGroup{sem: make(chan struct{}, limit)}
+		l.slots[key] = g
+	}
+	g.refs++
+	l.mu.Unlock()
+
+	release := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if g.refs--; g.refs == 0 {
+			delete(l.slots, key)
+		}
+	}
+
+	select {
+	case g.sem <- struct{}{}:
+		return func() { <-g.sem; release() }, nil
+	default:
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case g.sem <- struct{}{}:
+			return func() { <-g.sem; release() }, nil
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	release()
+	return nil, newPGError(pgerrcode.ConfigurationLimitExceeded, fmt.Errorf("too many concurrent queries for %s %q (limit is %d)", l.scope, key, limit))
+}
+
+// admitQuery waits until the session may run a query under the rate and concurrency limits.
+// It returns a function to call when the query is done.
+func (p *Proxy) admitQuery(ctx context.Context, s *session) (func(), error) {
+	now := time.Now()
+	if err := p.queryRate.take(now); err != nil {
+		return nil, err
+	}
+	if err := p.userQueryRate.take(s.userName, now); err != nil {
+		return nil, err
+	}
+	// the session's own queries would never release their slots while this one waits.
+	releaseSession, err := p.sessionLimiter.acquire(ctx, strconv.Itoa(int(s.pid)), 0)
+	if err != nil {
+		return nil, err
+	}
+	// queries wait in the queue of their priority class before taking any other slot.
+	releasePriority, err := p.priorityLimiter.acquire(ctx, s.priority, p.concurrencyQueueTimeout)
+	if err != nil {
+		releaseSession()
+		return nil, err
+	}
+	releaseDatabase, err := p.databaseLimiter.acquire(ctx, s.databaseName, p.concurrencyQueueTimeout)
+	if err != nil {
+		releasePriority()
+		releaseSession()
+		return nil, err
+	}
+	releaseUser, err := p.userLimiter.acquire(ctx, s.userName, p.concurrencyQueueTimeout)
+	if err != nil {
+		releaseDatabase()
+		releasePriority()
+		releaseSession()
+		return nil, err
+	}
+	releaseGlobal, err := p.scheduler.acquire(ctx, s.databaseName, p.concurrencyQueueTimeout)
+	if err != nil {
+		releaseUser()
+		releaseDatabase()
+		releasePriority()
+		releaseSession()
+		return nil, err
+	}
+	return func() {
+		releaseGlobal()
+		releaseUser()
+		releaseDatabase()
+		releasePriority()
+		releaseSession()
+	}, nil
+}
@@ -0,0 +1,106 @@
+package pigox
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// WithMaxConnections limits the number of sessions the proxy serves at the same time. Connections over the
+// limit are rejected after the startup message with too_many_connections. Proxies created by a Server share
+// the limit. Zero means unlimited.
+func WithMaxConnections(n int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.maxConnections = n
+	}
+}
+
+// WithMaxConnectionsPerUser limits the number of sessions each user can have at the same time, like
+// WithMaxConnections. Zero means unlimited.
+func WithMaxConnectionsPerUser(n int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.maxConnectionsPerUser = n
+	}
+}
+
+// withConnectionLimiter shares a connection limiter between proxies.
+func withConnectionLimiter(l *connectionLimiter) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.connections = l
+	}
+}
+
+// WithMaxConcurrentQueriesPerSession limits the number of queries each session can run at the same time. A
+// session runs a single query at a time, but its open cursors and suspended portals keep their queries running
+// until they are closed. Queries over the limit are rejected immediately. Zero means unlimited.
+func WithMaxConcurrentQueriesPerSession(n int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.maxConcurrentQueriesPerSession = n
+	}
+}
+
+// WithMaxQueriesPerSecondPerUser limits the rate of the queries of each user, like WithMaxQueriesPerSecond.
+// Proxies created by a Server share the limit. Zero means unlimited.
+func WithMaxQueriesPerSecondPerUser(rate float64, burst int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.maxQueriesPerSecondPerUser = rate
+		opts.userQueryBurst = burst
+	}
+}
+
+// withUserQueryRateLimiter shares a per-user query rate limiter between proxies.
+func withUserQueryRateLimiter(l *userQueryRateLimiter) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.userQueryRate = l
+	}
+}
+
+var errTooManyConnections = newPGError(pgerrcode.TooManyConnections, errors.New("sorry, too many clients already"))
+
+// connectionLimiter bounds the number of sessions, in total and for each user.
+type connectionLimiter struct {
+	max, perUser int
+
+	mu    sync.Mutex
+	total int
+	users map[string]int
+}
+
+// newConnectionLimiter returns a limiter admitting up to max sessions, and up to perUser sessions of each user,
+// or nil if both are zero (unlimited).
+func newConnectionLimiter(max, perUser int) *connectionLimiter {
+	if max <= 0 && perUser <= 0 {
+		return nil
+	}
+	return &connectionLimiter{max: max, perUser: perUser, users: map[string]int{}}
+}
+
+// admit admits a session of user. It returns a function to call when the session ends.
+func (l *connectionLimiter) admit(user string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.total >= l.max {
+		return nil, errTooManyConnections
+	}
+	if l.perUser > 0 && l.users[user] >= l.perUser {
+		return nil, newPGError(pgerrcode.TooManyConnections, fmt.Errorf("too many connections for role %q", user))
+	}
+	l.total++
+	l.users[user]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if l.users[user]--; l.users[user] == 0 {
+				delete(l.users, user)
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,549 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/parquet/compress"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+)
+
+type copyFormat int
+
+const (
+	copyText copyFormat = iota
+	copyCSV
+	copyBinary
+	// copyArrow streams the results as an Arrow IPC stream.
+	copyArrow
+	// copyParquet streams the results as a Parquet file.
+	copyParquet
+)
+
+// binaryCopySignature starts the header of the binary COPY format; it is followed by the flags and
+// the header extension length.
+const binaryCopySignature = "PGCOPY\n\xff\r\n\x00"
+
+// copyStatement is a parsed `COPY ... TO STDOUT` statement.
+type copyStatement struct {
+	// query produces the rows to copy.
+	query  string
+	format copyFormat
+	header bool
+	// delimiter, null, quote and escape are only used by the text and CSV formats.
+	delimiter byte
+	null      string
+	quote     byte
+	escape    byte
+	// forceQuote are the columns whose non-NULL CSV values are always quoted; "*" stands for all columns.
+	forceQuote []string
+	// compression is only used by the parquet format.
+	compression compress.Compression
+}
+
+// parseCopyStatement parses `COPY (query) TO STDOUT [[WITH] options]` and `COPY table [(columns)] TO STDOUT ...`.
+// Besides the postgres formats, `FORMAT arrow` returns the results as an Arrow IPC stream and
+// `FORMAT parquet` as a Parquet file, optionally with `COMPRESSION none|snappy|gzip|zstd`.
+// Both the parenthesized option list of postgres 9+ (e.g. `WITH (FORMAT csv, HEADER)`) and the older
+// keyword syntax (e.g. `WITH CSV HEADER`) are accepted.
+// It returns nil if the query is not a COPY statement.
+func parseCopyStatement(query string) (*copyStatement, error) {
+	toks := significant(scanSQL(query))
+	if n := len(toks); n > 0 && toks[n-1].is(";") {
+		toks = toks[:n-1]
+	}
+	if len(toks) == 0 || !toks[0].is("copy") {
+		return nil, nil
+	}
+	toks = toks[1:]
+	syntaxError := func(format string, args ...interface{}) error {
+		return newPGError(pgerrcode.SyntaxError, fmt.Errorf(format, args...))
+	}
+
+	stmt := &copyStatement{}
+	switch {
+	case len(toks) > 0 && toks[0].is("("):
+		end := matchingParen(toks)
+		if end < 0 {
+			return nil, syntaxError("unterminated COPY query")
+		}
+		stmt.query = strings.TrimSpace(query[toks[0].pos+1 : toks[end].pos])
+		toks = toks[end+1:]
+	case len(toks) > 0 && (toks[0].kind == tokIdent || toks[0].kind == tokQuotedIdent):
+		i := 1
+		for i+1 < len(toks) && toks[i].is(".") {
+			i += 2
+		}
+		table := joinTokens(toks[:i])
+		columns := "*"
+		if i < len(toks) && toks[i].is("(") {
+			end := matchingParen(toks[i:])
+			if end < 0 {
+				return nil, syntaxError("unterminated COPY column list")
+			}
+			columns = query[toks[i].pos+1 : toks[i+end].pos]
+			i += end + 1
+		}
+		stmt.query = fmt.Sprintf("SELECT %s FROM %s", columns, table)
+		toks = toks[i:]
+	default:
+		return nil, syntaxError("syntax error in COPY statement")
+	}
+
+	switch {
+	case len(toks) >= 1 && toks[0].is("from"):
+		return nil, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("COPY FROM is not supported"))
+	case len(toks) < 2 || !toks[0].is("to"):
+		return nil, syntaxError("syntax error in COPY statement: expected TO STDOUT")
+	case !toks[1].is("stdout"):
+		return nil, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("only COPY TO STDOUT is supported"))
+	}
+	toks = toks[2:]
+	if len(toks) > 0 && toks[0].is("with") {
+		toks = toks[1:]
+	}
+
+	opts := map[string]string{}
+	if len(toks) > 0 && toks[0].is("(") {
+		end := matchingParen(toks)
+		if end != len(toks)-1 {
+			return nil, syntaxError("syntax error in COPY options")
+		}
+		for _, opt := range splitOnCommas(toks[1:end]) {
+			if len(opt) > 0 && opt[0].is("force_quote") {
+				names, ok := forceQuoteColumns(opt[1:])
+				if !ok {
+					return nil, syntaxError("syntax error in COPY option FORCE_QUOTE")
+				}
+				opts["force_quote"] = names
+				continue
+			}
+			if len(opt) == 0 || len(opt) > 2 || opt[0].kind != tokIdent {
+				return nil, syntaxError("syntax error in COPY options")
+			}
+			value := "true"
+			if len(opt) == 2 {
+				value = optionValue(opt[1])
+			}
+			opts[strings.ToLower(opt[0].text)] = value
+		}
+	} else {
+		for len(toks) > 0 {
+			kw := strings.ToLower(toks[0].text)
+			toks = toks[1:]
+			switch kw {
+			case "binary", "csv":
+				opts["format"] = kw
+			case "header":
+				opts["header"] = "true"
+			case "force":
+				if len(toks) < 2 || !toks[0].is("quote") {
+					return nil, syntaxError("syntax error in COPY options at %q", kw)
+				}
+				// the column list extends to the next option, whose keyword is never a column name here.
+				n := 2
+				for n+1 < len(toks) && toks[n].is(",") {
+					n += 2
+				}
+				names, ok := forceQuoteColumns(toks[1:n])
+				if !ok {
+					return nil, syntaxError("syntax error in COPY option FORCE QUOTE")
+				}
+				opts["force_quote"] = names
+				toks = toks[n:]
+			case "delimiter", "null", "quote", "escape":
+				if len(toks) > 0 && toks[0].is("as") {
+					toks = toks[1:]
+				}
+				if len(toks) == 0 {
+					return nil, syntaxError("missing value for COPY option %s", kw)
+				}
+				opts[kw] = optionValue(toks[0])
+				toks = toks[1:]
+			default:
+				return nil, syntaxError("syntax error in COPY options at %q", kw)
+			}
+		}
+	}
+	if err := stmt.setOptions(opts); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+func (s *copyStatement) setOptions(opts map[string]string) error {
+	f := strings.ToLower(opts["format"])
+	switch f {
+	case "", "text":
+		s.format, s.delimiter, s.null = copyText, '\t', `\N`
+	case "csv":
+		s.format, s.delimiter, s.null, s.quote = copyCSV, ',', "", '"'
+	case "binary":
+		s.format = copyBinary
+	case "arrow":
+		s.format = copyArrow
+	case "parquet":
+		s.format, s.compression = copyParquet, compress.Codecs.Snappy
+	default:
+		return newPGError(pgerrcode.InvalidParameterValue, fmt.Errorf("COPY format %q not recognized", f))
+	}
+	delete(opts, "format")
+
+	invalid := func(format string, args ...interface{}) error {
+		return newPGError(pgerrcode.InvalidParameterValue, fmt.Errorf(format, args...))
+	}
+	single := func(name, value string) (byte, error) {
+		if len(value) != 1 {
+			return 0, invalid("COPY %s must be a single one-byte character", name)
+		}
+		return value[0], nil
+	}
+	for name, value := range opts {
+		if name == "compression" {
+			if s.format != copyParquet {
+				return invalid("COPY compression available only in PARQUET mode")
+			}
+			var err error
+			if s.compression, err = parseParquetCompression(value); err != nil {
+				return err
+			}
+			continue
+		}
+		if s.isBinary() && name != "header" {
+			return invalid("cannot specify %s in %s mode", strings.ToUpper(name), strings.ToUpper(f))
+		}
+		if s.format != copyCSV && (name == "quote" || name == "escape" || name == "force_quote") {
+			return invalid("COPY %s available only in CSV mode", name)
+		}
+		var err error
+		switch name {
+		case "header":
+			if s.header, err = parseBool(value); err != nil {
+				return invalid("header requires a Boolean value")
+			}
+			if s.header && s.isBinary() {
+				return invalid("cannot specify HEADER in %s mode", strings.ToUpper(f))
+			}
+		case "delimiter":
+			s.delimiter, err = single(name, value)
+		case "null":
+			s.null = value
+		case "quote":
+			s.quote, err = single(name, value)
+		case "escape":
+			s.escape, err = single(name, value)
+		case "force_quote":
+			s.forceQuote = strings.Split(value, ",")
+		case "encoding":
+			if e := strings.ToLower(strings.ReplaceAll(value, "-", "")); e != "utf8" {
+				return newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("only UTF8 encoding is supported"))
+			}
+		default:
+			return newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("COPY option %q is not supported", name))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if s.escape == 0 {
+		s.escape = s.quote
+	}
+	return nil
+}
+
+// forceQuoteColumns returns the comma separated names of the columns of a FORCE_QUOTE option, `*` or a list of
+// column names with or without parentheses.
+func forceQuoteColumns(toks []token) (string, bool) {
+	if len(toks) == 1 && toks[0].is("*") {
+		return "*", true
+	}
+	if len(toks) > 1 && toks[0].is("(") && matchingParen(toks) == len(toks)-1 {
+		toks = toks[1 : len(toks)-1]
+	}
+	var names []string
+	for _, col := range splitOnCommas(toks) {
+		if len(col) != 1 || !isName(col[0]) {
+			return "", false
+		}
+		names = append(names, col[0].identName())
+	}
+	return strings.Join(names, ","), len(names) > 0
+}
+
+// forceQuoted returns whether the values of each of the copied columns are always quoted.
+func (s *copyStatement) forceQuoted(fields []arrow.Field) ([]bool, error) {
+	quoted := make([]bool, len(fields))
+	for _, name := range s.forceQuote {
+		found := false
+		for i, f := range fields {
+			if name == "*" || f.Name == name {
+				quoted[i], found = true, true
+			}
+		}
+		if !found && name != "*" {
+			return nil, newPGError(pgerrcode.InvalidColumnReference, fmt.Errorf("FORCE_QUOTE column %q not referenced by COPY", name))
+		}
+	}
+	return quoted, nil
+}
+
+// isBinary reports whether the format is made of binary data rather than text lines.
+func (s *copyStatement) isBinary() bool {
+	return s.format == copyBinary || s.format == copyArrow || s.format == copyParquet
+}
+
+// matchingParen returns the index of the parenthesis closing toks[0], or -1.
+func matchingParen(toks []token) int {
+	depth := 0
+	for i, t := range toks {
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitOnCommas splits a list of significant tokens on top level commas.
+func splitOnCommas(toks []token) [][]token {
+	var res [][]token
+	depth, start := 0, 0
+	for i, t := range toks {
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		case t.is(",") && depth == 0:
+			res = append(res, toks[start:i])
+			start = i + 1
+		}
+	}
+	return append(res, toks[start:])
+}
+
+func optionValue(t token) string {
+	if t.kind == tokString {
+		return t.stringValue()
+	}
+	return t.text
+}
+
+// handleCopy executes a COPY TO STDOUT statement; source is the statement as sent by the client.
+// It returns the statement error, if any, or an error writing to the client.
+func (p *Proxy) handleCopy(ctx context.Context, source string, stmt *copyStatement, session *session) error {
+	query, hints, err := p.rewrite(ctx, session, stmt.query)
+	if err != nil {
+		return p.reportError(err)
+	}
+	start := time.Now()
+	rows, err := p.processCopy(ctx, stmt, query, hints, session)
+	p.recordQuery(session, source, query, start, rows, err)
+	p.logSlowQuery(session, source, query, start, rows, err)
+	return err
+}
+
+func (p *Proxy) processCopy(ctx context.Context, stmt *copyStatement, query string, hints queryHints, session *session) (totalRows int, err error) {
+	defer func() {
+		if err = canceledError(ctx, err); err == nil {
+			err = writeMessages(p.conn, &pgproto3.CommandComplete{CommandTag: []byte(fmt.Sprintf("COPY %d", totalRows))})
+		} else if werr := p.writeError("ERROR", err); werr != nil {
+			err = werr
+		}
+	}()
+
+	done, err := p.admitQuery(ctx, session)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	mem, err := p.memory.admit(ctx, p.concurrencyQueueTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer mem.release()
+
+	p.mirrorQuery(session, query)
+	p.awaitWrites(ctx, session)
+	reader, err := p.runQuery(ctx, session, query)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Release()
+
+	fields := resultFields(reader.Schema().Fields(), session)
+	colOpts := columnRenderOptions(fields, hints, session)
+	quoted, err := stmt.forceQuoted(fields)
+	if err != nil {
+		return 0, err
+	}
+
+	resp := &pgproto3.CopyOutResponse{ColumnFormatCodes: make([]uint16, len(fields))}
+	if stmt.isBinary() {
+		resp.OverallFormat = 1
+		for i := range resp.ColumnFormatCodes {
+			resp.ColumnFormatCodes[i] = 1
+		}
+	}
+	// the copy is started right away, so that clients don't wait for IOx to compute the first batch to know
+	// the query succeeded.
+	buf := resp.Encode(nil)
+	if _, err := p.conn.Write(buf); err != nil {
+		return 0, fmt.Errorf("error writing copy data: %w", err)
+	}
+	buf = buf[:0]
+	switch stmt.format {
+	case copyArrow:
+		return writeArrowCopy(ctx, p.conn, buf, reader, p.throttle, mem)
+	case copyParquet:
+		return writeParquetCopy(ctx, p.conn, buf, reader, p.throttle, mem, stmt.compression)
+	}
+	var line []byte
+	switch {
+	case stmt.format == copyBinary:
+		line = append([]byte(binaryCopySignature), 0, 0, 0, 0, 0, 0, 0, 0)
+	case stmt.header:
+		for i, f := range fields {
+			line = stmt.appendValue(line, i, []byte(f.Name), false)
+		}
+		line = append(line, '\n')
+	}
+	if len(line) > 0 {
+		if err := writeMessages(p.conn, &pgproto3.CopyData{Data: line}); err != nil {
+			return 0, fmt.Errorf("error writing copy data: %w", err)
+		}
+	}
+
+	for {
+		batch, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+
+		bcols := batch.Columns()
+		for r := 0; r < int(batch.NumRows()); r++ {
+			line, err = stmt.appendRow(line[:0], bcols, r, colOpts, quoted)
+			if err != nil {
+				return 0, err
+			}
+			buf = (&pgproto3.CopyData{Data: line}).Encode(buf)
+		}
+		totalRows += int(batch.NumRows())
+
+		mem.hold(recordSize(batch) + int64(len(buf)))
+		if err := p.throttle.wait(ctx, int(batch.NumRows()), len(buf)); err != nil {
+			return 0, err
+		}
+		if _, err := p.conn.Write(buf); err != nil {
+			return 0, fmt.Errorf("error writing copy data: %w", err)
+		}
+		buf = buf[:0]
+	}
+
+	if stmt.format == copyBinary {
+		buf = (&pgproto3.CopyData{Data: []byte{0xff, 0xff}}).Encode(buf)
+	}
+	buf = (&pgproto3.CopyDone{}).Encode(buf)
+	if _, err := p.conn.Write(buf); err != nil {
+		return 0, fmt.Errorf("error writing copy data: %w", err)
+	}
+	return totalRows, nil
+}
+
+// appendRow appends the encoding of a row to dst; the CSV values of the quoted columns are always quoted.
+func (s *copyStatement) appendRow(dst []byte, cols []arrow.Array, row int, opts []renderOptions, quoted []bool) ([]byte, error) {
+	if s.format == copyBinary {
+		dst = appendUint16(dst, uint16(len(cols)))
+		for c, col := range cols {
+			v, err := renderBinary(col, row, opts[c])
+			if err != nil {
+				return nil, err
+			}
+			if v == nil {
+				dst = appendUint32(dst, 0xffffffff)
+				continue
+			}
+			dst = append(appendUint32(dst, uint32(len(v))), v...)
+		}
+		return dst, nil
+	}
+
+	for c, col := range cols {
+		if col.IsNull(row) {
+			if c > 0 {
+				dst = append(dst, s.delimiter)
+			}
+			dst = append(dst, s.null...)
+			continue
+		}
+		v, err := renderText(col, row, opts[c])
+		if err != nil {
+			return nil, err
+		}
+		dst = s.appendValue(dst, c, []byte(v), quoted[c])
+	}
+	return append(dst, '\n'), nil
+}
+
+// appendValue appends the c-th non-NULL value of a text or CSV row, preceded by a delimiter if needed.
+// CSV values are quoted if needed, or if force is set.
+func (s *copyStatement) appendValue(dst []byte, c int, v []byte, force bool) []byte {
+	if c > 0 {
+		dst = append(dst, s.delimiter)
+	}
+	if s.format == copyText {
+		for _, b := range v {
+			switch b {
+			case '\\', s.delimiter:
+				dst = append(dst, '\\', b)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, b)
+			}
+		}
+		return dst
+	}
+
+	needsQuote := force || string(v) == s.null || string(v) == `\.`
+	for _, b := range v {
+		if b == s.delimiter || b == s.quote || b == s.escape || b == '\n' || b == '\r' {
+			needsQuote = true
+			break
+		}
+	}
+	if !needsQuote {
+		return append(dst, v...)
+	}
+	dst = append(dst, s.quote)
+	for _, b := range v {
+		if b == s.quote || b == s.escape {
+			dst = append(dst, s.escape)
+		}
+		dst = append(dst, b)
+	}
+	return append(dst, s.quote)
+}
+
+func appendUint16(dst []byte, v uint16) []byte {
+	return append(dst, byte(v>>8), byte(v))
+}
+
+func appendUint32(dst []byte, v uint32) []byte {
+	return append(dst, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,446 @@
+package pigox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+)
+
+// cursorStatement is a parsed `DECLARE`, `FETCH`, `MOVE` or `CLOSE` cursor statement.
+type cursorStatement struct {
+	// verb is "declare", "fetch", "move" or "close".
+	verb string
+	// name is the name of the cursor; empty for CLOSE ALL.
+	name string
+
+	// query, binary and hold are the query, the BINARY and the WITH HOLD options of DECLARE.
+	query  string
+	binary bool
+	hold   bool
+
+	// count is the number of rows FETCH and MOVE advance by; zero is ALL.
+	count int
+}
+
+var errBackwardScan = newPGError(pgerrcode.ObjectNotInPrerequisiteState, errors.New("cursor can only scan forward"))
+
+// parseCursorStatement parses a cursor statement:
+//
+//	DECLARE name [BINARY] [ASENSITIVE | INSENSITIVE] [NO SCROLL] CURSOR [{WITH | WITHOUT} HOLD] FOR query
+//	{FETCH | MOVE} [NEXT | FORWARD | count | FORWARD count | ALL | FORWARD ALL] [FROM | IN] name
+//	CLOSE {name | ALL}
+//
+// Cursors only scan forward, since IOx results are streamed. It returns nil if query is not a cursor statement.
+func parseCursorStatement(query string) (*cursorStatement, error) {
+	toks := scanSQL(query)
+	sig := significant(toks)
+	if n := len(sig); n > 0 && sig[n-1].is(";") {
+		sig = sig[:n-1]
+	}
+	if len(sig) < 2 || sig[0].kind != tokIdent {
+		return nil, nil
+	}
+	rest := sig[1:]
+	optional := func(kws ...string) bool {
+		for _, kw := range kws {
+			if len(rest) > 0 && rest[0].is(kw) {
+				rest = rest[1:]
+				return true
+			}
+		}
+		return false
+	}
+	name := func() (string, bool) {
+		if len(rest) == 0 || !isName(rest[0]) {
+			return "", false
+		}
+		n := rest[0].identName()
+		rest = rest[1:]
+		return n, true
+	}
+
+	stmt := &cursorStatement{verb: sig[0].identName()}
+	switch stmt.verb {
+	case "declare":
+		var ok bool
+		if stmt.name, ok = name(); !ok {
+			return nil, nil
+		}
+		stmt.binary = optional("binary")
+		optional("asensitive", "insensitive")
+		if optional("scroll") {
+			return nil, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("scrollable cursors are not supported"))
+		}
+		if optional("no") && !optional("scroll") {
+			return nil, nil
+		}
+		if !optional("cursor") {
+			return nil, nil
+		}
+		if optional("with") {
+			if !optional("hold") {
+				return nil, nil
+			}
+			stmt.hold = true
+		} else if optional("without") && !optional("hold") {
+			return nil, nil
+		}
+		if !optional("for") || len(rest) == 0 {
+			return nil, newPGError(pgerrcode.SyntaxError, fmt.Errorf("DECLARE CURSOR requires a query"))
+		}
+		for i, t := range toks {
+			if t.pos == rest[0].pos {
+				stmt.query = trimStatement(joinTokens(toks[i:]))
+				break
+			}
+		}
+		return stmt, nil
+	case "fetch", "move":
+		stmt.count = 1
+		switch {
+		case optional("prior", "first", "last", "absolute", "relative", "backward"):
+			return nil, errBackwardScan
+		case optional("next"):
+		case optional("all"):
+			stmt.count = 0
+		case optional("forward"):
+			if optional("all") {
+				stmt.count = 0
+			} else if len(rest) > 0 && rest[0].kind == tokNumber {
+				if stmt.count = countToken(rest[0]); stmt.count <= 0 {
+					return nil, errBackwardScan
+				}
+				rest = rest[1:]
+			}
+		case len(rest) > 0 && (rest[0].kind == tokNumber || rest[0].is("-")):
+			if stmt.count = countToken(rest[0]); stmt.count <= 0 {
+				return nil, errBackwardScan
+			}
+			rest = rest[1:]
+		}
+		optional("from", "in")
+	case "close":
+		if optional("all") {
+			break
+		}
+		var ok bool
+		if stmt.name, ok = name(); !ok {
+			return nil, nil
+		}
+	default:
+		return nil, nil
+	}
+	if stmt.verb != "close" {
+		var ok bool
+		if stmt.name, ok = name(); !ok {
+			return nil, newPGError(pgerrcode.SyntaxError, fmt.Errorf("%s requires a cursor name", stmt.tag()))
+		}
+	}
+	if len(rest) > 0 {
+		return nil, newPGError(pgerrcode.SyntaxError, fmt.Errorf("syntax error at or near %q", rest[0].text))
+	}
+	return stmt, nil
+}
+
+// countToken returns the row count of a FETCH or MOVE statement; negative counts and the minus sign of one,
+// which scan backward, are returned as -1.
+func countToken(t token) int {
+	n, err := strconv.Atoi(t.text)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// tag returns the command tag of the statement, without the row count of FETCH and MOVE.
+func (stmt *cursorStatement) tag() string {
+	switch stmt.verb {
+	case "declare":
+		return "DECLARE CURSOR"
+	case "close":
+		return "CLOSE CURSOR"
+	}
+	return strings.ToUpper(stmt.verb)
+}
+
+// cursor is an open query result read a few rows at a time, by the FETCH statements of a cursor declared with
+// DECLARE or by the Execute messages of a portal with a row limit. The Arrow reader is suspended between fetches.
+//
+// A cursor holds its concurrency slots, its result memory and its IOx result stream until it is closed. Its
+// results are not compared to those of the shadow backend.
+type cursor struct {
+	p       *Proxy
+	session *session
+	// source is the query as sent by the client and query the query sent to IOx.
+	source, query string
+	start         time.Time
+	// hold is set for the cursors that outlive the transaction they were declared in.
+	hold bool
+	// codes are the formats the rows are fetched in by FETCH statements.
+	codes []int16
+
+	// cancel cancels the context of the query, which outlives the statement that opened the cursor.
+	cancel  context.CancelFunc
+	done    func()
+	mem     *resultMemory
+	reader  recordReader
+	fields  []arrow.Field
+	colOpts []renderOptions
+	sources []fieldSource
+
+	// batch is the batch being read, from row row.
+	batch arrow.Record
+	row   int
+	// rows is the number of rows fetched.
+	rows int
+	// eof is set once all the rows were fetched; closed once the cursor released its resources.
+	eof, closed bool
+}
+
+// openCursor runs a query, returning a cursor on its result sent in the given formats.
+func (p *Proxy) openCursor(ctx context.Context, session *session, source, query string, hints queryHints, codes []int16) (_ *cursor, err error) {
+	if hints.json != nil {
+		return nil, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("cursors do not support JSON results"))
+	}
+	c := &cursor{p: p, session: session, source: source, query: query, start: time.Now()}
+	defer func() {
+		if err != nil {
+			c.close(err)
+		}
+	}()
+
+	// canceling the statement cancels the query, but the query outlives it.
+	var qctx context.Context
+	qctx, c.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	defer context.AfterFunc(ctx, c.cancel)()
+
+	if c.done, err = p.admitQuery(ctx, session); err != nil {
+		return nil, err
+	}
+	if c.mem, err = p.memory.admit(ctx, p.concurrencyQueueTimeout); err != nil {
+		return nil, err
+	}
+	p.mirrorQuery(session, query)
+	p.awaitWrites(ctx, session)
+	if c.reader, err = p.runQuery(qctx, session, query); err != nil {
+		return nil, canceledError(ctx, err)
+	}
+	c.fields = resultFields(c.reader.Schema().Fields(), session)
+	c.colOpts = columnRenderOptions(c.fields, hints, session)
+	c.sources = p.fieldSources(ctx, session, query, c.fields)
+	if n := len(codes); n > 1 && n != len(c.fields) {
+		return nil, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("bind message has %d result formats but query has %d columns", n, len(c.fields)))
+	}
+	return c, nil
+}
+
+// fetch writes up to n rows, or all the remaining ones if n is zero, in the given formats with w; if w is nil
+// the rows are skipped. It returns the number of rows fetched. Canceling ctx cancels the query and fails the
+// cursor.
+func (c *cursor) fetch(ctx context.Context, w *rowWriter, n int, codes []int16) (fetched int, err error) {
+	if c.closed {
+		return 0, nil
+	}
+	defer context.AfterFunc(ctx, c.cancel)()
+	defer func() {
+		if err != nil {
+			err = canceledError(ctx, err)
+			c.close(err)
+		}
+	}()
+
+	for !c.eof && (n == 0 || fetched < n) {
+		if c.batch == nil || c.row >= int(c.batch.NumRows()) {
+			if c.batch, err = c.reader.Read(); err == io.EOF {
+				c.batch, c.eof = nil, true
+				break
+			} else if err != nil {
+				return 0, err
+			}
+			c.row = 0
+			c.mem.hold(recordSize(c.batch))
+			continue
+		}
+		if max := c.session.maxRows; max > 0 && c.rows >= max {
+			c.p.log.Debug("truncated result (piggo.max_rows)", "rows", c.rows)
+			c.eof = true
+			break
+		}
+		if w != nil {
+			cols, err := renderRow(c.batch.Columns(), c.row, c.colOpts, codes)
+			if err != nil {
+				return 0, err
+			}
+			if err := w.writeRow(cols); err != nil {
+				return 0, err
+			}
+			c.mem.hold(recordSize(c.batch) + w.size())
+		}
+		c.row++
+		c.rows++
+		fetched++
+	}
+	if w != nil {
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+	}
+	if c.eof {
+		c.close(nil)
+	}
+	return fetched, nil
+}
+
+// close releases the resources of the cursor and records its query; err is the error it failed with.
+func (c *cursor) close(err error) {
+	if c.closed {
+		return
+	}
+	c.closed, c.eof = true, true
+	if c.reader != nil {
+		c.reader.Release()
+		c.p.recordQuery(c.session, c.source, c.query, c.start, c.rows, err)
+	}
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.mem.release()
+	if c.done != nil {
+		c.done()
+	}
+	c.batch = nil
+}
+
+// closeCursors closes the cursors of a session, and the portals of its extended protocol state. Unless all is
+// set, the cursors declared WITH HOLD and the prepared statements are kept.
+func (s *session) closeCursors(all bool) {
+	for name, c := range s.cursors {
+		if all || !c.hold {
+			c.close(nil)
+			delete(s.cursors, name)
+		}
+	}
+	s.extended.closePortals()
+	if all {
+		s.extended.closeStatements()
+	}
+}
+
+// handleCursorStatement runs a cursor statement of a simple query, or of a portal executed with the given format,
+// and writes its result. It returns the statement error, if any, or an error writing to the client.
+func (p *Proxy) handleCursorStatement(ctx context.Context, session *session, stmt *cursorStatement, format resultFormat) error {
+	switch stmt.verb {
+	case "declare":
+		if session.transaction == txIdle && !stmt.hold {
+			return p.reportError(newPGError(pgerrcode.NoActiveSQLTransaction, fmt.Errorf("DECLARE CURSOR can only be used in transaction blocks")))
+		}
+		if _, ok := session.cursors[stmt.name]; ok {
+			return p.reportError(newPGError(pgerrcode.DuplicateCursor, fmt.Errorf("cursor %q already exists", stmt.name)))
+		}
+		_, span := p.tracer.Start(ctx, "rewrite")
+		q, hints, err := p.rewrite(ctx, session, stmt.query)
+		endSpan(span, err)
+		if err != nil {
+			return p.reportError(err)
+		}
+		var codes []int16
+		if stmt.binary {
+			codes = []int16{pgtype.BinaryFormatCode}
+		}
+		c, err := p.openCursor(ctx, session, stmt.query, q, hints, codes)
+		if err != nil {
+			return p.reportError(err)
+		}
+		c.hold, c.codes = stmt.hold, codes
+		if session.cursors == nil {
+			session.cursors = map[string]*cursor{}
+		}
+		session.cursors[stmt.name] = c
+	case "fetch", "move":
+		c, ok := session.cursors[stmt.name]
+		if !ok {
+			return p.reportError(newPGError(pgerrcode.InvalidCursorName, fmt.Errorf("cursor %q does not exist", stmt.name)))
+		}
+		var w *rowWriter
+		codes := c.codes
+		if stmt.verb == "fetch" {
+			if !format.describe {
+				// the rows of portals are sent in the formats of their Bind message.
+				codes = format.codes
+			} else if err := writeMessages(p.conn, rowDescription(c.fields, c.colOpts, codes, c.sources)); err != nil {
+				return fmt.Errorf("error writing query response: %w", err)
+			}
+			stream := p.startStreamSpan(ctx)
+			w = p.newRowWriter(ctx, stream)
+			defer stream.end(nil)
+		}
+		n, err := c.fetch(ctx, w, stmt.count, codes)
+		if err != nil {
+			delete(session.cursors, stmt.name)
+			return p.reportError(err)
+		}
+		return writeMessages(p.conn, &pgproto3.CommandComplete{CommandTag: []byte(fmt.Sprintf("%s %d", stmt.tag(), n))})
+	case "close":
+		if stmt.name == "" {
+			for name, c := range session.cursors {
+				c.close(nil)
+				delete(session.cursors, name)
+			}
+			break
+		}
+		c, ok := session.cursors[stmt.name]
+		if !ok {
+			return p.reportError(newPGError(pgerrcode.InvalidCursorName, fmt.Errorf("cursor %q does not exist", stmt.name)))
+		}
+		c.close(nil)
+		delete(session.cursors, stmt.name)
+	}
+	return writeMessages(p.conn, &pgproto3.CommandComplete{CommandTag: []byte(stmt.tag())})
+}
+
+// cursor returns the cursor of a session with the given name.
+func (s *session) cursor(name string) (*cursor, error) {
+	c, ok := s.cursors[name]
+	if !ok {
+		return nil, newPGError(pgerrcode.InvalidCursorName, fmt.Errorf("cursor %q does not exist", name))
+	}
+	return c, nil
+}
+
+// executePortal runs a portal executed with a row limit, or resumes it if it was suspended, and writes up to
+// maxRows of its rows; zero is all of them. A portal that has more rows is suspended.
+// Like handleExtended, only errors writing to the client are returned.
+func (p *Proxy) executePortal(ctx context.Context, session *session, pt *portal, maxRows int) (err error) {
+	ps := pt.stmt
+	defer func() {
+		if err != nil {
+			session.extended.failed = true
+			p.log.Info("statement failed", "err", err)
+			err = p.writeError("ERROR", err)
+		}
+	}()
+	if pt.cursor == nil {
+		if pt.cursor, err = p.openCursor(ctx, session, ps.source, pt.query, ps.hints, pt.formats); err != nil {
+			return err
+		}
+	}
+	stream := p.startStreamSpan(ctx)
+	n, err := pt.cursor.fetch(ctx, p.newRowWriter(ctx, stream), maxRows, pt.formats)
+	stream.end(err)
+	if err != nil {
+		return err
+	}
+	if maxRows > 0 && n == maxRows && !pt.cursor.eof {
+		return writeMessages(p.conn, &pgproto3.PortalSuspended{})
+	}
+	return writeMessages(p.conn, &pgproto3.CommandComplete{CommandTag: []byte(fmt.Sprintf("SELECT %d", n))})
+}
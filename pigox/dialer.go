@@ -0,0 +1,108 @@
+package pigox
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Dialer dials a network connection to address.
+type Dialer = func(ctx context.Context, address string) (net.Conn, error)
+
+// NewUpstreamProxyDialer returns a Dialer that tunnels connections through the proxy at proxyURL.
+//
+// Supported schemes are "http" and "https" (HTTP CONNECT), and "socks5". Credentials in the URL userinfo
+// are sent as basic proxy authentication and SOCKS5 username/password authentication respectively.
+func NewUpstreamProxyDialer(proxyURL *url.URL) (Dialer, error) {
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return func(ctx context.Context, address string) (net.Conn, error) {
+			return dialHTTPConnect(ctx, proxyURL, address)
+		}, nil
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u := proxyURL.User; u != nil {
+			password, _ := u.Password()
+			auth = &proxy.Auth{User: u.Username(), Password: password}
+		}
+		d, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, &net.Dialer{})
+		if err != nil {
+			return nil, err
+		}
+		cd := d.(proxy.ContextDialer)
+		return func(ctx context.Context, address string) (net.Conn, error) {
+			return cd.DialContext(ctx, "tcp", address)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (expected http, https or socks5)", proxyURL.Scheme)
+	}
+}
+
+func dialHTTPConnect(ctx context.Context, proxyURL *url.URL, address string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to proxy: %w", err)
+	}
+	if proxyURL.Scheme == "https" {
+		tconn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tconn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("cannot connect to proxy: %w", err)
+		}
+		conn = tconn
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error sending CONNECT to proxy: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error reading CONNECT response from proxy: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", address, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose first bytes have already been read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
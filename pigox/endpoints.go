@@ -0,0 +1,234 @@
+package pigox
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/flight"
+	"github.com/jackc/pgerrcode"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// recordReader is a stream of query result batches. Batches returned by Read are only valid until the next call.
+type recordReader interface {
+	Schema() *arrow.Schema
+	Read() (arrow.Record, error)
+	Release()
+}
+
+// concatPrefetch is the number of batches fetched ahead from each part of a concatenated result.
+const concatPrefetch = 4
+
+// readEndpoints returns a reader over the result described by info.
+//
+// Sharded Flight backends answer with a FlightInfo listing multiple endpoints, each serving a part of the result
+// possibly at another location. All the endpoints are fetched concurrently and their batches are streamed in
+// endpoint order. Endpoints without a location are fetched from client, the others from their first location.
+func (o *proxyOptions) readEndpoints(ctx context.Context, client flight.FlightServiceClient, info *flight.FlightInfo) (recordReader, error) {
+	if len(info.Endpoint) == 0 {
+		return nil, fmt.Errorf("flight info has no endpoints")
+	}
+	return concatReaders(ctx, len(info.Endpoint), func(ctx context.Context, i int) (recordReader, error) {
+		ep := info.Endpoint[i]
+		c := client
+		var conn *grpc.ClientConn
+		if len(ep.Location) > 0 {
+			var err error
+			if conn, err = o.dialLocation(ctx, ep.Location[0].Uri); err != nil {
+				return nil, err
+			}
+			c = flight.NewFlightServiceClient(conn)
+		}
+		reader, err := doGet(ctx, c, ep.Ticket)
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil, err
+		}
+		if conn != nil {
+			return &closingReader{recordReader: reader, conn: conn}, nil
+		}
+		return reader, nil
+	})
+}
+
+func doGet(ctx context.Context, client flight.FlightServiceClient, ticket *flight.Ticket) (recordReader, error) {
+	stream, err := client.DoGet(ctx, ticket)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := flight.NewRecordReader(stream)
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// closingReader closes the connection its result is read from when released.
+type closingReader struct {
+	recordReader
+	conn *grpc.ClientConn
+}
+
+func (r *closingReader) Release() {
+	r.recordReader.Release()
+	r.conn.Close()
+}
+
+// concatReaders returns a reader over the concatenation of n results, in order. The results are opened with
+// open and read concurrently, with a few batches fetched ahead; they must all have the same schema.
+// A single result is returned as is.
+func concatReaders(ctx context.Context, n int, open func(ctx context.Context, i int) (recordReader, error)) (recordReader, error) {
+	if n == 1 {
+		return open(ctx, 0)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &concatReader{cancel: cancel, parts: make([]chan concatBatch, n)}
+	schemas := make([]chan *arrow.Schema, n)
+	for i := range r.parts {
+		r.parts[i] = make(chan concatBatch, concatPrefetch)
+		schemas[i] = make(chan *arrow.Schema, 1)
+		r.wg.Add(1)
+		go func(i int, out chan<- concatBatch, schema chan<- *arrow.Schema) {
+			defer r.wg.Done()
+			defer close(out)
+			defer close(schema)
+			err := readPart(ctx, i, open, out, schema)
+			if err != nil && err != io.EOF {
+				select {
+				case out <- concatBatch{err: err}:
+				case <-ctx.Done():
+				}
+			}
+		}(i, r.parts[i], schemas[i])
+	}
+
+	for i := range schemas {
+		schema, ok := <-schemas[i]
+		if !ok {
+			// the part failed before sending its schema.
+			b := <-r.parts[i]
+			r.Release()
+			if b.err == nil {
+				b.err = fmt.Errorf("result part %d has no schema", i)
+			}
+			return nil, b.err
+		}
+		if r.schema == nil {
+			r.schema = schema
+		} else if !r.schema.Equal(schema) {
+			r.Release()
+			return nil, newPGError(pgerrcode.DataException, fmt.Errorf("result parts have different schemas: %s and %s", r.schema, schema))
+		}
+	}
+	return r, nil
+}
+
+// readPart sends the schema and then the batches of a part; batches are retained for the consumer.
+func readPart(ctx context.Context, i int, open func(ctx context.Context, i int) (recordReader, error), out chan<- concatBatch, schema chan<- *arrow.Schema) error {
+	reader, err := open(ctx, i)
+	if err != nil {
+		return err
+	}
+	defer reader.Release()
+	schema <- reader.Schema()
+
+	for {
+		rec, err := reader.Read()
+		if err != nil {
+			return err
+		}
+		rec.Retain()
+		select {
+		case out <- concatBatch{rec: rec}:
+		case <-ctx.Done():
+			rec.Release()
+			return ctx.Err()
+		}
+	}
+}
+
+// dialLocation connects to a Flight location URI, e.g. grpc+tcp://host:port or grpc+tls://host:port.
+func (o *proxyOptions) dialLocation(ctx context.Context, uri string) (*grpc.ClientConn, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flight location %q: %w", uri, err)
+	}
+	var opts []grpc.DialOption
+	switch u.Scheme {
+	case "grpc", "grpc+tcp":
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	case "grpc+tls":
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})))
+	default:
+		return nil, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("unsupported flight location %q", uri))
+	}
+	if o.upstreamDialer != nil {
+		opts = append(opts, grpc.WithContextDialer(o.upstreamDialer))
+	}
+	return grpc.DialContext(ctx, u.Host, opts...)
+}
+
+type concatBatch struct {
+	rec arrow.Record
+	err error
+}
+
+// concatReader concatenates the batches of the parts of a result, in order.
+type concatReader struct {
+	schema *arrow.Schema
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	parts  []chan concatBatch
+	// cur is the batch returned by the last Read.
+	cur arrow.Record
+}
+
+func (r *concatReader) Schema() *arrow.Schema { return r.schema }
+
+func (r *concatReader) Read() (arrow.Record, error) {
+	if r.cur != nil {
+		r.cur.Release()
+		r.cur = nil
+	}
+	for len(r.parts) > 0 {
+		b, ok := <-r.parts[0]
+		if !ok {
+			r.parts = r.parts[1:]
+			continue
+		}
+		if b.err != nil {
+			return nil, b.err
+		}
+		r.cur = b.rec
+		return b.rec, nil
+	}
+	return nil, io.EOF
+}
+
+// Release stops fetching the parts and releases the batches fetched ahead.
+func (r *concatReader) Release() {
+	r.cancel()
+	for _, part := range r.parts {
+		for b := range part {
+			if b.rec != nil {
+				b.rec.Release()
+			}
+		}
+	}
+	r.wg.Wait()
+	r.parts = nil
+	if r.cur != nil {
+		r.cur.Release()
+		r.cur = nil
+	}
+}
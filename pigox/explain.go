@@ -0,0 +1,235 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// explainColumn is the column of EXPLAIN results, like in postgres.
+const explainColumn = "QUERY PLAN"
+
+// explainStatement is a parsed `EXPLAIN [ANALYZE] [VERBOSE] query` or `EXPLAIN (option [value], ...) query`
+// statement.
+//
+// EXPLAIN runs EXPLAIN on IOx and returns its plans as text rows. The PIGOX option instead shows the query the
+// proxy sends to IOx after rewriting it and the backend it is sent to, without running anything.
+type explainStatement struct {
+	analyze, verbose, pigox bool
+	query                   string
+}
+
+// explainOptions are the postgres EXPLAIN options that are accepted and ignored, as IOx has no equivalent.
+var explainOptions = map[string]bool{"costs": true, "buffers": true, "timing": true, "summary": true, "settings": true, "wal": true}
+
+// parseExplainStatement parses an EXPLAIN statement. It returns nil if query is not an EXPLAIN statement.
+func parseExplainStatement(query string) (*explainStatement, error) {
+	toks := scanSQL(query)
+	sig := significant(toks)
+	if len(sig) == 0 || !sig[0].is("explain") {
+		return nil, nil
+	}
+	stmt := &explainStatement{}
+	rest := sig[1:]
+	if len(rest) > 0 && rest[0].is("(") {
+		rest = rest[1:]
+		for {
+			if len(rest) == 0 || rest[0].kind != tokIdent {
+				return nil, newPGError(pgerrcode.SyntaxError, fmt.Errorf("syntax error in EXPLAIN options"))
+			}
+			name, value := strings.ToLower(rest[0].text), ""
+			rest = rest[1:]
+			if len(rest) > 0 && !rest[0].is(",") && !rest[0].is(")") {
+				value = rest[0].text
+				if rest[0].kind == tokString {
+					value = rest[0].stringValue()
+				}
+				value, rest = strings.ToLower(value), rest[1:]
+			}
+			if err := stmt.setOption(name, value); err != nil {
+				return nil, err
+			}
+			if len(rest) == 0 {
+				return nil, newPGError(pgerrcode.SyntaxError, fmt.Errorf("syntax error in EXPLAIN options"))
+			}
+			sep := rest[0]
+			rest = rest[1:]
+			if sep.is(")") {
+				break
+			} else if !sep.is(",") {
+				return nil, newPGError(pgerrcode.SyntaxError, fmt.Errorf("syntax error at or near %q", sep.text))
+			}
+		}
+	} else {
+		if len(rest) > 0 && (rest[0].is("analyze") || rest[0].is("analyse")) {
+			stmt.analyze, rest = true, rest[1:]
+		}
+		if len(rest) > 0 && rest[0].is("verbose") {
+			stmt.verbose, rest = true, rest[1:]
+		}
+	}
+	if stmt.pigox && stmt.analyze {
+		return nil, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("EXPLAIN option PIGOX cannot be used with ANALYZE"))
+	}
+	if len(rest) == 0 {
+		return nil, newPGError(pgerrcode.SyntaxError, fmt.Errorf("EXPLAIN requires a query"))
+	}
+	for i, t := range toks {
+		if t.pos == rest[0].pos {
+			stmt.query = trimStatement(joinTokens(toks[i:]))
+			break
+		}
+	}
+	return stmt, nil
+}
+
+// setOption sets an option of a parenthesized EXPLAIN option list; an empty value means true.
+func (stmt *explainStatement) setOption(name, value string) error {
+	if name == "format" {
+		if value != "text" {
+			return newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("EXPLAIN format %q is not supported", value))
+		}
+		return nil
+	}
+	on := true
+	if value != "" {
+		var err error
+		if on, err = parseBool(value); err != nil {
+			return newPGError(pgerrcode.InvalidParameterValue, fmt.Errorf("EXPLAIN option %s requires a Boolean value", name))
+		}
+	}
+	switch name {
+	case "analyze", "analyse":
+		stmt.analyze = on
+	case "verbose":
+		stmt.verbose = on
+	case "pigox":
+		stmt.pigox = on
+	default:
+		if !explainOptions[name] {
+			return newPGError(pgerrcode.SyntaxError, fmt.Errorf("unrecognized EXPLAIN option %q", name))
+		}
+	}
+	return nil
+}
+
+// handleExplain runs an EXPLAIN statement whose query was rewritten into query, the query sent to IOx, and
+// writes its plan. It returns the statement error, if any, or an error writing to the client.
+func (p *Proxy) handleExplain(ctx context.Context, session *session, source string, stmt *explainStatement, query string, format resultFormat) error {
+	start := time.Now()
+	var lines []string
+	var err error
+	if stmt.pigox {
+		lines = p.describeRouting(session, stmt.query, query)
+	} else {
+		lines, err = p.explainPlan(ctx, session, stmt, query)
+	}
+	p.recordQuery(session, source, query, start, len(lines), err)
+	if err != nil {
+		return p.reportError(err)
+	}
+	rows := make([][]string, len(lines))
+	for i, l := range lines {
+		rows[i] = []string{l}
+	}
+	msgs := textResult("EXPLAIN", []string{explainColumn}, rows...)
+	if !format.describe {
+		msgs = msgs[1:]
+	}
+	return writeMessages(p.conn, msgs...)
+}
+
+// describeRouting returns the lines of the result of EXPLAIN (PIGOX).
+func (p *Proxy) describeRouting(session *session, source, query string) []string {
+	kind := p.backendKind
+	if kind == "" {
+		kind = BackendKindIOx
+	}
+	lines := []string{"Query: " + source}
+	if query == source {
+		lines = append(lines, "Rewritten Query: (unchanged)")
+	} else {
+		lines = append(lines, "Rewritten Query: "+query)
+	}
+	lines = append(lines,
+		fmt.Sprintf("Backend: %s %s", kind, p.ioxAddress),
+		"Database: "+session.databaseName,
+	)
+	if p.shadow != nil {
+		lines = append(lines, "Shadow Backend: enabled")
+	}
+	if p.mirror != nil {
+		lines = append(lines, "Mirror Backend: enabled")
+	}
+	return lines
+}
+
+// explainPlan runs EXPLAIN on IOx and returns the plans it returned, each preceded by its type.
+func (p *Proxy) explainPlan(ctx context.Context, session *session, stmt *explainStatement, query string) ([]string, error) {
+	done, err := p.admitQuery(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	q := "EXPLAIN "
+	if stmt.analyze {
+		q += "ANALYZE "
+	}
+	if stmt.verbose {
+		q += "VERBOSE "
+	}
+	reader, err := p.runQuery(ctx, session, q+strings.TrimSuffix(query, ";"))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Release()
+	plans, err := readPlans(reader)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, plan := range plans {
+		lines = append(lines, plan.typ+":")
+		for _, l := range strings.Split(strings.TrimRight(plan.plan, "\n"), "\n") {
+			lines = append(lines, "  "+l)
+		}
+	}
+	return lines, nil
+}
+
+// queryPlan is a plan returned by IOx for an EXPLAIN query, e.g. its physical_plan.
+type queryPlan struct {
+	typ, plan string
+}
+
+// readPlans reads the (plan_type, plan) rows IOx returns for EXPLAIN queries.
+func readPlans(reader recordReader) ([]queryPlan, error) {
+	var plans []queryPlan
+	for {
+		batch, err := reader.Read()
+		if err == io.EOF {
+			return plans, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if batch.NumCols() < 2 {
+			continue
+		}
+		for r := 0; r < int(batch.NumRows()); r++ {
+			typ, err := renderText(batch.Column(0), r, renderOptions{})
+			if err != nil {
+				return nil, err
+			}
+			plan, err := renderText(batch.Column(1), r, renderOptions{})
+			if err != nil {
+				return nil, err
+			}
+			plans = append(plans, queryPlan{typ: typ, plan: plan})
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// extendedState is the per session state of the extended query protocol.
+type extendedState struct {
+	// failed is set when a message fails; all messages are then discarded until the next Sync.
+	failed bool
+	// statements are the prepared statements by name; the unnamed statement has the empty name.
+	statements map[string]*preparedStatement
+	// portals are the portals created by Bind by name; they are closed by the end of the transaction they
+	// belong to: Sync outside of transaction blocks, which ends their implicit transaction.
+	portals map[string]*portal
+}
+
+// preparedStatement is a statement created by a Parse message.
+type preparedStatement struct {
+	// source is the query as sent by the client.
+	source string
+	// query is the rewritten query that is sent to IOx.
+	query string
+	hints queryHints
+	// setting is set if the statement is a SET/RESET/SHOW statement of a setting handled by the proxy.
+	setting *settingStatement
+	// insert is set if the statement is an INSERT, which is written to IOx rather than rewritten.
+	insert bool
+	// transaction is set if the statement is a transaction control statement.
+	transaction *transactionStatement
+	// cursor is set if the statement is a cursor statement, e.g. FETCH.
+	cursor *cursorStatement
+	// explain is set if the statement is an EXPLAIN statement; query is then the rewritten explained query.
+	explain *explainStatement
+	// paramOIDs are the types of the parameters, as declared by the client or inferred.
+	paramOIDs []uint32
+	// backend is the statement prepared by backends binding parameters themselves; see statementPreparer.
+	backend backendStatement
+
+	// fields describe the result rows, and sources the table columns they come from; only valid if described
+	// is set.
+	fields    []arrow.Field
+	sources   []fieldSource
+	described bool
+}
+
+// portal is a prepared statement bound to parameters by a Bind message.
+type portal struct {
+	stmt *preparedStatement
+	// query is the query of the statement with the parameters substituted.
+	query string
+	// params are the parameters bound by the backend, nil if it can't bind them.
+	params *boundParams
+	// formats are the format codes of the result columns.
+	formats []int16
+	// cursor is the result of a portal executed with a row limit, which is suspended between Execute messages.
+	cursor *cursor
+}
+
+// closeStatements closes the prepared statements, and the statements the backend prepared for them.
+func (st *extendedState) closeStatements() {
+	for _, ps := range st.statements {
+		ps.backend.close()
+	}
+	st.statements = nil
+}
+
+// closePortals closes the portals, and their results.
+func (st *extendedState) closePortals() {
+	for _, pt := range st.portals {
+		if pt.cursor != nil {
+			pt.cursor.close(nil)
+		}
+	}
+	st.portals = nil
+}
+
+// handleExtended handles a message of the extended query protocol.
+//
+// Clients may pipeline many messages before a Sync (e.g. pgx batches or libpq pipeline mode).
+// Messages are processed in order and no ReadyForQuery is sent until Sync. Once a message fails
+// the error is reported and the remaining messages are discarded until the next Sync,
+// as postgres does.
+// Only errors writing to the client are returned.
+func (p *Proxy) handleExtended(ctx context.Context, session *session, msg pgproto3.FrontendMessage) error {
+	st := &session.extended
+	switch msg.(type) {
+	case *pgproto3.Sync:
+		if st.failed && session.transaction == txOpen {
+			session.transaction = txFailed
+		}
+		st.failed = false
+		if session.transaction == txIdle {
+			st.closePortals()
+		}
+		return writeMessages(p.conn, &pgproto3.ReadyForQuery{TxStatus: session.transaction.status()})
+	case *pgproto3.Flush:
+		// responses are never buffered.
+		return nil
+	}
+	if st.failed {
+		return nil
+	}
+
+	var err error
+	switch msg := msg.(type) {
+	case *pgproto3.Parse:
+		err = p.handleParse(ctx, session, msg)
+	case *pgproto3.Bind:
+		err = p.handleBind(session, msg)
+	case *pgproto3.Describe:
+		ctx, end := session.cancel.begin(ctx, session.statementTimeout)
+		defer end()
+		ctx, span := p.tracer.Start(ctx, "describe")
+		if msg.ObjectType == 'S' {
+			err = p.handleDescribeStatement(ctx, session, msg.Name)
+		} else {
+			err = p.handleDescribePortal(ctx, session, msg.Name)
+		}
+		err = canceledError(ctx, err)
+		endSpan(span, err)
+	case *pgproto3.Execute:
+		ctx, end := session.cancel.begin(ctx, session.statementTimeout)
+		defer end()
+		return p.handleExecute(ctx, session, msg)
+	case *pgproto3.Close:
+		if msg.ObjectType == 'S' {
+			if ps, ok := st.statements[msg.Name]; ok {
+				ps.backend.close()
+				delete(st.statements, msg.Name)
+			}
+		} else if pt, ok := st.portals[msg.Name]; ok {
+			if pt.cursor != nil {
+				pt.cursor.close(nil)
+			}
+			delete(st.portals, msg.Name)
+		}
+		err = writeMessages(p.conn, &pgproto3.CloseComplete{})
+	default:
+		err = newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("unsupported message type: %T", msg))
+	}
+	if err != nil {
+		st.failed = true
+		return p.writeError("ERROR", err)
+	}
+	return nil
+}
+
+func (p *Proxy) handleParse(ctx context.Context, session *session, msg *pgproto3.Parse) error {
+	if err := checkTerminated(msg.Query); err != nil {
+		return err
+	}
+	st := &session.extended
+	if old, ok := st.statements[msg.Name]; ok {
+		if msg.Name != "" {
+			return newPGError(pgerrcode.DuplicatePreparedStatement, fmt.Errorf("prepared statement %q already exists", msg.Name))
+		}
+		old.backend.close()
+	}
+
+	// the message is reused by the next Receive, so its fields must be copied.
+	ps := &preparedStatement{source: msg.Query}
+	if stmt := parseTransactionStatement(msg.Query); stmt != nil {
+		ps.transaction = stmt
+	} else if stmt, ok := parseSettingStatement(msg.Query); ok && isProxySetting(stmt.name) {
+		ps.setting = stmt
+	} else if isInsertStatement(msg.Query) {
+		ps.query, ps.insert = msg.Query, true
+	} else {
+		q, err := expandGrafanaMacros(msg.Query, session.grafana, time.Now())
+		if err != nil {
+			return err
+		}
+		if stmt, err := parseCursorStatement(q); err != nil {
+			return err
+		} else if stmt != nil {
+			ps.cursor = stmt
+		} else if stmt, err := parseExplainStatement(q); err != nil {
+			return err
+		} else if stmt != nil {
+			if ps.query, _, err = p.rewrite(ctx, session, stmt.query); err != nil {
+				return err
+			}
+			ps.explain = stmt
+		} else {
+			_, span := p.tracer.Start(ctx, "rewrite")
+			q, hints, err := p.rewrite(ctx, session, q)
+			endSpan(span, err)
+			if err != nil {
+				return err
+			}
+			ps.query, ps.hints = q, hints
+		}
+	}
+	ps.paramOIDs = inferParameterTypes(msg.Query, msg.ParameterOIDs, p.defaultParameterOID)
+
+	if st.statements == nil {
+		st.statements = map[string]*preparedStatement{}
+	}
+	st.statements[msg.Name] = ps
+	return writeMessages(p.conn, &pgproto3.ParseComplete{})
+}
+
+func (p *Proxy) handleDescribeStatement(ctx context.Context, session *session, name string) error {
+	ps, ok := session.extended.statements[name]
+	if !ok {
+		return newPGError(pgerrcode.InvalidSQLStatementName, fmt.Errorf("prepared statement %q does not exist", name))
+	}
+	fields, err := p.statementFields(ctx, session, ps)
+	if err != nil {
+		return err
+	}
+	return writeMessages(p.conn, &pgproto3.ParameterDescription{ParameterOIDs: ps.paramOIDs}, resultDescription(session, ps, fields, nil))
+}
+
+func (p *Proxy) handleBind(session *session, msg *pgproto3.Bind) error {
+	st := &session.extended
+	ps, ok := st.statements[msg.PreparedStatement]
+	if !ok {
+		return newPGError(pgerrcode.InvalidSQLStatementName, fmt.Errorf("prepared statement %q does not exist", msg.PreparedStatement))
+	}
+	if old, ok := st.portals[msg.DestinationPortal]; ok {
+		if msg.DestinationPortal != "" {
+			return newPGError(pgerrcode.DuplicateCursor, fmt.Errorf("portal %q already exists", msg.DestinationPortal))
+		}
+		if old.cursor != nil {
+			old.cursor.close(nil)
+		}
+	}
+	literals, err := paramLiterals(msg, ps.paramOIDs)
+	if err != nil {
+		return err
+	}
+	// the message is reused by the next Receive, so its fields must be copied.
+	pt := &portal{stmt: ps, formats: append([]int16(nil), msg.ResultFormatCodes...)}
+	if ps.setting == nil && ps.transaction == nil {
+		if pt.query, err = substituteParams(ps.query, literals); err != nil {
+			return err
+		}
+		if pt.params, err = p.bindParams(msg, ps, pt.query); err != nil {
+			return err
+		}
+	}
+
+	if st.portals == nil {
+		st.portals = map[string]*portal{}
+	}
+	st.portals[msg.DestinationPortal] = pt
+	return writeMessages(p.conn, &pgproto3.BindComplete{})
+}
+
+func (p *Proxy) handleDescribePortal(ctx context.Context, session *session, name string) error {
+	pt, ok := session.extended.portals[name]
+	if !ok {
+		return newPGError(pgerrcode.InvalidCursorName, fmt.Errorf("portal %q does not exist", name))
+	}
+	fields, err := p.statementFields(ctx, session, pt.stmt)
+	if err != nil {
+		return err
+	}
+	return writeMessages(p.conn, resultDescription(session, pt.stmt, fields, pt.formats))
+}
+
+// resultDescription returns the RowDescription of the result of a statement sent in the given formats,
+// or NoData if it returns no rows.
+func resultDescription(session *session, ps *preparedStatement, fields []arrow.Field, codes []int16) pgproto3.Message {
+	switch {
+	case ps.hints.json != nil:
+		rowDesc := ps.hints.json.rowDescription()
+		rowDesc.Fields[0].Format = formatCode(codes, 0)
+		return rowDesc
+	case fields == nil:
+		return &pgproto3.NoData{}
+	case ps.cursor != nil:
+		c := session.cursors[ps.cursor.name]
+		return rowDescription(c.fields, c.colOpts, codes, c.sources)
+	}
+	return rowDescription(fields, columnRenderOptions(fields, ps.hints, session), codes, ps.sources)
+}
+
+// handleExecute runs a portal and writes its rows, which are described by Describe rather than by a
+// RowDescription. Portals executed with a row limit are suspended once it is reached, and resumed by the next
+// Execute; JSON results are returned whole.
+// Like handleExtended, only errors writing to the client are returned.
+func (p *Proxy) handleExecute(ctx context.Context, session *session, msg *pgproto3.Execute) error {
+	st := &session.extended
+	pt, ok := st.portals[msg.Portal]
+	if !ok {
+		st.failed = true
+		return p.writeError("ERROR", newPGError(pgerrcode.InvalidCursorName, fmt.Errorf("portal %q does not exist", msg.Portal)))
+	}
+	ps := pt.stmt
+	p.log.Debug("executing query", p.queryAttr(ps.source))
+
+	if ps.transaction != nil && (session.transaction != txFailed || ps.transaction.endsFailedTransaction()) {
+		msgs, err := execTransactionStatement(session, ps.transaction)
+		if err != nil {
+			st.failed = true
+			return p.writeError("ERROR", err)
+		}
+		return writeMessages(p.conn, msgs...)
+	}
+	if session.transaction == txFailed {
+		st.failed = true
+		return p.writeError("ERROR", errTransactionAborted)
+	}
+
+	if ps.setting != nil {
+		msgs, err := p.execSettingStatement(session, ps.setting)
+		if err != nil {
+			st.failed = true
+			return p.writeError("ERROR", err)
+		}
+		if _, ok := msgs[0].(*pgproto3.RowDescription); ok {
+			msgs = msgs[1:]
+		}
+		return writeMessages(p.conn, msgs...)
+	}
+	if ps.cursor != nil {
+		ctx, span := p.startQuerySpan(ctx, session, ps.source)
+		err := p.handleCursorStatement(ctx, session, ps.cursor, resultFormat{codes: pt.formats})
+		endSpan(span, err)
+		if err != nil {
+			st.failed = true
+			p.log.Info("statement failed", "err", err)
+		}
+		return nil
+	}
+	if ps.explain != nil {
+		ctx, span := p.startQuerySpan(ctx, session, ps.source)
+		err := p.handleExplain(ctx, session, ps.source, ps.explain, pt.query, resultFormat{codes: pt.formats})
+		endSpan(span, err)
+		if err != nil {
+			st.failed = true
+			p.log.Info("statement failed", "err", err)
+		}
+		return nil
+	}
+	if trimStatement(pt.query) == "" {
+		return writeMessages(p.conn, &pgproto3.EmptyQueryResponse{})
+	}
+	ctx, span := p.startQuerySpan(ctx, session, ps.source)
+	ctx = withBoundParams(ctx, pt.params)
+	if ps.insert {
+		// inserts return no rows, whatever the row limit of the Execute.
+		err := p.processInsert(ctx, session, ps.source, pt.query)
+		endSpan(span, err)
+		if err != nil {
+			st.failed = true
+			p.log.Info("statement failed", "err", err)
+		}
+		return nil
+	}
+	if (msg.MaxRows > 0 || pt.cursor != nil) && ps.hints.json == nil {
+		err := p.executePortal(ctx, session, pt, int(msg.MaxRows))
+		endSpan(span, err)
+		return err
+	}
+
+	start := time.Now()
+	rows, err := p.processQuery(ctx, ps.source, pt.query, ps.hints, session, resultFormat{codes: pt.formats})
+	endSpan(span, err)
+	p.recordQuery(session, ps.source, pt.query, start, rows, err)
+	p.logSlowQuery(session, ps.source, pt.query, start, rows, err)
+	if err != nil {
+		st.failed = true
+		p.log.Info("statement failed", "err", err)
+	}
+	return nil
+}
+
+// statementFields returns the fields of the rows returned by a statement, or nil if it returns no rows.
+//
+// The result schema of IOx queries is only known after running them, so the statement is run once with
+// placeholder arguments, returning no rows, and the result is remembered.
+func (p *Proxy) statementFields(ctx context.Context, session *session, ps *preparedStatement) ([]arrow.Field, error) {
+	if ps.described {
+		return ps.fields, nil
+	}
+
+	var fields []arrow.Field
+	switch {
+	case ps.setting != nil:
+		if ps.setting.verb == "show" {
+			fields = []arrow.Field{{Name: ps.setting.name, Type: arrow.BinaryTypes.String}}
+		}
+	case ps.cursor != nil:
+		// the cursor may be declared after the statement is prepared, and declared again.
+		if ps.cursor.verb != "fetch" {
+			return nil, nil
+		}
+		c, err := session.cursor(ps.cursor.name)
+		if err != nil {
+			return nil, err
+		}
+		return c.fields, nil
+	case ps.explain != nil:
+		fields = []arrow.Field{{Name: explainColumn, Type: arrow.BinaryTypes.String}}
+	case ps.insert, ps.transaction != nil, trimStatement(ps.query) == "":
+	default:
+		literals := make([]string, len(ps.paramOIDs))
+		for i, oid := range ps.paramOIDs {
+			literals[i] = placeholderLiteral(oid)
+		}
+		q, err := substituteParams(trimStatement(ps.query), literals)
+		if err != nil {
+			return nil, err
+		}
+		schema, err := p.describeQuery(ctx, session, q)
+		if err != nil {
+			return nil, err
+		}
+		fields = resultFields(schema.Fields(), session)
+		ps.sources = p.fieldSources(ctx, session, q, fields)
+	}
+	ps.fields, ps.described = fields, true
+	return fields, nil
+}
+
+// describeQuery returns the schema of the result of a query, running it limited to no rows.
+func (p *Proxy) describeQuery(ctx context.Context, session *session, query string) (*arrow.Schema, error) {
+	schema, err := p.querySchema(ctx, session, "SELECT * FROM ("+query+") AS pigox_describe LIMIT 0")
+	if err == nil {
+		return schema, nil
+	}
+	// not every statement can be wrapped in a subquery, e.g. SHOW TABLES. Those that aren't queries have small
+	// results and run as they are; queries fail if they can't be limited either, rather than running in full.
+	if !isSelect(query) {
+		return p.querySchema(ctx, session, query)
+	}
+	schema, lerr := p.querySchema(ctx, session, query+" LIMIT 0")
+	if lerr != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// querySchema returns the schema of the result of a query.
+func (p *Proxy) querySchema(ctx context.Context, session *session, query string) (*arrow.Schema, error) {
+	reader, err := p.runQuery(ctx, session, query)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Release()
+	return reader.Schema(), nil
+}
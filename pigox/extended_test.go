@@ -0,0 +1,102 @@
+package pigox
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+// fakeBackend answers every query with rows rows of a text column, and records the queries it runs.
+type fakeBackend struct {
+	rows int
+	// fail, if set, fails the queries it returns true for.
+	fail func(query string) bool
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (b *fakeBackend) PrepareQuery(ctx context.Context, database, query string) (preparedQuery, error) {
+	return fakeQuery{b: b, query: query}, nil
+}
+
+func (b *fakeBackend) WaitForReadable(ctx context.Context, token string) error { return nil }
+func (b *fakeBackend) GetState() connectivity.State                            { return connectivity.Ready }
+func (b *fakeBackend) Reconnect(ctx context.Context) error                     { return nil }
+func (b *fakeBackend) Close() error                                            { return nil }
+
+// ran returns the queries the backend ran.
+func (b *fakeBackend) ran() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.queries...)
+}
+
+type fakeQuery struct {
+	b     *fakeBackend
+	query string
+}
+
+func (q fakeQuery) Query(ctx context.Context) (recordReader, error) {
+	q.b.mu.Lock()
+	q.b.queries = append(q.b.queries, q.query)
+	q.b.mu.Unlock()
+	if q.b.fail != nil && q.b.fail(q.query) {
+		return nil, errors.New("syntax error")
+	}
+	values := make([]string, q.b.rows)
+	if strings.Contains(q.query, "LIMIT 0") {
+		values = nil
+	}
+	for i := range values {
+		values[i] = strconv.Itoa(i)
+	}
+	return stringRecords([]string{"n"}, values), nil
+}
+
+func TestDescribeDoesNotRunQuery(t *testing.T) {
+	const query = "SELECT * FROM cpu ORDER BY time"
+	tests := []struct {
+		name    string
+		fail    func(string) bool
+		want    []string
+		wantErr bool
+	}{
+		{"subquery", nil, []string{"SELECT * FROM (" + query + ") AS pigox_describe LIMIT 0"}, false},
+		{"limited", func(q string) bool { return strings.Contains(q, "pigox_describe") },
+			[]string{"SELECT * FROM (" + query + ") AS pigox_describe LIMIT 0", query + " LIMIT 0"}, false},
+		{"unlimited", func(q string) bool { return strings.Contains(q, "LIMIT 0") },
+			[]string{"SELECT * FROM (" + query + ") AS pigox_describe LIMIT 0", query + " LIMIT 0"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &fakeBackend{rows: 10, fail: tt.fail}
+			p := newTestProxy(t)
+			p.upstream.set(nil, b)
+			s := newTestSession(p, 1, "a")
+
+			fields, err := p.statementFields(context.Background(), s, &preparedStatement{query: query})
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("got %v, %v; want error %v", fields, err, tt.wantErr)
+			}
+			if !tt.wantErr && (len(fields) != 1 || fields[0].Name != "n") {
+				t.Errorf("got fields %v, want n", fields)
+			}
+			var ran []string
+			for _, q := range b.ran() {
+				// the catalog lookups of the result columns.
+				if !strings.Contains(q, "information_schema") {
+					ran = append(ran, q)
+				}
+			}
+			if strings.Join(ran, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("ran %q, want %q", ran, tt.want)
+			}
+		})
+	}
+}
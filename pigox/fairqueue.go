@@ -0,0 +1,168 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// fairScheduler bounds the number of queries executing at the same time across all tenants (databases).
+//
+// When the limit is reached, queries wait in per-tenant queues instead of a single FIFO queue, and released
+// slots are handed to the tenants in turns proportional to their weights (start-time fair queuing), so that
+// a burst of queries of one tenant cannot add queueing latency to the queries of the others.
+type fairScheduler struct {
+	limit int
+	// weights are the relative shares of the slots of specific tenants; the default weight is 1.
+	weights map[string]int
+
+	mu      sync.Mutex
+	running int
+	tenants map[string]*tenantQueue
+	seq     uint64
+	// vtime is the virtual time of the last slot handed out.
+	vtime float64
+}
+
+type tenantQueue struct {
+	running int
+	waiters []*fairWaiter
+	// tag is the virtual time of the tenant's next slot; each slot advances it by 1/weight.
+	tag float64
+}
+
+type fairWaiter struct {
+	// seq orders the waiters of different tenants with the same share by arrival.
+	seq   uint64
+	ready chan struct{}
+}
+
+func newFairScheduler(limit int, weights map[string]int) *fairScheduler {
+	if limit <= 0 {
+		return nil
+	}
+	return &fairScheduler{limit: limit, weights: weights, tenants: map[string]*tenantQueue{}}
+}
+
+func (f *fairScheduler) weight(tenant string) int {
+	if w, ok := f.weights[tenant]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+// acquire takes a slot for a query of tenant, waiting up to wait for its turn. It returns a function releasing the slot.
+func (f *fairScheduler) acquire(ctx context.Context, tenant string, wait time.Duration) (func(), error) {
+	if f == nil {
+		return func() {}, nil
+	}
+	release := func() { f.release(tenant) }
+
+	f.mu.Lock()
+	t, ok := f.tenants[tenant]
+	if !ok {
+		t = &tenantQueue{}
+		f.tenants[tenant] = t
+	}
+	// slots are only free when nobody is waiting: releases hand them to the waiters right away.
+	if f.running < f.limit {
+		f.grant(tenant, t)
+		f.mu.Unlock()
+		return release, nil
+	}
+	if wait <= 0 {
+		f.drop(tenant, t)
+		f.mu.Unlock()
+		return nil, f.limitError()
+	}
+	// tenants that were idle don't get to claim the turns they didn't use.
+	if len(t.waiters) == 0 && t.tag < f.vtime {
+		t.tag = f.vtime
+	}
+	f.seq++
+	w := &fairWaiter{seq: f.seq, ready: make(chan struct{})}
+	t.waiters = append(t.waiters, w)
+	f.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = f.limitError()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, tw := range t.waiters {
+		if tw == w {
+			t.waiters = append(t.waiters[:i], t.waiters[i+1:]...)
+			f.drop(tenant, t)
+			return nil, err
+		}
+	}
+	// the slot was handed over while giving up.
+	f.releaseLocked(tenant, t)
+	return nil, err
+}
+
+func (f *fairScheduler) limitError() error {
+	return newPGError(pgerrcode.ConfigurationLimitExceeded, fmt.Errorf("too many concurrent queries (limit is %d)", f.limit))
+}
+
+func (f *fairScheduler) release(tenant string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.releaseLocked(tenant, f.tenants[tenant])
+}
+
+func (f *fairScheduler) releaseLocked(tenant string, t *tenantQueue) {
+	f.running--
+	t.running--
+	f.drop(tenant, t)
+
+	for f.running < f.limit {
+		var next string
+		var nt *tenantQueue
+		for name, q := range f.tenants {
+			if len(q.waiters) == 0 {
+				continue
+			}
+			if nt == nil || q.tag < nt.tag || (q.tag == nt.tag && q.waiters[0].seq < nt.waiters[0].seq) {
+				next, nt = name, q
+			}
+		}
+		if nt == nil {
+			return
+		}
+		w := nt.waiters[0]
+		nt.waiters = nt.waiters[1:]
+		f.grant(next, nt)
+		close(w.ready)
+	}
+}
+
+// grant gives a slot to tenant.
+func (f *fairScheduler) grant(tenant string, t *tenantQueue) {
+	if t.tag < f.vtime {
+		t.tag = f.vtime
+	}
+	f.vtime = t.tag
+	t.tag += 1 / float64(f.weight(tenant))
+	t.running++
+	f.running++
+}
+
+// drop forgets tenants with no running or waiting queries.
+func (f *fairScheduler) drop(tenant string, t *tenantQueue) {
+	if t.running == 0 && len(t.waiters) == 0 {
+		delete(f.tenants, tenant)
+	}
+}
@@ -0,0 +1,307 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// aggregateFunctions are the functions that make a query without GROUP BY return a single row, which prevents
+// it from being split by time range.
+var aggregateFunctions = map[string]bool{
+	"count": true, "sum": true, "avg": true, "min": true, "max": true, "median": true,
+	"stddev": true, "stddev_pop": true, "stddev_samp": true, "variance": true, "var_pop": true, "var_samp": true,
+	"array_agg": true, "string_agg": true, "json_agg": true, "bool_and": true, "bool_or": true,
+	"approx_distinct": true, "approx_median": true, "approx_percentile_cont": true,
+	"selector_first": true, "selector_last": true,
+	"selector_min": true, "selector_max": true,
+}
+
+// timeLiteralLayouts are the layouts of the timestamp literals recognized in time range predicates.
+var timeLiteralLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// fanoutPlan splits a query with a time range predicate into queries over consecutive sub-ranges.
+//
+// Only queries whose result is the concatenation of the results of the sub-ranges are split: single table
+// SELECTs, without DISTINCT, aggregates, window functions, GROUP BY or LIMIT, whose WHERE clause is a conjunction
+// bounding a column from both sides with timestamp literals (e.g. $__timeFilter), optionally ordered by that
+// column only.
+type fanoutPlan struct {
+	// prefix is the query up to the WHERE condition, cond is the condition and suffix the ORDER BY clause.
+	prefix, cond, suffix string
+	// column is the bounded column, as written in the query.
+	column   string
+	from, to time.Time
+	desc     bool
+	// bounds are the boundaries between the sub-ranges, in ascending order.
+	bounds []time.Time
+}
+
+// planTimeFanout returns a plan splitting query in up to parts sub-ranges of at least minRange,
+// or nil if query cannot or need not be split.
+func planTimeFanout(query string, parts int, minRange time.Duration) *fanoutPlan {
+	if parts < 2 {
+		return nil
+	}
+	query = trimStatement(query)
+	toks := significant(scanSQL(query))
+	if len(toks) < 2 || !toks[0].is("select") || toks[1].is("distinct") {
+		return nil
+	}
+
+	clause := "select"
+	depth := 0
+	whereStart, orderStart := -1, -1
+	for i, t := range toks {
+		switch {
+		case t.is("("):
+			depth++
+			continue
+		case t.is(")"):
+			depth--
+			continue
+		case t.is("over"):
+			return nil
+		case clause == "select" && t.kind == tokIdent && i+1 < len(toks) && toks[i+1].is("(") && aggregateFunctions[t.identName()]:
+			return nil
+		}
+		if depth > 0 {
+			continue
+		}
+		switch {
+		case t.is("from") && clause == "select":
+			clause = "from"
+		case t.is("where") && clause == "from":
+			clause, whereStart = "where", i+1
+		case t.is("order") && clause == "where":
+			clause, orderStart = "order", i
+		case t.is(",") && clause == "from", t.is("or") && clause == "where":
+			return nil
+		}
+		for _, kw := range []string{"group", "having", "window", "limit", "offset", "fetch", "union", "intersect", "except", "join", "into"} {
+			if t.is(kw) {
+				return nil
+			}
+		}
+	}
+	if whereStart < 0 || whereStart >= len(toks) || depth != 0 {
+		return nil
+	}
+	whereEnd := len(toks)
+	if orderStart >= 0 {
+		whereEnd = orderStart
+	}
+
+	plan := findTimeRange(toks[whereStart:whereEnd], time.Time{})
+	if plan == nil {
+		return nil
+	}
+	if orderStart >= 0 {
+		order := toks[orderStart:]
+		if len(order) < 3 || len(order) > 4 || !order[1].is("by") || !sameColumn(order[2], plan.column) {
+			return nil
+		}
+		if len(order) == 4 {
+			switch {
+			case order[3].is("desc"):
+				plan.desc = true
+			case !order[3].is("asc"):
+				return nil
+			}
+		}
+	}
+
+	span := plan.to.Sub(plan.from)
+	if minRange > 0 && int64(span/minRange) < int64(parts) {
+		parts = int(span / minRange)
+	}
+	if parts < 2 {
+		return nil
+	}
+	for i := 1; i < parts; i++ {
+		plan.bounds = append(plan.bounds, plan.from.Add(time.Duration(int64(span)/int64(parts)*int64(i))))
+	}
+
+	condEnd := len(query)
+	if orderStart >= 0 {
+		condEnd = toks[orderStart].pos
+	}
+	plan.prefix = query[:toks[whereStart].pos]
+	plan.cond = strings.TrimSpace(query[toks[whereStart].pos:condEnd])
+	plan.suffix = query[condEnd:]
+	return plan
+}
+
+// findTimeRange finds the lower and upper timestamp bounds of a column in a WHERE condition. Unless now is zero,
+// bounds relative to now(), e.g. now() - INTERVAL '30 days', are resolved against it, and a range without an
+// upper bound ends at now.
+func findTimeRange(cond []token, now time.Time) *fanoutPlan {
+	type bounds struct {
+		column   string
+		from, to time.Time
+	}
+	var found []*bounds
+	get := func(column string) *bounds {
+		for _, b := range found {
+			if b.column == column {
+				return b
+			}
+		}
+		b := &bounds{column: column}
+		found = append(found, b)
+		return b
+	}
+
+	depth := 0
+	for i, t := range cond {
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		}
+		if depth > 0 || i == 0 || !(t.is(">") || t.is(">=") || t.is("<") || t.is("<=") || t.is("between")) {
+			continue
+		}
+		col := cond[i-1]
+		if col.kind != tokIdent && col.kind != tokQuotedIdent {
+			continue
+		}
+		start := i - 1
+		if start >= 2 && cond[start-1].is(".") {
+			start -= 2
+		}
+		if start > 0 && !cond[start-1].is("and") {
+			continue
+		}
+		lit, n, ok := timeBound(cond[i+1:], now)
+		if !ok {
+			continue
+		}
+		b := get(joinTokens(cond[start:i]))
+		switch {
+		case t.is("between"):
+			if i+1+n >= len(cond) || !cond[i+1+n].is("and") {
+				continue
+			}
+			hi, _, ok := timeBound(cond[i+2+n:], now)
+			if !ok {
+				continue
+			}
+			if b.from.IsZero() || lit.After(b.from) {
+				b.from = lit
+			}
+			if b.to.IsZero() || hi.Before(b.to) {
+				b.to = hi
+			}
+		case t.is(">") || t.is(">="):
+			if b.from.IsZero() || lit.After(b.from) {
+				b.from = lit
+			}
+		default:
+			if b.to.IsZero() || lit.Before(b.to) {
+				b.to = lit
+			}
+		}
+	}
+	for _, b := range found {
+		if b.to.IsZero() && !now.IsZero() {
+			b.to = now
+		}
+		if !b.from.IsZero() && !b.to.IsZero() && b.to.After(b.from) {
+			return &fanoutPlan{column: b.column, from: b.from, to: b.to}
+		}
+	}
+	return nil
+}
+
+// timeLiteral parses a `TIMESTAMP 'literal'` or `'literal'` timestamp at the start of toks. It returns the time
+// and the number of tokens it spans.
+func timeLiteral(toks []token) (time.Time, int, bool) {
+	n := 1
+	if len(toks) > 1 && toks[0].is("timestamp") {
+		toks, n = toks[1:], 2
+	}
+	if len(toks) == 0 || toks[0].kind != tokString {
+		return time.Time{}, 0, false
+	}
+	for _, layout := range timeLiteralLayouts {
+		if t, err := time.Parse(layout, toks[0].stringValue()); err == nil {
+			return t, n, true
+		}
+	}
+	return time.Time{}, 0, false
+}
+
+// timeBound parses a timestamp literal at the start of toks like timeLiteral or, unless now is zero, now()
+// optionally offset by an interval literal, resolved against now. It returns the time and the number of tokens
+// it spans.
+func timeBound(toks []token, now time.Time) (time.Time, int, bool) {
+	if t, n, ok := timeLiteral(toks); ok || now.IsZero() {
+		return t, n, ok
+	}
+	if len(toks) < 3 || !toks[0].is("now") || !toks[1].is("(") || !toks[2].is(")") {
+		return time.Time{}, 0, false
+	}
+	t, n := now, 3
+	if len(toks) >= 6 && (toks[3].is("-") || toks[3].is("+")) && toks[4].is("interval") && toks[5].kind == tokString {
+		d, ok := intervalDuration(toks[5].stringValue())
+		if !ok {
+			return time.Time{}, 0, false
+		}
+		if toks[3].is("-") {
+			d = -d
+		}
+		t, n = now.Add(d), 6
+	}
+	// the bound must not be part of a longer expression, as in now() - INTERVAL '1 day' * 30.
+	if n < len(toks) && !toks[n].is("and") && !toks[n].is(")") {
+		return time.Time{}, 0, false
+	}
+	return t, n, true
+}
+
+// sameColumn reports whether t names column, ignoring any table qualifier of column.
+func sameColumn(t token, column string) bool {
+	c := significant(scanSQL(column))
+	last := c[len(c)-1]
+	return (t.kind == tokIdent || t.kind == tokQuotedIdent) && t.identName() == last.identName()
+}
+
+// query returns the query over the i-th sub-range, in result order.
+func (f *fanoutPlan) query(i int) string {
+	if f.desc {
+		i = len(f.bounds) - i
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s(%s)", f.prefix, f.cond)
+	if i > 0 {
+		fmt.Fprintf(&b, " AND %s >= %s", f.column, timestampLiteral(f.bounds[i-1]))
+	}
+	if i < len(f.bounds) {
+		fmt.Fprintf(&b, " AND %s < %s", f.column, timestampLiteral(f.bounds[i]))
+	}
+	if f.suffix != "" {
+		b.WriteString(" " + f.suffix)
+	}
+	return b.String()
+}
+
+// runFanout runs the sub-range queries of a plan concurrently on IOx and streams their results in order.
+func (p *Proxy) runFanout(ctx context.Context, session *session, query string, plan *fanoutPlan) (recordReader, error) {
+	ctx = withQueryMetadata(ctx, session, query)
+	if err := p.ensureConnected(ctx); err != nil {
+		return nil, err
+	}
+	p.log.Debug("splitting query in time ranges", "span", plan.to.Sub(plan.from), "ranges", len(plan.bounds)+1)
+	return concatReaders(ctx, len(plan.bounds)+1, func(ctx context.Context, i int) (recordReader, error) {
+		return p.query(ctx, session, plan.query(i))
+	})
+}
@@ -0,0 +1,167 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// defaultCatalog is the catalog IOx names its tables in, e.g. public.iox.cpu; it always refers to the database the
+// query runs on.
+const defaultCatalog = "public"
+
+// federatedPart is the part of a federated query that runs on a database.
+type federatedPart struct {
+	database, query string
+}
+
+// planFederation splits a query referring to tables of other databases with database.schema.table names, e.g.
+//
+//	SELECT * FROM eu.iox.cpu UNION ALL SELECT * FROM us.iox.cpu
+//
+// into queries run on each database, whose results are concatenated. Only UNION ALLs of SELECTs which each read from
+// a single database are supported. It returns nil if query only refers to tables of the session's database.
+func planFederation(query, database string) ([]federatedPart, error) {
+	if !isSelect(query) || !strings.Contains(query, ".") {
+		return nil, nil
+	}
+	query = trimStatement(query)
+	toks := significant(scanSQL(query))
+
+	// branches are the token ranges of the SELECTs joined by UNION ALL, or by the other set operation setOp.
+	var branches [][2]int
+	var setOp string
+	start, depth := 0, 0
+	for i, t := range toks {
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		case depth > 0:
+		case t.is("union") && i+1 < len(toks) && toks[i+1].is("all"):
+			branches = append(branches, [2]int{start, i})
+			start = i + 2
+		case t.is("union"), t.is("intersect"), t.is("except"):
+			branches = append(branches, [2]int{start, i})
+			start, setOp = i+1, t.text
+			if start < len(toks) && toks[start].is("distinct") {
+				start++
+			}
+		}
+	}
+	branches = append(branches, [2]int{start, len(toks)})
+
+	federated := false
+	var parts []federatedPart
+	for _, br := range branches {
+		db, q, err := federatedBranch(query, toks, br[0], br[1], database)
+		if err != nil {
+			return nil, err
+		}
+		if db != database {
+			federated = true
+		}
+		if n := len(parts); n > 0 && parts[n-1].database == db {
+			parts[n-1].query += " UNION ALL " + q
+			continue
+		}
+		parts = append(parts, federatedPart{database: db, query: q})
+	}
+	switch {
+	case !federated:
+		return nil, nil
+	case setOp != "":
+		return nil, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("%s of tables of different databases is not supported", strings.ToUpper(setOp))).
+			withHint("Use UNION ALL.")
+	case len(parts) > 1 && hasTrailingClause(toks[branches[len(branches)-1][0]:]):
+		return nil, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("ORDER BY and LIMIT are not supported over the union of tables of different databases"))
+	}
+	return parts, nil
+}
+
+// federatedBranch returns the database a SELECT toks[from:to] reads from and the SELECT with its table names
+// stripped of the database.
+func federatedBranch(query string, toks []token, from, to int, session string) (string, string, error) {
+	var b strings.Builder
+	last := toks[from].pos
+	db := ""
+	// subquery tells, for each open parenthesis, whether it encloses a query rather than e.g. function arguments
+	// like extract(hour FROM time).
+	var subquery []bool
+	for i := from; i < to; i++ {
+		switch t := toks[i]; {
+		case t.is("("):
+			subquery = append(subquery, i+1 < to && (toks[i+1].is("select") || toks[i+1].is("with")))
+			continue
+		case t.is(")"):
+			if len(subquery) > 0 {
+				subquery = subquery[:len(subquery)-1]
+			}
+			continue
+		case !(t.is("from") || t.is("join")):
+			continue
+		case len(subquery) > 0 && !subquery[len(subquery)-1]:
+			continue
+		}
+		ref, name := session, toks[i+1:to]
+		if len(name) >= 5 && isName(name[0]) && name[1].is(".") && isName(name[2]) && name[3].is(".") && isName(name[4]) {
+			if c := name[0].identName(); c != defaultCatalog {
+				ref = c
+			}
+			b.WriteString(query[last:name[0].pos])
+			last = name[2].pos
+		} else if len(name) == 0 || name[0].is("(") {
+			continue
+		}
+		switch {
+		case db == "":
+			db = ref
+		case db != ref:
+			return "", "", newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("joining tables of different databases is not supported"))
+		}
+	}
+	end := len(query)
+	if to < len(toks) {
+		end = toks[to].pos
+	}
+	b.WriteString(query[last:end])
+	if db == "" {
+		db = session
+	}
+	return db, strings.TrimSpace(b.String()), nil
+}
+
+func isName(t token) bool {
+	return t.kind == tokIdent || t.kind == tokQuotedIdent
+}
+
+// hasTrailingClause reports whether a SELECT has a top level ORDER BY, LIMIT, OFFSET or FETCH clause.
+func hasTrailingClause(toks []token) bool {
+	depth := 0
+	for _, t := range toks {
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		case depth > 0:
+		case t.is("order"), t.is("limit"), t.is("offset"), t.is("fetch"):
+			return true
+		}
+	}
+	return false
+}
+
+// runFederated runs the parts of a federated query concurrently on their databases and streams their results in
+// order.
+func (p *Proxy) runFederated(ctx context.Context, session *session, parts []federatedPart) (recordReader, error) {
+	p.log.Debug("federating query", "databases", len(parts))
+	return concatReaders(ctx, len(parts), func(ctx context.Context, i int) (recordReader, error) {
+		s := *session
+		s.databaseName = parts[i].database
+		return p.runQueryUpstream(ctx, &s, parts[i].query)
+	})
+}
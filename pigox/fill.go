@@ -0,0 +1,165 @@
+package pigox
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// rewriteFill rewrites the InfluxQL style `FILL(mode)` clause of a query grouping rows by date_bin time buckets to
+// IOx's gap filling functions, so that buckets without rows are returned too:
+//
+//	FILL(null)      date_bin_gapfill(...), the aggregates of empty buckets are NULL
+//	FILL(previous)  date_bin_gapfill(...) and locf(aggregate), carrying the previous value forward
+//	FILL(linear)    date_bin_gapfill(...) and interpolate(aggregate)
+//	FILL(0)         date_bin_gapfill(...) and coalesce(aggregate, 0); any number can be given
+//	FILL(none)      date_bin(...), empty buckets are not returned
+//
+// The clause may appear anywhere after GROUP BY. Gap filling requires the query to bound the time range
+// in its WHERE clause.
+func rewriteFill(query string) (string, error) {
+	toks := scanSQL(query)
+	start, end, mode, err := findFillClause(toks)
+	if err != nil || start < 0 {
+		return query, err
+	}
+	if start > 0 && toks[start-1].isBlank() {
+		start--
+	}
+	toks = append(toks[:start:start], toks[end:]...)
+	if mode == "none" {
+		return joinTokens(toks), nil
+	}
+
+	// replacements of token texts, by token index.
+	replace := map[int]string{}
+	for i, t := range toks {
+		if t.kind == tokIdent && t.identName() == "date_bin" && isCall(toks, i) {
+			replace[i] = "date_bin_gapfill"
+		}
+	}
+	if len(replace) == 0 {
+		return "", newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("FILL requires the rows to be grouped by date_bin() time buckets"))
+	}
+
+	var wrap string
+	switch mode {
+	case "null":
+	case "previous":
+		wrap = "locf(%s)"
+	case "linear":
+		wrap = "interpolate(%s)"
+	default:
+		wrap = "coalesce(%s, " + mode + ")"
+	}
+	if wrap != "" {
+		for _, item := range selectListItems(toks) {
+			first, last, ok := aggregateCall(toks, item[0], item[1])
+			if !ok {
+				continue
+			}
+			call := fmt.Sprintf(wrap, joinTokens(toks[first:last+1]))
+			replace[first] = call
+			for i := first + 1; i <= last; i++ {
+				replace[i] = ""
+			}
+		}
+	}
+
+	var b strings.Builder
+	for i, t := range toks {
+		if r, ok := replace[i]; ok {
+			b.WriteString(r)
+		} else {
+			b.WriteString(t.text)
+		}
+	}
+	return b.String(), nil
+}
+
+// findFillClause returns the token range of the top level FILL clause of a query and its lower case mode.
+// start is -1 if there is none.
+func findFillClause(toks []token) (start, end int, mode string, err error) {
+	depth := 0
+	grouped := false
+	for i, t := range toks {
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		case depth > 0:
+		case t.is("group"):
+			grouped = true
+		case t.is("fill") && isCall(toks, i):
+			var args []token
+			for j := i + 1; j < len(toks); j++ {
+				if toks[j].isBlank() || toks[j].is("(") {
+					continue
+				}
+				if toks[j].is(")") {
+					end = j + 1
+					break
+				}
+				args = append(args, toks[j])
+			}
+			if !grouped {
+				return 0, 0, "", newPGError(pgerrcode.SyntaxError, fmt.Errorf("FILL requires GROUP BY"))
+			}
+			if mode, ok := fillMode(args); ok && end > 0 {
+				return i, end, mode, nil
+			}
+			return 0, 0, "", newPGError(pgerrcode.InvalidParameterValue, fmt.Errorf("invalid FILL mode: expected null, previous, linear, none or a number"))
+		}
+	}
+	return -1, 0, "", nil
+}
+
+func fillMode(args []token) (string, bool) {
+	switch {
+	case len(args) == 1 && args[0].kind == tokIdent:
+		switch mode := args[0].identName(); mode {
+		case "null", "previous", "linear", "none":
+			return mode, true
+		}
+	case len(args) == 1 && args[0].kind == tokNumber:
+		return args[0].text, true
+	case len(args) == 2 && args[0].is("-") && args[1].kind == tokNumber:
+		return "-" + args[1].text, true
+	}
+	return "", false
+}
+
+// aggregateCall returns the token range of the aggregate function call a select list item toks[from:to] starts with.
+func aggregateCall(toks []token, from, to int) (first, last int, ok bool) {
+	first = from
+	for first < to && toks[first].isBlank() {
+		first++
+	}
+	if first == to || toks[first].kind != tokIdent || !aggregateFunctions[toks[first].identName()] {
+		return 0, 0, false
+	}
+	depth := 0
+	for i := first + 1; i < to; i++ {
+		switch {
+		case toks[i].isBlank():
+		case toks[i].is("("):
+			depth++
+		case toks[i].is(")"):
+			depth--
+			if depth == 0 {
+				return first, i, true
+			}
+		case depth == 0:
+			return 0, 0, false
+		}
+	}
+	return 0, 0, false
+}
+
+// isCall reports whether toks[i] is followed by an opening parenthesis.
+func isCall(toks []token, i int) bool {
+	n := nextSignificant(toks, i)
+	return n >= 0 && toks[n].is("(")
+}
@@ -0,0 +1,212 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/apache/arrow/go/v7/arrow/flight"
+	"github.com/apache/arrow/go/v7/arrow/memory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	flightSQLTypeURLPrefix = "type.googleapis.com/arrow.flight.protocol.sql."
+	// flightSQLDatabaseHeader selects the database Flight SQL requests apply to.
+	flightSQLDatabaseHeader = "database"
+)
+
+// flightSQLCatalog answers the catalog probes of clients, e.g. psql's \d and \dn, with the Flight SQL metadata RPCs
+// (GetTables, GetDbSchemas) of the backend instead of SQL queries on its information_schema.
+// Once the backend reports that it doesn't implement them, the probes are run as SQL queries again.
+type flightSQLCatalog struct {
+	address string
+	// opts holds the dialer used to connect to the backend and to the locations of the results, and the logger.
+	opts proxyOptions
+
+	once   sync.Once
+	conn   *grpc.ClientConn
+	client flight.FlightServiceClient
+	err    error
+
+	// unsupported is set to 1 once the backend answered Unimplemented.
+	unsupported uint32
+}
+
+func newFlightSQLCatalog(address string, dialer Dialer, logger *slog.Logger) *flightSQLCatalog {
+	return &flightSQLCatalog{address: address, opts: proxyOptions{upstreamDialer: dialer, logger: logger}}
+}
+
+func (c *flightSQLCatalog) close() {
+	if c == nil {
+		return
+	}
+	c.once.Do(func() {})
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// answer answers query if it is a catalog probe the metadata RPCs can answer. It returns false if query must be
+// run on the backend instead. The metadata RPCs bypass the query path, so probes are authorized with authorize
+// first, as if they were run as SQL queries.
+func (c *flightSQLCatalog) answer(ctx context.Context, session *session, query string, authorize func(context.Context, *session, string) error) (recordReader, bool, error) {
+	if c == nil || atomic.LoadUint32(&c.unsupported) != 0 {
+		return nil, false, nil
+	}
+	probe := trimStatement(query)
+	if probe != tablesProbe && probe != userTablesProbe && probe != schemasProbe {
+		return nil, false, nil
+	}
+	if err := authorize(ctx, session, query); err != nil {
+		return nil, true, err
+	}
+	var r recordReader
+	var err error
+	switch probe {
+	case tablesProbe:
+		r, err = c.tables(ctx, session, false)
+	case userTablesProbe:
+		r, err = c.tables(ctx, session, true)
+	default:
+		r, err = c.schemas(ctx, session)
+	}
+	if grpcCode(err) == codes.Unimplemented {
+		c.opts.baseLogger().Warn("backend doesn't implement the Flight SQL metadata RPCs, using SQL catalog queries", "err", err)
+		atomic.StoreUint32(&c.unsupported, 1)
+		return nil, false, nil
+	}
+	return r, true, err
+}
+
+// tables lists the tables like tablesProbe, or userTablesProbe if user is set.
+func (c *flightSQLCatalog) tables(ctx context.Context, session *session, user bool) (recordReader, error) {
+	var schemas, names, types []string
+	err := c.command(ctx, session, "CommandGetTables", func(rec arrow.Record) error {
+		var cols [3]*array.String
+		for i, name := range []string{"db_schema_name", "table_name", "table_type"} {
+			var err error
+			if cols[i], err = stringColumn(rec, name); err != nil {
+				return err
+			}
+		}
+		schema, name, typ := cols[0], cols[1], cols[2]
+		for i := 0; i < int(rec.NumRows()); i++ {
+			s := stringValue(schema, i)
+			if user && (s == "system" || s == "information_schema") {
+				continue
+			}
+			schemas, names, types = append(schemas, s), append(names, stringValue(name, i)), append(types, stringValue(typ, i))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stringRecords([]string{"Schema", "Name", "Type", "Owner"}, schemas, names, types, make([]string, len(names))), nil
+}
+
+// schemas lists the schemas like schemasProbe.
+func (c *flightSQLCatalog) schemas(ctx context.Context, session *session) (recordReader, error) {
+	var names []string
+	err := c.command(ctx, session, "CommandGetDbSchemas", func(rec arrow.Record) error {
+		name, err := stringColumn(rec, "db_schema_name")
+		if err != nil {
+			return err
+		}
+		for i := 0; i < int(rec.NumRows()); i++ {
+			if s := stringValue(name, i); s != "information_schema" {
+				names = append(names, s)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stringRecords([]string{"Name", "Owner"}, names, make([]string, len(names))), nil
+}
+
+// command runs a Flight SQL metadata command without parameters and calls fn with each batch of its result.
+func (c *flightSQLCatalog) command(ctx context.Context, session *session, command string, fn func(arrow.Record) error) error {
+	c.once.Do(func() {
+		if c.conn, c.err = c.opts.dialLocation(context.Background(), "grpc+tcp://"+c.address); c.err == nil {
+			c.client = flight.NewFlightServiceClient(c.conn)
+		}
+	})
+	if c.err != nil {
+		return c.err
+	}
+
+	ctx = metadata.AppendToOutgoingContext(withQueryMetadata(ctx, session, command), flightSQLDatabaseHeader, session.databaseName)
+	// the command is a google.protobuf.Any holding an empty command message.
+	cmd := protowire.AppendTag(nil, 1, protowire.BytesType)
+	cmd = protowire.AppendString(cmd, flightSQLTypeURLPrefix+command)
+	info, err := c.client.GetFlightInfo(ctx, &flight.FlightDescriptor{Type: flight.FlightDescriptor_CMD, Cmd: cmd})
+	if err != nil {
+		return err
+	}
+	reader, err := c.opts.readEndpoints(ctx, c.client, info)
+	if err != nil {
+		return err
+	}
+	defer reader.Release()
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// stringColumn returns the string column of rec with the given name.
+func stringColumn(rec arrow.Record, name string) (*array.String, error) {
+	idx := rec.Schema().FieldIndices(name)
+	if len(idx) != 1 {
+		return nil, fmt.Errorf("flight SQL result has no %q column", name)
+	}
+	col, ok := rec.Column(idx[0]).(*array.String)
+	if !ok {
+		return nil, fmt.Errorf("flight SQL result column %q is a %s, not a string", name, rec.Column(idx[0]).DataType())
+	}
+	return col, nil
+}
+
+func stringValue(col *array.String, i int) string {
+	if col.IsNull(i) {
+		return ""
+	}
+	return col.Value(i)
+}
+
+// stringRecords returns a reader over a single batch with the given string columns.
+func stringRecords(names []string, columns ...[]string) recordReader {
+	fields := make([]arrow.Field, len(names))
+	arrays := make([]arrow.Array, len(names))
+	for i, name := range names {
+		fields[i] = arrow.Field{Name: name, Type: arrow.BinaryTypes.String}
+		b := array.NewStringBuilder(memory.DefaultAllocator)
+		b.AppendValues(columns[i], nil)
+		arrays[i] = b.NewArray()
+		b.Release()
+	}
+	schema := arrow.NewSchema(fields, nil)
+	rec := array.NewRecord(schema, arrays, int64(len(columns[0])))
+	for _, a := range arrays {
+		a.Release()
+	}
+	return &recordsReader{schema: schema, records: []arrow.Record{rec}}
+}
@@ -0,0 +1,240 @@
+package pigox
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// grafanaParams are the dashboard parameters Grafana macros expand to.
+type grafanaParams struct {
+	enabled bool
+	// from and to are the time range; they may be relative to the time the query runs (e.g. "now-6h").
+	from, to string
+	interval time.Duration
+}
+
+// grafanaCommentPrefix introduces a comment that overrides the session's Grafana parameters for a single query,
+// e.g. `/* grafana: from=2022-01-01T00:00:00Z to=now interval=5m */`.
+const grafanaCommentPrefix = "grafana:"
+
+// expandGrafanaMacros expands the macros of the Grafana postgres data source, so that dashboard
+// queries can be sent unmodified:
+//
+//	$__time(col)                  col AS "time"
+//	$__timeFilter(col)            col BETWEEN TIMESTAMP 'from' AND TIMESTAMP 'to'
+//	$__timeFrom(), $__timeTo()    TIMESTAMP 'from', TIMESTAMP 'to'
+//	$__timeGroup(col, interval)   date_bin(INTERVAL 'interval', col, TIMESTAMP '1970-01-01T00:00:00Z')
+//	$__timeGroupAlias(col, ival)  $__timeGroup(col, ival) AS "time"
+//	$__timeGroup(col, ival, fill) $__timeGroup(col, ival) and a FILL(fill) clause; see rewriteFill
+//	$__interval, $__interval_ms   the interval, e.g. 1m and 60000
+//
+// The time range and interval come from the piggo.grafana_* session settings, or from a
+// "grafana:" comment in the query.
+func expandGrafanaMacros(query string, params grafanaParams, now time.Time) (string, error) {
+	if !params.enabled || !strings.Contains(query, "$__") {
+		return query, nil
+	}
+	toks := scanSQL(query)
+	for _, t := range toks {
+		if t.kind != tokComment {
+			continue
+		}
+		body := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(t.text, "--"), "/*"), "*/"))
+		if strings.HasPrefix(body, grafanaCommentPrefix) {
+			if err := params.parseComment(strings.TrimPrefix(body, grafanaCommentPrefix)); err != nil {
+				return "", err
+			}
+		}
+	}
+	from, err := resolveGrafanaTime(params.from, now)
+	if err != nil {
+		return "", err
+	}
+	to, err := resolveGrafanaTime(params.to, now)
+	if err != nil {
+		return "", err
+	}
+
+	// like in grafana, the interval variables are replaced textually, also inside strings.
+	query = strings.NewReplacer(
+		"$__interval_ms", strconv.FormatInt(params.interval.Milliseconds(), 10),
+		"$__interval", formatGrafanaDuration(params.interval),
+	).Replace(query)
+
+	toks = scanSQL(query)
+	var b strings.Builder
+	// fill is the fill value of a $__timeGroup macro, if any.
+	var fill string
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		if !(t.is("$") && i+1 < len(toks) && toks[i+1].kind == tokIdent && strings.HasPrefix(toks[i+1].text, "__")) {
+			b.WriteString(t.text)
+			continue
+		}
+		name := toks[i+1].text
+		args, n, ok := macroArgs(toks[i+2:])
+		if !ok {
+			return "", newPGError(pgerrcode.SyntaxError, fmt.Errorf("missing arguments for macro $%s", name))
+		}
+		i += 1 + n
+
+		var expanded string
+		switch name {
+		case "__time":
+			if len(args) != 1 {
+				return "", macroArgError(name, 1)
+			}
+			expanded = args[0] + ` AS "time"`
+		case "__timeFilter":
+			if len(args) != 1 {
+				return "", macroArgError(name, 1)
+			}
+			expanded = fmt.Sprintf("%s BETWEEN %s AND %s", args[0], timestampLiteral(from), timestampLiteral(to))
+		case "__timeFrom", "__timeTo":
+			if len(args) != 0 {
+				return "", macroArgError(name, 0)
+			}
+			expanded = timestampLiteral(from)
+			if name == "__timeTo" {
+				expanded = timestampLiteral(to)
+			}
+		case "__timeGroup", "__timeGroupAlias":
+			if len(args) != 2 && len(args) != 3 {
+				return "", newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("macro $%s takes a column, an interval and optionally a fill value", name))
+			}
+			if len(args) == 3 {
+				fill = args[2]
+			}
+			d, err := parseGrafanaDuration(strings.Trim(args[1], "'"))
+			if err != nil || d <= 0 {
+				return "", newPGError(pgerrcode.InvalidParameterValue, fmt.Errorf("invalid interval %s for macro $%s", args[1], name))
+			}
+			expanded = fmt.Sprintf("date_bin(INTERVAL '%d milliseconds', %s, TIMESTAMP '1970-01-01T00:00:00Z')", d.Milliseconds(), args[0])
+			if name == "__timeGroupAlias" {
+				expanded += ` AS "time"`
+			}
+		default:
+			return "", newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("unsupported macro $%s", name))
+		}
+		b.WriteString(expanded)
+	}
+	if fill != "" {
+		return trimStatement(b.String()) + " FILL(" + fill + ")", nil
+	}
+	return b.String(), nil
+}
+
+// macroArgs parses the parenthesized, comma separated arguments at the start of toks.
+// It returns the arguments and the number of tokens consumed.
+func macroArgs(toks []token) ([]string, int, bool) {
+	if len(toks) == 0 || !toks[0].is("(") {
+		return nil, 0, false
+	}
+	var args []string
+	depth, start := 0, 1
+	for i, t := range toks {
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+			if depth == 0 {
+				if arg := strings.TrimSpace(joinTokens(toks[start:i])); arg != "" || len(args) > 0 {
+					args = append(args, arg)
+				}
+				return args, i + 1, true
+			}
+		case t.is(",") && depth == 1:
+			args = append(args, strings.TrimSpace(joinTokens(toks[start:i])))
+			start = i + 1
+		}
+	}
+	return nil, 0, false
+}
+
+func macroArgError(name string, n int) error {
+	return newPGError(pgerrcode.SyntaxError, fmt.Errorf("macro $%s takes %d argument(s)", name, n))
+}
+
+func timestampLiteral(t time.Time) string {
+	return "TIMESTAMP '" + t.UTC().Format(time.RFC3339Nano) + "'"
+}
+
+// parseComment applies the key=value pairs of a "grafana:" comment.
+func (g *grafanaParams) parseComment(s string) error {
+	for _, kv := range strings.Fields(s) {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return newPGError(pgerrcode.SyntaxError, fmt.Errorf("invalid grafana parameter %q (expected key=value)", kv))
+		}
+		var err error
+		switch k {
+		case "from":
+			g.from = v
+		case "to":
+			g.to = v
+		case "interval":
+			g.interval, err = parseGrafanaDuration(v)
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			return newPGError(pgerrcode.InvalidParameterValue, fmt.Errorf("invalid grafana parameter %q: %v", kv, err))
+		}
+	}
+	return nil
+}
+
+// resolveGrafanaTime parses an RFC 3339 timestamp, milliseconds since the epoch (as in Grafana's ${__from})
+// or a time relative to now, like "now" or "now-6h".
+func resolveGrafanaTime(s string, now time.Time) (time.Time, error) {
+	if rel := strings.TrimPrefix(s, "now"); rel != s {
+		if rel == "" {
+			return now, nil
+		}
+		d, err := parseGrafanaDuration(strings.TrimPrefix(rel, "+"))
+		if err != nil {
+			return time.Time{}, newPGError(pgerrcode.InvalidParameterValue, fmt.Errorf("invalid time %q", s))
+		}
+		return now.Add(d), nil
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, newPGError(pgerrcode.InvalidParameterValue, fmt.Errorf("invalid time %q (expected RFC 3339, epoch milliseconds or now-<interval>)", s))
+	}
+	return t, nil
+}
+
+// parseGrafanaDuration parses a Go duration, additionally accepting the d (day) and w (week) units grafana uses.
+func parseGrafanaDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			f, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(f * float64(unit)), nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// formatGrafanaDuration formats a duration the way grafana renders $__interval, e.g. 30s, 5m or 1h.
+func formatGrafanaDuration(d time.Duration) string {
+	for _, u := range []struct {
+		suffix string
+		unit   time.Duration
+	}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}} {
+		if d >= u.unit && d%u.unit == 0 {
+			return strconv.FormatInt(int64(d/u.unit), 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+}
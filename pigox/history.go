@@ -0,0 +1,221 @@
+package pigox
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+)
+
+// queryHistory is a bounded, in-memory log of the most recent queries, exposed as the piggo.queries table.
+type queryHistory struct {
+	mu      sync.Mutex
+	records []queryRecord
+	// next is the index of the slot the next record is stored in, once records is full.
+	next int
+}
+
+type queryRecord struct {
+	pid             int32
+	userName        string
+	databaseName    string
+	applicationName string
+	labels          map[string]string
+	query           string
+	start           time.Time
+	duration        time.Duration
+	rows            int
+	err             error
+}
+
+func newQueryHistory(size int) *queryHistory {
+	return &queryHistory{records: make([]queryRecord, 0, size)}
+}
+
+func (h *queryHistory) add(r queryRecord) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.records) < cap(h.records) {
+		h.records = append(h.records, r)
+		return
+	}
+	h.records[h.next] = r
+	h.next = (h.next + 1) % len(h.records)
+}
+
+// list returns the records matching keep, most recent first.
+func (h *queryHistory) list(keep func(*queryRecord) bool) []queryRecord {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var res []queryRecord
+	for i := len(h.records) - 1; i >= 0; i-- {
+		r := &h.records[(h.next+i)%len(h.records)]
+		if keep(r) {
+			res = append(res, *r)
+		}
+	}
+	return res
+}
+
+// recordQuery adds a query executed by a session to the query history, counts it in the metrics and audits it;
+// source is the query as sent by the client and query the query sent to IOx.
+func (p *Proxy) recordQuery(s *session, source, query string, start time.Time, rows int, err error) {
+	code := ""
+	if err != nil {
+		code = errorCode(err)
+	}
+	p.metrics.QueryExecuted(time.Since(start), code)
+	p.queryHistory.add(queryRecord{
+		pid:             s.pid,
+		userName:        s.userName,
+		databaseName:    s.databaseName,
+		applicationName: s.applicationName,
+		labels:          s.labels,
+		query:           source,
+		start:           start,
+		duration:        time.Since(start),
+		rows:            rows,
+		err:             err,
+	})
+	p.auditQuery(s, source, query, start, rows, err)
+}
+
+type historyColumn struct {
+	name   string
+	oid    uint32
+	render func(r *queryRecord) []byte
+}
+
+var historyColumns = []historyColumn{
+	{"pid", pgtype.Int4OID, func(r *queryRecord) []byte { return []byte(strconv.Itoa(int(r.pid))) }},
+	{"user_name", pgtype.TextOID, func(r *queryRecord) []byte { return []byte(r.userName) }},
+	{"database_name", pgtype.TextOID, func(r *queryRecord) []byte { return []byte(r.databaseName) }},
+	{"application_name", pgtype.TextOID, func(r *queryRecord) []byte { return []byte(r.applicationName) }},
+	{"labels", pgtype.TextOID, func(r *queryRecord) []byte { return []byte(formatLabels(r.labels)) }},
+	{"query_start", pgtype.TimestamptzOID, func(r *queryRecord) []byte { return []byte(r.start.UTC().Format(pgTimestampMicrosFormat + "-07")) }},
+	{"duration_ms", pgtype.Float8OID, func(r *queryRecord) []byte {
+		return []byte(strconv.FormatFloat(float64(r.duration)/float64(time.Millisecond), 'f', 3, 64))
+	}},
+	{"rows", pgtype.Int8OID, func(r *queryRecord) []byte { return []byte(strconv.Itoa(r.rows)) }},
+	{"error", pgtype.TextOID, func(r *queryRecord) []byte {
+		if r.err == nil {
+			return nil
+		}
+		return []byte(r.err.Error())
+	}},
+	{"query", pgtype.TextOID, func(r *queryRecord) []byte { return []byte(r.query) }},
+}
+
+// historyQuery is a parsed `SELECT columns FROM piggo.queries [LIMIT n]` query.
+type historyQuery struct {
+	columns []historyColumn
+	// limit is the maximum number of rows to return; -1 for no limit.
+	limit int
+}
+
+// parseHistoryQuery parses a query on the piggo.queries table. It returns nil if the query doesn't read the table.
+func parseHistoryQuery(query string) (*historyQuery, error) {
+	toks := significant(scanSQL(query))
+	if n := len(toks); n > 0 && toks[n-1].is(";") {
+		toks = toks[:n-1]
+	}
+	from := -1
+	for i := 0; i+3 < len(toks); i++ {
+		if toks[i].is("from") && toks[i+1].is("piggo") && toks[i+2].is(".") && toks[i+3].is("queries") {
+			from = i
+			break
+		}
+	}
+	if from < 0 {
+		return nil, nil
+	}
+	unsupported := newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("only SELECT columns FROM piggo.queries [LIMIT n] is supported"))
+	if len(toks) < 2 || !toks[0].is("select") {
+		return nil, unsupported
+	}
+
+	hq := &historyQuery{limit: -1}
+	for _, item := range splitOnCommas(toks[1:from]) {
+		switch {
+		case len(item) == 1 && item[0].is("*"):
+			hq.columns = append(hq.columns, historyColumns...)
+		case len(item) == 1 && (item[0].kind == tokIdent || item[0].kind == tokQuotedIdent):
+			name := item[0].identName()
+			found := false
+			for _, c := range historyColumns {
+				if c.name == name {
+					hq.columns, found = append(hq.columns, c), true
+				}
+			}
+			if !found {
+				return nil, newPGError(pgerrcode.UndefinedColumn, fmt.Errorf("column %q does not exist", name))
+			}
+		default:
+			return nil, unsupported
+		}
+	}
+
+	rest := toks[from+4:]
+	switch {
+	case len(rest) == 0:
+	case len(rest) == 2 && rest[0].is("limit") && rest[1].kind == tokNumber:
+		n, err := strconv.Atoi(rest[1].text)
+		if err != nil {
+			return nil, newPGError(pgerrcode.InvalidParameterValue, fmt.Errorf("invalid LIMIT %s", rest[1].text))
+		}
+		hq.limit = n
+	case len(rest) == 2 && rest[0].is("limit") && rest[1].is("all"):
+	default:
+		return nil, unsupported
+	}
+	return hq, nil
+}
+
+// handleHistoryQuery returns the query history of the session, or of all sessions for admin users.
+func (p *Proxy) handleHistoryQuery(w io.Writer, s *session, hq *historyQuery) error {
+	admin := p.isAdmin(s.userName)
+	records := p.queryHistory.list(func(r *queryRecord) bool { return admin || r.pid == s.pid })
+	if hq.limit >= 0 && len(records) > hq.limit {
+		records = records[:hq.limit]
+	}
+
+	var rowDesc pgproto3.RowDescription
+	for _, c := range hq.columns {
+		rowDesc.Fields = append(rowDesc.Fields, pgproto3.FieldDescription{
+			Name:         []byte(c.name),
+			DataTypeOID:  c.oid,
+			DataTypeSize: -1,
+			TypeModifier: -1,
+		})
+	}
+	msgs := []pgproto3.Message{&rowDesc}
+	for i := range records {
+		values := make([][]byte, len(hq.columns))
+		for j, c := range hq.columns {
+			values[j] = c.render(&records[i])
+		}
+		msgs = append(msgs, &pgproto3.DataRow{Values: values})
+	}
+	msgs = append(msgs, &pgproto3.CommandComplete{CommandTag: []byte(fmt.Sprintf("SELECT %d", len(records)))})
+	return writeMessages(w, msgs...)
+}
+
+func (p *Proxy) isAdmin(user string) bool {
+	for _, u := range p.adminUsers {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,239 @@
+package pigox
+
+import (
+	"strings"
+
+	"github.com/jackc/pgtype"
+)
+
+// informationSchemaRelations are the information_schema views answered by the proxy, by name. IOx has its own,
+// but describes columns by their Arrow type, e.g. "Dictionary(Int32, Utf8)", and lacks most of the columns of the
+// postgres views clients introspect.
+var informationSchemaRelations = map[string]pgCatalogRelation{
+	"tables": {
+		columns: "table_catalog VARCHAR, table_schema VARCHAR, table_name VARCHAR, table_type VARCHAR, " +
+			"self_referencing_column_name VARCHAR, reference_generation VARCHAR, user_defined_type_catalog VARCHAR, " +
+			"user_defined_type_schema VARCHAR, user_defined_type_name VARCHAR, is_insertable_into VARCHAR, " +
+			"is_typed VARCHAR, commit_action VARCHAR",
+		rows: func(c *catalogSnapshot) [][]interface{} {
+			var rows [][]interface{}
+			for _, t := range c.tables {
+				typ := "BASE TABLE"
+				if t.kind == "v" {
+					typ = "VIEW"
+				}
+				rows = append(rows, []interface{}{c.database, t.schema, t.name, typ,
+					nil, nil, nil,
+					nil, nil, "NO",
+					"NO", nil})
+			}
+			return rows
+		},
+	},
+	"columns": {
+		columns: "table_catalog VARCHAR, table_schema VARCHAR, table_name VARCHAR, column_name VARCHAR, " +
+			"ordinal_position INT, column_default VARCHAR, is_nullable VARCHAR, data_type VARCHAR, " +
+			"character_maximum_length INT, character_octet_length INT, numeric_precision INT, " +
+			"numeric_precision_radix INT, numeric_scale INT, datetime_precision INT, interval_type VARCHAR, " +
+			"udt_catalog VARCHAR, udt_schema VARCHAR, udt_name VARCHAR, is_identity VARCHAR, is_generated VARCHAR, " +
+			"is_updatable VARCHAR",
+		rows: func(c *catalogSnapshot) [][]interface{} {
+			var rows [][]interface{}
+			for _, t := range c.tables {
+				for _, col := range t.columns {
+					typ := catalogTypeByOID(col.typeOID)
+					nullable := "YES"
+					if col.notNull {
+						nullable = "NO"
+					}
+					dataType := typ.sqlName
+					if typ.category == "A" {
+						// like in postgres, the element type of arrays is only in udt_name.
+						dataType = "ARRAY"
+					}
+					precision, radix, scale, datetimePrecision := columnPrecision(col.typeOID)
+					rows = append(rows, []interface{}{c.database, t.schema, t.name, col.name,
+						col.position, nil, nullable, dataType,
+						nil, nil, precision,
+						radix, scale, datetimePrecision, nil,
+						c.database, "pg_catalog", typ.name, "NO", "NEVER",
+						"NO"})
+				}
+			}
+			return rows
+		},
+	},
+}
+
+// columnPrecision returns the numeric_precision, numeric_precision_radix, numeric_scale and datetime_precision
+// information_schema.columns reports for a type; they are NULL for the types they don't apply to.
+func columnPrecision(oid uint32) (precision, radix, scale, datetimePrecision interface{}) {
+	switch oid {
+	case pgtype.Int2OID:
+		return 16, 2, 0, nil
+	case pgtype.Int4OID:
+		return 32, 2, 0, nil
+	case pgtype.Int8OID:
+		return 64, 2, 0, nil
+	case pgtype.Float4OID:
+		return 24, 2, nil, nil
+	case pgtype.Float8OID:
+		return 53, 2, nil, nil
+	case pgtype.NumericOID:
+		return 20, 10, 0, nil
+	case pgtype.DateOID:
+		return nil, nil, nil, 0
+	case pgtype.TimestampOID, pgtype.TimestamptzOID:
+		return nil, nil, nil, 6
+	}
+	return nil, nil, nil, nil
+}
+
+// informationSchemaReferences returns the token indexes of the references of a query to emulated
+// information_schema views, e.g. information_schema.columns. The indexes point to the view names.
+func informationSchemaReferences(toks []token) []int {
+	var refs []int
+	for i, t := range toks {
+		if !isName(t) {
+			continue
+		}
+		if _, ok := informationSchemaRelations[t.identName()]; !ok {
+			continue
+		}
+		if n := nextSignificant(toks, i); n >= 0 && (toks[n].is("(") || toks[n].is(".")) {
+			continue
+		}
+		if p := prevSignificant(toks, i); p >= 0 && toks[p].is(".") {
+			if q := prevSignificant(toks, p); q >= 0 && isName(toks[q]) && toks[q].identName() == "information_schema" {
+				refs = append(refs, i)
+			}
+		}
+	}
+	return refs
+}
+
+// catalogFilter returns the conditions on table_schema and table_name of a query reading the catalog relation
+// toks[i] alone, e.g. `table_name = 'cpu'` of
+//
+//	SELECT column_name, data_type FROM information_schema.columns WHERE table_name = 'cpu' ORDER BY ordinal_position
+//
+// so that only the tables the query is about are listed from IOx. It returns the empty string if the WHERE clause
+// has no such conditions, or if they may not restrict the rows of the relation, e.g. because of an OR.
+func catalogFilter(toks []token, i int) string {
+	rel := toks[i].identName()
+	alias := rel
+	p := prevSignificant(toks, i)
+	if p >= 0 && toks[p].is(".") {
+		p = prevSignificant(toks, prevSignificant(toks, p))
+	}
+	if p < 0 || !toks[p].is("from") {
+		return ""
+	}
+	w := nextSignificant(toks, i)
+	if relationAliasFollows(toks, i) {
+		if toks[w].is("as") {
+			if w = nextSignificant(toks, w); w < 0 {
+				return ""
+			}
+		}
+		alias = toks[w].identName()
+		w = nextSignificant(toks, w)
+	}
+	if w < 0 || !toks[w].is("where") {
+		return ""
+	}
+
+	// conds are the conditions of the WHERE clause joined by AND at its top level.
+	var conds [][]token
+	var cond []token
+	depth, between := 0, false
+clause:
+	for _, t := range significant(toks[w+1:]) {
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			if depth == 0 {
+				break clause
+			}
+			depth--
+		case depth > 0:
+		case t.is("or"):
+			return ""
+		case t.is("between"):
+			between = true
+		case t.is("and") && between:
+			between = false
+		case t.is("and"):
+			conds = append(conds, cond)
+			cond = nil
+			continue
+		case t.is(";"), t.is("group"), t.is("having"), t.is("window"), t.is("order"), t.is("limit"), t.is("offset"),
+			t.is("fetch"), t.is("union"), t.is("intersect"), t.is("except"):
+			break clause
+		}
+		cond = append(cond, t)
+	}
+	conds = append(conds, cond)
+
+	var filters []string
+	for _, cond := range conds {
+		if f := tableCondition(cond, rel, alias); f != "" {
+			filters = append(filters, f)
+		}
+	}
+	return strings.Join(filters, " AND ")
+}
+
+// tableCondition returns a condition comparing table_schema or table_name with string literals, e.g.
+// `c.table_name IN ('cpu', 'mem')`, without the qualifier; the empty string for other conditions.
+func tableCondition(cond []token, rel, alias string) string {
+	// column returns the name of the column toks start with and the number of tokens naming it.
+	column := func(toks []token) (string, int) {
+		n := 1
+		if len(toks) >= 3 && isName(toks[0]) && toks[1].is(".") && isName(toks[2]) {
+			if q := toks[0].identName(); q != rel && q != alias {
+				return "", 0
+			}
+			toks, n = toks[2:], 3
+		} else if len(toks) == 0 || !isName(toks[0]) {
+			return "", 0
+		}
+		switch name := toks[0].identName(); name {
+		case "table_schema", "table_name":
+			return name, n
+		}
+		return "", 0
+	}
+
+	if len(cond) >= 3 && cond[0].kind == tokString && cond[1].is("=") {
+		if name, n := column(cond[2:]); name != "" && 2+n == len(cond) {
+			return name + " = " + quoteString(cond[0].stringValue())
+		}
+	}
+	name, n := column(cond)
+	if name == "" || n >= len(cond) {
+		return ""
+	}
+	rest := cond[n:]
+	switch {
+	case len(rest) == 2 && rest[0].is("=") && rest[1].kind == tokString:
+		return name + " = " + quoteString(rest[1].stringValue())
+	case len(rest) >= 4 && rest[0].is("in") && rest[1].is("(") && rest[len(rest)-1].is(")"):
+		var values []string
+		for j, t := range rest[2 : len(rest)-1] {
+			switch {
+			case j%2 == 0 && t.kind == tokString:
+				values = append(values, quoteString(t.stringValue()))
+			case j%2 == 1 && t.is(","):
+			default:
+				return ""
+			}
+		}
+		if len(rest)%2 != 0 {
+			return ""
+		}
+		return name + " IN (" + strings.Join(values, ", ") + ")"
+	}
+	return ""
+}
@@ -0,0 +1,471 @@
+package pigox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+)
+
+// insertStatement is an `INSERT INTO table (columns) VALUES (values), ...` statement. Its rows are written to IOx
+// as line protocol, to the measurement named after the table.
+type insertStatement struct {
+	table   string
+	columns []string
+	// rows are the values of the inserted rows: nil, string, bool, insertNumber or time.Time.
+	rows [][]interface{}
+}
+
+// insertNumber is a numeric literal, whose line protocol type depends on the column it is written to.
+type insertNumber string
+
+// isInsertStatement reports whether query is an INSERT statement.
+func isInsertStatement(query string) bool {
+	toks := significant(scanSQL(query))
+	return len(toks) > 0 && toks[0].is("insert")
+}
+
+// parseInsertStatement parses `INSERT INTO table (columns) VALUES (values), ...`, whose values are literals:
+// strings, numbers, booleans, NULL, and timestamps such as `TIMESTAMP '2022-01-02 03:04:05'`, `'...'::timestamp`
+// or now(). Tables may be qualified with the iox schema, which holds the tables IOx creates from writes.
+// It returns nil if the query is not an INSERT statement.
+func parseInsertStatement(query string) (*insertStatement, error) {
+	toks := significant(scanSQL(query))
+	if n := len(toks); n > 0 && toks[n-1].is(";") {
+		toks = toks[:n-1]
+	}
+	if len(toks) == 0 || !toks[0].is("insert") {
+		return nil, nil
+	}
+	syntaxError := func(format string, args ...interface{}) error {
+		return newPGError(pgerrcode.SyntaxError, fmt.Errorf(format, args...))
+	}
+	if len(toks) < 3 || !toks[1].is("into") || !isName(toks[2]) {
+		return nil, syntaxError("syntax error in INSERT statement: expected INTO table")
+	}
+	stmt := &insertStatement{table: toks[2].identName()}
+	toks = toks[3:]
+	if len(toks) >= 2 && toks[0].is(".") && isName(toks[1]) {
+		if stmt.table != "iox" {
+			return nil, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("cannot insert into schema %q: only the tables of the iox schema can be written", stmt.table))
+		}
+		stmt.table, toks = toks[1].identName(), toks[2:]
+	}
+
+	if len(toks) == 0 || !toks[0].is("(") {
+		return nil, newPGError(pgerrcode.FeatureNotSupported, errors.New("INSERT requires a column list"))
+	}
+	end := matchingParen(toks)
+	if end < 0 {
+		return nil, syntaxError("unterminated INSERT column list")
+	}
+	seen := map[string]bool{}
+	for _, col := range splitOnCommas(toks[1:end]) {
+		if len(col) != 1 || !isName(col[0]) {
+			return nil, syntaxError("syntax error in INSERT column list")
+		}
+		name := col[0].identName()
+		if seen[name] {
+			return nil, newPGError(pgerrcode.DuplicateColumn, fmt.Errorf("column %q specified more than once", name))
+		}
+		seen[name] = true
+		stmt.columns = append(stmt.columns, name)
+	}
+	toks = toks[end+1:]
+	if len(toks) == 0 || !toks[0].is("values") {
+		return nil, newPGError(pgerrcode.FeatureNotSupported, errors.New("only INSERT ... VALUES is supported"))
+	}
+
+	for _, row := range splitOnCommas(toks[1:]) {
+		end := -1
+		if len(row) > 0 && row[0].is("(") {
+			end = matchingParen(row)
+		}
+		switch {
+		case end < 0:
+			return nil, syntaxError("syntax error in INSERT VALUES")
+		case end+1 < len(row) && (row[end+1].is("on") || row[end+1].is("returning")):
+			return nil, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("INSERT ... %s is not supported", strings.ToUpper(row[end+1].text)))
+		case end+1 < len(row):
+			return nil, syntaxError("syntax error in INSERT VALUES at %q", row[end+1].text)
+		}
+		exprs := splitOnCommas(row[1:end])
+		switch {
+		case len(exprs) > len(stmt.columns):
+			return nil, syntaxError("INSERT has more expressions than target columns")
+		case len(exprs) < len(stmt.columns):
+			return nil, syntaxError("INSERT has more target columns than expressions")
+		}
+		values := make([]interface{}, len(exprs))
+		for i, expr := range exprs {
+			v, err := insertLiteral(expr)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		stmt.rows = append(stmt.rows, values)
+	}
+	return stmt, nil
+}
+
+// insertParameterTypes returns the types of the $n placeholders an INSERT statement inserts into columns whose
+// type is known without looking at the schema, by placeholder number.
+func insertParameterTypes(sig []token) map[int]uint32 {
+	if len(sig) < 3 || !sig[0].is("insert") || !sig[1].is("into") {
+		return nil
+	}
+	open := 3
+	for open+1 < len(sig) && sig[open].is(".") {
+		open += 2
+	}
+	if open >= len(sig) || !sig[open].is("(") {
+		return nil
+	}
+	end := matchingParen(sig[open:])
+	if end < 0 || open+end+1 >= len(sig) || !sig[open+end+1].is("values") {
+		return nil
+	}
+	columns := splitOnCommas(sig[open+1 : open+end])
+	types := map[int]uint32{}
+	for _, row := range splitOnCommas(sig[open+end+2:]) {
+		if len(row) < 2 || !row[0].is("(") {
+			continue
+		}
+		for i, expr := range splitOnCommas(row[1 : len(row)-1]) {
+			if len(expr) != 1 || expr[0].kind != tokParam || i >= len(columns) || len(columns[i]) != 1 {
+				continue
+			}
+			n, err := strconv.Atoi(expr[0].text[1:])
+			if oid := columnType(columns[i][0]); err == nil && oid != 0 {
+				types[n] = oid
+			}
+		}
+	}
+	return types
+}
+
+// insertLiteral returns the value of a literal of an INSERT statement.
+func insertLiteral(toks []token) (interface{}, error) {
+	for len(toks) > 2 && toks[0].is("(") && matchingParen(toks) == len(toks)-1 {
+		toks = toks[1 : len(toks)-1]
+	}
+	n := len(toks)
+	switch {
+	case n == 1 && toks[0].kind == tokString:
+		return toks[0].stringValue(), nil
+	case n == 1 && toks[0].kind == tokNumber:
+		return insertNumber(toks[0].text), nil
+	case n == 1 && toks[0].is("null"):
+		return nil, nil
+	case n == 1 && (toks[0].is("true") || toks[0].is("false")):
+		return toks[0].is("true"), nil
+	case n == 1 && (toks[0].is("current_timestamp") || toks[0].is("localtimestamp")),
+		n == 3 && toks[0].is("now") && toks[1].is("(") && toks[2].is(")"):
+		return time.Now(), nil
+	case n == 2 && (toks[0].is("-") || toks[0].is("+")) && toks[1].kind == tokNumber:
+		return insertNumber(strings.TrimPrefix(toks[0].text, "+") + toks[1].text), nil
+	case n == 2 && (toks[0].is("timestamp") || toks[0].is("timestamptz") || toks[0].is("date")) && toks[1].kind == tokString:
+		return parseInsertTime(toks[1].stringValue())
+	case n >= 3 && toks[n-2].is("::") && isName(toks[n-1]):
+		v, err := insertLiteral(toks[:n-2])
+		if err != nil {
+			return nil, err
+		}
+		return castInsertValue(v, toks[n-1].identName())
+	case n >= 6 && toks[0].is("cast") && toks[1].is("(") && matchingParen(toks[1:]) == n-2:
+		for i := n - 2; i > 2; i-- {
+			if toks[i].is("as") && i+1 < n-1 && isName(toks[i+1]) {
+				v, err := insertLiteral(toks[2:i])
+				if err != nil {
+					return nil, err
+				}
+				return castInsertValue(v, toks[i+1].identName())
+			}
+		}
+	}
+	return nil, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("INSERT values must be literals, got %s", joinTokens(toks)))
+}
+
+// castInsertValue converts the string literals cast to a type, e.g. in `'1.5'::double`, to the value of the type.
+func castInsertValue(v interface{}, typ string) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return v, nil
+	}
+	switch typ {
+	case "timestamp", "timestamptz", "date":
+		return parseInsertTime(s)
+	case "bool", "boolean":
+		return parseInsertBool(s)
+	case "smallint", "int", "integer", "bigint", "int2", "int4", "int8", "real", "float", "float4", "float8",
+		"double", "numeric", "decimal":
+		s = strings.TrimSpace(s)
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			return nil, newPGError(pgerrcode.InvalidTextRepresentation, fmt.Errorf("invalid input syntax for type %s: %q", typ, s))
+		}
+		return insertNumber(s), nil
+	}
+	return s, nil
+}
+
+func parseInsertTime(s string) (time.Time, error) {
+	for _, layout := range timeLiteralLayouts {
+		if t, err := time.Parse(layout, strings.TrimSpace(s)); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, newPGError(pgerrcode.InvalidDatetimeFormat, fmt.Errorf("invalid input syntax for type timestamp: %q", s))
+}
+
+func parseInsertBool(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "t", "true", "y", "yes", "on", "1":
+		return true, nil
+	case "f", "false", "n", "no", "off", "0":
+		return false, nil
+	}
+	return false, newPGError(pgerrcode.InvalidTextRepresentation, fmt.Errorf("invalid input syntax for type boolean: %q", s))
+}
+
+// lineProtocol encodes the rows of the statement as line protocol. The time column is the timestamp of the rows.
+// The other columns are tags if listed in tags, or if IOx stores them as tags in columns, the existing columns of
+// the table; new columns are tags if given only strings and fields otherwise. NULLs are omitted.
+func (stmt *insertStatement) lineProtocol(columns map[string]catalogColumn, tags []string) (string, error) {
+	isTag := map[string]bool{}
+	for _, name := range tags {
+		isTag[name] = true
+	}
+	for i, name := range stmt.columns {
+		if col, ok := columns[name]; ok {
+			isTag[name] = isTag[name] || col.tag
+			continue
+		}
+		strs, others := 0, 0
+		for _, row := range stmt.rows {
+			switch row[i].(type) {
+			case string:
+				strs++
+			case nil:
+			default:
+				others++
+			}
+		}
+		isTag[name] = isTag[name] || (strs > 0 && others == 0)
+	}
+	var b strings.Builder
+	for r, row := range stmt.rows {
+		var tagSet, fieldSet []string
+		timestamp := ""
+		for i, v := range row {
+			name := stmt.columns[i]
+			if v == nil {
+				continue
+			}
+			if name == "time" {
+				ts, err := lineTimestamp(v)
+				if err != nil {
+					return "", err
+				}
+				timestamp = " " + ts
+				continue
+			}
+			if isTag[name] {
+				value, err := lineTagValue(name, v)
+				if err != nil {
+					return "", err
+				}
+				if value != "" {
+					tagSet = append(tagSet, escapeLineProtocol(name, ",= ")+"="+escapeLineProtocol(value, ",= "))
+				}
+				continue
+			}
+			value, err := lineFieldValue(name, v, columns[name].typeOID)
+			if err != nil {
+				return "", err
+			}
+			fieldSet = append(fieldSet, escapeLineProtocol(name, ",= ")+"="+value)
+		}
+		if len(fieldSet) == 0 {
+			return "", newPGError(pgerrcode.NotNullViolation, fmt.Errorf("row %d has no field values: IOx requires at least one non-NULL field per row", r+1))
+		}
+		// IOx ingests tags sorted by key fastest.
+		sort.Strings(tagSet)
+
+		b.WriteString(escapeLineProtocol(stmt.table, ", "))
+		for _, tag := range tagSet {
+			b.WriteString("," + tag)
+		}
+		b.WriteString(" " + strings.Join(fieldSet, ",") + timestamp + "\n")
+	}
+	return b.String(), nil
+}
+
+// lineTimestamp returns the line protocol timestamp, in nanoseconds since the epoch, of a value of the time column.
+func lineTimestamp(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return strconv.FormatInt(v.UnixNano(), 10), nil
+	case string:
+		t, err := parseInsertTime(v)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(t.UnixNano(), 10), nil
+	case insertNumber:
+		if _, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return string(v), nil
+		}
+	}
+	return "", newPGError(pgerrcode.DatatypeMismatch, fmt.Errorf("column \"time\" is of type timestamp but expression is %v", v))
+}
+
+// lineTagValue returns the value of a tag; line protocol has no NULL tags, so empty values are omitted.
+func lineTagValue(name string, v interface{}) (string, error) {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case insertNumber:
+		s = strings.TrimPrefix(string(v), "+")
+	case bool:
+		s = strconv.FormatBool(v)
+	default:
+		return "", newPGError(pgerrcode.DatatypeMismatch, fmt.Errorf("column %q is a tag but expression is %v", name, v))
+	}
+	if strings.ContainsAny(s, "\r\n") {
+		return "", newPGError(pgerrcode.InvalidParameterValue, fmt.Errorf("tag %q cannot contain line breaks", name))
+	}
+	return s, nil
+}
+
+// lineFieldValue returns the line protocol value of a field. Numbers and strings are converted to the type of the
+// existing column typeOID, if any; numbers written to new columns are floats, as in line protocol.
+func lineFieldValue(name string, v interface{}, typeOID uint32) (string, error) {
+	invalid := func(s, typ string) error {
+		return newPGError(pgerrcode.InvalidTextRepresentation, fmt.Errorf("invalid input syntax for type %s of column %q: %q", typ, name, s))
+	}
+	switch v := v.(type) {
+	case bool:
+		return strconv.FormatBool(v), nil
+	case string:
+		switch typeOID {
+		case pgtype.BoolOID:
+			b, err := parseInsertBool(v)
+			return strconv.FormatBool(b), err
+		case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.NumericOID, pgtype.Float4OID, pgtype.Float8OID:
+			return lineFieldValue(name, insertNumber(strings.TrimSpace(v)), typeOID)
+		}
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`, nil
+	case insertNumber:
+		s := strings.TrimPrefix(string(v), "+")
+		switch typeOID {
+		case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID:
+			if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+				return "", invalid(s, "bigint")
+			}
+			return s + "i", nil
+		case pgtype.NumericOID:
+			if _, err := strconv.ParseUint(s, 10, 64); err != nil {
+				return "", invalid(s, "unsigned bigint")
+			}
+			return s + "u", nil
+		case pgtype.TextOID:
+			return `"` + s + `"`, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return "", invalid(s, "double")
+		}
+		return s, nil
+	}
+	return "", newPGError(pgerrcode.DatatypeMismatch, fmt.Errorf("column %q is a field but expression is %v; only the time column holds timestamps", name, v))
+}
+
+// escapeLineProtocol escapes the special characters of a line protocol element with backslashes.
+func escapeLineProtocol(s, special string) string {
+	if !strings.ContainsAny(s, special+`\`) {
+		return s
+	}
+	var b strings.Builder
+	for _, c := range s {
+		if c == '\\' || strings.ContainsRune(special, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// processInsert writes the rows of an INSERT statement to IOx and reports the result, or the error it failed
+// with, to the client. It returns the statement error, if any, or an error writing to the client.
+func (p *Proxy) processInsert(ctx context.Context, session *session, source, query string) (err error) {
+	start := time.Now()
+	rows := 0
+	defer func() {
+		err = canceledError(ctx, err)
+		p.recordQuery(session, source, query, start, rows, err)
+		if err == nil {
+			err = writeMessages(p.conn, &pgproto3.CommandComplete{CommandTag: []byte(fmt.Sprintf("INSERT 0 %d", rows))})
+		} else if werr := p.writeError("ERROR", err); werr != nil {
+			err = werr
+		}
+	}()
+
+	if p.writer == nil {
+		return newPGError(pgerrcode.FeatureNotSupported, errors.New("INSERT is not supported: the proxy has no IOx write address"))
+	}
+	stmt, err := parseInsertStatement(query)
+	if err != nil {
+		return err
+	}
+	if err := p.authorize(ctx, session, query); err != nil {
+		return err
+	}
+	catalog, err := p.catalogSnapshot(ctx, session, "table_schema = 'iox' AND table_name = "+quoteString(stmt.table))
+	if err != nil {
+		return err
+	}
+	columns := map[string]catalogColumn{}
+	for _, t := range catalog.tables {
+		if t.schema == "iox" && t.name == stmt.table {
+			for _, col := range t.columns {
+				columns[col.name] = col
+			}
+		}
+	}
+	lines, err := stmt.lineProtocol(columns, p.tagColumns[stmt.table])
+	if err != nil {
+		return err
+	}
+	token, err := p.writer.write(ctx, session.databaseName, session.token, lines)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		session.noteWrite(token)
+	}
+	rows = len(stmt.rows)
+	return nil
+}
+
+// ParseTagColumns parses table.column names of columns written as tags, e.g. "cpu.host", for WithTagColumns.
+func ParseTagColumns(names []string) (map[string][]string, error) {
+	tags := map[string][]string{}
+	for _, name := range names {
+		i := strings.Index(name, ".")
+		if i <= 0 || i == len(name)-1 {
+			return nil, fmt.Errorf("invalid tag column %q: expected table.column", name)
+		}
+		tags[name[:i]] = append(tags[name[:i]], name[i+1:])
+	}
+	return tags, nil
+}
@@ -0,0 +1,227 @@
+package pigox
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgtype"
+)
+
+func TestParseInsertStatement(t *testing.T) {
+	ts := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		query string
+		want  *insertStatement
+		// code is the SQLSTATE of the error, if any.
+		code string
+	}{
+		{`SELECT 1`, nil, ""},
+		{`INSERT INTO cpu (host, usage) VALUES ('a', 0.5), ('b', -1);`,
+			&insertStatement{table: "cpu", columns: []string{"host", "usage"}, rows: [][]interface{}{{"a", insertNumber("0.5")}, {"b", insertNumber("-1")}}}, ""},
+		{`insert into iox."My Table" ("Host", time) values ('it''s', TIMESTAMP '2022-01-02 03:04:05')`,
+			&insertStatement{table: "My Table", columns: []string{"Host", "time"}, rows: [][]interface{}{{"it's", ts}}}, ""},
+		{`INSERT INTO cpu (a, b, c, d) VALUES (NULL, true, +3, (E'x\ty'))`,
+			&insertStatement{table: "cpu", columns: []string{"a", "b", "c", "d"}, rows: [][]interface{}{{nil, true, insertNumber("3"), "x\ty"}}}, ""},
+		{`INSERT INTO cpu (a, b, c, time) VALUES ('1.5'::double, 't'::bool, CAST(' 2 ' AS bigint), '2022-01-02T03:04:05Z'::timestamptz)`,
+			&insertStatement{table: "cpu", columns: []string{"a", "b", "c", "time"}, rows: [][]interface{}{{insertNumber("1.5"), true, insertNumber("2"), ts}}}, ""},
+		{`INSERT INTO cpu (a, b) VALUES (CAST('x' AS text), 7::float8)`,
+			&insertStatement{table: "cpu", columns: []string{"a", "b"}, rows: [][]interface{}{{"x", insertNumber("7")}}}, ""},
+		{`INSERT INTO cpu (a) VALUES ('x'::bigint)`, nil, pgerrcode.InvalidTextRepresentation},
+		{`INSERT INTO cpu (a) VALUES ('maybe'::bool)`, nil, pgerrcode.InvalidTextRepresentation},
+		{`INSERT INTO cpu (a) VALUES ('yesterday'::timestamp)`, nil, pgerrcode.InvalidDatetimeFormat},
+		{`INSERT INTO cpu (a) VALUES (1 + 1)`, nil, pgerrcode.FeatureNotSupported},
+		{`INSERT INTO cpu VALUES (1)`, nil, pgerrcode.FeatureNotSupported},
+		{`INSERT INTO cpu (a) SELECT 1`, nil, pgerrcode.FeatureNotSupported},
+		{`INSERT INTO cpu (a) VALUES (1) RETURNING a`, nil, pgerrcode.FeatureNotSupported},
+		{`INSERT INTO public.cpu (a) VALUES (1)`, nil, pgerrcode.FeatureNotSupported},
+		{`INSERT INTO cpu (a, a) VALUES (1, 2)`, nil, pgerrcode.DuplicateColumn},
+		{`INSERT INTO cpu (a, b) VALUES (1)`, nil, pgerrcode.SyntaxError},
+		{`INSERT INTO cpu (a) VALUES (1, 2)`, nil, pgerrcode.SyntaxError},
+		{`INSERT cpu (a) VALUES (1)`, nil, pgerrcode.SyntaxError},
+	}
+	for _, tt := range tests {
+		got, err := parseInsertStatement(tt.query)
+		if code := errorCode(err); err != nil || tt.code != "" {
+			if code != tt.code {
+				t.Errorf("%s: got error %v (code %s), want code %s", tt.query, err, code, tt.code)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\ngot  %#v\nwant %#v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestLineProtocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		columns map[string]catalogColumn
+		tags    []string
+		want    string
+		code    string
+	}{
+		{
+			name:  "tags and fields inferred from the values",
+			query: `INSERT INTO cpu (usage, host, time, region) VALUES (0.5, 'a', 1641092645000000000, 'eu'), (2, 'b', NULL, NULL)`,
+			want:  "cpu,host=a,region=eu usage=0.5 1641092645000000000\ncpu,host=b usage=2\n",
+		},
+		{
+			name:    "string fields",
+			query:   `INSERT INTO logs (msg, level) VALUES ('say "hi" \ bye', 1), (NULL, 2)`,
+			columns: map[string]catalogColumn{"msg": {typeOID: pgtype.TextOID}},
+			want:    "logs msg=\"say \\\"hi\\\" \\\\ bye\",level=1\nlogs level=2\n",
+		},
+		{
+			name:  "columns listed as tags",
+			query: `INSERT INTO cpu (host, core, usage) VALUES ('a', 1, 0.5)`,
+			tags:  []string{"core"},
+			want:  "cpu,core=1,host=a usage=0.5\n",
+		},
+		{
+			name:    "existing columns, and a new string column written as a tag",
+			query:   `INSERT INTO cpu (host, n, u, f, s, b, t) VALUES (7, '3', 4, 5, 6, 'on', 'x')`,
+			columns: map[string]catalogColumn{"host": {tag: true}, "n": {typeOID: pgtype.Int8OID}, "u": {typeOID: pgtype.NumericOID}, "f": {typeOID: pgtype.Float8OID}, "s": {typeOID: pgtype.TextOID}, "b": {typeOID: pgtype.BoolOID}},
+			want:    "cpu,host=7,t=x n=3i,u=4u,f=5,s=\"6\",b=true\n",
+		},
+		{
+			name:    "escaping",
+			query:   `INSERT INTO "my table, x" ("tag key=1", "field key", "a\b") VALUES ('v, =\', 'it''s "x"', 1)`,
+			columns: map[string]catalogColumn{"field key": {typeOID: pgtype.TextOID}},
+			want:    "my\\ table\\,\\ x,tag\\ key\\=1=v\\,\\ \\=\\\\ field\\ key=\"it's \\\"x\\\"\",a\\\\b=1\n",
+		},
+		{
+			name:  "measurement with equals sign",
+			query: `INSERT INTO "a=b" (v) VALUES (1)`,
+			want:  "a=b v=1\n",
+		},
+		{
+			name:  "timestamps",
+			query: `INSERT INTO cpu (v, time) VALUES (1, TIMESTAMP '2022-01-02 03:04:05'), (2, '2022-01-02T03:04:05Z')`,
+			want:  "cpu v=1 1641092645000000000\ncpu v=2 1641092645000000000\n",
+		},
+		{
+			name:  "cast literals",
+			query: `INSERT INTO cpu (v, w, time) VALUES ('1.5'::float8, CAST('2' AS bigint), '2022-01-02 03:04:05'::timestamp)`,
+			want:  "cpu v=1.5,w=2 1641092645000000000\n",
+		},
+		{
+			name:    "cast literals into existing columns",
+			query:   `INSERT INTO cpu (v, w) VALUES ('1'::int, CAST('2' AS numeric))`,
+			columns: map[string]catalogColumn{"v": {typeOID: pgtype.Int8OID}, "w": {typeOID: pgtype.NumericOID}},
+			want:    "cpu v=1i,w=2u\n",
+		},
+		{
+			name:  "NULL-only row",
+			query: `INSERT INTO cpu (host, usage) VALUES ('a', 1), ('b', NULL)`,
+			code:  pgerrcode.NotNullViolation,
+		},
+		{
+			name:  "NULL-only column",
+			query: `INSERT INTO cpu (host, usage) VALUES (NULL, 1)`,
+			want:  "cpu usage=1\n",
+		},
+		{
+			name:  "empty tag",
+			query: `INSERT INTO cpu (host, usage) VALUES ('', 1)`,
+			want:  "cpu usage=1\n",
+		},
+		{
+			name:  "tag with line break",
+			query: `INSERT INTO cpu (host, usage) VALUES (E'a\nb', 1)`,
+			code:  pgerrcode.InvalidParameterValue,
+		},
+		{
+			name:  "timestamp field",
+			query: `INSERT INTO cpu (usage, at) VALUES (1, now())`,
+			code:  pgerrcode.DatatypeMismatch,
+		},
+		{
+			name:  "non integer time",
+			query: `INSERT INTO cpu (usage, time) VALUES (1, 1.5)`,
+			code:  pgerrcode.DatatypeMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt, err := parseInsertStatement(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := stmt.lineProtocol(tt.columns, tt.tags)
+			if code := errorCode(err); err != nil || tt.code != "" {
+				if code != tt.code {
+					t.Fatalf("got error %v (code %s), want code %s", err, code, tt.code)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("got  %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineFieldValue(t *testing.T) {
+	tests := []struct {
+		v       interface{}
+		typeOID uint32
+		want    string
+		code    string
+	}{
+		{true, 0, "true", ""},
+		{"a \"b\" \\c", 0, `"a \"b\" \\c"`, ""},
+		{"", 0, `""`, ""},
+		{insertNumber("1"), 0, "1", ""},
+		{insertNumber("+1.5e3"), 0, "1.5e3", ""},
+		{insertNumber("-2"), pgtype.Int8OID, "-2i", ""},
+		{insertNumber("2"), pgtype.Int2OID, "2i", ""},
+		{insertNumber("1.5"), pgtype.Int4OID, "", pgerrcode.InvalidTextRepresentation},
+		{insertNumber("18446744073709551615"), pgtype.NumericOID, "18446744073709551615u", ""},
+		{insertNumber("-1"), pgtype.NumericOID, "", pgerrcode.InvalidTextRepresentation},
+		{insertNumber("3"), pgtype.Float4OID, "3", ""},
+		{insertNumber("3"), pgtype.TextOID, `"3"`, ""},
+		{insertNumber("1e999"), 0, "", pgerrcode.InvalidTextRepresentation},
+		{" 42 ", pgtype.Int8OID, "42i", ""},
+		{"4.5", pgtype.Float8OID, "4.5", ""},
+		{"x", pgtype.Float8OID, "", pgerrcode.InvalidTextRepresentation},
+		{"yes", pgtype.BoolOID, "true", ""},
+		{"maybe", pgtype.BoolOID, "", pgerrcode.InvalidTextRepresentation},
+		{time.Unix(0, 0), 0, "", pgerrcode.DatatypeMismatch},
+	}
+	for _, tt := range tests {
+		got, err := lineFieldValue("c", tt.v, tt.typeOID)
+		if code := errorCode(err); err != nil || tt.code != "" {
+			if code != tt.code {
+				t.Errorf("%#v (type %d): got error %v (code %s), want code %s", tt.v, tt.typeOID, err, code, tt.code)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%#v (type %d): got %s, want %s", tt.v, tt.typeOID, got, tt.want)
+		}
+	}
+}
+
+func TestEscapeLineProtocol(t *testing.T) {
+	tests := []struct {
+		s, special, want string
+	}{
+		{"cpu", ", ", "cpu"},
+		// measurements escape commas and spaces.
+		{"my cpu,x=1", ", ", `my\ cpu\,x=1`},
+		// tag and field keys, and tag values, escape equals signs too.
+		{"my key=1,2", ",= ", `my\ key\=1\,2`},
+		{`a\b`, ",= ", `a\\b`},
+		{`"quoted"`, ",= ", `"quoted"`},
+		{"héllo wörld", ", ", `héllo\ wörld`},
+	}
+	for _, tt := range tests {
+		if got := escapeLineProtocol(tt.s, tt.special); got != tt.want {
+			t.Errorf("escapeLineProtocol(%q, %q): got %s, want %s", tt.s, tt.special, got, tt.want)
+		}
+	}
+}
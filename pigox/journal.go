@@ -0,0 +1,198 @@
+package pigox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journaledWrite is a write to IOx, in line protocol.
+type journaledWrite struct {
+	Database string    `json:"database"`
+	Lines    string    `json:"lines"`
+	Received time.Time `json:"received"`
+}
+
+// writeJournal persists writes that IOx failed to accept to a local directory, and retries them in the
+// background until they succeed.
+//
+// Writes are delivered in the order they were received: while the journal holds pending writes, new
+// writes are appended to it rather than sent directly, so they cannot overtake older ones.
+// Each write is stored in its own file, named after its sequence number.
+type writeJournal struct {
+	dir     string
+	deliver func(ctx context.Context, w journaledWrite) error
+	// retryInterval is the delay between delivery attempts while IOx fails.
+	retryInterval time.Duration
+
+	mu      sync.Mutex
+	nextSeq uint64
+	pending int
+	wake    chan struct{}
+}
+
+const journalSuffix = ".write"
+
+// openWriteJournal opens the journal in dir, creating it if needed. Writes left over by a previous run are
+// retried once run is called.
+func openWriteJournal(dir string, deliver func(ctx context.Context, w journaledWrite) error) (*writeJournal, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	j := &writeJournal{dir: dir, deliver: deliver, retryInterval: time.Second, wake: make(chan struct{}, 1)}
+	seqs, err := j.list()
+	if err != nil {
+		return nil, err
+	}
+	if n := len(seqs); n > 0 {
+		j.nextSeq = seqs[n-1] + 1
+		j.pending = n
+		slog.Info("write journal has pending writes", "dir", dir, "writes", n)
+	}
+	return j, nil
+}
+
+// write delivers w to IOx, journaling it if IOx is unavailable or older writes are still pending.
+// Errors returned by deliver as *pgError denote writes IOx rejected; they are returned and never retried.
+func (j *writeJournal) write(ctx context.Context, w journaledWrite) error {
+	j.mu.Lock()
+	pending := j.pending > 0
+	j.mu.Unlock()
+	if !pending {
+		err := j.deliver(ctx, w)
+		var perr *pgError
+		if err == nil || errors.As(err, &perr) {
+			return err
+		}
+		slog.Warn("journaling write after delivery failed", "database", w.Database, "err", err)
+	}
+	return j.append(w)
+}
+
+func (j *writeJournal) append(w journaledWrite) error {
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	name := j.path(j.nextSeq)
+	tmp := name + ".tmp"
+	if err := writeFileSync(tmp, data); err != nil {
+		return fmt.Errorf("journaling write: %w", err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return fmt.Errorf("journaling write: %w", err)
+	}
+	j.nextSeq++
+	j.pending++
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// run retries the journaled writes, oldest first, until ctx is done.
+func (j *writeJournal) run(ctx context.Context) {
+	for {
+		if err := j.replay(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("retrying journaled writes", "err", err)
+			select {
+			case <-time.After(j.retryInterval):
+			case <-ctx.Done():
+			}
+		} else {
+			select {
+			case <-j.wake:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// replay delivers the journaled writes in order, stopping at the first one that fails.
+func (j *writeJournal) replay(ctx context.Context) error {
+	seqs, err := j.list()
+	if err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		name := j.path(seq)
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		var w journaledWrite
+		if err := json.Unmarshal(data, &w); err != nil {
+			slog.Error("dropping corrupt journaled write", "file", name, "err", err)
+		} else if err := j.deliver(ctx, w); err != nil {
+			var perr *pgError
+			if !errors.As(err, &perr) {
+				return err
+			}
+			slog.Error("dropping journaled write rejected by IOx", "file", name, "err", err)
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		j.mu.Lock()
+		j.pending--
+		j.mu.Unlock()
+	}
+	return nil
+}
+
+// list returns the sequence numbers of the journaled writes, in order.
+func (j *writeJournal) list() ([]uint64, error) {
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), journalSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), journalSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(a, b int) bool { return seqs[a] < seqs[b] })
+	return seqs, nil
+}
+
+func (j *writeJournal) path(seq uint64) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%020d%s", seq, journalSuffix))
+}
+
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,212 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"github.com/mkmik/piggo/pigox/arrowpg"
+)
+
+// jsonResult describes a query whose rows are wrapped as JSON by the proxy.
+type jsonResult struct {
+	// column is the name of the single output column, e.g. "row_to_json".
+	column string
+	oid    uint32
+	// aggregate is set if all rows are returned as a single JSON array, rather than one object per row.
+	aggregate bool
+}
+
+// jsonWrappers maps the supported call chains, outermost function first, to the shape of their result.
+var jsonWrappers = map[string]jsonResult{
+	"row_to_json":                         {oid: pgtype.JSONOID},
+	"to_json":                             {oid: pgtype.JSONOID},
+	"to_jsonb":                            {oid: pgtype.JSONBOID},
+	"json_agg":                            {oid: pgtype.JSONOID, aggregate: true},
+	"json_agg.row_to_json":                {oid: pgtype.JSONOID, aggregate: true},
+	"json_agg.to_json":                    {oid: pgtype.JSONOID, aggregate: true},
+	"jsonb_agg":                           {oid: pgtype.JSONBOID, aggregate: true},
+	"jsonb_agg.to_jsonb":                  {oid: pgtype.JSONBOID, aggregate: true},
+	"array_to_json.array_agg.row_to_json": {oid: pgtype.JSONOID, aggregate: true},
+}
+
+// rewriteJSONWrapper recognizes queries that wrap the rows of a subquery as JSON, which IOx cannot evaluate:
+//
+//	SELECT row_to_json(t) FROM (subquery) t
+//	SELECT json_agg(t) FROM (subquery) AS t
+//	SELECT array_to_json(array_agg(row_to_json(t))) AS data FROM (subquery) t
+//
+// It returns the subquery, to be sent to IOx, and how to wrap its rows.
+func rewriteJSONWrapper(query string) (string, *jsonResult, bool) {
+	if !strings.Contains(strings.ToLower(query), "json") {
+		return "", nil, false
+	}
+	toks := significant(scanSQL(query))
+	if n := len(toks); n > 0 && toks[n-1].is(";") {
+		toks = toks[:n-1]
+	}
+	if len(toks) < 2 || !toks[0].is("select") {
+		return "", nil, false
+	}
+
+	// the call chain, e.g. array_to_json(array_agg(row_to_json(t)))
+	var chain []string
+	i := 1
+	for i+1 < len(toks) && toks[i].kind == tokIdent && toks[i+1].is("(") {
+		chain = append(chain, strings.ToLower(toks[i].text))
+		i += 2
+	}
+	if len(chain) == 0 || i >= len(toks) || !(toks[i].kind == tokIdent || toks[i].kind == tokQuotedIdent) {
+		return "", nil, false
+	}
+	alias := toks[i].identName()
+	i++
+	for range chain {
+		if i >= len(toks) || !toks[i].is(")") {
+			return "", nil, false
+		}
+		i++
+	}
+	shape, ok := jsonWrappers[strings.Join(chain, ".")]
+	if !ok {
+		return "", nil, false
+	}
+	shape.column = chain[0]
+
+	// optional output column alias
+	if i < len(toks) && toks[i].is("as") {
+		i++
+	}
+	if i < len(toks) && (toks[i].kind == tokQuotedIdent || (toks[i].kind == tokIdent && !toks[i].is("from"))) {
+		shape.column = toks[i].identName()
+		i++
+	}
+
+	if i+1 >= len(toks) || !toks[i].is("from") || !toks[i+1].is("(") {
+		return "", nil, false
+	}
+	end := matchingParen(toks[i+1:])
+	if end < 0 {
+		return "", nil, false
+	}
+	open, closing := toks[i+1], toks[i+1+end]
+	rest := toks[i+2+end:]
+	if len(rest) > 0 && rest[0].is("as") {
+		rest = rest[1:]
+	}
+	if len(rest) != 1 || rest[0].identName() != alias {
+		return "", nil, false
+	}
+	return query[open.pos+1 : closing.pos], &shape, true
+}
+
+func (shape *jsonResult) rowDescription() *pgproto3.RowDescription {
+	return &pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{
+		Name:         []byte(shape.column),
+		DataTypeOID:  shape.oid,
+		DataTypeSize: -1,
+		TypeModifier: -1,
+	}}}
+}
+
+// processJSONQuery writes the rows read from reader wrapped as JSON, as described by shape.
+// It returns the number of rows written.
+func (p *Proxy) processJSONQuery(ctx context.Context, reader recordReader, shape *jsonResult, colOpts []renderOptions, session *session, mem *resultMemory, format resultFormat) (int, error) {
+	if n := len(format.codes); n > 1 {
+		return 0, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("bind message has %d result formats but query has 1 column", n))
+	}
+	fields := resultFields(reader.Schema().Fields(), session)
+	if format.describe {
+		rowDesc := shape.rowDescription()
+		rowDesc.Fields[0].Format = formatCode(format.codes, 0)
+		if err := writeMessages(p.conn, rowDesc); err != nil {
+			return 0, fmt.Errorf("error writing query response: %w", err)
+		}
+	}
+	// the binary format of jsonb is its text prefixed by a version number, the one of json is its text.
+	var prefix []byte
+	if formatCode(format.codes, 0) == pgtype.BinaryFormatCode && shape.oid == pgtype.JSONBOID {
+		prefix = []byte{1}
+	}
+
+	var agg []byte
+	w := p.newRowWriter(ctx, nil)
+	totalRows := 0
+	for {
+		batch, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		bcols := batch.Columns()
+		for r := 0; r < int(batch.NumRows()); r++ {
+			var obj []byte
+			if shape.aggregate {
+				if agg == nil {
+					agg = append(append(agg, prefix...), '[')
+				} else {
+					agg = append(agg, ", "...)
+				}
+				obj = agg
+			} else {
+				obj = append(obj, prefix...)
+			}
+			if obj, err = appendJSONObject(obj, fields, bcols, r, colOpts); err != nil {
+				return 0, err
+			}
+			if shape.aggregate {
+				agg = obj
+				continue
+			}
+			if err := w.writeRow([][]byte{obj}); err != nil {
+				return 0, err
+			}
+			totalRows++
+			if session.maxRows > 0 && totalRows >= session.maxRows {
+				break
+			}
+		}
+		mem.hold(recordSize(batch) + w.size() + int64(len(agg)))
+		if session.maxRows > 0 && totalRows >= session.maxRows {
+			break
+		}
+	}
+	if err := w.flush(); err != nil {
+		return 0, err
+	}
+	if !shape.aggregate {
+		return totalRows, nil
+	}
+
+	// like in postgres, aggregating no rows yields NULL.
+	if agg != nil {
+		agg = append(agg, ']')
+	}
+	if err := w.writeRow([][]byte{agg}); err != nil {
+		return 0, err
+	}
+	return 1, w.flush()
+}
+
+// appendJSONObject appends a row as a JSON object, formatted like postgres' row_to_json.
+func appendJSONObject(buf []byte, fields []arrow.Field, columns []arrow.Array, row int, colOpts []renderOptions) ([]byte, error) {
+	buf = append(buf, '{')
+	for c, f := range fields {
+		if c > 0 {
+			buf = append(buf, ',')
+		}
+		buf = arrowpg.AppendJSONString(buf, f.Name)
+		buf = append(buf, ':')
+		var err error
+		if buf, err = arrowpg.AppendJSON(buf, columns[c], row, colOpts[c]); err != nil {
+			return nil, renderError(err)
+		}
+	}
+	return append(buf, '}'), nil
+}
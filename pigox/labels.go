@@ -0,0 +1,41 @@
+package pigox
+
+import (
+	"sort"
+	"strings"
+)
+
+// maxLabelValueLength bounds the length of label values, which come from clients.
+const maxLabelValueLength = 128
+
+// sessionLabels returns the labels of a session, extracted from its startup parameters as configured by
+// WithConnectionLabels. Labels whose parameter is missing have the empty value, so that all sessions have the
+// same label set.
+func (o *proxyOptions) sessionLabels(params map[string]string) map[string]string {
+	if len(o.connectionLabels) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(o.connectionLabels))
+	for label, param := range o.connectionLabels {
+		v := params[param]
+		if len(v) > maxLabelValueLength {
+			v = v[:maxLabelValueLength]
+		}
+		labels[label] = v
+	}
+	return labels
+}
+
+// formatLabels formats labels as comma separated name=value pairs, sorted by name.
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + labels[name]
+	}
+	return strings.Join(pairs, ",")
+}
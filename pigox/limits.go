@@ -0,0 +1,64 @@
+package pigox
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+)
+
+const (
+	// DefaultMaxMessageSize is the default limit on the size of a single frontend message.
+	DefaultMaxMessageSize = 16 << 20
+	// maxStartupParameters limits the number of parameters accepted in a StartupMessage.
+	maxStartupParameters = 64
+)
+
+// limitedChunkReader rejects reads larger than max before any buffer is allocated for them.
+//
+// pgproto3 reads a message by first reading its 5 byte header and then its body with a single Next call
+// sized by the length announced in the header, so this bounds the memory a peer can make us allocate.
+type limitedChunkReader struct {
+	cr  pgproto3.ChunkReader
+	max int
+}
+
+func (r *limitedChunkReader) Next(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("invalid message length %d", n))
+	}
+	if n > r.max {
+		return nil, newPGError(pgerrcode.ProgramLimitExceeded, fmt.Errorf("message of %d bytes exceeds the maximum of %d bytes", n, r.max))
+	}
+	return r.cr.Next(n)
+}
+
+// protocolError classifies an error returned while receiving a message.
+// After such an error the message stream cannot be resynchronized, so the connection has to be closed.
+func protocolError(err error) error {
+	var perr *pgError
+	if errors.As(err, &perr) {
+		return err
+	}
+	return newPGError(pgerrcode.ProtocolViolation, err)
+}
+
+// validateStartupMessage rejects the startup messages of connections the proxy cannot serve.
+func validateStartupMessage(msg *pgproto3.StartupMessage) error {
+	if n := len(msg.Parameters); n > maxStartupParameters {
+		return newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("too many startup parameters: %d (maximum is %d)", n, maxStartupParameters))
+	}
+	// replication connections, e.g. from CDC tools, would otherwise fail later with obscure errors.
+	if v, ok := msg.Parameters["replication"]; ok {
+		kind := "physical"
+		if strings.EqualFold(v, "database") {
+			kind = "logical"
+		} else if on, err := parseBool(v); err == nil && !on {
+			return nil
+		}
+		return newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("%s replication is not supported by piggo", kind))
+	}
+	return nil
+}
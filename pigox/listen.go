@@ -0,0 +1,98 @@
+package pigox
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// Listen opens a TCP listener for each of the given addresses.
+//
+// IPv4 literals listen on IPv4 only and IPv6 literals on IPv6 only. The IPv6 wildcard address ([::]) listens
+// dual-stack, accepting IPv4 clients as IPv4-mapped addresses, unless an IPv4 address on the same port is listed too,
+// in which case it is restricted to IPv6 so that both listeners can be bound. Host names and empty hosts
+// (e.g. ":5432") use the system default, which is dual-stack on most platforms.
+func Listen(addresses []string) ([]net.Listener, error) {
+	var lns []net.Listener
+	for _, address := range addresses {
+		ln, err := net.Listen(listenNetwork(address, addresses), address)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("cannot listen on %q: %w", address, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+func listenNetwork(address string, all []string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "tcp"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	case !ip.IsUnspecified():
+		return "tcp6"
+	}
+	for _, other := range all {
+		if h, p, err := net.SplitHostPort(other); err == nil && p == port {
+			if ip := net.ParseIP(h); ip != nil && ip.To4() != nil {
+				// go sets IPV6_V6ONLY for wildcard addresses on the "tcp6" network.
+				return "tcp6"
+			}
+		}
+	}
+	return "tcp"
+}
+
+// UnixSocketPath returns the path of the unix socket a postgres server listening on port creates in dir,
+// e.g. /var/run/postgresql/.s.PGSQL.5432, which is where clients look for it.
+func UnixSocketPath(dir string, port int) string {
+	return filepath.Join(dir, fmt.Sprintf(".s.PGSQL.%d", port))
+}
+
+// ListenUnix opens a unix socket listener in each of the given directories, named like the sockets of a postgres
+// server listening on port (see UnixSocketPath). Like postgres, any local user can connect to the sockets; see
+// WithPeerAuth to authenticate them. Stale sockets left behind by a process that is gone are replaced.
+func ListenUnix(dirs []string, port int) ([]net.Listener, error) {
+	var lns []net.Listener
+	for _, dir := range dirs {
+		path := UnixSocketPath(dir, port)
+		removeStaleSocket(path)
+		ln, err := net.Listen("unix", path)
+		if err == nil {
+			err = os.Chmod(path, 0o777)
+		}
+		if err != nil {
+			if ln != nil {
+				ln.Close()
+			}
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("cannot listen on %q: %w", path, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// removeStaleSocket removes the unix socket at path if no process accepts connections on it.
+func removeStaleSocket(path string) {
+	if fi, err := os.Lstat(path); err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
@@ -0,0 +1,92 @@
+package pigox
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+)
+
+// QueryLogMode tells how the text of queries appears in logs.
+type QueryLogMode string
+
+const (
+	// QueryLogFull logs the full text of queries.
+	QueryLogFull QueryLogMode = "full"
+	// QueryLogTruncate logs the text of queries truncated to a maximum length.
+	QueryLogTruncate QueryLogMode = "truncate"
+	// QueryLogOmit leaves the text of queries out of logs; slow queries and shadow read divergences are still
+	// identified by their fingerprint.
+	QueryLogOmit QueryLogMode = "omit"
+)
+
+// DefaultQueryLogLength is the length queries are truncated to in logs by QueryLogTruncate.
+const DefaultQueryLogLength = 256
+
+// ParseQueryLogMode parses a query log mode: full, truncate or omit.
+func ParseQueryLogMode(s string) (QueryLogMode, error) {
+	switch m := QueryLogMode(strings.ToLower(s)); m {
+	case QueryLogFull, QueryLogTruncate, QueryLogOmit:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid query log mode %q (expected full, truncate or omit)", s)
+}
+
+// WithLogger sets the logger the proxy logs to. Log lines about a connection carry its remote address and, once
+// the client started up, its user, database and session id. Defaults to slog.Default().
+func WithLogger(logger *slog.Logger) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.logger = logger
+	}
+}
+
+// WithQueryLogging sets how query text is logged; QueryLogTruncate truncates it to maxLength bytes, or to
+// DefaultQueryLogLength if maxLength is not positive. Defaults to QueryLogFull.
+func WithQueryLogging(mode QueryLogMode, maxLength int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.queryLogMode = mode
+		opts.queryLogLength = maxLength
+	}
+}
+
+// baseLogger returns the logger set with WithLogger; it is the default logger if none is set.
+func (o *proxyOptions) baseLogger() *slog.Logger {
+	if o.logger == nil {
+		return slog.Default()
+	}
+	return o.logger
+}
+
+// queryAttr returns the log attribute of query, redacted as set with WithQueryLogging; handlers ignore the empty
+// attribute returned if queries are omitted.
+func (o *proxyOptions) queryAttr(query string) slog.Attr {
+	switch o.queryLogMode {
+	case QueryLogOmit:
+		return slog.Attr{}
+	case QueryLogTruncate:
+		n := o.queryLogLength
+		if n <= 0 {
+			n = DefaultQueryLogLength
+		}
+		if len(query) > n {
+			// don't split multi-byte characters.
+			for n > 0 && !utf8.RuneStart(query[n]) {
+				n--
+			}
+			return slog.String("query", query[:n]+"...")
+		}
+	}
+	return slog.String("query", query)
+}
+
+// sessionLogger returns the logger of the connection of a session, with the attributes identifying the session.
+func (p *Proxy) sessionLogger(s *session) *slog.Logger {
+	args := []interface{}{"user", s.userName, "database", s.databaseName, "session", s.pid}
+	if s.applicationName != "" {
+		args = append(args, "application", s.applicationName)
+	}
+	if len(s.labels) > 0 {
+		args = append(args, "labels", formatLabels(s.labels))
+	}
+	return p.log.With(args...)
+}
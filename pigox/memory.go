@@ -0,0 +1,108 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/jackc/pgerrcode"
+)
+
+// memoryBudget accounts the memory held by the in-flight results of all sessions, approximated by the size of
+// the Arrow batches being converted plus that of the encoded messages not yet sent. New queries are only admitted
+// while the total is under the limit, so that concurrent large exports cannot get the proxy OOM-killed.
+type memoryBudget struct {
+	limit int64
+
+	mu   sync.Mutex
+	used int64
+	// released is closed, and replaced, whenever memory is released.
+	released chan struct{}
+}
+
+// newMemoryBudget returns a budget of limit bytes, or nil if limit is zero (unlimited).
+func newMemoryBudget(limit int64) *memoryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &memoryBudget{limit: limit, released: make(chan struct{})}
+}
+
+// admit waits up to wait for the memory in use to drop below the limit.
+// It returns the account the result memory of the admitted query is to be held on.
+func (b *memoryBudget) admit(ctx context.Context, wait time.Duration) (*resultMemory, error) {
+	if b == nil {
+		return nil, nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		b.mu.Lock()
+		used, released := b.used, b.released
+		b.mu.Unlock()
+		if used < b.limit {
+			return &resultMemory{budget: b}, nil
+		}
+		select {
+		case <-released:
+		case <-timer.C:
+			return nil, newPGError(pgerrcode.OutOfMemory, fmt.Errorf("proxy result memory limit of %d bytes reached, try again later", b.limit))
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (b *memoryBudget) add(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used += n
+	if n < 0 {
+		close(b.released)
+		b.released = make(chan struct{})
+	}
+}
+
+// resultMemory is the memory held by the result of a single query. A nil resultMemory accounts nothing.
+type resultMemory struct {
+	budget *memoryBudget
+	held   int64
+}
+
+// hold sets the memory currently held by the result to n bytes.
+func (m *resultMemory) hold(n int64) {
+	if m == nil || n == m.held {
+		return
+	}
+	m.budget.add(n - m.held)
+	m.held = n
+}
+
+// release releases all the memory held by the result.
+func (m *resultMemory) release() {
+	m.hold(0)
+}
+
+// recordSize returns the size of the buffers of a record batch.
+func recordSize(rec arrow.Record) int64 {
+	var n int64
+	for _, col := range rec.Columns() {
+		n += arrayDataSize(col.Data())
+	}
+	return n
+}
+
+func arrayDataSize(d arrow.ArrayData) int64 {
+	var n int64
+	for _, b := range d.Buffers() {
+		if b != nil {
+			n += int64(b.Len())
+		}
+	}
+	for _, c := range d.Children() {
+		n += arrayDataSize(c)
+	}
+	return n
+}
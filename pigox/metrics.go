@@ -0,0 +1,158 @@
+package pigox
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics receives the instrumentation events of the proxy, e.g. to export them to a monitoring system; see
+// NewPrometheusMetrics. The methods are called concurrently by all connections, and must not block.
+type Metrics interface {
+	// ConnectionOpened and ConnectionClosed are called when a client connection is accepted and closed.
+	ConnectionOpened()
+	ConnectionClosed()
+	// StartupFailed is called when a connection fails before completing the startup handshake, e.g. because
+	// authentication failed, with the SQLSTATE code of the error.
+	StartupFailed(code string)
+	// QueryExecuted is called when a query completes, with the time it took; code is the SQLSTATE code of its
+	// error, empty if it succeeded.
+	QueryExecuted(d time.Duration, code string)
+	// ResultStreamed is called whenever rows of a result are sent to a client, with their number and size.
+	ResultStreamed(rows, bytes int)
+	// ErrorReported is called for each error reported to a client, with its SQLSTATE code.
+	ErrorReported(code string)
+	// ResultCacheLookup is called whenever a query looks up the result cache, telling whether its result was
+	// cached; see WithResultCache.
+	ResultCacheLookup(hit bool)
+}
+
+// WithMetrics sends the instrumentation events of the proxy to m.
+func WithMetrics(m Metrics) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.metrics = m
+	}
+}
+
+// noMetrics discards the instrumentation events.
+type noMetrics struct{}
+
+func (noMetrics) ConnectionOpened()                   {}
+func (noMetrics) ConnectionClosed()                   {}
+func (noMetrics) StartupFailed(string)                {}
+func (noMetrics) QueryExecuted(time.Duration, string) {}
+func (noMetrics) ResultStreamed(int, int)             {}
+func (noMetrics) ErrorReported(string)                {}
+func (noMetrics) ResultCacheLookup(bool)              {}
+
+// errorCode returns the SQLSTATE code clients see err with.
+func errorCode(err error) string {
+	var perr *pgError
+	if errors.As(err, &perr) {
+		return perr.code
+	}
+	return pgerrcode.InternalError
+}
+
+// PrometheusMetrics is a Metrics exporting the instrumentation events as Prometheus metrics.
+type PrometheusMetrics struct {
+	connections      prometheus.Gauge
+	connectionsTotal prometheus.Counter
+	startupFailures  *prometheus.CounterVec
+	queries          *prometheus.CounterVec
+	queryDuration    prometheus.Histogram
+	rows             prometheus.Counter
+	bytes            prometheus.Counter
+	errors           *prometheus.CounterVec
+	resultCache      *prometheus.CounterVec
+}
+
+// NewPrometheusMetrics returns a Metrics exporting the piggo_* metrics, registered with reg.
+func NewPrometheusMetrics(reg prometheus.Registerer) (*PrometheusMetrics, error) {
+	m := &PrometheusMetrics{
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "piggo_connections",
+			Help: "Number of open client connections.",
+		}),
+		connectionsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "piggo_connections_total",
+			Help: "Number of client connections accepted.",
+		}),
+		startupFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "piggo_startup_failures_total",
+			Help: "Number of connections that failed before completing the startup, by SQLSTATE code (28P01 is a failed authentication).",
+		}, []string{"code"}),
+		queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "piggo_queries_total",
+			Help: "Number of queries executed, by status (ok or error).",
+		}, []string{"status"}),
+		queryDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "piggo_query_duration_seconds",
+			Help:    "Latency of the queries, up to the last row sent to the client.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+		rows: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "piggo_result_rows_total",
+			Help: "Number of result rows sent to clients.",
+		}),
+		bytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "piggo_result_bytes_total",
+			Help: "Size in bytes of the result rows sent to clients.",
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "piggo_errors_total",
+			Help: "Number of errors reported to clients, by SQLSTATE code.",
+		}, []string{"code"}),
+		resultCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "piggo_result_cache_lookups_total",
+			Help: "Number of result cache lookups, by result (hit or miss).",
+		}, []string{"result"}),
+	}
+	for _, c := range []prometheus.Collector{m.connections, m.connectionsTotal, m.startupFailures, m.queries, m.queryDuration, m.rows, m.bytes, m.errors, m.resultCache} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *PrometheusMetrics) ConnectionOpened() {
+	m.connections.Inc()
+	m.connectionsTotal.Inc()
+}
+
+func (m *PrometheusMetrics) ConnectionClosed() {
+	m.connections.Dec()
+}
+
+func (m *PrometheusMetrics) StartupFailed(code string) {
+	m.startupFailures.WithLabelValues(code).Inc()
+}
+
+func (m *PrometheusMetrics) QueryExecuted(d time.Duration, code string) {
+	status := "ok"
+	if code != "" {
+		status = "error"
+	}
+	m.queries.WithLabelValues(status).Inc()
+	m.queryDuration.Observe(d.Seconds())
+}
+
+func (m *PrometheusMetrics) ResultStreamed(rows, bytes int) {
+	m.rows.Add(float64(rows))
+	m.bytes.Add(float64(bytes))
+}
+
+func (m *PrometheusMetrics) ErrorReported(code string) {
+	m.errors.WithLabelValues(code).Inc()
+}
+
+func (m *PrometheusMetrics) ResultCacheLookup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.resultCache.WithLabelValues(result).Inc()
+}
@@ -0,0 +1,63 @@
+package pigox
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sync/atomic"
+)
+
+// maxMirroredQueries bounds the number of mirrored queries running at the same time; queries sampled
+// while the limit is reached are not mirrored, so that a slow mirror backend cannot pile up goroutines.
+const maxMirroredQueries = 64
+
+// queryMirror tees a sample of the queries to a backend under test, discarding the results.
+type queryMirror struct {
+	backend *secondaryBackend
+	// percent is the percentage of the queries that is mirrored.
+	percent  float64
+	inflight chan struct{}
+	// skipped counts the sampled queries that weren't mirrored because too many were running.
+	skipped uint64
+}
+
+func newQueryMirror(backend *secondaryBackend, percent float64) *queryMirror {
+	return &queryMirror{backend: backend, percent: percent, inflight: make(chan struct{}, maxMirroredQueries)}
+}
+
+// mirrorQuery asynchronously runs a copy of a query on the mirror backend, if the query is sampled.
+func (p *Proxy) mirrorQuery(session *session, query string) {
+	m := p.mirror
+	if m == nil || rand.Float64()*100 >= m.percent {
+		return
+	}
+	select {
+	case m.inflight <- struct{}{}:
+	default:
+		if n := atomic.AddUint64(&m.skipped, 1); n&(n-1) == 0 {
+			p.log.Warn("not mirroring queries: too many already running", "running", maxMirroredQueries, "skipped", n)
+		}
+		return
+	}
+	s := *session
+	logger := p.log
+	go func() {
+		defer func() { <-m.inflight }()
+		ctx, cancel := context.WithTimeout(context.Background(), shadowQueryTimeout)
+		defer cancel()
+		reader, err := m.backend.query(ctx, &s, query)
+		if err != nil {
+			logger.Debug("mirrored query failed", "err", err)
+			return
+		}
+		defer reader.Release()
+		for {
+			if _, err := reader.Read(); err != nil {
+				if err != io.EOF {
+					logger.Debug("mirrored query failed", "err", err)
+				}
+				return
+			}
+		}
+	}()
+}
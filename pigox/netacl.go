@@ -0,0 +1,77 @@
+package pigox
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// networkACL restricts the source addresses clients can connect from.
+type networkACL struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+// allows reports whether a client connecting from addr may proceed to the startup exchange.
+// Denied networks take precedence over allowed ones; when no network is allowed explicitly, any
+// address that is not denied is allowed. Addresses that aren't IP addresses (e.g. unix sockets) are
+// always allowed.
+//
+// The rules of each address family only match the clients of that family: IPv4 clients accepted by a dual-stack
+// listener as IPv4-mapped IPv6 addresses (::ffff:10.0.0.1) match the IPv4 networks, not the IPv6 ones.
+func (a *networkACL) allows(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		return true
+	}
+	if containsIP(a.denied, ip) {
+		return false
+	}
+	return len(a.allowed) == 0 || containsIP(a.allowed, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNetworks parses CIDR networks like 10.0.0.0/8 or fd00::/8. A bare address matches only itself, and the
+// keywords ipv4 and ipv6 match every address of their family, e.g. to deny IPv6 clients on a dual-stack listener.
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+		switch strings.ToLower(s) {
+		case "ipv4":
+			nets = append(nets, &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 8*net.IPv4len)})
+			continue
+		case "ipv6":
+			nets = append(nets, &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)})
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", s)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,43 @@
+package pigox
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNetworkACLAddressFamilies(t *testing.T) {
+	tests := []struct {
+		allowed, denied []string
+		addr            string
+		want            bool
+	}{
+		{nil, nil, "10.0.0.1", true},
+		{[]string{"ipv4"}, nil, "10.0.0.1", true},
+		{[]string{"ipv4"}, nil, "::ffff:10.0.0.1", true},
+		{[]string{"ipv4"}, nil, "fd00::1", false},
+		{[]string{"ipv6"}, nil, "fd00::1", true},
+		{[]string{"ipv6"}, nil, "::ffff:10.0.0.1", false},
+		{nil, []string{"ipv6"}, "::1", false},
+		{nil, []string{"ipv6"}, "::ffff:127.0.0.1", true},
+		{nil, []string{"IPv4"}, "127.0.0.1", false},
+		// per family rules, e.g. IPv4 clients of a private network and any IPv6 client but one.
+		{[]string{"10.0.0.0/8", "ipv6"}, []string{"fd00::bad"}, "::ffff:10.1.2.3", true},
+		{[]string{"10.0.0.0/8", "ipv6"}, []string{"fd00::bad"}, "192.168.0.1", false},
+		{[]string{"10.0.0.0/8", "ipv6"}, []string{"fd00::bad"}, "fd00::1", true},
+		{[]string{"10.0.0.0/8", "ipv6"}, []string{"fd00::bad"}, "fd00::bad", false},
+	}
+	for _, tt := range tests {
+		allowed, err := ParseNetworks(tt.allowed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		denied, err := ParseNetworks(tt.denied)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acl := networkACL{allowed: allowed, denied: denied}
+		if got := acl.allows(&net.TCPAddr{IP: net.ParseIP(tt.addr), Port: 5432}); got != tt.want {
+			t.Errorf("allowed %v, denied %v: %s allowed %v, want %v", tt.allowed, tt.denied, tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package pigox
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// messageLevels orders the message levels of client_min_messages; the messages of lower levels are not sent.
+var messageLevels = map[string]int{
+	"debug5":  1,
+	"debug4":  2,
+	"debug3":  3,
+	"debug2":  4,
+	"debug1":  5,
+	"log":     6,
+	"notice":  7,
+	"warning": 8,
+	"error":   9,
+}
+
+func canonicalMessageLevel(value string) (string, error) {
+	value = strings.ToLower(value)
+	if value == "debug" {
+		value = "debug2"
+	}
+	if _, ok := messageLevels[value]; !ok {
+		return "", fmt.Errorf("expected debug5, debug4, debug3, debug2, debug1, log, notice, warning or error")
+	}
+	return value, nil
+}
+
+// notice returns a NoticeResponse of the given severity, NOTICE or WARNING, or nil if the client_min_messages
+// setting of the session filters it out.
+func notice(s *session, severity, code, format string, args ...interface{}) *pgproto3.NoticeResponse {
+	if messageLevels[strings.ToLower(severity)] < messageLevels[s.settings["client_min_messages"]] {
+		return nil
+	}
+	return &pgproto3.NoticeResponse{
+		Severity:            severity,
+		SeverityUnlocalized: severity,
+		Code:                code,
+		Message:             fmt.Sprintf(format, args...),
+	}
+}
+
+// writeNotice sends a notice to the client, unless the session filters it out.
+func (p *Proxy) writeNotice(s *session, severity, code, format string, args ...interface{}) error {
+	if n := notice(s, severity, code, format, args...); n != nil {
+		return writeMessages(p.conn, n)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// defaultNotifyInterval is how often IOx is polled for the channels a session listens on unless configured.
+const defaultNotifyInterval = 5 * time.Second
+
+// notifyStatement is a parsed `LISTEN channel`, `UNLISTEN channel` or `UNLISTEN *` statement.
+type notifyStatement struct {
+	verb string // "listen" or "unlisten"
+	// channel is empty for UNLISTEN *.
+	channel string
+}
+
+// parseNotifyStatement parses LISTEN and UNLISTEN statements. It returns nil if query is neither.
+// NOTIFY is rejected: channels are fed by the rows written to IOx.
+func parseNotifyStatement(query string) (*notifyStatement, error) {
+	toks := significant(scanSQL(trimStatement(query)))
+	if len(toks) == 0 {
+		return nil, nil
+	}
+	switch {
+	case toks[0].is("notify"):
+		return nil, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("NOTIFY is not supported: notifications are sent when new rows are written to IOx"))
+	case toks[0].is("listen"), toks[0].is("unlisten"):
+	default:
+		return nil, nil
+	}
+	stmt := &notifyStatement{verb: toks[0].identName()}
+	switch {
+	case len(toks) == 2 && stmt.verb == "unlisten" && toks[1].is("*"):
+	case len(toks) == 2 && (toks[1].kind == tokIdent || toks[1].kind == tokQuotedIdent):
+		stmt.channel = toks[1].identName()
+	default:
+		return nil, newPGError(pgerrcode.SyntaxError, fmt.Errorf("syntax error: expected %s channel", toks[0].text))
+	}
+	return stmt, nil
+}
+
+// handleNotifyStatement runs a LISTEN or UNLISTEN statement. Only errors writing to the client are returned.
+//
+// Listening on a channel polls IOx for rows more recent than the time of the LISTEN: the rows of the table
+// named like the channel, or of the query the channel is mapped to with WithNotifyChannels. A NotificationResponse
+// is sent for each poll finding new rows, with the number of new rows as payload. Like postgres, notifications are
+// only delivered while the session is not running a statement.
+func (p *Proxy) handleNotifyStatement(ctx context.Context, session *session, stmt *notifyStatement) error {
+	if stmt.verb == "unlisten" {
+		for channel, stop := range session.listening {
+			if stmt.channel == "" || stmt.channel == channel {
+				stop()
+				delete(session.listening, channel)
+			}
+		}
+		return writeMessages(p.conn, &pgproto3.CommandComplete{CommandTag: []byte("UNLISTEN")})
+	}
+
+	if _, ok := session.listening[stmt.channel]; !ok {
+		query, ok := p.notifyChannels[stmt.channel]
+		if !ok {
+			query = stmt.channel
+		}
+		if !isSelect(query) {
+			query = "SELECT * FROM " + quoteIdent(query)
+		}
+		interval := p.notifyInterval
+		if interval <= 0 {
+			interval = defaultNotifyInterval
+		}
+		lctx, stop := context.WithCancel(ctx)
+		if session.listening == nil {
+			session.listening = map[string]context.CancelFunc{}
+		}
+		session.listening[stmt.channel] = stop
+		l := &channelListener{p: p, session: session, channel: stmt.channel, query: query, since: time.Now()}
+		go l.run(lctx, interval)
+	}
+	return writeMessages(p.conn, &pgproto3.CommandComplete{CommandTag: []byte("LISTEN")})
+}
+
+// channelListener polls IOx for the new rows of a channel.
+type channelListener struct {
+	p       *Proxy
+	session *session
+	channel string
+	query   string
+
+	// since is the time of the most recent row notified.
+	since time.Time
+	// pending counts the new rows not notified yet because the session was busy.
+	pending int64
+}
+
+func (l *channelListener) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := l.poll(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			l.p.log.Warn("cannot poll for new rows of channel", "channel", l.channel, "err", err)
+		}
+		if l.pending == 0 {
+			continue
+		}
+		msg := &pgproto3.NotificationResponse{PID: uint32(l.session.pid), Channel: l.channel, Payload: strconv.FormatInt(l.pending, 10)}
+		var err error
+		if l.p.lifecycle.whileIdle(func() { err = writeMessages(l.p.conn, msg) }) {
+			if err != nil {
+				return
+			}
+			l.pending = 0
+		}
+	}
+}
+
+// poll counts the rows more recent than the last ones notified.
+func (l *channelListener) poll(ctx context.Context) error {
+	q := fmt.Sprintf("SELECT count(*), max(%[1]s) FROM (%[2]s) AS piggo_listen WHERE %[1]s > %[3]s",
+		quoteIdent(tailTimeColumn), l.query, timestampLiteral(l.since))
+	// the session settings may be changed meanwhile, so the query bypasses runQuery.
+	reader, err := l.p.query(withQueryMetadata(ctx, l.session, q), l.session, q)
+	if err != nil {
+		return err
+	}
+	defer reader.Release()
+	rec, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	if rec.NumRows() != 1 || rec.NumCols() != 2 {
+		return fmt.Errorf("unexpected result shape")
+	}
+	count, ok := rec.Column(0).(*array.Int64)
+	if !ok {
+		return fmt.Errorf("unexpected count type %s", rec.Column(0).DataType())
+	}
+	last, ok := rec.Column(1).(*array.Timestamp)
+	if !ok {
+		return fmt.Errorf("unexpected %q column type %s", tailTimeColumn, rec.Column(1).DataType())
+	}
+	if count.Value(0) == 0 || last.IsNull(0) {
+		return nil
+	}
+	l.pending += count.Value(0)
+	l.since = last.Value(0).ToTime(last.DataType().(*arrow.TimestampType).Unit)
+	return nil
+}
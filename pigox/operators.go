@@ -0,0 +1,211 @@
+package pigox
+
+import (
+	"strings"
+)
+
+// nonFunctionKeywords are keywords that can precede a parenthesized expression without being a function name.
+var nonFunctionKeywords = map[string]bool{
+	"and": true, "or": true, "not": true, "where": true, "on": true, "having": true, "when": true,
+	"then": true, "else": true, "select": true, "by": true, "in": true, "like": true, "ilike": true,
+	"is": true, "from": true, "as": true, "case": true, "exists": true,
+}
+
+// rewriteTextOperators rewrites the postgres pattern matching operators IOx does not support into equivalent
+// DataFusion expressions:
+//
+//	a ILIKE b      lower(a) LIKE lower(b)
+//	a NOT ILIKE b  lower(a) NOT LIKE lower(b)
+//	a ~ b          (regexp_match(a, b) IS NOT NULL)
+//	a ~* b         (regexp_match(a, b, 'i') IS NOT NULL)
+//	a !~ b         (regexp_match(a, b) IS NULL)
+//	a !~* b        (regexp_match(a, b, 'i') IS NULL)
+//
+// Unlike in postgres, the negated regular expression operators return true rather than NULL for a NULL input.
+func rewriteTextOperators(query string) string {
+	lower := strings.ToLower(query)
+	if !strings.Contains(lower, "ilike") && !strings.Contains(query, "~") {
+		return query
+	}
+	toks := scanSQL(query)
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		if !(t.is("ilike") || t.is("~") || t.is("~*") || t.is("!~") || t.is("!~*")) {
+			continue
+		}
+		leftEnd := prevSignificant(toks, i)
+		negated := false
+		if t.is("ilike") && leftEnd >= 0 && toks[leftEnd].is("not") {
+			negated = true
+			leftEnd = prevSignificant(toks, leftEnd)
+		}
+		if leftEnd < 0 {
+			continue
+		}
+		leftStart := operandStart(toks, leftEnd)
+		rightStart := nextSignificant(toks, i)
+		if rightStart < 0 {
+			continue
+		}
+		rightEnd := operandEnd(toks, rightStart)
+		if leftStart < 0 || rightEnd < 0 {
+			continue
+		}
+		left := strings.TrimSpace(joinTokens(toks[leftStart : leftEnd+1]))
+		right := strings.TrimSpace(joinTokens(toks[rightStart : rightEnd+1]))
+
+		var expr string
+		switch {
+		case t.is("ilike") && negated:
+			expr = "lower(" + left + ") NOT LIKE lower(" + right + ")"
+		case t.is("ilike"):
+			expr = "lower(" + left + ") LIKE lower(" + right + ")"
+		default:
+			args := left + ", " + right
+			if strings.HasSuffix(t.text, "*") {
+				args += ", 'i'"
+			}
+			test := "IS NOT NULL"
+			if strings.HasPrefix(t.text, "!") {
+				test = "IS NULL"
+			}
+			expr = "(regexp_match(" + args + ") " + test + ")"
+		}
+
+		res := append([]token{}, toks[:leftStart]...)
+		res = append(res, token{kind: tokIdent, text: expr})
+		res = append(res, toks[rightEnd+1:]...)
+		toks = scanSQL(joinTokens(res))
+		i = -1
+	}
+	return joinTokens(toks)
+}
+
+func prevSignificant(toks []token, i int) int {
+	for i--; i >= 0; i-- {
+		if !toks[i].isBlank() {
+			return i
+		}
+	}
+	return -1
+}
+
+func nextSignificant(toks []token, i int) int {
+	for i++; i < len(toks); i++ {
+		if !toks[i].isBlank() {
+			return i
+		}
+	}
+	return -1
+}
+
+// operandStart returns the index of the first token of the operand ending at the token with index end,
+// or -1 if it cannot be determined.
+func operandStart(toks []token, end int) int {
+	// trailing casts, e.g. a::text
+	for toks[end].kind == tokIdent {
+		p := prevSignificant(toks, end)
+		if p < 0 || !toks[p].is("::") {
+			break
+		}
+		if end = prevSignificant(toks, p); end < 0 {
+			return -1
+		}
+	}
+
+	start := end
+	switch t := toks[end]; {
+	case t.is(")"):
+		depth := 0
+		for start = end; start >= 0; start-- {
+			if toks[start].is(")") {
+				depth++
+			} else if toks[start].is("(") {
+				if depth--; depth == 0 {
+					break
+				}
+			}
+		}
+		if start < 0 {
+			return -1
+		}
+		if p := prevSignificant(toks, start); p >= 0 && toks[p].kind == tokIdent && !nonFunctionKeywords[strings.ToLower(toks[p].text)] {
+			start = p
+		}
+	case t.kind == tokIdent && nonFunctionKeywords[strings.ToLower(t.text)]:
+		return -1
+	case t.kind == tokIdent || t.kind == tokQuotedIdent:
+		for {
+			dot := prevSignificant(toks, start)
+			if dot < 0 || !toks[dot].is(".") {
+				break
+			}
+			p := prevSignificant(toks, dot)
+			if p < 0 || !(toks[p].kind == tokIdent || toks[p].kind == tokQuotedIdent) {
+				break
+			}
+			start = p
+		}
+	case t.kind == tokString || t.kind == tokNumber || t.kind == tokParam:
+	default:
+		return -1
+	}
+	return start
+}
+
+// operandEnd returns the index of the last token of the operand starting at the token with index start,
+// or -1 if it cannot be determined.
+func operandEnd(toks []token, start int) int {
+	end := start
+	switch t := toks[start]; {
+	case t.is("("):
+		if end = closingParen(toks, start); end < 0 {
+			return -1
+		}
+	case t.kind == tokIdent || t.kind == tokQuotedIdent:
+		for {
+			n := nextSignificant(toks, end)
+			switch {
+			case n >= 0 && toks[n].is("."):
+				if m := nextSignificant(toks, n); m >= 0 && (toks[m].kind == tokIdent || toks[m].kind == tokQuotedIdent || toks[m].is("*")) {
+					end = m
+					continue
+				}
+			case n >= 0 && toks[n].is("(") && t.kind == tokIdent:
+				if end = closingParen(toks, n); end < 0 {
+					return -1
+				}
+			}
+			break
+		}
+	case t.kind == tokString || t.kind == tokNumber || t.kind == tokParam:
+	default:
+		return -1
+	}
+
+	// trailing casts, e.g. $1::text or 'a'::varchar(10)
+	for {
+		n := nextSignificant(toks, end)
+		if n < 0 || !toks[n].is("::") {
+			return end
+		}
+		typ := nextSignificant(toks, n)
+		if typ < 0 || toks[typ].kind != tokIdent {
+			return end
+		}
+		end = typ
+		if p := nextSignificant(toks, end); p >= 0 && toks[p].is("(") {
+			if end = closingParen(toks, p); end < 0 {
+				return -1
+			}
+		}
+	}
+}
+
+// closingParen returns the index of the parenthesis closing the one at index open.
+func closingParen(toks []token, open int) int {
+	if end := matchingParen(toks[open:]); end >= 0 {
+		return open + end
+	}
+	return -1
+}
@@ -0,0 +1,53 @@
+package pigox
+
+// orderTimeColumn is the column time-series results are ordered by when piggo.order_by_time is on.
+const orderTimeColumn = "time"
+
+// systemSchemas are the schemas of the tables without a time column.
+var systemSchemas = map[string]bool{"information_schema": true, "system": true, "pg_catalog": true}
+
+// injectTimeOrder appends `ORDER BY "time"` to a SELECT returning a time column and lacking an ORDER BY clause,
+// before its LIMIT clause if any. Grafana assumes time series rows to be ordered, and IOx doesn't return them
+// in any particular order. Other queries are returned unchanged.
+func injectTimeOrder(query string) string {
+	query = trimStatement(query)
+	all := scanSQL(query)
+
+	hasTime := false
+	for _, item := range selectListItems(all) {
+		toks := significant(all[item[0]:item[1]])
+		if len(toks) == 0 {
+			continue
+		}
+		last := toks[len(toks)-1]
+		if last.is("*") || ((last.kind == tokIdent || last.kind == tokQuotedIdent) && last.identName() == orderTimeColumn) {
+			hasTime = true
+		}
+	}
+	if !hasTime {
+		return query
+	}
+
+	toks := significant(all)
+	insert := len(query)
+	depth := 0
+	for i, t := range toks {
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		case depth > 0:
+		case t.is("order"), t.is("union"), t.is("intersect"), t.is("except"), t.is("into"):
+			return query
+		case t.is("from") && i+2 < len(toks) && systemSchemas[toks[i+1].identName()] && toks[i+2].is("."):
+			return query
+		case (t.is("limit") || t.is("offset") || t.is("fetch")) && insert == len(query):
+			insert = t.pos
+		}
+	}
+	if insert == len(query) {
+		return query + " ORDER BY " + quoteIdent(orderTimeColumn)
+	}
+	return query[:insert] + "ORDER BY " + quoteIdent(orderTimeColumn) + " " + query[insert:]
+}
@@ -0,0 +1,117 @@
+package pigox
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// defaultParameterStatus are the run-time parameters reported to clients after authentication, with the values
+// postgres reports. Several drivers refuse to work without some of them, e.g. standard_conforming_strings.
+var defaultParameterStatus = map[string]string{
+	"server_version":              "14.2",
+	"server_encoding":             "UTF8",
+	"client_encoding":             "UTF8",
+	"DateStyle":                   "ISO, MDY",
+	"IntervalStyle":               "postgres",
+	"TimeZone":                    "UTC",
+	"integer_datetimes":           "on",
+	"standard_conforming_strings": "on",
+	"is_superuser":                "off",
+	"in_hot_standby":              "off",
+}
+
+// parameterStatus returns the ParameterStatus messages sent to a session at startup, sorted by name.
+// The configured parameters override the defaults; an empty value suppresses a parameter.
+// Parameters set by the session itself take precedence.
+func (p *Proxy) parameterStatus(s *session) []pgproto3.Message {
+	params := map[string]string{
+		"session_authorization": s.userName,
+		"application_name":      s.applicationName,
+	}
+	for name, value := range defaultParameterStatus {
+		params[name] = value
+	}
+	for name, value := range p.parameterStatusOverrides {
+		if value == "" {
+			delete(params, name)
+		} else {
+			params[name] = value
+		}
+	}
+	// the parameters the client can change, possibly already in the startup message.
+	for name, setting := range sessionSettings {
+		if _, ok := params[setting.report]; ok {
+			params[setting.report] = s.settings[name]
+		}
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]pgproto3.Message, len(names))
+	for i, name := range names {
+		msgs[i] = &pgproto3.ParameterStatus{Name: name, Value: params[name]}
+	}
+	return msgs
+}
+
+// reportedParameter returns the value of a run-time parameter reported to clients at startup.
+func (o *proxyOptions) reportedParameter(name string) string {
+	if v, ok := o.parameterStatusOverrides[name]; ok {
+		return v
+	}
+	return defaultParameterStatus[name]
+}
+
+func canonicalTimeZone(value string) (string, error) {
+	if _, err := time.LoadLocation(value); err != nil {
+		return "", fmt.Errorf("unknown time zone")
+	}
+	return value, nil
+}
+
+// canonicalDateStyle accepts the ISO output style, which is the only one the proxy renders dates in,
+// with any field order.
+func canonicalDateStyle(value string) (string, error) {
+	style, order := "ISO", "MDY"
+	for _, part := range strings.Split(value, ",") {
+		switch p := strings.ToUpper(strings.TrimSpace(part)); p {
+		case "ISO":
+		case "MDY", "DMY", "YMD":
+			order = p
+		case "US", "NONEURO", "NONEUROPEAN":
+			order = "MDY"
+		case "EURO", "EUROPEAN":
+			order = "DMY"
+		case "SQL", "POSTGRES", "GERMAN":
+			style = p
+		default:
+			return "", fmt.Errorf("unrecognized date style %q", strings.TrimSpace(part))
+		}
+	}
+	if style != "ISO" {
+		return "", fmt.Errorf("only the ISO date style is supported")
+	}
+	return style + ", " + order, nil
+}
+
+func canonicalIntervalStyle(value string) (string, error) {
+	if v := strings.ToLower(value); v != "postgres" {
+		return "", fmt.Errorf("only the postgres interval style is supported")
+	}
+	return "postgres", nil
+}
+
+func canonicalClientEncoding(value string) (string, error) {
+	switch strings.ToUpper(strings.ReplaceAll(value, "-", "")) {
+	case "UTF8", "UNICODE":
+		return "UTF8", nil
+	}
+	return "", fmt.Errorf("only the UTF8 encoding is supported")
+}
@@ -0,0 +1,271 @@
+package pigox
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+)
+
+// comparisonOperators are the operators whose operands are expected to have the same type.
+var comparisonOperators = map[string]bool{"=": true, "<>": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// inferParameterTypes returns the type OIDs of the $n placeholders of a query.
+//
+// Types declared by the client (non-zero OIDs) take precedence. Otherwise the type is inferred from the
+// placeholder's usage: explicit casts ($1::int8, CAST($1 AS int8)), LIMIT/OFFSET/FETCH counts, pattern matching,
+// and comparisons against and INSERTs into IOx's "time" column. Placeholders whose type cannot be inferred get def.
+func inferParameterTypes(query string, declared []uint32, def uint32) []uint32 {
+	sig := significant(scanSQL(query))
+
+	inferred := map[int]uint32{}
+	maxN := len(declared)
+	for i, t := range sig {
+		if t.kind != tokParam {
+			continue
+		}
+		n, err := strconv.Atoi(t.text[1:])
+		if err != nil || n < 1 {
+			continue
+		}
+		if n > maxN {
+			maxN = n
+		}
+		if _, ok := inferred[n]; ok {
+			continue
+		}
+		if oid := inferParameterType(sig, i); oid != 0 {
+			inferred[n] = oid
+		}
+	}
+	for n, oid := range insertParameterTypes(sig) {
+		if _, ok := inferred[n]; !ok {
+			inferred[n] = oid
+		}
+	}
+
+	oids := make([]uint32, maxN)
+	for i := range oids {
+		switch {
+		case i < len(declared) && declared[i] != 0:
+			oids[i] = declared[i]
+		case inferred[i+1] != 0:
+			oids[i] = inferred[i+1]
+		default:
+			oids[i] = def
+		}
+	}
+	return oids
+}
+
+// inferParameterType infers the type of the placeholder sig[i] from its context, returning 0 if unknown.
+func inferParameterType(sig []token, i int) uint32 {
+	at := func(j int) token {
+		if j < 0 || j >= len(sig) {
+			return token{}
+		}
+		return sig[j]
+	}
+
+	// $1::type
+	if at(i + 1).is("::") {
+		if oid, n := parseTypeName(sig[i+2:]); n > 0 {
+			return oid
+		}
+	}
+	// CAST($1 AS type)
+	if at(i-1).is("(") && at(i-2).is("cast") && at(i+1).is("as") {
+		if oid, n := parseTypeName(sig[i+2:]); n > 0 {
+			return oid
+		}
+	}
+
+	prev := at(i - 1)
+	switch {
+	case prev.is("limit") || prev.is("offset") || ((prev.is("first") || prev.is("next")) && at(i-2).is("fetch")):
+		return pgtype.Int8OID
+	case prev.is("like") || prev.is("ilike"):
+		return pgtype.TextOID
+	case prev.kind == tokPunct && comparisonOperators[prev.text]:
+		return columnType(at(i - 2))
+	case at(i+1).kind == tokPunct && comparisonOperators[at(i+1).text]:
+		return columnType(at(i + 2))
+	case prev.is("between"):
+		return columnType(at(i - 2))
+	case prev.is("and") && at(i-2).kind == tokParam && at(i-3).is("between"):
+		return columnType(at(i - 4))
+	}
+	return 0
+}
+
+// columnType returns the type of a column referenced by t, for the columns whose type is known without
+// looking at the schema.
+func columnType(t token) uint32 {
+	if (t.kind == tokIdent || t.kind == tokQuotedIdent) && t.identName() == "time" {
+		return pgtype.TimestampOID
+	}
+	return 0
+}
+
+// substituteParams replaces the $n placeholders of a query with the given SQL literals.
+func substituteParams(query string, literals []string) (string, error) {
+	toks := scanSQL(query)
+	for i, t := range toks {
+		if t.kind != tokParam {
+			continue
+		}
+		n, err := strconv.Atoi(t.text[1:])
+		if err != nil || n < 1 || n > len(literals) {
+			return "", newPGError(pgerrcode.UndefinedParameter, fmt.Errorf("there is no parameter %s", t.text))
+		}
+		toks[i].text = literals[n-1]
+	}
+	return joinTokens(toks), nil
+}
+
+// placeholderLiteral returns an arbitrary literal of the given type, used to run a statement
+// before its parameters are known.
+func placeholderLiteral(oid uint32) string {
+	switch oid {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.NumericOID, pgtype.Float4OID, pgtype.Float8OID, pgtype.OIDOID:
+		return "0"
+	case pgtype.BoolOID:
+		return "false"
+	case pgtype.TimestampOID, pgtype.TimestamptzOID:
+		return "CAST('1970-01-01T00:00:00Z' AS TIMESTAMP)"
+	case pgtype.DateOID:
+		return "CAST('1970-01-01' AS DATE)"
+	case pgtype.IntervalOID:
+		return "INTERVAL '0 seconds'"
+	default:
+		return "''"
+	}
+}
+
+// paramLiterals returns the SQL literals of the parameters of a Bind message, to be substituted for the
+// placeholders of a statement with the given parameter types.
+func paramLiterals(msg *pgproto3.Bind, oids []uint32) ([]string, error) {
+	if len(msg.Parameters) != len(oids) {
+		return nil, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("bind message supplies %d parameters, but prepared statement %q requires %d", len(msg.Parameters), msg.PreparedStatement, len(oids)))
+	}
+	if n := len(msg.ParameterFormatCodes); n > 1 && n != len(oids) {
+		return nil, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("bind message has %d parameter formats but %d parameters", n, len(oids)))
+	}
+	literals := make([]string, len(oids))
+	for i, v := range msg.Parameters {
+		var err error
+		switch {
+		case v == nil:
+			literals[i] = "NULL"
+		case formatCode(msg.ParameterFormatCodes, i) == pgtype.BinaryFormatCode:
+			literals[i], err = binaryParamLiteral(oids[i], v)
+		default:
+			literals[i], err = textParamLiteral(oids[i], string(v))
+		}
+		if err != nil {
+			return nil, newPGError(pgerrcode.InvalidTextRepresentation, fmt.Errorf("invalid value of parameter $%d: %w", i+1, err))
+		}
+	}
+	return literals, nil
+}
+
+// formatCode returns the format code of the i-th value from the format codes of a Bind message: no codes
+// means text, a single code applies to all values.
+func formatCode(codes []int16, i int) int16 {
+	switch {
+	case len(codes) == 0:
+		return pgtype.TextFormatCode
+	case len(codes) == 1:
+		return codes[0]
+	case i < len(codes):
+		return codes[i]
+	}
+	return pgtype.TextFormatCode
+}
+
+// textParamLiteral returns the SQL literal of a parameter value in the text format.
+func textParamLiteral(oid uint32, s string) (string, error) {
+	switch oid {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.OIDOID:
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			return "", err
+		}
+		return numberLiteral(strconv.FormatInt(n, 10)), nil
+	case pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		s = strings.TrimSpace(s)
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return "", err
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return "CAST(" + quoteString(s) + " AS DOUBLE)", nil
+		}
+		return numberLiteral(s), nil
+	case pgtype.BoolOID:
+		switch strings.ToLower(strings.TrimSpace(s)) {
+		case "t", "true", "y", "yes", "on", "1":
+			return "true", nil
+		case "f", "false", "n", "no", "off", "0":
+			return "false", nil
+		}
+		return "", fmt.Errorf("invalid boolean %q", s)
+	case pgtype.TimestampOID, pgtype.TimestamptzOID:
+		return "CAST(" + quoteString(s) + " AS TIMESTAMP)", nil
+	case pgtype.DateOID:
+		return "CAST(" + quoteString(s) + " AS DATE)", nil
+	case pgtype.IntervalOID:
+		return "INTERVAL " + quoteString(s), nil
+	}
+	return quoteString(s), nil
+}
+
+// numberLiteral parenthesizes negative numbers, which could otherwise form a comment with a preceding minus.
+func numberLiteral(s string) string {
+	if strings.HasPrefix(s, "-") {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+// binaryParamLiteral returns the SQL literal of a parameter value in the binary format.
+func binaryParamLiteral(oid uint32, b []byte) (string, error) {
+	dt, ok := pgtype.NewConnInfo().DataTypeForOID(oid)
+	if !ok {
+		return "", fmt.Errorf("binary format of type %d is not supported", oid)
+	}
+	value := pgtype.NewValue(dt.Value)
+	decoder, ok := value.(pgtype.BinaryDecoder)
+	if !ok {
+		return "", fmt.Errorf("binary format of type %s is not supported", dt.Name)
+	}
+	if err := decoder.DecodeBinary(nil, b); err != nil {
+		return "", err
+	}
+	switch v := value.(type) {
+	case *pgtype.Timestamp:
+		if v.InfinityModifier != pgtype.None {
+			return "", fmt.Errorf("infinite timestamps are not supported")
+		}
+		return timestampLiteral(v.Time), nil
+	case *pgtype.Timestamptz:
+		if v.InfinityModifier != pgtype.None {
+			return "", fmt.Errorf("infinite timestamps are not supported")
+		}
+		return timestampLiteral(v.Time), nil
+	}
+	encoder, ok := value.(pgtype.TextEncoder)
+	if !ok {
+		return "", fmt.Errorf("binary format of type %s is not supported", dt.Name)
+	}
+	text, err := encoder.EncodeText(nil, nil)
+	if err != nil {
+		return "", err
+	}
+	return textParamLiteral(oid, string(text))
+}
@@ -0,0 +1,67 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/apache/arrow/go/v7/parquet"
+	"github.com/apache/arrow/go/v7/parquet/compress"
+	"github.com/apache/arrow/go/v7/parquet/pqarrow"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+)
+
+var parquetCompressions = map[string]compress.Compression{
+	"none":   compress.Codecs.Uncompressed,
+	"snappy": compress.Codecs.Snappy,
+	"gzip":   compress.Codecs.Gzip,
+	"zstd":   compress.Codecs.Zstd,
+}
+
+func parseParquetCompression(s string) (compress.Compression, error) {
+	c, ok := parquetCompressions[strings.ToLower(s)]
+	if !ok {
+		return 0, newPGError(pgerrcode.InvalidParameterValue, fmt.Errorf("parquet compression %q not recognized (expected none, snappy, gzip or zstd)", s))
+	}
+	return c, nil
+}
+
+// writeParquetCopy writes the COPY data of a `FORMAT parquet` copy: the query results as a Parquet file.
+// Each record batch becomes a row group and is sent as soon as it is encoded; the file footer is sent last.
+// buf holds messages to send before the file.
+func writeParquetCopy(ctx context.Context, w io.Writer, buf []byte, reader recordReader, t *throttle, mem *resultMemory, compression compress.Compression) (totalRows int, err error) {
+	cw := &copyDataWriter{w: w, buf: buf}
+	props := parquet.NewWriterProperties(parquet.WithCompression(compression))
+	fw, err := pqarrow.NewFileWriter(reader.Schema(), cw, props, pqarrow.NewArrowWriterProperties(pqarrow.WithStoreSchema()))
+	if err != nil {
+		return 0, err
+	}
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if err := fw.Write(rec); err != nil {
+			return 0, err
+		}
+		totalRows += int(rec.NumRows())
+		mem.hold(recordSize(rec) + int64(cw.pending()))
+		if err := t.wait(ctx, int(rec.NumRows()), cw.pending()); err != nil {
+			return 0, err
+		}
+		if err := cw.flush(); err != nil {
+			return 0, err
+		}
+	}
+	if err := fw.Close(); err != nil {
+		return 0, err
+	}
+	if err := cw.flush(); err != nil {
+		return 0, err
+	}
+	return totalRows, writeMessages(w, &pgproto3.CopyDone{})
+}
@@ -0,0 +1,55 @@
+package pigox
+
+import (
+	"fmt"
+	osuser "os/user"
+	"strconv"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// WithPeerAuth authenticates the clients connecting over unix sockets by the operating system user of their
+// process, obtained from the kernel (SO_PEERCRED), without asking for a password: the session user must be the
+// name of the operating system user, or the user it is mapped to by users. The queries of the session are
+// authorized with the token returned for the user by the WithAuthMethod credentials, if any. Clients connecting
+// over TCP are authenticated as usual. Peer authentication is only supported on Linux.
+func WithPeerAuth(enable bool, users map[string]string) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.peerAuth = enable
+		opts.peerUsers = users
+	}
+}
+
+// checkPeer authenticates the user of a session connected over a unix socket by its peer credentials, if the
+// proxy is configured so (see WithPeerAuth). It reports whether it did, and returns the IOx token of the session.
+func (p *Proxy) checkPeer(user, database string) (string, bool, error) {
+	if !p.peerAuth || p.unixConn == nil {
+		return "", false, nil
+	}
+	failed := newPGError(pgerrcode.InvalidAuthorizationSpecification, fmt.Errorf("peer authentication failed for user %q", user))
+	uid, err := peerUID(p.unixConn)
+	if err != nil {
+		p.log.Error("cannot get the peer credentials of the client", "err", err)
+		return "", false, failed
+	}
+	name := strconv.FormatUint(uint64(uid), 10)
+	if u, err := osuser.LookupId(name); err == nil {
+		name = u.Username
+	}
+	if mapped, ok := p.peerUsers[name]; ok {
+		name = mapped
+	}
+	if name != user {
+		p.log.Warn("peer authentication failed", "user", user, "uid", uid)
+		return "", false, failed
+	}
+	if p.credentials == nil {
+		return "", true, nil
+	}
+	creds, err := p.credentials(user, database)
+	if err != nil {
+		p.log.Warn("cannot get the credentials of user", "user", user, "err", err)
+		return "", false, failed
+	}
+	return creds.Token, true, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package pigox
+
+import (
+	"errors"
+	"net"
+)
+
+// peerUID returns the user id of the process on the other end of a unix socket.
+func peerUID(conn *net.UnixConn) (uint32, error) {
+	return 0, errors.New("peer credentials are not supported on this platform")
+}
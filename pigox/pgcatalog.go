@@ -0,0 +1,724 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/mkmik/piggo/pigox/arrowpg"
+)
+
+const (
+	// catalogOwner is the role reported as the owner of every object of the emulated catalog.
+	catalogOwner = "piggo"
+	// the OIDs of the fixed objects of the emulated catalog; the ones of tables and namespaces are derived from
+	// their names, from firstCatalogOID up; see catalogOID.
+	catalogOwnerOID     = 10
+	catalogNamespaceOID = 11
+	catalogDatabaseOID  = 1
+	heapAccessMethodOID = 2
+	firstCatalogOID     = 16384
+)
+
+// catalogColumnsQuery lists the columns of the tables the emulated pg_catalog relations describe.
+const catalogColumnsQuery = `SELECT table_schema, table_name, column_name, ordinal_position, is_nullable, data_type FROM information_schema.columns`
+
+// pgCatalogType describes a postgres type in pg_type and format_type().
+type pgCatalogType struct {
+	oid      uint32
+	name     string
+	sqlName  string
+	length   int
+	category string
+}
+
+// pgCatalogTypes are the types listed in pg_type: the ones IOx columns are mapped to, with the array types of
+// list columns, and the ones of the catalog columns.
+var pgCatalogTypes = withArrayTypes([]pgCatalogType{
+	{pgtype.BoolOID, "bool", "boolean", 1, "B"},
+	{pgtype.ByteaOID, "bytea", "bytea", -1, "U"},
+	{pgtype.QCharOID, "char", `"char"`, 1, "S"},
+	{pgtype.NameOID, "name", "name", 64, "S"},
+	{pgtype.Int8OID, "int8", "bigint", 8, "N"},
+	{pgtype.Int2OID, "int2", "smallint", 2, "N"},
+	{pgtype.Int4OID, "int4", "integer", 4, "N"},
+	{pgtype.TextOID, "text", "text", -1, "S"},
+	{pgtype.OIDOID, "oid", "oid", 4, "N"},
+	{pgtype.JSONOID, "json", "json", -1, "U"},
+	{pgtype.Float4OID, "float4", "real", 4, "N"},
+	{pgtype.Float8OID, "float8", "double precision", 8, "N"},
+	{pgtype.VarcharOID, "varchar", "character varying", -1, "S"},
+	{pgtype.DateOID, "date", "date", 4, "D"},
+	{pgtype.TimestampOID, "timestamp", "timestamp without time zone", 8, "D"},
+	{pgtype.TimestamptzOID, "timestamptz", "timestamp with time zone", 8, "D"},
+	{pgtype.IntervalOID, "interval", "interval", 16, "T"},
+	{pgtype.NumericOID, "numeric", "numeric", -1, "N"},
+	{pgtype.JSONBOID, "jsonb", "jsonb", -1, "U"},
+	{pgtype.RecordOID, "record", "record", -1, "P"},
+})
+
+// withArrayTypes adds the array types of the types lists of which are rendered as arrays.
+func withArrayTypes(types []pgCatalogType) []pgCatalogType {
+	for _, t := range types {
+		if oid, ok := arrowpg.ArrayOID(t.oid); ok {
+			types = append(types, pgCatalogType{oid: oid, name: "_" + t.name, sqlName: t.sqlName + "[]", length: -1, category: "A"})
+		}
+	}
+	return types
+}
+
+// arrayElementOID returns the element type of an array type, zero if oid is not an array type.
+func arrayElementOID(oid uint32) uint32 {
+	for _, t := range pgCatalogTypes {
+		if a, ok := arrowpg.ArrayOID(t.oid); ok && a == oid {
+			return t.oid
+		}
+	}
+	return 0
+}
+
+// catalogSnapshot holds the tables of a database, from which the emulated pg_catalog relations are generated.
+type catalogSnapshot struct {
+	database   string
+	user       string
+	namespaces []catalogNamespace
+	tables     []*catalogTable
+}
+
+type catalogNamespace struct {
+	oid  int64
+	name string
+}
+
+type catalogTable struct {
+	oid       int64
+	namespace int64
+	schema    string
+	name      string
+	// kind is the relkind: 'r' for tables, 'v' for the views of the information_schema and system schemas.
+	kind    string
+	columns []catalogColumn
+}
+
+type catalogColumn struct {
+	name     string
+	position int
+	typeOID  uint32
+	notNull  bool
+	// tag is set for the dictionary encoded string columns IOx stores tags in.
+	tag bool
+}
+
+// pgCatalogRelation is an emulated pg_catalog relation.
+type pgCatalogRelation struct {
+	// columns are the comma separated column names and DataFusion types of the relation.
+	columns string
+	rows    func(c *catalogSnapshot) [][]interface{}
+}
+
+// pgCatalogRelations are the pg_catalog relations answered by the proxy, by name. Those without rows describe
+// objects IOx doesn't have, e.g. indexes and constraints.
+var pgCatalogRelations = map[string]pgCatalogRelation{
+	"pg_namespace": {
+		columns: "oid BIGINT, nspname VARCHAR, nspowner BIGINT, nspacl VARCHAR",
+		rows: func(c *catalogSnapshot) [][]interface{} {
+			rows := [][]interface{}{{int64(catalogNamespaceOID), "pg_catalog", int64(catalogOwnerOID), nil}}
+			for _, ns := range c.namespaces {
+				rows = append(rows, []interface{}{ns.oid, ns.name, int64(catalogOwnerOID), nil})
+			}
+			return rows
+		},
+	},
+	"pg_class": {
+		columns: "oid BIGINT, relname VARCHAR, relnamespace BIGINT, reltype BIGINT, reloftype BIGINT, relowner BIGINT, " +
+			"relam BIGINT, relfilenode BIGINT, reltablespace BIGINT, relpages INT, reltuples DOUBLE, relhasindex BOOLEAN, " +
+			"relisshared BOOLEAN, relpersistence VARCHAR, relkind VARCHAR, relnatts INT, relchecks INT, relhasrules BOOLEAN, " +
+			"relhastriggers BOOLEAN, relhassubclass BOOLEAN, relrowsecurity BOOLEAN, relforcerowsecurity BOOLEAN, " +
+			"relispopulated BOOLEAN, relreplident VARCHAR, relispartition BOOLEAN, relacl VARCHAR, reloptions VARCHAR, " +
+			"relpartbound VARCHAR",
+		rows: func(c *catalogSnapshot) [][]interface{} {
+			var rows [][]interface{}
+			for _, t := range c.tables {
+				am := int64(heapAccessMethodOID)
+				if t.kind == "v" {
+					am = 0
+				}
+				rows = append(rows, []interface{}{t.oid, t.name, t.namespace, int64(0), int64(0), int64(catalogOwnerOID),
+					am, t.oid, int64(0), 0, -1.0, false,
+					false, "p", t.kind, len(t.columns), 0, false,
+					false, false, false, false,
+					true, "d", false, nil, nil,
+					nil})
+			}
+			return rows
+		},
+	},
+	"pg_attribute": {
+		columns: "attrelid BIGINT, attname VARCHAR, atttypid BIGINT, attlen INT, attnum INT, atttypmod INT, attndims INT, " +
+			"attnotnull BOOLEAN, atthasdef BOOLEAN, atthasmissing BOOLEAN, attidentity VARCHAR, attgenerated VARCHAR, " +
+			"attisdropped BOOLEAN, attislocal BOOLEAN, attinhcount INT, attcollation BIGINT, attacl VARCHAR, attoptions VARCHAR",
+		rows: func(c *catalogSnapshot) [][]interface{} {
+			var rows [][]interface{}
+			for _, t := range c.tables {
+				for _, col := range t.columns {
+					rows = append(rows, []interface{}{t.oid, col.name, int64(col.typeOID), catalogTypeByOID(col.typeOID).length, col.position, -1, 0,
+						col.notNull, false, false, "", "",
+						false, true, 0, int64(0), nil, nil})
+				}
+			}
+			return rows
+		},
+	},
+	"pg_type": {
+		columns: "oid BIGINT, typname VARCHAR, typnamespace BIGINT, typowner BIGINT, typlen INT, typbyval BOOLEAN, " +
+			"typtype VARCHAR, typcategory VARCHAR, typisdefined BOOLEAN, typdelim VARCHAR, typrelid BIGINT, typelem BIGINT, " +
+			"typarray BIGINT, typbasetype BIGINT, typtypmod INT, typnotnull BOOLEAN, typndims INT, typcollation BIGINT, " +
+			"typdefault VARCHAR",
+		rows: func(c *catalogSnapshot) [][]interface{} {
+			var rows [][]interface{}
+			for _, t := range pgCatalogTypes {
+				array, _ := arrowpg.ArrayOID(t.oid)
+				rows = append(rows, []interface{}{int64(t.oid), t.name, int64(catalogNamespaceOID), int64(catalogOwnerOID), t.length, t.length > 0 && t.length <= 8,
+					"b", t.category, true, ",", int64(0), int64(arrayElementOID(t.oid)),
+					int64(array), int64(0), -1, false, 0, int64(0),
+					nil})
+			}
+			return rows
+		},
+	},
+	"pg_database": {
+		columns: "oid BIGINT, datname VARCHAR, datdba BIGINT, encoding INT, datcollate VARCHAR, datctype VARCHAR, " +
+			"datistemplate BOOLEAN, datallowconn BOOLEAN, datconnlimit INT, dattablespace BIGINT, datacl VARCHAR",
+		rows: func(c *catalogSnapshot) [][]interface{} {
+			return [][]interface{}{{int64(catalogDatabaseOID), c.database, int64(catalogOwnerOID), 6, "C", "C", false, true, -1, int64(0), nil}}
+		},
+	},
+	"pg_roles": {
+		columns: "oid BIGINT, rolname VARCHAR, rolsuper BOOLEAN, rolinherit BOOLEAN, rolcreaterole BOOLEAN, " +
+			"rolcreatedb BOOLEAN, rolcanlogin BOOLEAN, rolreplication BOOLEAN, rolconnlimit INT, rolvaliduntil VARCHAR, " +
+			"rolbypassrls BOOLEAN, rolconfig VARCHAR",
+		rows: func(c *catalogSnapshot) [][]interface{} {
+			return [][]interface{}{{int64(catalogOwnerOID), catalogOwner, false, true, false, false, true, false, -1, nil, false, nil}}
+		},
+	},
+	"pg_user": {
+		columns: "usename VARCHAR, usesysid BIGINT, usecreatedb BOOLEAN, usesuper BOOLEAN, userepl BOOLEAN, " +
+			"usebypassrls BOOLEAN, passwd VARCHAR, valuntil VARCHAR, useconfig VARCHAR",
+		rows: func(c *catalogSnapshot) [][]interface{} {
+			return [][]interface{}{{c.user, int64(catalogOwnerOID), false, false, false, false, "********", nil, nil}}
+		},
+	},
+	"pg_am": {
+		columns: "oid BIGINT, amname VARCHAR, amhandler VARCHAR, amtype VARCHAR",
+		rows: func(c *catalogSnapshot) [][]interface{} {
+			return [][]interface{}{{int64(heapAccessMethodOID), "heap", "heap_tableam_handler", "t"}}
+		},
+	},
+	"pg_tables": {
+		columns: "schemaname VARCHAR, tablename VARCHAR, tableowner VARCHAR, tablespace VARCHAR, hasindexes BOOLEAN, " +
+			"hasrules BOOLEAN, hastriggers BOOLEAN, rowsecurity BOOLEAN",
+		rows: func(c *catalogSnapshot) [][]interface{} {
+			var rows [][]interface{}
+			for _, t := range c.tables {
+				if t.kind == "r" {
+					rows = append(rows, []interface{}{t.schema, t.name, catalogOwner, nil, false, false, false, false})
+				}
+			}
+			return rows
+		},
+	},
+	"pg_views": {
+		columns: "schemaname VARCHAR, viewname VARCHAR, viewowner VARCHAR, definition VARCHAR",
+		rows: func(c *catalogSnapshot) [][]interface{} {
+			var rows [][]interface{}
+			for _, t := range c.tables {
+				if t.kind == "v" {
+					rows = append(rows, []interface{}{t.schema, t.name, catalogOwner, nil})
+				}
+			}
+			return rows
+		},
+	},
+	"pg_tablespace": {
+		columns: "oid BIGINT, spcname VARCHAR, spcowner BIGINT, spcacl VARCHAR, spcoptions VARCHAR",
+		rows: func(c *catalogSnapshot) [][]interface{} {
+			return [][]interface{}{{int64(1663), "pg_default", int64(catalogOwnerOID), nil, nil}}
+		},
+	},
+	"pg_index":       {columns: "indexrelid BIGINT, indrelid BIGINT, indnatts INT, indisunique BOOLEAN, indisprimary BOOLEAN, indisclustered BOOLEAN, indisvalid BOOLEAN, indkey VARCHAR"},
+	"pg_inherits":    {columns: "inhrelid BIGINT, inhparent BIGINT, inhseqno INT"},
+	"pg_constraint":  {columns: "oid BIGINT, conname VARCHAR, connamespace BIGINT, contype VARCHAR, conrelid BIGINT, confrelid BIGINT, conindid BIGINT, conkey VARCHAR, confkey VARCHAR"},
+	"pg_description": {columns: "objoid BIGINT, classoid BIGINT, objsubid INT, description VARCHAR"},
+	"pg_attrdef":     {columns: "oid BIGINT, adrelid BIGINT, adnum INT, adbin VARCHAR"},
+	"pg_proc":        {columns: "oid BIGINT, proname VARCHAR, pronamespace BIGINT, proowner BIGINT, prokind VARCHAR, prorettype BIGINT, proargtypes VARCHAR"},
+	"pg_trigger":     {columns: "oid BIGINT, tgrelid BIGINT, tgname VARCHAR, tgenabled VARCHAR, tgisinternal BOOLEAN"},
+	"pg_enum":        {columns: "oid BIGINT, enumtypid BIGINT, enumsortorder DOUBLE, enumlabel VARCHAR"},
+	"pg_extension":   {columns: "oid BIGINT, extname VARCHAR, extowner BIGINT, extnamespace BIGINT, extversion VARCHAR"},
+	"pg_collation":   {columns: "oid BIGINT, collname VARCHAR, collnamespace BIGINT, collowner BIGINT"},
+	"pg_rewrite":     {columns: "oid BIGINT, rulename VARCHAR, ev_class BIGINT, ev_type VARCHAR"},
+	"pg_policy":      {columns: "oid BIGINT, polname VARCHAR, polrelid BIGINT, polcmd VARCHAR"},
+}
+
+// catalogTypeByOID returns the pg_type entry of a type.
+func catalogTypeByOID(oid uint32) pgCatalogType {
+	for _, t := range pgCatalogTypes {
+		if t.oid == oid {
+			return t
+		}
+	}
+	return pgCatalogType{oid: oid, name: strconv.Itoa(int(oid)), sqlName: "???", length: -1}
+}
+
+// arrowTypeOID returns the postgres type of the values of columns of an arrow type, as named by the DataFusion
+// information_schema, e.g. "Timestamp(Nanosecond, None)" or "Dictionary(Int32, Utf8)".
+func arrowTypeOID(name string) uint32 {
+	if strings.HasPrefix(name, "Dictionary(") {
+		if i := strings.Index(name, ","); i >= 0 {
+			return arrowTypeOID(strings.TrimSuffix(strings.TrimSpace(name[i+1:]), ")"))
+		}
+	}
+	switch {
+	case strings.HasPrefix(name, "Timestamp"):
+		return pgtype.TimestampOID
+	case strings.HasPrefix(name, "Date"):
+		return pgtype.DateOID
+	case strings.HasPrefix(name, "Decimal"):
+		return pgtype.NumericOID
+	case strings.HasPrefix(name, "Struct("):
+		return pgtype.RecordOID
+	case strings.HasPrefix(name, "Map("):
+		return pgtype.JSONOID
+	case strings.HasPrefix(name, "List(") || strings.HasPrefix(name, "FixedSizeList("):
+		// e.g. List(Field { name: "item", data_type: Int64, ... })
+		if _, elem, ok := strings.Cut(name, "data_type: "); ok && !strings.Contains(elem, "List(") {
+			if i := strings.IndexAny(elem, ",}"); i >= 0 {
+				if oid, ok := arrowpg.ArrayOID(arrowTypeOID(strings.TrimSpace(elem[:i]))); ok {
+					return oid
+				}
+			}
+		}
+		return pgtype.TextOID
+	}
+	switch name {
+	case "Boolean":
+		return pgtype.BoolOID
+	case "Int8", "UInt8", "Int16":
+		return pgtype.Int2OID
+	case "UInt16", "Int32":
+		return pgtype.Int4OID
+	case "UInt32", "Int64":
+		return pgtype.Int8OID
+	case "UInt64":
+		return pgtype.NumericOID
+	case "Float16", "Float32":
+		return pgtype.Float4OID
+	case "Float64":
+		return pgtype.Float8OID
+	}
+	return pgtype.TextOID
+}
+
+// catalogFunctions are the catalog information functions whose result is the same for every object of the
+// emulated catalog.
+var catalogFunctions = map[string]string{
+	"pg_get_userbyid":        quoteString(catalogOwner),
+	"pg_encoding_to_char":    "'UTF8'",
+	"pg_tablespace_location": "''",
+	"pg_get_expr":            "CAST(NULL AS VARCHAR)",
+	"pg_get_indexdef":        "CAST(NULL AS VARCHAR)",
+	"pg_get_constraintdef":   "CAST(NULL AS VARCHAR)",
+	"pg_get_triggerdef":      "CAST(NULL AS VARCHAR)",
+	"pg_get_viewdef":         "CAST(NULL AS VARCHAR)",
+	"pg_get_partkeydef":      "CAST(NULL AS VARCHAR)",
+	// the only arrays of the catalog are access privileges, which are all NULL.
+	"array_to_string": "CAST(NULL AS VARCHAR)",
+}
+
+// catalogCastTypes are the DataFusion types casts to postgres specific types are rewritten to in catalog queries.
+var catalogCastTypes = map[string]string{
+	"regclass":     "BIGINT",
+	"regtype":      "BIGINT",
+	"regproc":      "BIGINT",
+	"regprocedure": "BIGINT",
+	"regnamespace": "BIGINT",
+	"regrole":      "BIGINT",
+	"oid":          "BIGINT",
+	"name":         "VARCHAR",
+	"char":         "VARCHAR",
+	"bpchar":       "VARCHAR",
+	"text":         "VARCHAR",
+}
+
+// rewriteCatalogSyntax rewrites the postgres specific syntax of the catalog queries of clients and IDEs, which
+// refer to emulated pg_catalog relations, into DataFusion SQL:
+//
+//	pg_catalog.f(...)          f(...)
+//	OPERATOR(pg_catalog.~)     ~
+//	x COLLATE pg_catalog.C     x
+//	x::pg_catalog.regclass     x::BIGINT, and likewise for the other object identifier types and oid
+//	x::name                    x::VARCHAR, and likewise for "char" and text
+//	format_type(t, typmod)     CASE t WHEN 16 THEN 'boolean' ... END
+//
+// and the catalog information functions whose result is the same for every object (see catalogFunctions) with
+// constants. Other queries are returned unchanged.
+func rewriteCatalogSyntax(query string) string {
+	if !strings.Contains(strings.ToLower(query), "pg_") {
+		return query
+	}
+	toks := scanSQL(query)
+	if len(pgCatalogReferences(toks)) == 0 {
+		return query
+	}
+
+	var res []token
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		switch {
+		case isPGCatalog(t) && i+2 < len(toks) && toks[i+1].is(".") && nextSignificant(toks, i+1) == i+2 && isCall(toks, i+2):
+			// pg_catalog.f(...)
+			i++
+			continue
+		case t.is("operator") && isCall(toks, i):
+			open := nextSignificant(toks, i)
+			closing := closingParen(toks, open)
+			if closing < 0 {
+				break
+			}
+			op := significant(toks[open+1 : closing])
+			if len(op) == 3 && isPGCatalog(op[0]) && op[1].is(".") {
+				op = op[2:]
+			}
+			if len(op) == 1 && op[0].kind == tokPunct {
+				res = append(res, op[0])
+				i = closing
+				continue
+			}
+		case t.is("collate"):
+			// COLLATE [schema.]name
+			j := nextSignificant(toks, i)
+			if j < 0 || !isName(toks[j]) {
+				break
+			}
+			if k := nextSignificant(toks, j); k >= 0 && toks[k].is(".") {
+				if j = nextSignificant(toks, k); j < 0 || !isName(toks[j]) {
+					break
+				}
+			}
+			if n := len(res); n > 0 && res[n-1].isBlank() {
+				res = res[:n-1]
+			}
+			i = j
+			continue
+		case t.is("::"):
+			j := nextSignificant(toks, i)
+			if j < 0 || !isName(toks[j]) {
+				break
+			}
+			if isPGCatalog(toks[j]) {
+				if k := nextSignificant(toks, j); k >= 0 && toks[k].is(".") {
+					if j = nextSignificant(toks, k); j < 0 || !isName(toks[j]) {
+						break
+					}
+				}
+			}
+			if typ, ok := catalogCastTypes[toks[j].identName()]; ok {
+				res = append(res, t, token{kind: tokIdent, text: typ})
+				i = j
+				continue
+			}
+		}
+		res = append(res, t)
+	}
+
+	return joinTokens(replaceCalls(res, func(name string, toks []token, open, closing int) (string, bool) {
+		if name != "format_type" {
+			constant, ok := catalogFunctions[name]
+			return constant, ok
+		}
+		args := splitArgs(toks, open+1, closing)
+		if len(args) != 2 {
+			return "", false
+		}
+		var b strings.Builder
+		b.WriteString("CASE " + strings.TrimSpace(joinTokens(toks[args[0][0]:args[0][1]])))
+		for _, t := range pgCatalogTypes {
+			fmt.Fprintf(&b, " WHEN %d THEN %s", t.oid, quoteString(t.sqlName))
+		}
+		b.WriteString(" ELSE '???' END")
+		return b.String(), true
+	}))
+}
+
+// pgCatalogReferences returns the token indexes of the references to emulated pg_catalog relations in a query:
+// pg_catalog qualified names, and bare names following FROM or JOIN. The indexes point to the relation names.
+func pgCatalogReferences(toks []token) []int {
+	var refs []int
+	for i, t := range toks {
+		if t.kind != tokIdent {
+			continue
+		}
+		if _, ok := pgCatalogRelations[t.identName()]; !ok {
+			continue
+		}
+		if n := nextSignificant(toks, i); n >= 0 && (toks[n].is("(") || toks[n].is(".")) {
+			continue
+		}
+		p := prevSignificant(toks, i)
+		switch {
+		case p < 0:
+		case toks[p].is("from") || toks[p].is("join"):
+			refs = append(refs, i)
+		case toks[p].is("."):
+			if q := prevSignificant(toks, p); q >= 0 && isPGCatalog(toks[q]) {
+				refs = append(refs, i)
+			}
+		}
+	}
+	return refs
+}
+
+// isPGCatalog reports whether t names the pg_catalog schema.
+func isPGCatalog(t token) bool {
+	return isName(t) && t.identName() == "pg_catalog"
+}
+
+// relationAliasFollows reports whether the relation name toks[i] is followed by an alias.
+func relationAliasFollows(toks []token, i int) bool {
+	n := nextSignificant(toks, i)
+	if n < 0 {
+		return false
+	}
+	t := toks[n]
+	if t.kind == tokQuotedIdent {
+		return true
+	}
+	if t.kind != tokIdent {
+		return false
+	}
+	switch t.identName() {
+	case "where", "join", "left", "right", "inner", "outer", "full", "cross", "natural", "on", "using", "order",
+		"group", "having", "limit", "offset", "fetch", "union", "intersect", "except", "window":
+		return false
+	}
+	return true
+}
+
+// expandCatalog replaces the references of a query to emulated catalog relations, i.e. the pg_catalog relations
+// (e.g. pg_catalog.pg_class) and the information_schema views of informationSchemaRelations, with subqueries
+// returning their rows, generated from the tables IOx lists in its information_schema. It returns query unchanged
+// if it doesn't refer to them.
+func (p *Proxy) expandCatalog(ctx context.Context, session *session, query string) (string, error) {
+	if lower := strings.ToLower(query); !strings.Contains(lower, "pg_") && !strings.Contains(lower, "information_schema") {
+		return query, nil
+	}
+	toks := scanSQL(query)
+	relations := map[int]pgCatalogRelation{}
+	for _, i := range pgCatalogReferences(toks) {
+		relations[i] = pgCatalogRelations[toks[i].identName()]
+	}
+	for _, i := range informationSchemaReferences(toks) {
+		relations[i] = informationSchemaRelations[toks[i].identName()]
+	}
+	if len(relations) == 0 {
+		return query, nil
+	}
+	filter := ""
+	if len(relations) == 1 {
+		for i := range relations {
+			filter = catalogFilter(toks, i)
+		}
+	}
+	snapshot, err := p.catalogSnapshot(ctx, session, filter)
+	if err != nil {
+		return "", err
+	}
+
+	// relation SQL by name, generated once per query.
+	generated := map[string]string{}
+	replace := map[int]string{}
+	for i, rel := range relations {
+		name := toks[i].identName()
+		sql, ok := generated[name]
+		if !ok {
+			sql = rel.sql(snapshot)
+			generated[name] = sql
+		}
+		start := i
+		if p := prevSignificant(toks, i); p >= 0 && toks[p].is(".") {
+			start = prevSignificant(toks, p)
+		}
+		sql = "(" + sql + ")"
+		if !relationAliasFollows(toks, i) {
+			sql += " AS " + name
+		}
+		replace[start] = sql
+		for j := start + 1; j <= i; j++ {
+			replace[j] = ""
+		}
+	}
+
+	var b strings.Builder
+	for i, t := range toks {
+		if r, ok := replace[i]; ok {
+			b.WriteString(r)
+		} else {
+			b.WriteString(t.text)
+		}
+	}
+	return b.String(), nil
+}
+
+// sql returns a query returning the rows of the relation.
+func (r pgCatalogRelation) sql(c *catalogSnapshot) string {
+	var cols [][2]string
+	for _, def := range strings.Split(r.columns, ", ") {
+		name, typ, _ := strings.Cut(def, " ")
+		cols = append(cols, [2]string{name, typ})
+	}
+	var rows [][]interface{}
+	if r.rows != nil {
+		rows = r.rows(c)
+	}
+	empty := len(rows) == 0
+	if empty {
+		rows = [][]interface{}{make([]interface{}, len(cols))}
+	}
+
+	var b strings.Builder
+	for i, row := range rows {
+		if i > 0 {
+			b.WriteString(" UNION ALL ")
+		}
+		b.WriteString("SELECT ")
+		for j, v := range row {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "CAST(%s AS %s)", catalogLiteral(v), cols[j][1])
+			if i == 0 {
+				b.WriteString(" AS " + cols[j][0])
+			}
+		}
+	}
+	if empty {
+		b.WriteString(" LIMIT 0")
+	}
+	return b.String()
+}
+
+// catalogLiteral renders a value of an emulated catalog relation as a SQL literal.
+func catalogLiteral(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return quoteString(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return numberLiteral(strconv.Itoa(v))
+	case int64:
+		return numberLiteral(strconv.FormatInt(v, 10))
+	case float64:
+		return numberLiteral(strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	panic(fmt.Sprintf("unsupported catalog value %T", v))
+}
+
+// catalogSnapshot lists the tables and columns of the session's database, or only those matching filter, a
+// condition on the information_schema.columns of IOx, if not empty.
+func (p *Proxy) catalogSnapshot(ctx context.Context, session *session, filter string) (*catalogSnapshot, error) {
+	query := catalogColumnsQuery
+	if filter != "" {
+		query += " WHERE " + filter
+	}
+	var reader recordReader
+	var err error
+	if p.catalog != nil {
+		reader, err = p.runCatalogQuery(ctx, session, query)
+	} else {
+		reader, err = p.runQueryUpstream(ctx, session, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Release()
+
+	idx := map[string]int{}
+	for i, f := range reader.Schema().Fields() {
+		idx[f.Name] = i
+	}
+	for _, name := range []string{"table_schema", "table_name", "column_name", "ordinal_position", "is_nullable", "data_type"} {
+		if _, ok := idx[name]; !ok {
+			return nil, fmt.Errorf("information_schema.columns has no %s column", name)
+		}
+	}
+
+	tables := map[[2]string]*catalogTable{}
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		cols := rec.Columns()
+		value := func(name string, row int) (string, error) {
+			return renderText(cols[idx[name]], row, renderOptions{})
+		}
+		for r := 0; r < int(rec.NumRows()); r++ {
+			var v [6]string
+			for i, name := range []string{"table_schema", "table_name", "column_name", "ordinal_position", "is_nullable", "data_type"} {
+				if v[i], err = value(name, r); err != nil {
+					return nil, err
+				}
+			}
+			key := [2]string{v[0], v[1]}
+			t, ok := tables[key]
+			if !ok {
+				t = &catalogTable{schema: v[0], name: v[1], kind: "r"}
+				if v[0] == "information_schema" || v[0] == "system" {
+					t.kind = "v"
+				}
+				tables[key] = t
+			}
+			position, _ := strconv.Atoi(v[3])
+			t.columns = append(t.columns, catalogColumn{name: v[2], position: position, typeOID: arrowTypeOID(v[5]), notNull: v[4] == "NO",
+				tag: strings.HasPrefix(v[5], "Dictionary(")})
+		}
+	}
+
+	snapshot := &catalogSnapshot{database: session.databaseName, user: session.userName}
+	for _, t := range tables {
+		snapshot.tables = append(snapshot.tables, t)
+	}
+	sort.Slice(snapshot.tables, func(i, j int) bool {
+		a, b := snapshot.tables[i], snapshot.tables[j]
+		return a.schema < b.schema || (a.schema == b.schema && a.name < b.name)
+	})
+	for _, t := range snapshot.tables {
+		if n := len(snapshot.namespaces); n == 0 || snapshot.namespaces[n-1].name != t.schema {
+			snapshot.namespaces = append(snapshot.namespaces, catalogNamespace{oid: catalogOID(t.schema), name: t.schema})
+		}
+		t.namespace = snapshot.namespaces[len(snapshot.namespaces)-1].oid
+		t.oid = catalogOID(t.schema, t.name)
+		sort.Slice(t.columns, func(i, j int) bool { return t.columns[i].position < t.columns[j].position })
+	}
+	session.schema.add(session.databaseName, snapshot.tables, time.Now())
+	return snapshot, nil
+}
+
+// catalogOID returns the OID of the namespace or table with the given qualified name. OIDs are derived from the
+// names, so that they are the same in every snapshot, whichever tables it has, and in every session.
+func catalogOID(name ...string) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(strings.Join(name, "\x00")))
+	return firstCatalogOID + int64(h.Sum32()%(math.MaxInt32-firstCatalogOID))
+}
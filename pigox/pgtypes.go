@@ -0,0 +1,77 @@
+package pigox
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgtype"
+)
+
+// typeOIDs maps postgres type names (and their common aliases) to type OIDs.
+var typeOIDs = map[string]uint32{
+	"bool":                        pgtype.BoolOID,
+	"boolean":                     pgtype.BoolOID,
+	"int2":                        pgtype.Int2OID,
+	"smallint":                    pgtype.Int2OID,
+	"int4":                        pgtype.Int4OID,
+	"int":                         pgtype.Int4OID,
+	"integer":                     pgtype.Int4OID,
+	"int8":                        pgtype.Int8OID,
+	"bigint":                      pgtype.Int8OID,
+	"float4":                      pgtype.Float4OID,
+	"real":                        pgtype.Float4OID,
+	"float8":                      pgtype.Float8OID,
+	"float":                       pgtype.Float8OID,
+	"double precision":            pgtype.Float8OID,
+	"numeric":                     pgtype.NumericOID,
+	"decimal":                     pgtype.NumericOID,
+	"text":                        pgtype.TextOID,
+	"varchar":                     pgtype.VarcharOID,
+	"character varying":           pgtype.VarcharOID,
+	"char":                        pgtype.BPCharOID,
+	"character":                   pgtype.BPCharOID,
+	"bpchar":                      pgtype.BPCharOID,
+	"name":                        pgtype.NameOID,
+	"bytea":                       pgtype.ByteaOID,
+	"date":                        pgtype.DateOID,
+	"time":                        pgtype.TimeOID,
+	"timestamp":                   pgtype.TimestampOID,
+	"timestamp without time zone": pgtype.TimestampOID,
+	"timestamptz":                 pgtype.TimestamptzOID,
+	"timestamp with time zone":    pgtype.TimestamptzOID,
+	"interval":                    pgtype.IntervalOID,
+	"json":                        pgtype.JSONOID,
+	"jsonb":                       pgtype.JSONBOID,
+	"uuid":                        pgtype.UUIDOID,
+	"oid":                         pgtype.OIDOID,
+	"regclass":                    pgtype.OIDOID,
+}
+
+// typeOIDByName returns the OID of the named postgres type.
+func typeOIDByName(name string) (uint32, bool) {
+	oid, ok := typeOIDs[strings.Join(strings.Fields(strings.ToLower(name)), " ")]
+	return oid, ok
+}
+
+// ParseTypeOID returns the OID of the named postgres type (e.g. "text" or "bigint").
+func ParseTypeOID(name string) (uint32, error) {
+	oid, ok := typeOIDByName(name)
+	if !ok {
+		return 0, fmt.Errorf("unknown type %q", name)
+	}
+	return oid, nil
+}
+
+// parseTypeName parses a (possibly multi word) type name at the start of toks, which must contain only
+// significant tokens. It returns the type OID and the number of tokens consumed.
+func parseTypeName(toks []token) (uint32, int) {
+	var words []string
+	best, n := uint32(0), 0
+	for i := 0; i < len(toks) && i < 4 && toks[i].kind == tokIdent; i++ {
+		words = append(words, toks[i].text)
+		if oid, ok := typeOIDByName(strings.Join(words, " ")); ok {
+			best, n = oid, i+1
+		}
+	}
+	return best, n
+}
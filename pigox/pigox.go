@@ -2,35 +2,105 @@ package pigox
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"os"
+	"runtime/debug"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/apache/arrow/go/v7/arrow"
-	"github.com/apache/arrow/go/v7/arrow/array"
 	influxdbiox "github.com/influxdata/influxdb-iox-client-go"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgproto3/v2"
 	"github.com/jackc/pgtype"
-)
-
-const (
-	pgTimestampFormat = "2006-01-02 15:04:05.999999999"
+	"github.com/mkmik/piggo/pigox/arrowpg"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 type session struct {
+	// pid identifies the session within the proxy process.
+	pid          int32
 	databaseName string
 	userName     string
 	token        string
+	// identity is the identity of the user if authenticated by an Authenticator.
+	identity *Identity
+	// applicationName is the application_name startup parameter.
+	applicationName string
+	// labels are attached to the logs and statistics of the session; see WithConnectionLabels.
+	labels map[string]string
+
+	// settings holds the piggo.* session variables.
+	settings map[string]string
+	// renderOptions are the proxy wide render options, possibly overridden by session settings.
+	renderOptions renderOptions
+	// maxRows, if non-zero, truncates query results to the given number of rows.
+	maxRows int
+	// priority is the priority class of the session's queries; see WithPriorityConcurrencyLimits.
+	priority string
+	// uniqueColumnNames renames duplicate result column names; see resultFields.
+	uniqueColumnNames bool
+	// timeFanout is the number of time ranges queries are split into; see WithTimeFanout.
+	timeFanout int
+	// rollups reroutes long range queries to rollup tables; see WithRollupRules.
+	rollups bool
+	// transcript captures the protocol transcript of the session; see WithTranscripts.
+	transcript bool
+	// orderByTime orders time series results by time; see injectTimeOrder.
+	orderByTime bool
+	grafana     grafanaParams
+	// writeTokens are the IOx write tokens of the writes not yet known to be readable.
+	writeTokens []string
+	// listening stops the pollers of the channels the session listens on.
+	listening map[string]context.CancelFunc
+	// cancel is canceled by the CancelRequests for the session; see cancelRegistry.
+	cancel *cancelTarget
+	// transaction is the state of the emulated transaction block; see transactionState.
+	transaction transactionState
+	// statementTimeout, if non-zero, cancels the requests running longer; see WithQueryTimeout.
+	statementTimeout time.Duration
+	// idleSessionTimeout, if non-zero, terminates the session when idle longer; see WithIdleSessionTimeout.
+	idleSessionTimeout time.Duration
+	// cursors are the cursors declared with DECLARE by name.
+	cursors map[string]*cursor
+	// schema holds the tables of the database the session looked up; see schemaCache.
+	schema *schemaCache
+
+	extended extendedState
+}
+
+// lastSessionID is the last session pid assigned.
+var lastSessionID int32
+
+// queryHints carries per-query adjustments to the rendering of results, collected while rewriting the query.
+type queryHints struct {
+	// timeZones maps output column names to the time zone their timestamps are rendered in.
+	timeZones map[string]*time.Location
+	// toChar maps output column names to the to_char pattern their timestamps are rendered with.
+	toChar map[string]string
+	// json, if set, wraps the result rows as JSON.
+	json *jsonResult
+	// noCache is set if the query has a `/* nocache */` comment; see WithResultCache.
+	noCache bool
 }
 
 type pgError struct {
 	error
 	code string
+	// detail and hint, if set, are sent as the DETAIL and HINT fields of the error response.
+	detail, hint string
+	// position, if set, is the 1-based character position in the query the error refers to.
+	position int32
 }
 
 func (p *pgError) Unwrap() error {
@@ -44,8 +114,141 @@ func newPGError(code string, err error) *pgError {
 	}
 }
 
+func (p *pgError) withHint(format string, a ...interface{}) *pgError {
+	p.hint = fmt.Sprintf(format, a...)
+	return p
+}
+
+// atPosition points the error at the byte offset of query.
+func (p *pgError) atPosition(query string, offset int) *pgError {
+	p.position = int32(utf8.RuneCountInString(query[:offset]) + 1)
+	return p
+}
+
 type proxyOptions struct {
-	requireAuth bool
+	requireAuth    bool
+	authMethod     AuthMethod
+	credentials    CredentialVerifier
+	authenticator  Authenticator
+	maxMessageSize int
+	startupTimeout time.Duration
+	queryTimeout   time.Duration
+	idleTimeout    time.Duration
+	renderOptions
+	upstreamDialer  Dialer
+	warmConnections int
+	warmPool        *warmPool
+	clientPool      *ClientPool
+	backendKind     BackendKind
+	router          Router
+	queryRewriters  []QueryRewriter
+	flushRows       int
+	flushBytes      int
+	writeTimeout    time.Duration
+	stmtCacheSize   int
+	stmtCache       *statementCache
+	shadowAddress   string
+	shadow          *secondaryBackend
+	mirrorAddress   string
+	mirrorPercent   float64
+	mirror          *queryMirror
+
+	upstreamRetries      int
+	upstreamRetryBackoff time.Duration
+
+	networks networkACL
+
+	serverTLS       *tls.Config
+	requireTLS      bool
+	minTLSVersion   uint16
+	tlsCipherSuites []uint16
+	clientCertAuth  bool
+	clientCertUsers map[string]string
+	peerAuth        bool
+	peerUsers       map[string]string
+
+	maxConcurrentQueriesPerUser int
+	userLimiter                 *concurrencyLimiter
+	maxConcurrentQueriesPerDB   int
+	databaseConcurrencyLimits   map[string]int
+	databaseLimiter             *concurrencyLimiter
+	priorityConcurrencyLimits   map[string]int
+	priorityLimiter             *concurrencyLimiter
+	maxConcurrentQueries        int
+	tenantWeights               map[string]int
+	scheduler                   *fairScheduler
+	concurrencyQueueTimeout     time.Duration
+
+	maxResultMemory int64
+	memory          *memoryBudget
+
+	maxQueriesPerSecond float64
+	queryBurst          int
+	queryRate           *queryRateLimiter
+
+	maxQueriesPerSecondPerUser float64
+	userQueryBurst             int
+	userQueryRate              *userQueryRateLimiter
+
+	maxConnections                 int
+	maxConnectionsPerUser          int
+	connections                    *connectionLimiter
+	maxConcurrentQueriesPerSession int
+	sessionLimiter                 *concurrencyLimiter
+
+	readYourWritesTimeout time.Duration
+
+	writeAddress string
+	writer       *ioxWriter
+	tagColumns   map[string][]string
+
+	maxRowsPerSecond  float64
+	maxBytesPerSecond float64
+
+	queryHistorySize int
+	queryHistory     *queryHistory
+	adminUsers       []string
+
+	catalogCacheTTL  time.Duration
+	catalog          *catalogCache
+	resultCacheSize  int
+	resultCacheTTL   time.Duration
+	resultCache      *resultCache
+	flightSQLCatalog bool
+	flightSQL        *flightSQLCatalog
+
+	connectionLabels map[string]string
+
+	parameterStatusOverrides map[string]string
+
+	slowQueryThreshold time.Duration
+	slowQueryPlans     bool
+	planner            *secondaryBackend
+
+	defaultParameterOID uint32
+	grafanaMacros       bool
+	uniqueColumnNames   bool
+
+	timeFanout         int
+	timeFanoutMinRange time.Duration
+	orderByTime        bool
+	rollupRules        []RollupRule
+
+	notifyChannels map[string]string
+	notifyInterval time.Duration
+
+	transcriptDir string
+	transcriptAll bool
+
+	logger         *slog.Logger
+	queryLogMode   QueryLogMode
+	queryLogLength int
+
+	metrics   Metrics
+	auditSink AuditSink
+
+	tracerProvider  trace.TracerProvider
+	tracePropagator propagation.TextMapPropagator
 }
 
 type ProxyOption = func(opts *proxyOptions)
@@ -56,40 +259,633 @@ func WithRequireAuth(requireAuth bool) func(opts *proxyOptions) {
 	}
 }
 
+// WithStartupTimeout bounds the time clients have to complete the startup handshake, authentication included.
+// Zero means no limit.
+func WithStartupTimeout(d time.Duration) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.startupTimeout = d
+	}
+}
+
+// WithQueryTimeout cancels the queries running longer than d, with a query_canceled error. It is the default
+// statement_timeout of sessions, which clients can change with SET. Zero means no limit.
+func WithQueryTimeout(d time.Duration) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.queryTimeout = d
+	}
+}
+
+// WithIdleSessionTimeout closes the connections of sessions waiting for a query, outside of transaction blocks,
+// for longer than d. It is the default idle_session_timeout of sessions. Zero means no limit.
+func WithIdleSessionTimeout(d time.Duration) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.idleTimeout = d
+	}
+}
+
+// WithUpstreamDialer sets the dialer used to connect to IOx, e.g. one returned by NewUpstreamProxyDialer.
+func WithUpstreamDialer(dialer Dialer) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.upstreamDialer = dialer
+	}
+}
+
+// WithMaxMessageSize limits the size of a single message received from clients.
+// Defaults to DefaultMaxMessageSize.
+func WithMaxMessageSize(size int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.maxMessageSize = size
+	}
+}
+
+// WithWarmConnections keeps n pre-dialed IOx connections ready to be used by new sessions.
+// It only has effect on proxies created by a Server, which shares the connections among them.
+func WithWarmConnections(n int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.warmConnections = n
+	}
+}
+
+func withWarmPool(wp *warmPool) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.warmPool = wp
+	}
+}
+
+// WithShadowBackend sends a copy of every query to the IOx backend at address and logs the queries whose
+// results differ, in row count or content, from the primary backend's. Clients only see the primary results.
+// It only has effect on proxies created by a Server, which shares the shadow connection among them.
+func WithShadowBackend(address string) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.shadowAddress = address
+	}
+}
+
+func withShadow(b *secondaryBackend) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.shadow = b
+	}
+}
+
+// WithMirrorBackend asynchronously sends a copy of a sample of the queries to the IOx backend at address,
+// e.g. a staging cluster to load test with production traffic; the mirrored results are discarded.
+// The sample is set with WithMirrorPercent.
+// It only has effect on proxies created by a Server, which shares the mirror connection among them.
+func WithMirrorBackend(address string) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.mirrorAddress = address
+	}
+}
+
+// WithMirrorPercent sets the percentage of the queries sent to the mirror backend. Defaults to 100.
+func WithMirrorPercent(percent float64) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.mirrorPercent = percent
+	}
+}
+
+func withMirror(m *queryMirror) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.mirror = m
+	}
+}
+
+// WithStatementCacheSize caches the rewritten form of up to n distinct queries, and up to n queries prepared by
+// the backend, so that repeated queries skip PrepareQuery; see statementCache. Proxies created by a Server share
+// the cache.
+func WithStatementCacheSize(n int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.stmtCacheSize = n
+	}
+}
+
+func withStatementCache(c *statementCache) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.stmtCache = c
+	}
+}
+
+// WithAllowedNetworks only accepts clients connecting from one of nets.
+// The connection is closed before the startup exchange, regardless of authentication.
+func WithAllowedNetworks(nets ...*net.IPNet) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.networks.allowed = nets
+	}
+}
+
+// WithDeniedNetworks rejects clients connecting from one of nets, even if they belong to an allowed network.
+func WithDeniedNetworks(nets ...*net.IPNet) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.networks.denied = nets
+	}
+}
+
+// WithMaxConcurrentQueriesPerUser limits the number of queries each user can run at the same time,
+// across all of their sessions. Proxies created by a Server share the limit.
+// Queries over the limit wait for WithConcurrencyQueueTimeout and are then rejected.
+func WithMaxConcurrentQueriesPerUser(n int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.maxConcurrentQueriesPerUser = n
+	}
+}
+
+func withUserLimiter(l *concurrencyLimiter) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.userLimiter = l
+	}
+}
+
+// WithMaxConcurrentQueriesPerDatabase limits the number of queries that can run at the same time on each
+// database (IOx namespace), across all sessions. Proxies created by a Server share the limit.
+func WithMaxConcurrentQueriesPerDatabase(n int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.maxConcurrentQueriesPerDB = n
+	}
+}
+
+// WithDatabaseConcurrencyLimits overrides WithMaxConcurrentQueriesPerDatabase for specific databases.
+// A limit of 0 lifts the limit for that database.
+func WithDatabaseConcurrencyLimits(limits map[string]int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.databaseConcurrencyLimits = limits
+	}
+}
+
+func withDatabaseLimiter(l *concurrencyLimiter) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.databaseLimiter = l
+	}
+}
+
+// WithPriorityConcurrencyLimits limits the number of queries of each priority class ("low", "normal" or "high",
+// set with piggo.priority) that can run at the same time across all sessions, so that e.g. batch exports
+// running with low priority cannot take the capacity needed by interactive queries.
+// Classes without a limit, or with a limit of 0, are unlimited.
+func WithPriorityConcurrencyLimits(limits map[string]int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.priorityConcurrencyLimits = limits
+	}
+}
+
+func withPriorityLimiter(l *concurrencyLimiter) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.priorityLimiter = l
+	}
+}
+
+// WithMaxConcurrentQueries limits the number of queries that can run at the same time across all sessions.
+// Queries over the limit are queued per database and served in turns, weighted by WithTenantWeights, so that
+// a burst of queries on one database doesn't delay the queries on the others.
+// Proxies created by a Server share the limit.
+func WithMaxConcurrentQueries(n int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.maxConcurrentQueries = n
+	}
+}
+
+// WithTenantWeights sets the relative shares of the WithMaxConcurrentQueries slots that databases get when
+// they compete for them. The default weight is 1.
+func WithTenantWeights(weights map[string]int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.tenantWeights = weights
+	}
+}
+
+func withFairScheduler(f *fairScheduler) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.scheduler = f
+	}
+}
+
+// WithConcurrencyQueueTimeout sets how long a query over a concurrency limit waits for a slot.
+// Defaults to 0, rejecting such queries immediately.
+func WithConcurrencyQueueTimeout(d time.Duration) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.concurrencyQueueTimeout = d
+	}
+}
+
+// WithMaxResultMemory limits the memory used by the in-flight results of all sessions. Queries started while
+// the limit is reached wait for WithConcurrencyQueueTimeout for memory to be released and are then rejected.
+// Zero means unlimited.
+func WithMaxResultMemory(bytes int64) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.maxResultMemory = bytes
+	}
+}
+
+// withMemoryBudget shares a result memory budget between proxies.
+func withMemoryBudget(b *memoryBudget) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.memory = b
+	}
+}
+
+// WithMaxQueriesPerSecond limits the rate of queries sent to IOx across all sessions, as a last resort protection
+// of the backend. Up to burst queries are admitted at once; queries over the limit are rejected immediately
+// with a hint telling when to retry. Zero means unlimited.
+func WithMaxQueriesPerSecond(rate float64, burst int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.maxQueriesPerSecond = rate
+		opts.queryBurst = burst
+	}
+}
+
+// withQueryRateLimiter shares a query rate limiter between proxies.
+func withQueryRateLimiter(l *queryRateLimiter) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.queryRate = l
+	}
+}
+
+// WithCatalogCacheTTL caches the results of queries on the information_schema, run by clients to introspect
+// tables and columns, for ttl. Proxies created by a Server share the cache; Server.InvalidateCatalog and
+// `SELECT piggo.invalidate_catalog()` drop the cached results of a database.
+func WithCatalogCacheTTL(ttl time.Duration) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.catalogCacheTTL = ttl
+	}
+}
+
+func withCatalogCache(c *catalogCache) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.catalog = c
+	}
+}
+
+// WithReadYourWrites makes queries wait, for at most timeout, until the writes previously made through the
+// same session are readable, so that clients can query the data they just inserted.
+func WithReadYourWrites(timeout time.Duration) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.readYourWritesTimeout = timeout
+	}
+}
+
+// WithWriteAddress accepts INSERT statements, writing their rows as line protocol to the HTTP API of the IOx
+// router at address (host:port, or a http:// or https:// URL).
+func WithWriteAddress(address string) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.writeAddress = address
+	}
+}
+
+func withWriter(w *ioxWriter) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.writer = w
+	}
+}
+
+// WithTagColumns sets the columns INSERT writes as tags, by table, e.g. as returned by ParseTagColumns.
+// The other columns are written as tags if IOx stores them as such, or if they are new and given strings.
+func WithTagColumns(tags map[string][]string) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.tagColumns = tags
+	}
+}
+
+// WithTLSConfig accepts the SSLRequests of clients, which then encrypt the connection with TLS configured by cfg.
+// cfg must provide the server certificate, e.g. with CertReloader.GetCertificate, and may request client
+// certificates with ClientAuth and ClientCAs. Without it SSLRequests are denied.
+func WithTLSConfig(cfg *tls.Config) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.serverTLS = cfg
+	}
+}
+
+// WithClientCertAuth authenticates clients by the certificate they present, verified as configured by
+// WithTLSConfig: the session user must be the common name of the certificate, or the user it is mapped to by
+// users. Clients without a valid certificate are rejected.
+func WithClientCertAuth(enable bool, users map[string]string) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.clientCertAuth = enable
+		opts.clientCertUsers = users
+	}
+}
+
+// WithRequireTLS rejects clients that don't encrypt the connection with an "SSL required" FATAL error.
+// It can be set per listener with Server.Serve.
+func WithRequireTLS(require bool) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.requireTLS = require
+	}
+}
+
+// WithMinTLSVersion sets the minimum TLS version accepted from clients, e.g. tls.VersionTLS12.
+func WithMinTLSVersion(version uint16) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.minTLSVersion = version
+	}
+}
+
+// WithTLSCipherSuites restricts the cipher suites negotiated with clients using TLS 1.2 or older.
+// TLS 1.3 cipher suites are not configurable.
+func WithTLSCipherSuites(ids ...uint16) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.tlsCipherSuites = ids
+	}
+}
+
+// WithMaxRowsPerSecond limits the rate at which each connection streams result rows. Zero means unlimited.
+func WithMaxRowsPerSecond(n float64) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.maxRowsPerSecond = n
+	}
+}
+
+// WithMaxBytesPerSecond limits the rate at which each connection streams results. Zero means unlimited.
+func WithMaxBytesPerSecond(n float64) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.maxBytesPerSecond = n
+	}
+}
+
+// WithQueryHistorySize keeps the n most recent queries, which sessions can inspect with
+// SELECT * FROM piggo.queries. Sessions see their own queries, admin users see all of them.
+func WithQueryHistorySize(n int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.queryHistorySize = n
+	}
+}
+
+// withQueryHistory shares a query history between proxies.
+func withQueryHistory(h *queryHistory) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.queryHistory = h
+	}
+}
+
+// WithConnectionLabels attaches labels to each session, taking their values from startup parameters, e.g.
+// application_name or a custom parameter set by the client. labels maps label names to parameter names.
+func WithConnectionLabels(labels map[string]string) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.connectionLabels = labels
+	}
+}
+
+// WithParameterStatus overrides the run-time parameters, e.g. server_version, reported to clients at startup,
+// or adds new ones. Parameters set to the empty string are not reported.
+func WithParameterStatus(params map[string]string) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.parameterStatusOverrides = params
+	}
+}
+
+// WithSlowQueryThreshold logs the queries that run for longer than d. Zero disables the slow query log.
+func WithSlowQueryThreshold(d time.Duration) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.slowQueryThreshold = d
+	}
+}
+
+// WithSlowQueryPlans also logs the physical plan of slow queries, obtained by running EXPLAIN on IOx.
+func WithSlowQueryPlans(enabled bool) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.slowQueryPlans = enabled
+	}
+}
+
+// withPlanner shares the connection slow query plans are captured on between proxies.
+func withPlanner(b *secondaryBackend) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.planner = b
+	}
+}
+
+// WithFlightSQLCatalog answers the catalog probes of clients, e.g. psql's \d, with the Flight SQL metadata RPCs of
+// IOx instead of SQL queries on its information_schema, when IOx implements them.
+func WithFlightSQLCatalog(enabled bool) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.flightSQLCatalog = enabled
+	}
+}
+
+// withFlightSQL shares the connection the Flight SQL metadata RPCs are sent on between proxies.
+func withFlightSQL(c *flightSQLCatalog) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.flightSQL = c
+	}
+}
+
+// WithAdminUsers sets the users that are allowed to inspect other sessions, e.g. in piggo.queries.
+func WithAdminUsers(users ...string) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.adminUsers = users
+	}
+}
+
+// WithDefaultParameterType sets the type OID reported for prepared statement parameters whose type
+// can be neither inferred from the query nor is declared by the client. Defaults to text.
+func WithDefaultParameterType(oid uint32) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.defaultParameterOID = oid
+	}
+}
+
+// WithGrafanaMacros enables the expansion of Grafana macros such as $__timeFilter by default.
+// Sessions can toggle it with the piggo.grafana_macros setting.
+func WithGrafanaMacros(enabled bool) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.grafanaMacros = enabled
+	}
+}
+
+// WithUniqueColumnNames makes the proxy rename duplicate result column names to col, col_1, col_2, ... by default.
+// Sessions can toggle it with the piggo.unique_column_names setting.
+func WithUniqueColumnNames(enabled bool) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.uniqueColumnNames = enabled
+	}
+}
+
+// WithOrderByTime makes the proxy append ORDER BY time to the SELECTs returning a time column without an ORDER BY
+// clause by default. Sessions can toggle it with the piggo.order_by_time setting; pass it to Server.Serve to
+// enable it for the clients of a listener only, e.g. the one Grafana connects to.
+func WithOrderByTime(enabled bool) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.orderByTime = enabled
+	}
+}
+
+// WithRollupRules makes the proxy reroute the queries over a long time range to downsampled rollup tables, so that
+// long range dashboards don't read the raw data. Sessions can toggle it with the piggo.rollups setting.
+func WithRollupRules(rules ...RollupRule) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.rollupRules = rules
+	}
+}
+
+// WithNotifyChannels maps LISTEN channels to the table or SELECT query whose new rows are notified on them, and sets
+// how often IOx is polled for them (defaults to 5s); channels that aren't mapped notify the new rows of the table
+// named like them.
+func WithNotifyChannels(channels map[string]string, interval time.Duration) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.notifyChannels = channels
+		opts.notifyInterval = interval
+	}
+}
+
+// WithTimeFanout makes the proxy split queries over a wide time range, e.g. long range exports, into up to parts
+// queries over sub-ranges of at least minRange, which run concurrently on IOx; their results are streamed in order.
+// Only queries whose results can be concatenated are split; see planTimeFanout. Sessions can change the number of
+// parts with the piggo.time_fanout setting. Zero or one disables the fan-out.
+func WithTimeFanout(parts int, minRange time.Duration) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.timeFanout = parts
+		opts.timeFanoutMinRange = minRange
+	}
+}
+
+// WithTranscripts enables the capture of protocol transcripts to files in dir, to diagnose clients that cannot
+// connect or misbehave; if all is set, every connection is captured from its first message. Otherwise admin users
+// (see WithAdminUsers) start and stop capturing their session with the piggo.transcript setting.
+// Transcripts can be checked for protocol state violations with AnalyzeTranscript.
+func WithTranscripts(dir string, all bool) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.transcriptDir = dir
+		opts.transcriptAll = all
+	}
+}
+
+// WithTimestampPrecision sets the number of fractional second digits rendered for timestamps.
+// Defaults to NanosecondPrecision.
+func WithTimestampPrecision(precision TimestampPrecision) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.TimestampPrecision = precision
+	}
+}
+
+// WithTimestampRounding sets how timestamps are reduced to the configured precision.
+// Defaults to TruncateTimestamps.
+func WithTimestampRounding(rounding TimestampRounding) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.TimestampRounding = rounding
+	}
+}
+
+// WithTimestampFormat sets whether timestamps are returned as text or as integers since the Unix epoch.
+// Defaults to TextTimestamps.
+func WithTimestampFormat(format TimestampFormat) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.TimestampFormat = format
+	}
+}
+
 // Proxy is a PG->IOx proxy.
 type Proxy struct {
 	proxyOptions
 	ioxAddress string
 	backend    *pgproto3.Backend
 	conn       net.Conn
-	client     *influxdbiox.Client
+	// unixConn is the client connection if it is a unix socket; see WithPeerAuth.
+	unixConn *net.UnixConn
+	// upstream is the IOx client of the session; see ioxClient.
+	upstream  *upstreamClient
+	lifecycle *lifecycle
+	throttle  *throttle
+	// transcript is conn if protocol transcripts are enabled; see WithTranscripts.
+	transcript *transcriptConn
+	// log is the logger of the connection; see WithLogger.
+	log    *slog.Logger
+	tracer trace.Tracer
 }
 
 // NewProxy creates a new PG->IOx proxy.
 //
 // ioxAddress is the address of the IOx gRPC API endpoint.
 func NewProxy(conn net.Conn, ioxAddress string, opt ...ProxyOption) Proxy {
-	var opts proxyOptions
+	opts := proxyOptions{
+		maxMessageSize:      DefaultMaxMessageSize,
+		mirrorPercent:       100,
+		defaultParameterOID: pgtype.TextOID,
+	}
 	for _, ofn := range opt {
 		ofn(&opts)
 	}
 
-	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+	if opts.stmtCache == nil && opts.stmtCacheSize > 0 {
+		opts.stmtCache = newStatementCache(opts.stmtCacheSize)
+	}
+	if opts.writer == nil && opts.writeAddress != "" {
+		opts.writer = newIOxWriter(opts.writeAddress, opts.upstreamDialer)
+	}
+	if opts.queryHistory == nil && opts.queryHistorySize > 0 {
+		opts.queryHistory = newQueryHistory(opts.queryHistorySize)
+	}
+	if opts.userLimiter == nil {
+		opts.userLimiter = newConcurrencyLimiter("user", opts.maxConcurrentQueriesPerUser, nil)
+	}
+	if opts.memory == nil {
+		opts.memory = newMemoryBudget(opts.maxResultMemory)
+	}
+	if opts.catalog == nil {
+		opts.catalog = newCatalogCache(opts.catalogCacheTTL)
+	}
+	if opts.resultCache == nil {
+		opts.resultCache = newResultCache(opts.resultCacheSize, opts.resultCacheTTL)
+	}
+	if opts.queryRate == nil {
+		opts.queryRate = newQueryRateLimiter(opts.maxQueriesPerSecond, opts.queryBurst)
+	}
+	if opts.userQueryRate == nil {
+		opts.userQueryRate = newUserQueryRateLimiter(opts.maxQueriesPerSecondPerUser, opts.userQueryBurst)
+	}
+	if opts.connections == nil {
+		opts.connections = newConnectionLimiter(opts.maxConnections, opts.maxConnectionsPerUser)
+	}
+	// the queries of a session are not shared with other proxies.
+	opts.sessionLimiter = newConcurrencyLimiter("session", opts.maxConcurrentQueriesPerSession, nil)
+	if opts.databaseLimiter == nil {
+		opts.databaseLimiter = newConcurrencyLimiter("database", opts.maxConcurrentQueriesPerDB, opts.databaseConcurrencyLimits)
+	}
+	if opts.priorityLimiter == nil {
+		opts.priorityLimiter = newConcurrencyLimiter("priority", 0, opts.priorityConcurrencyLimits)
+	}
+	if opts.scheduler == nil {
+		opts.scheduler = newFairScheduler(opts.maxConcurrentQueries, opts.tenantWeights)
+	}
+	if opts.metrics == nil {
+		opts.metrics = noMetrics{}
+	}
+
+	unixConn, _ := conn.(*net.UnixConn)
+	logger := opts.baseLogger().With("remote", conn.RemoteAddr().String())
+	transcript := newTranscriptConn(conn, opts.transcriptDir, logger)
+	if transcript != nil {
+		conn = transcript
+	}
+	cr := &limitedChunkReader{cr: pgproto3.NewChunkReader(conn), max: opts.maxMessageSize}
+	backend := pgproto3.NewBackend(cr, conn)
 
 	return Proxy{
 		proxyOptions: opts,
 		ioxAddress:   ioxAddress,
 		backend:      backend,
 		conn:         conn,
+		unixConn:     unixConn,
+		upstream:     &upstreamClient{},
+		lifecycle:    &lifecycle{busy: true},
+		throttle:     newThrottle(opts.maxRowsPerSecond, opts.maxBytesPerSecond),
+		transcript:   transcript,
+		log:          logger,
+		tracer:       opts.newTracer(),
 	}
 }
 
-func (p *Proxy) testConnection(ctx context.Context, session *session) error {
-	q, err := p.client.PrepareQuery(ctx, session.databaseName, "select 1")
-	if err != nil {
-		return err
+// clientConfig returns the configuration of the backend clients connecting to address.
+func (o *proxyOptions) clientConfig(address string) backendConfig {
+	config := backendConfig{
+		ClientConfig: influxdbiox.ClientConfig{Address: address},
+		kind:         o.backendKind,
+		dialer:       o.upstreamDialer,
+	}
+	if o.upstreamDialer != nil {
+		config.DialOptions = append(config.DialOptions, grpc.WithContextDialer(o.upstreamDialer))
 	}
-	reader, err := q.Query(ctx)
+	return config
+}
+
+func (p *Proxy) testConnection(ctx context.Context, session *session) error {
+	reader, err := p.runQuery(ctx, session, "select 1")
 	if err != nil {
 		return err
 	}
@@ -97,119 +893,362 @@ func (p *Proxy) testConnection(ctx context.Context, session *session) error {
 	return nil
 }
 
+// errIdleSessionTimeout terminates the sessions idle longer than their idle_session_timeout.
+var errIdleSessionTimeout = newPGError(pgerrcode.IdleSessionTimeout, errors.New("terminating connection due to idle-session timeout"))
+
 func (p *Proxy) runE() error {
+	if !p.networks.allows(p.conn.RemoteAddr()) {
+		p.log.Warn("rejected connection: address not allowed")
+		return nil
+	}
+
+	p.transcript.capture(p.transcriptAll)
+
+	// clients that never complete the handshake must not hold on to the connection.
+	if p.startupTimeout > 0 {
+		p.conn.SetDeadline(time.Now().Add(p.startupTimeout))
+	}
 	session, err := p.handleStartup()
 	if err != nil {
+		p.metrics.StartupFailed(errorCode(err))
+		return err
+	} else if session == nil {
+		return nil
+	}
+	p.log = p.sessionLogger(session)
+	releaseConnection, err := p.connections.admit(session.userName)
+	if err != nil {
+		p.startupFailed(session, err)
+		return err
+	}
+	defer releaseConnection()
+	if err := p.route(session); err != nil {
+		p.startupFailed(session, err)
 		return err
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	p.client, err = influxdbiox.NewClient(ctx, &influxdbiox.ClientConfig{
-		Address:  p.ioxAddress,
-		Database: session.databaseName,
-	})
-	if err != nil {
+	if err := p.connectUpstream(ctx, session); err != nil {
+		p.startupFailed(session, err)
 		return err
 	}
+	defer func() {
+		// queries still running in other goroutines, e.g. those of LISTEN, stop before their client is released.
+		cancel()
+		p.disconnectUpstream()
+	}()
+	defer session.closeCursors(true)
 
-	// TODO: pass token to IOx client.
-	if p.requireAuth && session.token != "hunter12" {
-		return newPGError(pgerrcode.InvalidPassword, fmt.Errorf("password authentication failed for user %q", session.userName))
+	// the password is checked by IOx, as the token of the session's requests.
+	if err := p.testConnection(ctx, session); err != nil {
+		p.log.Error("cannot connect downstream", "err", err)
+		if code := grpcCode(err); code == codes.Unauthenticated || code == codes.PermissionDenied {
+			err = errPasswordAuthentication(session.userName)
+		}
+		p.startupFailed(session, err)
+		return err
 	}
+	p.auditLogin(session, nil)
 
-	if err := p.testConnection(ctx, session); err != nil {
-		log.Printf("cannot connect downstream: %v", err)
+	if session.cancel, err = cancelTargets.register(session); err != nil {
 		return err
 	}
+	defer cancelTargets.unregister(session)
 
-	err = writeMessages(p.conn,
-		&pgproto3.AuthenticationOk{},
-		&pgproto3.ParameterStatus{Name: "server_version", Value: "14.2"},
-		&pgproto3.ParameterStatus{Name: "client_encoding", Value: "utf8"},
-		&pgproto3.ParameterStatus{Name: "DateStyle", Value: "ISO"},
-	)
-	if err != nil {
+	msgs := append([]pgproto3.Message{&pgproto3.AuthenticationOk{}}, p.parameterStatus(session)...)
+	msgs = append(msgs, &pgproto3.BackendKeyData{ProcessID: uint32(session.pid), SecretKey: session.cancel.secretKey})
+	if err := writeMessages(p.conn, msgs...); err != nil {
 		return fmt.Errorf("error sending ready for query: %w", err)
 	}
 
 	if err := writeMessages(p.conn, &pgproto3.ReadyForQuery{TxStatus: 'I'}); err != nil {
 		return fmt.Errorf("error writing query response: %w", err)
 	}
+	if p.startupTimeout > 0 {
+		p.conn.SetDeadline(time.Time{})
+	}
 
 	for {
-		msg, err := p.backend.Receive()
+		if p.lifecycle.idle() {
+			p.log.Info("closing drained connection")
+			return errAdminShutdown
+		}
+		p.transcript.capture(session.transcript)
+		idleTimeout := session.idleSessionTimeout > 0 && session.transaction == txIdle
+		if idleTimeout {
+			p.conn.SetReadDeadline(time.Now().Add(session.idleSessionTimeout))
+		}
+		msg, err := p.receive()
 		if err != nil {
-			return fmt.Errorf("error receiving message: %w", err)
+			if p.lifecycle.isDraining() {
+				return nil
+			}
+			if idleTimeout && errors.Is(err, os.ErrDeadlineExceeded) {
+				p.log.Info("closing idle connection", "timeout", session.idleSessionTimeout)
+				return errIdleSessionTimeout
+			}
+			return fmt.Errorf("error receiving message: %w", protocolError(err))
+		}
+		if idleTimeout {
+			p.conn.SetReadDeadline(time.Time{})
+		}
+		if !p.lifecycle.begin() {
+			// drain already terminated the connection.
+			return nil
 		}
 
 		switch msg := msg.(type) {
 		case *pgproto3.Query:
-			query := msg.String
-			log.Println("--------\nGot query", query)
-
-			if q, err := rewriteQuery(query); err != nil {
-				writeError(p.conn, "ERROR", err)
-			} else {
-				if q != query {
-					log.Println("query rewritten")
-				}
-				query = q
-				if q := strings.TrimSpace(query); q == "" || q == ";" {
-					log.Printf("Return empty query response")
-					if err := writeMessages(p.conn, &pgproto3.EmptyQueryResponse{}); err != nil {
-						return fmt.Errorf("error writing query response: %w", err)
-					}
-				} else {
-					if _, err := p.processQuery(ctx, query, session); err != nil {
-						log.Println(err)
-					}
-				}
+			if err := p.handleQuery(ctx, msg.String, session); err != nil {
+				return err
 			}
 		case *pgproto3.Terminate:
-			log.Println("got terminate message")
+			p.log.Debug("got terminate message")
 			return nil
-		case *pgproto3.Parse:
-			writeError(p.conn, "ERROR", newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("prepared statements are not yet implemented in IOx")))
+		case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Describe, *pgproto3.Execute, *pgproto3.Close, *pgproto3.Sync, *pgproto3.Flush:
+			if err := p.handleExtended(ctx, session, msg); err != nil {
+				return fmt.Errorf("error writing query response: %w", err)
+			}
+			// the extended protocol sends ReadyForQuery only in response to Sync.
+			continue
 		default:
-			writeError(p.conn, "ERROR", newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("unsupported message type: %T", msg)))
+			p.writeError("ERROR", newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("unsupported message type: %T", msg)))
 		}
 
 		// some clients expect a ReadForQuery message before reporiting the error message to the user.
-		if err := writeMessages(p.conn, &pgproto3.ReadyForQuery{TxStatus: 'I'}); err != nil {
+		if err := writeMessages(p.conn, &pgproto3.ReadyForQuery{TxStatus: session.transaction.status()}); err != nil {
 			return fmt.Errorf("error writing query response: %w", err)
 		}
 	}
 }
 
-func (p *Proxy) processQuery(ctx context.Context, query string, session *session) (totalRows int, err error) {
+// handleQuery handles a simple query protocol query, which may be made of several statements separated by
+// semicolons. They run in order, each with its own results, until one fails; the remaining ones are skipped,
+// as postgres does.
+// Errors in the query are reported to the client; only errors writing to the client are returned.
+func (p *Proxy) handleQuery(ctx context.Context, query string, session *session) error {
+	p.log.Debug("got query", p.queryAttr(query))
+
+	if err := checkTerminated(query); err != nil {
+		if session.transaction == txOpen {
+			session.transaction = txFailed
+		}
+		if werr := p.writeError("ERROR", err); werr != nil {
+			return werr
+		}
+		return nil
+	}
+	stmts := splitStatements(query)
+	if len(stmts) <= 1 {
+		stmts = []string{query}
+	}
+	for _, stmt := range stmts {
+		if err := p.handleStatement(ctx, stmt, session); err != nil {
+			p.log.Info("statement failed", "err", err)
+			if session.transaction == txOpen {
+				session.transaction = txFailed
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// handleStatement runs a statement of a simple query and writes its results, or the error it failed with, to the
+// client. It returns the statement error, if any, or an error writing to the client.
+func (p *Proxy) handleStatement(ctx context.Context, query string, session *session) (err error) {
+	ctx, span := p.startQuerySpan(ctx, session, query)
+	defer func() { endSpan(span, err) }()
+
+	if stmt := parseTransactionStatement(query); stmt != nil && (session.transaction != txFailed || stmt.endsFailedTransaction()) {
+		msgs, err := execTransactionStatement(session, stmt)
+		if err != nil {
+			return p.reportError(err)
+		}
+		return writeMessages(p.conn, msgs...)
+	}
+	if session.transaction == txFailed {
+		return p.reportError(errTransactionAborted)
+	}
+	if stmt, ok := parseSettingStatement(query); ok && isProxySetting(stmt.name) {
+		return p.handleSettingStatement(p.conn, session, stmt)
+	}
+	if stmt, err := parseNotifyStatement(query); err != nil {
+		return p.reportError(err)
+	} else if stmt != nil {
+		return p.handleNotifyStatement(ctx, session, stmt)
+	}
+	// the channel listeners started by LISTEN outlive the request, which can be canceled from here on.
+	ctx, end := session.cancel.begin(ctx, session.statementTimeout)
+	defer end()
+
+	q, err := expandGrafanaMacros(query, session.grafana, time.Now())
+	if err != nil {
+		return p.reportError(err)
+	}
+	if isInvalidateCatalog(q) {
+		p.catalog.invalidate(session.databaseName)
+		p.stmtCache.invalidate(session.databaseName)
+		session.schema.invalidate()
+		return writeTextResult(p.conn, "SELECT 1", []string{"invalidate_catalog"}, []string{""})
+	}
+	if hq, err := parseHistoryQuery(q); err != nil {
+		return p.reportError(err)
+	} else if hq != nil {
+		return p.handleHistoryQuery(p.conn, session, hq)
+	}
+	if sq := parseSizeQuery(q); sq != nil {
+		return p.handleSizeQuery(ctx, session, sq)
+	}
+	if stmt, err := parseCursorStatement(q); err != nil {
+		return p.reportError(err)
+	} else if stmt != nil {
+		return p.handleCursorStatement(ctx, session, stmt, resultFormat{describe: true})
+	}
+	if stmt, err := parseCopyStatement(q); err != nil {
+		return p.reportError(err)
+	} else if stmt != nil {
+		return p.handleCopy(ctx, query, stmt, session)
+	}
+	if stmt, err := parseTailStatement(q); err != nil {
+		return p.reportError(err)
+	} else if stmt != nil {
+		return p.handleTail(ctx, query, stmt, session)
+	}
+	if stmt, err := parseExplainStatement(q); err != nil {
+		return p.reportError(err)
+	} else if stmt != nil {
+		eq, _, err := p.rewrite(ctx, session, stmt.query)
+		if err != nil {
+			return p.reportError(err)
+		}
+		return p.handleExplain(ctx, session, query, stmt, eq, resultFormat{describe: true})
+	}
+	if isInsertStatement(q) {
+		return p.processInsert(ctx, session, query, q)
+	}
+	_, rewriteSpan := p.tracer.Start(ctx, "rewrite")
+	q, hints, err := p.rewrite(ctx, session, q)
+	endSpan(rewriteSpan, err)
+	if err != nil {
+		return p.reportError(err)
+	}
+	if q != query {
+		p.log.Debug("query rewritten", p.queryAttr(q))
+	}
+	if trimStatement(q) == "" {
+		p.log.Debug("returning empty query response")
+		if err := writeMessages(p.conn, &pgproto3.EmptyQueryResponse{}); err != nil {
+			return fmt.Errorf("error writing query response: %w", err)
+		}
+		return nil
+	}
+	start := time.Now()
+	rows, err := p.processQuery(ctx, query, q, hints, session, resultFormat{describe: true})
+	p.recordQuery(session, query, q, start, rows, err)
+	p.logSlowQuery(session, query, q, start, rows, err)
+	return err
+}
+
+// reportError reports a statement error to the client. It returns err, or the error writing it to the client.
+func (p *Proxy) reportError(err error) error {
+	if werr := p.writeError("ERROR", err); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// resultFormat tells how the results of a query are written.
+type resultFormat struct {
+	// describe is set if the rows are preceded by their RowDescription; in the extended protocol it is sent
+	// in response to Describe instead.
+	describe bool
+	// codes are the format codes of the columns, as in Bind messages.
+	codes []int16
+}
+
+// processQuery runs query, source rewritten, and writes its results, or the error it failed with, to the client.
+// It returns the query error, if any, or an error writing to the client.
+func (p *Proxy) processQuery(ctx context.Context, source, query string, hints queryHints, session *session, format resultFormat) (totalRows int, err error) {
+	// truncated is set if the result was truncated to piggo.max_rows rows.
+	truncated := false
 	defer func() {
-		if err == nil {
-			err = writeMessages(p.conn, &pgproto3.CommandComplete{CommandTag: []byte(fmt.Sprintf("SELECT %d", totalRows))})
-		} else {
-			err = writeError(p.conn, "ERROR", err)
+		if err = clientError(canceledError(ctx, err), source); err == nil {
+			if truncated {
+				err = p.writeNotice(session, "NOTICE", pgerrcode.Warning, "result truncated to %d rows (piggo.max_rows)", totalRows)
+			}
+			if err == nil {
+				err = writeMessages(p.conn, &pgproto3.CommandComplete{CommandTag: []byte(fmt.Sprintf("SELECT %d", totalRows))})
+			}
+		} else if werr := p.writeError("ERROR", err); werr != nil {
+			err = werr
 		}
 	}()
 
-	q, err := p.client.PrepareQuery(ctx, session.databaseName, query)
+	done, err := p.admitQuery(ctx, session)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	key, cacheable := p.resultCacheKey(session, query, hints, format)
+	if cacheable {
+		// cached results are replayed without querying IOx, so they are authorized here.
+		if err := p.authorize(ctx, session, query); err != nil {
+			return 0, err
+		}
+		r, hit := p.resultCache.get(key, time.Now())
+		p.metrics.ResultCacheLookup(hit)
+		if hit {
+			p.log.Debug("replaying cached result", "rows", r.nrows)
+			truncated = r.truncated
+			return r.nrows, p.replayResult(ctx, r, format)
+		}
+	}
+	mem, err := p.memory.admit(ctx, p.concurrencyQueueTimeout)
 	if err != nil {
 		return 0, err
 	}
-	reader, err := q.Query(ctx)
+	defer mem.release()
+
+	p.mirrorQuery(session, query)
+	shadow := p.startShadowRead(session, query, hints)
+	var digest resultDigest
+	defer func() { shadow.finish(digest, err) }()
+
+	p.awaitWrites(ctx, session)
+	reader, err := p.runQuery(ctx, session, query)
 	if err != nil {
 		return 0, err
 	}
 	defer reader.Release()
 
-	fields := reader.Schema().Fields()
+	stream := p.startStreamSpan(ctx)
+	defer func() { stream.end(err) }()
 
-	var rowDesc pgproto3.RowDescription
-	for _, f := range fields {
-		rowDesc.Fields = append(rowDesc.Fields, makeFieldDescriptor(f))
+	fields := resultFields(reader.Schema().Fields(), session)
+	colOpts := columnRenderOptions(fields, hints, session)
+	if hints.json != nil {
+		// the shadow backend returns the rows of the subquery.
+		digest.truncated = true
+		return p.processJSONQuery(ctx, reader, hints.json, colOpts, session, mem, format)
+	}
+	if n := len(format.codes); n > 1 && n != len(fields) {
+		return 0, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("bind message has %d result formats but query has %d columns", n, len(fields)))
 	}
-	buf := rowDesc.Encode(nil)
 
+	rowDesc := rowDescription(fields, colOpts, format.codes, p.fieldSources(ctx, session, query, fields))
+	if format.describe {
+		// the columns are sent right away, so that clients can show them while IOx computes the first batch.
+		if err := writeMessages(p.conn, rowDesc); err != nil {
+			return 0, fmt.Errorf("error writing query response: %w", err)
+		}
+	}
+
+	w := p.newRowWriter(ctx, stream)
+	w.recording = cacheable
 	for {
 		batch, err := reader.Read()
 		if err == io.EOF {
@@ -219,170 +1258,235 @@ func (p *Proxy) processQuery(ctx context.Context, query string, session *session
 		}
 
 		nrows := int(batch.NumRows())
+		// a result of exactly max_rows rows is not truncated: it is truncated once a batch has a row past them.
+		if session.maxRows > 0 && totalRows+nrows > session.maxRows {
+			nrows = session.maxRows - totalRows
+			truncated = true
+			digest.truncated = true
+		}
 		totalRows += nrows
 
+		mem.hold(recordSize(batch) + w.size())
 		bcols := batch.Columns()
 		for r := 0; r < nrows; r++ {
-			cols := make([][]byte, len(fields))
-			for c := range fields {
-				cols[c], err = renderBytes(bcols[c], r)
-				if err != nil {
-					return 0, err
-				}
+			cols, err := renderRow(bcols, r, colOpts, format.codes)
+			if err != nil {
+				return 0, err
+			}
+			if shadow != nil {
+				digest.add(cols)
+			}
+			if err := w.writeRow(cols); err != nil {
+				return 0, err
 			}
-			buf = (&pgproto3.DataRow{Values: cols}).Encode(buf)
 		}
-		_, err = p.conn.Write(buf)
-		if err != nil {
-			return 0, fmt.Errorf("error writing query response: %w", err)
+
+		if truncated {
+			p.log.Debug("truncated result (piggo.max_rows)", "rows", totalRows)
+			break
 		}
-		buf = buf[:0] // reset slice without deallocating memory
+	}
+	if err := w.flush(); err != nil {
+		return 0, err
+	}
+	if w.recording {
+		p.resultCache.add(&cachedResult{key: key, fields: rowDesc.Fields, rows: w.recorded, nrows: totalRows, truncated: truncated}, time.Now())
 	}
 
 	return totalRows, nil
 }
 
-func (p *Proxy) handleStartup() (*session, error) {
+// renderRow renders a row of a batch in the formats of the result columns.
+func renderRow(bcols []arrow.Array, r int, colOpts []renderOptions, codes []int16) ([][]byte, error) {
+	cols := make([][]byte, len(colOpts))
+	for c := range colOpts {
+		var err error
+		if formatCode(codes, c) == pgtype.BinaryFormatCode {
+			cols[c], err = renderBinary(bcols[c], r, colOpts[c])
+		} else {
+			cols[c], err = renderBytes(bcols[c], r, colOpts[c])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cols, nil
+}
+
+// rowDescription describes the result columns sent in the given formats.
+func rowDescription(fields []arrow.Field, colOpts []renderOptions, codes []int16, sources []fieldSource) *pgproto3.RowDescription {
+	rowDesc := &pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{}}
+	for c, f := range fields {
+		fd := arrowpg.FieldDescription(f, colOpts[c])
+		fd.Format = formatCode(codes, c)
+		if c < len(sources) {
+			fd.TableOID, fd.TableAttributeNumber = sources[c].tableOID, uint16(sources[c].attribute)
+		}
+		rowDesc.Fields = append(rowDesc.Fields, fd)
+	}
+	return rowDesc
+}
+
+// columnRenderOptions returns the render options of each result column.
+func columnRenderOptions(fields []arrow.Field, hints queryHints, session *session) []renderOptions {
+	colOpts := make([]renderOptions, len(fields))
+	for c, f := range fields {
+		colOpts[c] = session.renderOptions
+		if loc, ok := hints.timeZones[f.Name]; ok {
+			colOpts[c].Location = loc
+		} else if loc, ok := hints.timeZones[strings.ToLower(f.Name)]; ok {
+			colOpts[c].Location = loc
+		}
+		if pattern, ok := hints.toChar[f.Name]; ok {
+			colOpts[c].ToChar = pattern
+		} else if pattern, ok := hints.toChar[strings.ToLower(f.Name)]; ok {
+			colOpts[c].ToChar = pattern
+		}
+	}
+	return colOpts
+}
+
+// startupFailed counts and audits a connection failing to start up after its startup message was accepted.
+func (p *Proxy) startupFailed(s *session, err error) {
+	p.metrics.StartupFailed(errorCode(err))
+	p.auditLogin(s, err)
+}
+
+// handleStartup handles the startup of a connection and returns its session, or nil after a CancelRequest.
+func (p *Proxy) handleStartup() (_ *session, err error) {
 	startupMessage, err := p.backend.ReceiveStartupMessage()
 	if err != nil {
-		return nil, fmt.Errorf("error receiving startup message: %w", err)
+		return nil, fmt.Errorf("error receiving startup message: %w", protocolError(err))
 	}
+	p.transcript.received(startupMessage)
 
 	switch startupMessage := startupMessage.(type) {
 	case *pgproto3.StartupMessage:
-		var token string
-		if p.requireAuth {
-			err := writeMessages(p.conn, &pgproto3.AuthenticationCleartextPassword{})
+		user, database := startupMessage.Parameters["user"], startupMessage.Parameters["database"]
+		defer func() {
 			if err != nil {
-				return nil, fmt.Errorf("error sending request for password: %w", err)
+				p.auditLogin(&session{userName: user, databaseName: database, applicationName: startupMessage.Parameters["application_name"]}, err)
 			}
-			authMessage, err := p.backend.Receive()
-			if err != nil {
-				return nil, fmt.Errorf("error sending request for password: %w", err)
+		}()
+		if err := validateStartupMessage(startupMessage); err != nil {
+			return nil, err
+		}
+		if err := p.checkTLSRequired(); err != nil {
+			return nil, err
+		}
+		if err := p.checkClientCert(user); err != nil {
+			return nil, err
+		}
+		token, peer, err := p.checkPeer(user, database)
+		if err != nil {
+			return nil, err
+		}
+		if !peer {
+			if token, err = p.authenticate(user, database); err != nil {
+				return nil, err
 			}
-			password, ok := authMessage.(*pgproto3.PasswordMessage)
-			if !ok {
-				return nil, fmt.Errorf("unexpected message %T", authMessage)
+		}
+		identity, err := p.identify(user, database, token)
+		if err != nil {
+			return nil, err
+		} else if identity != nil {
+			token = identity.Token
+		}
+		p.log.Debug("startup", "parameters", startupMessage.Parameters)
+		s := &session{
+			pid:             atomic.AddInt32(&lastSessionID, 1),
+			databaseName:    database,
+			userName:        user,
+			token:           token,
+			identity:        identity,
+			applicationName: startupMessage.Parameters["application_name"],
+			labels:          p.sessionLabels(startupMessage.Parameters),
+			schema:          newSchemaCache(),
+		}
+		p.initSettings(s)
+		for name, value := range startupMessage.Parameters {
+			if name = strings.ToLower(name); isProxySetting(name) && value != "" {
+				if err := p.setSetting(s, name, value); err != nil {
+					return nil, err
+				}
 			}
-			token = password.Password
-		}
-		log.Printf("parameters %#v", startupMessage.Parameters)
-		return &session{
-			databaseName: startupMessage.Parameters["database"],
-			userName:     startupMessage.Parameters["user"],
-			token:        token,
-		}, nil
+		}
+		return s, nil
 	case *pgproto3.SSLRequest:
+		if p.serverTLS != nil && p.tlsConn() == nil {
+			if err := p.startTLS(); err != nil {
+				return nil, err
+			}
+			return p.handleStartup()
+		}
 		_, err = p.conn.Write([]byte("N"))
 		if err != nil {
 			return nil, fmt.Errorf("error sending deny SSL request: %w", err)
 		}
 		return p.handleStartup()
+	case *pgproto3.CancelRequest:
+		// the connection is closed without a response, whether the request matched a session or not.
+		cancelTargets.cancel(p.log, int32(startupMessage.ProcessID), startupMessage.SecretKey)
+		return nil, nil
 	default:
-		return nil, fmt.Errorf("unknown startup message: %#v", startupMessage)
+		return nil, newPGError(pgerrcode.ProtocolViolation, fmt.Errorf("unsupported startup message: %T", startupMessage))
 	}
 }
 
-func rewriteQuery(query string) (string, error) {
+func rewriteQuery(query string) (string, queryHints, error) {
 	if isInformational(query) {
-		return rewriteInformationalQuery(query)
-	}
-	return query, nil
-}
-
-func makeFieldDescriptor(f arrow.Field) pgproto3.FieldDescription {
-	var typ uint32 = pgtype.TextOID
-	switch t := f.Type.ID(); t {
-	case arrow.TIMESTAMP:
-		typ = pgtype.TimestampOID
-		// postgres has only signed integers of 2, 4, 8 bytes respectively/
-		// arrow names the types in bit widths, and supports unsigned types.
-		// Map arrow types to postgres types that can fit it.
-	case arrow.INT8, arrow.UINT8, arrow.INT16:
-		typ = pgtype.Int2OID
-	case arrow.UINT16, arrow.INT32:
-		typ = pgtype.Int4OID
-	case arrow.UINT32, arrow.INT64:
-		typ = pgtype.Int8OID
-	case arrow.UINT64:
-		typ = pgtype.NumericOID // I _think_ this means bigint.
-	case arrow.FLOAT16, arrow.FLOAT32:
-		typ = pgtype.Float4OID
-	case arrow.FLOAT64:
-		typ = pgtype.Float8OID
-	}
-	return pgproto3.FieldDescription{
-		Name:                 []byte(f.Name),
-		TableOID:             0,
-		TableAttributeNumber: 0,
-		DataTypeOID:          typ,
-		DataTypeSize:         -1,
-		TypeModifier:         -1,
-		Format:               0,
-	}
-}
-
-func renderText(column arrow.Array, row int) (string, error) {
-	if column.IsNull(row) {
-		return "NULL", nil
-	}
-	switch typedColumn := column.(type) {
-	case *array.Timestamp:
-		unit := typedColumn.DataType().(*arrow.TimestampType).Unit
-		return typedColumn.Value(row).ToTime(unit).Format(pgTimestampFormat), nil
-	case *array.Time32:
-		unit := typedColumn.DataType().(*arrow.Time32Type).Unit
-		return typedColumn.Value(row).ToTime(unit).Format(pgTimestampFormat), nil
-	case *array.Time64:
-		unit := typedColumn.DataType().(*arrow.Time64Type).Unit
-		return typedColumn.Value(row).ToTime(unit).Format(pgTimestampFormat), nil
-	case *array.Date32:
-		return typedColumn.Value(row).ToTime().Format(pgTimestampFormat), nil
-	case *array.Date64:
-		return typedColumn.Value(row).ToTime().Format(pgTimestampFormat), nil
-	case *array.Duration:
-		m := typedColumn.DataType().(*arrow.DurationType).Unit.Multiplier()
-		return (time.Duration(typedColumn.Value(row)) * m).String(), nil
-	case *array.Float16:
-		return fmt.Sprint(typedColumn.Value(row)), nil
-	case *array.Float32:
-		return fmt.Sprint(typedColumn.Value(row)), nil
-	case *array.Float64:
-		return fmt.Sprint(typedColumn.Value(row)), nil
-	case *array.Uint8:
-		return fmt.Sprint(typedColumn.Value(row)), nil
-	case *array.Uint16:
-		return fmt.Sprint(typedColumn.Value(row)), nil
-	case *array.Uint32:
-		return fmt.Sprint(typedColumn.Value(row)), nil
-	case *array.Uint64:
-		return fmt.Sprint(typedColumn.Value(row)), nil
-	case *array.Int8:
-		return fmt.Sprint(typedColumn.Value(row)), nil
-	case *array.Int16:
-		return fmt.Sprint(typedColumn.Value(row)), nil
-	case *array.Int32:
-		return fmt.Sprint(typedColumn.Value(row)), nil
-	case *array.Int64:
-		return fmt.Sprint(typedColumn.Value(row)), nil
-	case *array.String:
-		return typedColumn.Value(row), nil
-	case *array.Binary:
-		return fmt.Sprint(typedColumn.Value(row)), nil
-	case *array.Boolean:
-		if typedColumn.Value(row) {
-			return "t", nil
-		} else {
-			return "f", nil
+		if q, ok, err := rewriteInformationalQuery(query); ok {
+			return q, queryHints{}, err
 		}
-	default:
-		return "", newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("unsupported arrow type %q", column.DataType().Name()))
 	}
+	if inner, shape, ok := rewriteJSONWrapper(query); ok {
+		q, hints, err := rewriteQuery(inner)
+		hints.json = shape
+		return q, hints, err
+	}
+	q, err := translateSQL(query)
+	if err != nil {
+		return "", queryHints{}, err
+	}
+	if q, err = rewriteFill(q); err != nil {
+		return "", queryHints{}, err
+	}
+	q, patterns, err := rewriteToChar(q)
+	if err != nil {
+		return "", queryHints{}, err
+	}
+	q, zones, err := rewriteTimeZones(q)
+	if err != nil {
+		return "", queryHints{}, err
+	}
+	q = rewriteCatalogSyntax(q)
+	q = rewriteTextOperators(q)
+	q = rewriteRowLimits(q)
+	return q, queryHints{timeZones: zones, toChar: patterns}, nil
+}
+
+// renderText renders a value in the postgres text format.
+func renderText(column arrow.Array, row int, opts renderOptions) (string, error) {
+	s, err := arrowpg.Text(column, row, opts)
+	return s, renderError(err)
+}
+
+func renderBytes(column arrow.Array, row int, opts renderOptions) ([]byte, error) {
+	b, err := arrowpg.Bytes(column, row, opts)
+	return b, renderError(err)
 }
 
-func renderBytes(column arrow.Array, row int) ([]byte, error) {
-	s, err := renderText(column, row)
-	return []byte(s), err
+func renderBinary(column arrow.Array, row int, opts renderOptions) ([]byte, error) {
+	b, err := arrowpg.Binary(column, row, opts)
+	return b, renderError(err)
+}
+
+// renderError reports the values that cannot be rendered as unsupported features.
+func renderError(err error) error {
+	if errors.Is(err, arrowpg.ErrUnsupportedType) {
+		return newPGError(pgerrcode.FeatureNotSupported, err)
+	}
+	return err
 }
 
 // Close terminates a pigox proxy connection.
@@ -392,16 +1496,33 @@ func (p *Proxy) Close() error {
 
 // Run runs the PG->IOx proxy protocol.
 func (p *Proxy) Run() {
+	p.metrics.ConnectionOpened()
+	defer p.metrics.ConnectionClosed()
 	defer p.Close()
+	defer func() {
+		// a malformed message must not take down the whole proxy.
+		if r := recover(); r != nil {
+			p.log.Error("panic serving connection", "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
 
 	if err := p.runE(); err != nil {
-		log.Println("writing error to conn: ", err)
-		if err := writeError(p.conn, "FATAL", err); err != nil {
-			log.Printf("cannot return error to client: %v", err)
+		p.log.Warn("connection failed", "err", err)
+		if err := p.writeError("FATAL", err); err != nil {
+			p.log.Debug("cannot return error to client", "err", err)
 		}
 	}
 }
 
+// receive receives a message from the client, recording it in the transcript if one is being captured.
+func (p *Proxy) receive() (pgproto3.FrontendMessage, error) {
+	msg, err := p.backend.Receive()
+	if err == nil {
+		p.transcript.received(msg)
+	}
+	return msg, err
+}
+
 // writeMessages writes all messages to a single buffer before sending.
 func writeMessages(w io.Writer, msgs ...pgproto3.Message) error {
 	var buf []byte
@@ -412,16 +1533,54 @@ func writeMessages(w io.Writer, msgs ...pgproto3.Message) error {
 	return err
 }
 
+// writeTextResult writes a complete result set made of text columns, followed by CommandComplete.
+func writeTextResult(w io.Writer, tag string, columns []string, rows ...[]string) error {
+	return writeMessages(w, textResult(tag, columns, rows...)...)
+}
+
+// textResult returns the messages of a result of text columns.
+func textResult(tag string, columns []string, rows ...[]string) []pgproto3.Message {
+	var rowDesc pgproto3.RowDescription
+	for _, c := range columns {
+		rowDesc.Fields = append(rowDesc.Fields, arrowpg.FieldDescription(arrow.Field{Name: c, Type: arrow.BinaryTypes.String}, renderOptions{}))
+	}
+	msgs := []pgproto3.Message{&rowDesc}
+	for _, row := range rows {
+		values := make([][]byte, len(row))
+		for i, v := range row {
+			values[i] = []byte(v)
+		}
+		msgs = append(msgs, &pgproto3.DataRow{Values: values})
+	}
+	return append(msgs, &pgproto3.CommandComplete{CommandTag: []byte(tag)})
+}
+
+// writeError reports err to the client with severity, counting it in the metrics.
+func (p *Proxy) writeError(severity string, err error) error {
+	return p.writeErrorTo(p.conn, severity, err)
+}
+
+// writeErrorTo is like writeError, but writes to w.
+func (p *Proxy) writeErrorTo(w io.Writer, severity string, err error) error {
+	err = upstreamError(err)
+	p.metrics.ErrorReported(errorCode(err))
+	return writeError(w, severity, err)
+}
+
 func writeError(w io.Writer, severity string, err error) error {
-	code := pgerrcode.InternalError
+	var detail, hint string
+	var position int32
 	var perr *pgError
 	if errors.As(err, &perr) {
-		code = perr.code
+		detail, hint, position = perr.detail, perr.hint, perr.position
 	}
 	return writeMessages(w, &pgproto3.ErrorResponse{
 		Severity:            severity,
 		SeverityUnlocalized: severity,
-		Code:                code,
+		Code:                errorCode(err),
 		Message:             err.Error(),
+		Detail:              detail,
+		Hint:                hint,
+		Position:            position,
 	})
 }
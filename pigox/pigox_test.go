@@ -0,0 +1,56 @@
+package pigox
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+func TestMaxRowsTruncation(t *testing.T) {
+	tests := []struct {
+		rows, maxRows int
+		want          int
+		truncated     bool
+	}{
+		{rows: 2, maxRows: 3, want: 2},
+		{rows: 3, maxRows: 3, want: 3},
+		{rows: 4, maxRows: 3, want: 3, truncated: true},
+	}
+	for _, tt := range tests {
+		server, client := net.Pipe()
+		p := NewProxy(server, "localhost:0")
+		p.upstream.set(nil, &fakeBackend{rows: tt.rows})
+		s := newTestSession(&p, 1, "a")
+		s.maxRows = tt.maxRows
+
+		notices := make(chan int, 1)
+		go func() {
+			n := 0
+			frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(client), client)
+			for {
+				msg, err := frontend.Receive()
+				if err != nil {
+					break
+				}
+				if _, ok := msg.(*pgproto3.NoticeResponse); ok {
+					n++
+				}
+				if _, ok := msg.(*pgproto3.CommandComplete); ok {
+					break
+				}
+			}
+			notices <- n
+		}()
+		rows, err := p.processQuery(context.Background(), "SELECT * FROM cpu", "SELECT * FROM cpu", queryHints{}, s, resultFormat{describe: true})
+		if err != nil || rows != tt.want {
+			t.Errorf("%d rows, max_rows %d: got %d rows, %v; want %d rows", tt.rows, tt.maxRows, rows, err, tt.want)
+		}
+		if n := <-notices; (n > 0) != tt.truncated {
+			t.Errorf("%d rows, max_rows %d: got %d truncation notices, want truncated %v", tt.rows, tt.maxRows, n, tt.truncated)
+		}
+		server.Close()
+		client.Close()
+	}
+}
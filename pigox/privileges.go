@@ -0,0 +1,139 @@
+package pigox
+
+import (
+	"context"
+	"strings"
+)
+
+// privilegeFunctions are the privilege inquiry functions, by the kind of object they ask about.
+var privilegeFunctions = map[string]string{
+	"has_table_privilege":      "table",
+	"has_column_privilege":     "column",
+	"has_any_column_privilege": "table",
+	"has_schema_privilege":     "schema",
+	"has_database_privilege":   "database",
+}
+
+// constantFunctions are catalog functions with a result that doesn't depend on their arguments.
+var constantFunctions = map[string]string{
+	"pg_table_is_visible":    "true",
+	"pg_type_is_visible":     "true",
+	"pg_function_is_visible": "true",
+	"obj_description":        "CAST(NULL AS VARCHAR)",
+	"col_description":        "CAST(NULL AS VARCHAR)",
+	"shobj_description":      "CAST(NULL AS VARCHAR)",
+}
+
+// rewritePrivilegeFunctions replaces calls to the privilege inquiry and visibility functions IDEs use in
+// their catalog queries with constants consistent with what the session is allowed: every object is visible,
+// tables can be read and inserted into if the Authorizer allows it (see hasPrivilege), nothing else can be
+// modified, and no object has a comment. The privileges are those of the session, whatever user is asked about.
+func (p *Proxy) rewritePrivilegeFunctions(ctx context.Context, session *session, query string) string {
+	lower := strings.ToLower(query)
+	if !strings.Contains(lower, "privilege") && !strings.Contains(lower, "_is_visible") && !strings.Contains(lower, "description") {
+		return query
+	}
+	return joinTokens(replaceCalls(scanSQL(query), func(name string, toks []token, open, closing int) (string, bool) {
+		kind, isPrivilege := privilegeFunctions[name]
+		if !isPrivilege {
+			constant, ok := constantFunctions[name]
+			return constant, ok
+		}
+		args := splitArgs(toks, open+1, closing)
+		privs, ok := singleString(toks[args[len(args)-1][0]:args[len(args)-1][1]])
+		if !ok {
+			return "", false
+		}
+		// the table is the argument before the privileges, or before the column.
+		table, n := "", 2
+		if kind == "column" {
+			n = 3
+		}
+		if len(args) >= n {
+			// tables given by OID, e.g. by catalog queries, are left empty.
+			table, _ = singleString(toks[args[len(args)-n][0]:args[len(args)-n][1]])
+		}
+		for _, priv := range strings.Split(privs, ",") {
+			if !p.hasPrivilege(ctx, session, kind, table, strings.ToLower(strings.TrimSpace(priv))) {
+				return "false", true
+			}
+		}
+		return "true", true
+	}))
+}
+
+// hasPrivilege reports whether the session has a privilege on an object of a kind. Tables can be read, and
+// inserted into if the proxy has an IOx write address; the Authorizer, if any, is asked whether the session may
+// run a SELECT or an INSERT on table. table is empty if unknown, and then only the configuration is checked.
+func (p *Proxy) hasPrivilege(ctx context.Context, session *session, kind, table, privilege string) bool {
+	switch kind {
+	case "schema":
+		return privilege == "usage"
+	case "database":
+		return privilege == "connect"
+	}
+	var stmt string
+	switch privilege {
+	case "select":
+		stmt = "SELECT * FROM " + table
+	case "insert":
+		if p.writer == nil {
+			return false
+		}
+		stmt = "INSERT INTO " + table
+	default:
+		return false
+	}
+	if table == "" {
+		return true
+	}
+	return p.authorize(ctx, session, stmt) == nil
+}
+
+// replaceCalls replaces the function calls for which replacement returns an expression, given the lower case
+// function name and the indexes of the parentheses enclosing the arguments. A call making up a whole select list
+// item keeps the function name as column name, like in postgres.
+func replaceCalls(toks []token, replacement func(name string, toks []token, open, closing int) (string, bool)) []token {
+	itemCalls := map[int]int{}
+	for _, item := range selectListItems(toks) {
+		var sig []int
+		for i := item[0]; i < item[1]; i++ {
+			if !toks[i].isBlank() {
+				sig = append(sig, i)
+			}
+		}
+		if len(sig) > 0 {
+			itemCalls[sig[0]] = sig[len(sig)-1]
+		}
+	}
+	var res []token
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		if t.kind != tokIdent {
+			res = append(res, t)
+			continue
+		}
+		open := nextSignificant(toks, i)
+		if open < 0 || !toks[open].is("(") {
+			res = append(res, t)
+			continue
+		}
+		closing := closingParen(toks, open)
+		if closing < 0 {
+			res = append(res, t)
+			continue
+		}
+		name := strings.ToLower(t.text)
+		expr, ok := replacement(name, toks, open, closing)
+		if !ok {
+			res = append(res, t)
+			continue
+		}
+		if last, ok := itemCalls[i]; ok && last == closing {
+			expr += " AS " + quoteIdent(name)
+		}
+		res = append(res, token{kind: tokIdent, text: expr})
+		i = closing
+	}
+	return res
+}
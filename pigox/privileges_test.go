@@ -0,0 +1,53 @@
+package pigox
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// readOnlyAuthenticator authorizes the inserts of writer only, and no query on secret.
+type readOnlyAuthenticator struct{}
+
+func (readOnlyAuthenticator) Authenticate(ctx context.Context, user, database, token string) (Identity, error) {
+	return Identity{User: user, Database: database}, nil
+}
+
+func (readOnlyAuthenticator) Authorize(ctx context.Context, id Identity, query string) error {
+	if strings.Contains(query, "secret") || (strings.HasPrefix(query, "INSERT") && id.User != "writer") {
+		return errors.New("permission denied")
+	}
+	return nil
+}
+
+func TestPrivilegeFunctions(t *testing.T) {
+	const query = "SELECT has_table_privilege('cpu', 'SELECT'), has_table_privilege('cpu', 'INSERT'), " +
+		"has_table_privilege('bob', 'secret', 'select'), has_column_privilege('cpu', 'usage', 'select, insert'), " +
+		"has_table_privilege(c.oid, 'INSERT'), has_table_privilege('cpu', 'DELETE'), has_schema_privilege('iox', 'USAGE') FROM pg_class c"
+	tests := []struct {
+		name string
+		opts []ProxyOption
+		user string
+		want string
+	}{
+		{"read only proxy", nil, "writer", "true, false, false, false, false, false, true"},
+		{"writer", []ProxyOption{WithWriteAddress("localhost:0")}, "writer", "true, true, false, true, true, false, true"},
+		{"reader", []ProxyOption{WithWriteAddress("localhost:0")}, "reader", "true, false, false, false, true, false, true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, append(tt.opts, WithAuthenticator(readOnlyAuthenticator{}))...)
+			got := p.rewritePrivilegeFunctions(context.Background(), newTestSession(p, 1, tt.user), query)
+			// the calls are replaced by constants named after the functions.
+			var values []string
+			for _, item := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(got, "SELECT "), " FROM pg_class c"), ", ") {
+				v, _, _ := strings.Cut(item, " AS ")
+				values = append(values, v)
+			}
+			if strings.Join(values, ", ") != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
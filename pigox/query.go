@@ -0,0 +1,200 @@
+package pigox
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	influxdbiox "github.com/influxdata/influxdb-iox-client-go"
+	"github.com/mkmik/piggo/pigox/arrowpg"
+)
+
+// Column describes a result column as the proxy reports it to PG clients.
+type Column struct {
+	Name        string
+	DataTypeOID uint32
+}
+
+// Columns are the columns of a query result.
+type Columns []Column
+
+// RowIterator iterates over the rows of a query result, rendered as the proxy sends them to PG clients.
+type RowIterator interface {
+	// Next advances to the next row, returning false at the end of the result or on error.
+	Next() bool
+	// Values returns the text encoded values of the current row; NULLs are nil.
+	Values() [][]byte
+	// Err returns the error that stopped the iteration, if any.
+	Err() error
+	// Close releases the result. It must be called even if the iteration wasn't completed.
+	Close()
+}
+
+// Query runs a query on IOx through the proxy's rewriting and rendering pipeline, without going
+// through the PG wire protocol, so that Go programs can get PG-style results in process.
+//
+// The options configure rendering like they do for proxies; options affecting connections are ignored.
+func Query(ctx context.Context, client *influxdbiox.Client, database, query string, opt ...ProxyOption) (Columns, RowIterator, error) {
+	p, s := newInProcessProxy(client, database, opt...)
+	cols, rows, _, err := p.queryRows(ctx, s, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cols, rows, nil
+}
+
+// queryRows rewrites and runs query on behalf of session. It also returns the query sent to IOx.
+func (p *Proxy) queryRows(ctx context.Context, session *session, query string) (Columns, *rowIterator, string, error) {
+	q, err := expandGrafanaMacros(query, session.grafana, time.Now())
+	if err != nil {
+		return nil, nil, "", err
+	}
+	q, hints, err := p.rewrite(ctx, session, q)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if t := strings.TrimSpace(q); t == "" || t == ";" {
+		return nil, &rowIterator{}, q, nil
+	}
+	reader, err := p.runQuery(ctx, session, q)
+	if err != nil {
+		return nil, nil, q, err
+	}
+
+	fields := resultFields(reader.Schema().Fields(), session)
+	it := &rowIterator{
+		reader:  reader,
+		fields:  fields,
+		colOpts: columnRenderOptions(fields, hints, session),
+		json:    hints.json,
+		maxRows: session.maxRows,
+	}
+	var cols Columns
+	if hints.json != nil {
+		f := hints.json.rowDescription().Fields[0]
+		cols = Columns{{Name: string(f.Name), DataTypeOID: f.DataTypeOID}}
+	} else {
+		for c, f := range fields {
+			cols = append(cols, Column{Name: f.Name, DataTypeOID: arrowpg.FieldDescription(f, it.colOpts[c]).DataTypeOID})
+		}
+	}
+	return cols, it, q, nil
+}
+
+type rowIterator struct {
+	reader  recordReader
+	fields  []arrow.Field
+	colOpts []renderOptions
+	json    *jsonResult
+	maxRows int
+
+	batch  arrow.Record
+	row    int
+	nrows  int
+	values [][]byte
+	err    error
+	done   bool
+}
+
+func (it *rowIterator) Next() bool {
+	if it.done || it.reader == nil {
+		return false
+	}
+	if it.maxRows > 0 && it.nrows >= it.maxRows {
+		it.done = true
+		return false
+	}
+	if it.json != nil && it.json.aggregate {
+		return it.nextAggregate()
+	}
+	columns, row, ok := it.advance()
+	if !ok {
+		return false
+	}
+	if it.json != nil {
+		obj, err := appendJSONObject(nil, it.fields, columns, row, it.colOpts)
+		if err != nil {
+			return it.fail(err)
+		}
+		it.values = [][]byte{obj}
+	} else {
+		it.values = make([][]byte, len(it.fields))
+		for c := range it.fields {
+			if columns[c].IsNull(row) {
+				continue
+			}
+			v, err := renderBytes(columns[c], row, it.colOpts[c])
+			if err != nil {
+				return it.fail(err)
+			}
+			it.values[c] = v
+		}
+	}
+	it.nrows++
+	return true
+}
+
+// nextAggregate returns all the rows of the result as a single JSON array.
+func (it *rowIterator) nextAggregate() bool {
+	var agg []byte
+	for {
+		columns, row, ok := it.advance()
+		if !ok {
+			break
+		}
+		if agg == nil {
+			agg = append(agg, '[')
+		} else {
+			agg = append(agg, ", "...)
+		}
+		var err error
+		if agg, err = appendJSONObject(agg, it.fields, columns, row, it.colOpts); err != nil {
+			return it.fail(err)
+		}
+	}
+	if it.err != nil {
+		return false
+	}
+	// like in postgres, aggregating no rows yields NULL.
+	if agg != nil {
+		agg = append(agg, ']')
+	}
+	it.values = [][]byte{agg}
+	it.done = true
+	return true
+}
+
+// advance moves to the next row of the flight result, reading batches as needed.
+func (it *rowIterator) advance() ([]arrow.Array, int, bool) {
+	for it.batch == nil || it.row+1 >= int(it.batch.NumRows()) {
+		batch, err := it.reader.Read()
+		if err == io.EOF {
+			it.done = true
+			return nil, 0, false
+		} else if err != nil {
+			return nil, 0, it.fail(err)
+		}
+		it.batch, it.row = batch, -1
+	}
+	it.row++
+	return it.batch.Columns(), it.row, true
+}
+
+func (it *rowIterator) fail(err error) bool {
+	it.err, it.done = err, true
+	return false
+}
+
+func (it *rowIterator) Values() [][]byte { return it.values }
+
+func (it *rowIterator) Err() error { return it.err }
+
+func (it *rowIterator) Close() {
+	if it.reader != nil {
+		it.reader.Release()
+		it.reader = nil
+	}
+	it.done = true
+}
@@ -0,0 +1,91 @@
+package pigox
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// queryRateLimiter is a token bucket bounding the rate of queries the proxy sends to IOx.
+type queryRateLimiter struct {
+	// scope describes what the limit applies to in error messages, e.g. "proxy".
+	scope string
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newQueryRateLimiter returns a limiter admitting rate queries per second with bursts of up to burst queries,
+// or nil if rate is zero (unlimited). A burst under one is taken as one.
+func newQueryRateLimiter(rate float64, burst int) *queryRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if b < 1 {
+		b = 1
+	}
+	return &queryRateLimiter{scope: "proxy", rate: rate, burst: b, tokens: b}
+}
+
+// take takes a token for a query starting at now, or returns an error telling when the next token is available.
+func (l *queryRateLimiter) take(now time.Time) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return nil
+	}
+	retry := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	return newPGError(pgerrcode.ConfigurationLimitExceeded, fmt.Errorf("too many queries: %s query rate limit of %g per second exceeded", l.scope, l.rate)).
+		withHint("Retry after %v.", retry.Round(time.Millisecond))
+}
+
+// userQueryRateLimiter bounds the rate of the queries of each user with a token bucket per user.
+type userQueryRateLimiter struct {
+	rate  float64
+	burst int
+
+	mu    sync.Mutex
+	users map[string]*queryRateLimiter
+}
+
+// newUserQueryRateLimiter returns a limiter admitting rate queries per second for each user, with bursts of up
+// to burst queries, or nil if rate is zero (unlimited).
+func newUserQueryRateLimiter(rate float64, burst int) *userQueryRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &userQueryRateLimiter{rate: rate, burst: burst, users: map[string]*queryRateLimiter{}}
+}
+
+// take takes a token of user for a query starting at now; see queryRateLimiter.take.
+func (l *userQueryRateLimiter) take(user string, now time.Time) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	b, ok := l.users[user]
+	if !ok {
+		b = newQueryRateLimiter(l.rate, l.burst)
+		b.scope = fmt.Sprintf("user %q", user)
+		l.users[user] = b
+	}
+	l.mu.Unlock()
+	return b.take(now)
+}
@@ -0,0 +1,26 @@
+package pigox
+
+import "context"
+
+// noteWrite records the IOx write token of a write (the X-IOx-Write-Token of the write response)
+// made through the session, so that its next read waits until the write is readable.
+func (s *session) noteWrite(token string) {
+	s.writeTokens = append(s.writeTokens, token)
+}
+
+// awaitWrites waits, for at most the read-your-writes timeout, until the writes made through the session
+// are visible to queries. Reads proceed after the timeout anyway.
+func (p *Proxy) awaitWrites(ctx context.Context, s *session) {
+	if p.readYourWritesTimeout <= 0 || len(s.writeTokens) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.readYourWritesTimeout)
+	defer cancel()
+	for _, token := range s.writeTokens {
+		if err := p.ioxClient().WaitForReadable(ctx, token); err != nil {
+			p.log.Warn("reading without waiting for the writes of the session to be readable", "writes", len(s.writeTokens), "err", err)
+			break
+		}
+	}
+	s.writeTokens = s.writeTokens[:0]
+}
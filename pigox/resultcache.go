@@ -0,0 +1,210 @@
+package pigox
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// maxCachedResultSize bounds the size of the encoded rows of a cached result; larger results are not cached.
+const maxCachedResultSize = 1 << 20
+
+// noCacheComment is the comment that makes a query bypass the result cache, e.g. `/* nocache */ SELECT ...`.
+const noCacheComment = "nocache"
+
+// WithResultCache caches the results of up to size SELECT queries for ttl, replaying them to the sessions
+// running the same query on the same database without querying IOx. Results are cached as encoded DataRow
+// messages, so they are only shared by sessions with the same credentials and render settings. Queries with a
+// `/* nocache */` comment bypass the cache. Proxies created by a Server share the cache.
+func WithResultCache(size int, ttl time.Duration) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.resultCacheSize = size
+		opts.resultCacheTTL = ttl
+	}
+}
+
+func withResultCache(c *resultCache) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.resultCache = c
+	}
+}
+
+// resultCache is an LRU cache of encoded query results.
+type resultCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	ll      *list.List
+	entries map[resultKey]*list.Element
+}
+
+// resultKey identifies a cached result. Besides the database and the normalized query, it holds everything
+// else that changes the bytes sent to the client.
+type resultKey struct {
+	// address is the IOx endpoint the session is routed to; see WithRouter.
+	address  string
+	database string
+	query    string
+	// token and identity keep sessions from reading results they may not be authorized to read.
+	token    string
+	identity string
+	// variant fingerprints the render settings and format codes; see resultVariant.
+	variant string
+}
+
+type cachedResult struct {
+	key    resultKey
+	fields []pgproto3.FieldDescription
+	rows   []byte
+	nrows  int
+	// truncated is set if the result was truncated to piggo.max_rows rows.
+	truncated bool
+	expires   time.Time
+}
+
+// newResultCache returns a cache of size results, or nil if size or ttl is zero (disabled).
+func newResultCache(size int, ttl time.Duration) *resultCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &resultCache{size: size, ttl: ttl, ll: list.New(), entries: map[resultKey]*list.Element{}}
+}
+
+func (c *resultCache) get(key resultKey, now time.Time) (*cachedResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	r := e.Value.(*cachedResult)
+	if now.After(r.expires) {
+		c.ll.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return r, true
+}
+
+func (c *resultCache) add(r *cachedResult, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r.expires = now.Add(c.ttl)
+	if e, ok := c.entries[r.key]; ok {
+		e.Value = r
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.entries[r.key] = c.ll.PushFront(r)
+	for c.ll.Len() > c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.entries, e.Value.(*cachedResult).key)
+	}
+}
+
+// resultCacheKey returns the cache key of a query of session, and whether its result can be cached at all.
+func (p *Proxy) resultCacheKey(session *session, query string, hints queryHints, format resultFormat) (resultKey, bool) {
+	// the results of sessions waiting for their writes to be readable would be stale.
+	if p.resultCache == nil || hints.noCache || hints.json != nil || len(session.writeTokens) > 0 || !isSelect(query) {
+		return resultKey{}, false
+	}
+	return resultKey{
+		address:  p.ioxAddress,
+		database: session.databaseName,
+		query:    normalizeQuery(query),
+		token:    session.token,
+		identity: identityKey(session),
+		variant:  resultVariant(session, hints, format),
+	}, true
+}
+
+// identityKey identifies the user of a session, with the attributes of its Authenticator identity, if any.
+func identityKey(session *session) string {
+	id := session.identity
+	if id == nil {
+		return fmt.Sprintf("%q", session.userName)
+	}
+	names := make([]string, 0, len(id.Attributes))
+	for name := range id.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%q", id.User)
+	for _, name := range names {
+		fmt.Fprintf(&b, " %q=%q", name, id.Attributes[name])
+	}
+	return b.String()
+}
+
+// resultVariant fingerprints the session settings and query hints that change how the result of a query is
+// rendered or which rows it has.
+func resultVariant(session *session, hints queryHints, format resultFormat) string {
+	var b strings.Builder
+	o := session.renderOptions
+	fmt.Fprintf(&b, "%d/%d/%d/%s/%q", o.TimestampPrecision, o.TimestampRounding, o.TimestampFormat, locationName(o.Location), o.ToChar)
+	fmt.Fprintf(&b, " %d/%t/%t/%t %v", session.maxRows, session.uniqueColumnNames, session.orderByTime, session.rollups, format.codes)
+	names := make([]string, 0, len(hints.timeZones))
+	for name := range hints.timeZones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, " tz:%q=%s", name, hints.timeZones[name].String())
+	}
+	fmt.Fprintf(&b, " %q", hints.toChar)
+	return b.String()
+}
+
+func locationName(loc *time.Location) string {
+	if loc == nil {
+		return ""
+	}
+	return loc.String()
+}
+
+// hasNoCacheComment reports whether query has a `/* nocache */` comment.
+func hasNoCacheComment(query string) bool {
+	if !strings.Contains(query, noCacheComment) {
+		return false
+	}
+	for _, t := range scanSQL(query) {
+		if t.kind != tokComment {
+			continue
+		}
+		body := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(t.text, "--"), "/*"), "*/"))
+		if body == noCacheComment {
+			return true
+		}
+	}
+	return false
+}
+
+// replayResult writes a cached result to the client, preceded by its RowDescription if format asks for it.
+func (p *Proxy) replayResult(ctx context.Context, r *cachedResult, format resultFormat) error {
+	if format.describe {
+		if err := writeMessages(p.conn, &pgproto3.RowDescription{Fields: r.fields}); err != nil {
+			return fmt.Errorf("error writing query response: %w", err)
+		}
+	}
+	if len(r.rows) == 0 {
+		return nil
+	}
+	p.metrics.ResultStreamed(r.nrows, len(r.rows))
+	if err := p.throttle.wait(ctx, r.nrows, len(r.rows)); err != nil {
+		return err
+	}
+	if err := p.writeResult(r.rows); err != nil {
+		return fmt.Errorf("error writing query response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package pigox
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// denyingAuthenticator authorizes the queries of every user but denied.
+type denyingAuthenticator struct {
+	denied string
+}
+
+func (a denyingAuthenticator) Authenticate(ctx context.Context, user, database, token string) (Identity, error) {
+	return Identity{User: user, Database: database}, nil
+}
+
+func (a denyingAuthenticator) Authorize(ctx context.Context, id Identity, query string) error {
+	if id.User == a.denied {
+		return errors.New("permission denied")
+	}
+	return nil
+}
+
+// newTestProxy returns a proxy whose client discards everything the proxy writes.
+func newTestProxy(t *testing.T, opts ...ProxyOption) *Proxy {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	go io.Copy(io.Discard, client)
+	p := NewProxy(server, "localhost:0", opts...)
+	return &p
+}
+
+func newTestSession(p *Proxy, pid int32, user string) *session {
+	s := &session{pid: pid, userName: user, databaseName: "db", identity: &Identity{User: user, Database: "db"}, schema: newSchemaCache()}
+	p.initSettings(s)
+	return s
+}
+
+func TestResultCacheAuthorizesReplays(t *testing.T) {
+	p := newTestProxy(t, WithAuthenticator(denyingAuthenticator{denied: "b"}), WithResultCache(10, time.Minute))
+	const query = "SELECT * FROM cpu"
+	format := resultFormat{describe: true}
+
+	// user a warms the cache.
+	a := newTestSession(p, 1, "a")
+	key, ok := p.resultCacheKey(a, query, queryHints{}, format)
+	if !ok {
+		t.Fatalf("query is not cacheable")
+	}
+	row := (&pgproto3.DataRow{Values: [][]byte{[]byte("1")}}).Encode(nil)
+	p.resultCache.add(&cachedResult{key: key, rows: row, nrows: 1}, time.Now())
+
+	rows, err := p.processQuery(context.Background(), query, query, queryHints{}, a, format)
+	if err != nil || rows != 1 {
+		t.Fatalf("replay to a: got %d rows, %v; want 1 row", rows, err)
+	}
+
+	// user b, with the same (empty) token, is denied by the Authorizer.
+	b := newTestSession(p, 2, "b")
+	rows, err = p.processQuery(context.Background(), query, query, queryHints{}, b, format)
+	if got := errorCode(err); got != pgerrcode.InsufficientPrivilege {
+		t.Fatalf("query of b: got %d rows, %v (code %s); want %s", rows, err, got, pgerrcode.InsufficientPrivilege)
+	}
+	if rows != 0 {
+		t.Errorf("query of b: got %d rows replayed, want none", rows)
+	}
+}
+
+func TestCatalogCacheAuthorizesReplays(t *testing.T) {
+	p := newTestProxy(t, WithAuthenticator(denyingAuthenticator{denied: "b"}), WithCatalogCacheTTL(time.Minute))
+	const query = "SELECT table_name FROM information_schema.tables"
+
+	a := newTestSession(p, 1, "a")
+	key := catalogKey{address: p.ioxAddress, database: a.databaseName, query: normalizeQuery(query), token: a.token, identity: identityKey(a)}
+	p.catalog.put(key, nil, nil, time.Now())
+	r, err := p.runCatalogQuery(context.Background(), a, query)
+	if err != nil {
+		t.Fatalf("replay to a: %v", err)
+	}
+	r.Release()
+
+	b := newTestSession(p, 2, "b")
+	if _, err := p.runCatalogQuery(context.Background(), b, query); errorCode(err) != pgerrcode.InsufficientPrivilege {
+		t.Fatalf("query of b: got %v (code %s), want %s", err, errorCode(err), pgerrcode.InsufficientPrivilege)
+	}
+}
+
+func TestFlightSQLCatalogAuthorizesProbes(t *testing.T) {
+	p := newTestProxy(t, WithAuthenticator(denyingAuthenticator{denied: "b"}))
+	// the address is never dialed: the probe is denied before the metadata RPCs.
+	c := newFlightSQLCatalog("localhost:0", nil, p.log)
+	defer c.close()
+	b := newTestSession(p, 2, "b")
+	_, ok, err := c.answer(context.Background(), b, tablesProbe, p.authorize)
+	if !ok || errorCode(err) != pgerrcode.InsufficientPrivilege {
+		t.Fatalf("probe of b: got %v, %v (code %s); want %s", ok, err, errorCode(err), pgerrcode.InsufficientPrivilege)
+	}
+}
+
+func TestCacheKeysHoldRoutedAddress(t *testing.T) {
+	router := WithRouter(StaticRouter(map[string]Route{"other": {Address: "other:8082", Database: "db"}}))
+	const query = "SELECT * FROM cpu"
+	format := resultFormat{describe: true}
+
+	p := newTestProxy(t, router, WithResultCache(10, time.Minute))
+	s := newTestSession(p, 1, "a")
+	defaultKey, _ := p.resultCacheKey(s, query, queryHints{}, format)
+
+	routed := newTestProxy(t, router, WithResultCache(10, time.Minute))
+	rs := newTestSession(routed, 2, "a")
+	rs.databaseName = "other"
+	if err := routed.route(rs); err != nil {
+		t.Fatal(err)
+	}
+	routedKey, _ := routed.resultCacheKey(rs, query, queryHints{}, format)
+	if rs.databaseName != s.databaseName || routedKey == defaultKey {
+		t.Errorf("sessions routed to different addresses share result key %+v", routedKey)
+	}
+	if routed.preparedKey(rs, query, false) == p.preparedKey(s, query, false) {
+		t.Errorf("sessions routed to different addresses share prepared key %+v", routed.preparedKey(rs, query, false))
+	}
+}
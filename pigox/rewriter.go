@@ -0,0 +1,67 @@
+package pigox
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// SessionInfo describes the session a query is run for.
+type SessionInfo struct {
+	User     string
+	Database string
+	// ApplicationName is the application_name startup parameter.
+	ApplicationName string
+	// Identity is the identity of the user if authenticated by an Authenticator, otherwise nil.
+	Identity *Identity
+	// Labels are the labels of the connection; see WithConnectionLabels.
+	Labels map[string]string
+}
+
+// QueryRewriter rewrites the queries of clients before they are sent to IOx, e.g. to translate constructs IOx
+// doesn't support or to block statements. It returns the rewritten query, and whether it handled the query:
+// handled queries are sent to IOx as returned, skipping the rewriters that follow, including the built-in ones.
+// Errors fail the query; they are reported to the client as syntax_error_or_access_rule_violation errors.
+type QueryRewriter func(ctx context.Context, session SessionInfo, query string) (rewritten string, handled bool, err error)
+
+// WithQueryRewriter adds a rewriter to the chain the queries of clients go through. Rewriters run in the order
+// they are added, before the built-in rewrites (e.g. of informational queries), which end the chain.
+func WithQueryRewriter(r QueryRewriter) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.queryRewriters = append(opts.queryRewriters, r)
+	}
+}
+
+// info returns the description of the session passed to the extension points.
+func (s *session) info() SessionInfo {
+	return SessionInfo{
+		User:            s.userName,
+		Database:        s.databaseName,
+		ApplicationName: s.applicationName,
+		Identity:        s.identity,
+		Labels:          s.labels,
+	}
+}
+
+// runQueryRewriters runs the rewriters added with WithQueryRewriter on a query of session.
+func (p *Proxy) runQueryRewriters(ctx context.Context, session *session, query string) (string, bool, error) {
+	if len(p.queryRewriters) == 0 {
+		return query, false, nil
+	}
+	info := session.info()
+	for _, r := range p.queryRewriters {
+		q, handled, err := r(ctx, info, query)
+		if err != nil {
+			var perr *pgError
+			if !errors.As(err, &perr) {
+				err = newPGError(pgerrcode.SyntaxErrorOrAccessRuleViolation, err)
+			}
+			return "", false, err
+		}
+		if query = q; handled {
+			return query, true, nil
+		}
+	}
+	return query, false, nil
+}
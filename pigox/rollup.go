@@ -0,0 +1,104 @@
+package pigox
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RollupRule reroutes the queries reading a table over a time range of at least MinRange to a downsampled copy
+// of the table, which must have the same columns, e.g. one filled by a downsampling task with hourly averages.
+type RollupRule struct {
+	Table    string
+	MinRange time.Duration
+	// Database is the namespace of the rollup table; empty means the database of the session.
+	Database string
+	Target   string
+}
+
+// ParseRollupRules parses rollup rules like `cpu:168h=cpu_1h` or `cpu:720h=rollups/cpu_1d`, i.e.
+// table:min-range=[database/]target.
+func ParseRollupRules(specs []string) ([]RollupRule, error) {
+	var rules []RollupRule
+	for _, s := range specs {
+		s = strings.TrimSpace(s)
+		source, target := s, ""
+		if i := strings.Index(s, "="); i >= 0 {
+			source, target = s[:i], s[i+1:]
+		}
+		i := strings.LastIndex(source, ":")
+		if i < 0 || target == "" {
+			return nil, fmt.Errorf("invalid rollup rule %q: expected table:min-range=[database/]target", s)
+		}
+		minRange, err := time.ParseDuration(source[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rollup rule %q: %w", s, err)
+		}
+		rule := RollupRule{Table: source[:i], MinRange: minRange, Target: target}
+		if j := strings.Index(target, "/"); j >= 0 {
+			rule.Database, rule.Target = target[:j], target[j+1:]
+		}
+		if rule.Table == "" || rule.Target == "" {
+			return nil, fmt.Errorf("invalid rollup rule %q: expected table:min-range=[database/]target", s)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// rerouteRollup rewrites a single table SELECT whose WHERE clause bounds a column with timestamp literals (e.g.
+// $__timeFilter) or relative to now() (e.g. time > now() - INTERVAL '30 days') to read from the rollup table of
+// the rule with the longest MinRange not exceeding the time range. Bounds relative to now(), and ranges without
+// an upper bound, are resolved against now. It returns the rule applied, or nil if query is returned unchanged.
+func rerouteRollup(query string, rules []RollupRule, now time.Time) (string, *RollupRule) {
+	if len(rules) == 0 || !isSelect(query) {
+		return query, nil
+	}
+	toks := significant(scanSQL(query))
+	depth := 0
+	table, whereStart, whereEnd := -1, -1, len(toks)
+	for i, t := range toks {
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		case depth > 0:
+		case t.is("from") && table < 0:
+			table = i + 1
+			if i+3 < len(toks) && toks[i+2].is(".") {
+				table = i + 3
+			}
+			if table >= len(toks) || (toks[table].kind != tokIdent && toks[table].kind != tokQuotedIdent) {
+				return query, nil
+			}
+		case t.is(",") && table >= 0 && whereStart < 0, t.is("join"), t.is("union"), t.is("intersect"), t.is("except"):
+			return query, nil
+		case t.is("where") && table >= 0 && whereStart < 0:
+			whereStart = i + 1
+		case (t.is("group") || t.is("having") || t.is("window") || t.is("order") || t.is("limit") || t.is("offset") || t.is("fetch")) &&
+			whereStart >= 0 && whereEnd == len(toks):
+			whereEnd = i
+		}
+	}
+	if table < 0 || whereStart < 0 || whereStart >= whereEnd {
+		return query, nil
+	}
+	r := findTimeRange(toks[whereStart:whereEnd], now)
+	if r == nil {
+		return query, nil
+	}
+
+	span := r.to.Sub(r.from)
+	var best *RollupRule
+	for i, rule := range rules {
+		if rule.Table == toks[table].identName() && span >= rule.MinRange && (best == nil || rule.MinRange > best.MinRange) {
+			best = &rules[i]
+		}
+	}
+	if best == nil {
+		return query, nil
+	}
+	t := toks[table]
+	return query[:t.pos] + quoteIdent(best.Target) + query[t.pos+len(t.text):], best
+}
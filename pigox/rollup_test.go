@@ -0,0 +1,57 @@
+package pigox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRerouteRollup(t *testing.T) {
+	rules, err := ParseRollupRules([]string{"cpu:168h=cpu_1h", "cpu:720h=rollups/cpu_1d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		query  string
+		target string
+	}{
+		{"SELECT * FROM cpu WHERE time >= '2024-01-01 00:00:00' AND time < '2024-01-09 00:00:00'", "cpu_1h"},
+		{"SELECT * FROM cpu WHERE time > now() - INTERVAL '30 days'", "cpu_1d"},
+		{"SELECT * FROM cpu WHERE host = 'a' AND time > now() - interval '7 days' AND time <= now()", "cpu_1h"},
+		{"SELECT * FROM cpu WHERE time BETWEEN now() - INTERVAL '10 days' AND now() - INTERVAL '1 day'", "cpu_1h"},
+		{"SELECT * FROM cpu WHERE time > '2024-01-20 00:00:00'", "cpu_1h"},
+		{"SELECT * FROM cpu WHERE time > now() - INTERVAL '1 hour'", ""},
+		{"SELECT * FROM cpu WHERE time > now() - INTERVAL '1 day' * 30", ""},
+		{"SELECT * FROM mem WHERE time > now() - INTERVAL '30 days'", ""},
+	}
+	for _, tt := range tests {
+		q, rule := rerouteRollup(tt.query, rules, now)
+		target := ""
+		if rule != nil {
+			target = rule.Target
+		}
+		if target != tt.target {
+			t.Errorf("rerouteRollup(%q) = %q, rule %q; want rule %q", tt.query, q, target, tt.target)
+		}
+	}
+}
+
+func TestIntervalDuration(t *testing.T) {
+	tests := []struct {
+		interval string
+		want     time.Duration
+	}{
+		{"30 days", 30 * 24 * time.Hour},
+		{"1 day 02:30", 26*time.Hour + 30*time.Minute},
+		{"1.5 hours", 90 * time.Minute},
+		{"2 weeks ago", -14 * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got, ok := intervalDuration(tt.interval); !ok || got != tt.want {
+			t.Errorf("intervalDuration(%q) = %v, %v; want %v", tt.interval, got, ok, tt.want)
+		}
+	}
+	if _, ok := intervalDuration("5 fortnights"); ok {
+		t.Errorf("intervalDuration(\"5 fortnights\") succeeded")
+	}
+}
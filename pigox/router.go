@@ -0,0 +1,87 @@
+package pigox
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// Router picks the IOx endpoint of a connection from the database and user of its startup message: the address
+// of the IOx gRPC API and the IOx database the queries of the session run on. An empty address selects the
+// address passed to NewProxy and an empty database the one of the startup message. Errors reject the connection.
+type Router func(database, user string) (ioxAddress string, ioxDatabase string, err error)
+
+// WithRouter routes each connection to the IOx endpoint picked by r, so that a proxy can front several IOx
+// clusters. The shadow backend, the query planner and the Flight SQL catalog are only used by the sessions routed
+// to the default address.
+func WithRouter(r Router) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.router = r
+	}
+}
+
+// Route is the IOx endpoint of a database; see StaticRouter.
+type Route struct {
+	// Address is the address of the IOx gRPC API; empty is the default address.
+	Address string
+	// Database is the IOx database; empty is the database the client connected to.
+	Database string
+}
+
+// StaticRouter returns a Router routing the databases in routes to their Route, and the other databases to the
+// default address.
+func StaticRouter(routes map[string]Route) Router {
+	return func(database, user string) (string, string, error) {
+		r := routes[database]
+		return r.Address, r.Database, nil
+	}
+}
+
+// ParseRoutes parses database=address[/iox-database] routes, as used by StaticRouter.
+func ParseRoutes(specs []string) (map[string]Route, error) {
+	routes := map[string]Route{}
+	for _, s := range specs {
+		s = strings.TrimSpace(s)
+		database, target, ok := strings.Cut(s, "=")
+		if !ok || database == "" || target == "" {
+			return nil, fmt.Errorf("invalid route %q: expected database=address[/iox-database]", s)
+		}
+		r := Route{Address: target}
+		if i := strings.Index(target, "/"); i >= 0 {
+			r.Address, r.Database = target[:i], target[i+1:]
+		}
+		if r.Address == "" {
+			return nil, fmt.Errorf("invalid route %q: expected database=address[/iox-database]", s)
+		}
+		routes[database] = r
+	}
+	return routes, nil
+}
+
+// route routes the connection of a session to its IOx endpoint; see WithRouter.
+func (p *Proxy) route(s *session) error {
+	if p.router == nil {
+		return nil
+	}
+	address, database, err := p.router(s.databaseName, s.userName)
+	if err != nil {
+		var pgErr *pgError
+		if !errors.As(err, &pgErr) {
+			err = newPGError(pgerrcode.InvalidCatalogName, err)
+		}
+		return err
+	}
+	if database != "" && database != s.databaseName {
+		p.log.Debug("routing database", "iox_database", database)
+		s.databaseName = database
+	}
+	if address != "" && address != p.ioxAddress {
+		p.log.Debug("routing connection", "iox_address", address)
+		p.ioxAddress = address
+		// these are connected to the default address.
+		p.warmPool, p.shadow, p.planner, p.flightSQL = nil, nil, nil, nil
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package pigox
+
+import (
+	"strings"
+)
+
+// rewriteRowLimits normalizes the SQL standard row limiting clauses generated by ODBC drivers and ORMs into the
+// LIMIT/OFFSET syntax IOx accepts:
+//
+//	OFFSET m ROWS                          OFFSET m
+//	FETCH {FIRST|NEXT} [n] {ROW|ROWS} ONLY LIMIT n (n defaults to 1)
+//	OFFSET m ROWS FETCH FIRST n ROWS ONLY  LIMIT n OFFSET m
+//	LIMIT ALL                              (removed)
+func rewriteRowLimits(query string) string {
+	lower := strings.ToLower(query)
+	if !strings.Contains(lower, "fetch") && !strings.Contains(lower, "offset") && !strings.Contains(lower, "all") {
+		return query
+	}
+	toks := scanSQL(query)
+
+	// the start and end token index and the count of the last OFFSET clause, to move it after a FETCH clause.
+	offsetStart, offsetEnd, offset := -1, -1, ""
+	var res []token
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		switch {
+		case t.is("offset"):
+			n := nextSignificant(toks, i)
+			if n < 0 || !(toks[n].kind == tokNumber || toks[n].kind == tokParam) {
+				break
+			}
+			end := n
+			if r := nextSignificant(toks, n); r >= 0 && (toks[r].is("row") || toks[r].is("rows")) {
+				end = r
+			}
+			offsetStart, offsetEnd, offset = len(res), len(res)+1, toks[n].text
+			res = append(res, token{kind: tokIdent, text: "OFFSET " + offset})
+			i = end
+			continue
+		case t.is("fetch"):
+			count, end, ok := parseFetchFirst(toks, i)
+			if !ok {
+				break
+			}
+			limit := "LIMIT " + count
+			if offsetEnd >= 0 && onlyBlanks(res[offsetEnd:]) {
+				// LIMIT has to precede OFFSET.
+				res = append(res[:offsetStart], token{kind: tokIdent, text: limit + " OFFSET " + offset})
+			} else {
+				res = append(res, token{kind: tokIdent, text: limit})
+			}
+			i = end
+			continue
+		case t.is("limit"):
+			if n := nextSignificant(toks, i); n >= 0 && toks[n].is("all") {
+				i = n
+				continue
+			}
+		}
+		res = append(res, t)
+	}
+	return joinTokens(res)
+}
+
+// parseFetchFirst parses `FETCH {FIRST|NEXT} [n] {ROW|ROWS} ONLY` starting at the FETCH token with index i.
+// It returns the row count and the index of the ONLY token.
+func parseFetchFirst(toks []token, i int) (string, int, bool) {
+	n := nextSignificant(toks, i)
+	if n < 0 || !(toks[n].is("first") || toks[n].is("next")) {
+		return "", 0, false
+	}
+	count := "1"
+	n = nextSignificant(toks, n)
+	if n >= 0 && (toks[n].kind == tokNumber || toks[n].kind == tokParam) {
+		count = toks[n].text
+		n = nextSignificant(toks, n)
+	}
+	if n < 0 || !(toks[n].is("row") || toks[n].is("rows")) {
+		return "", 0, false
+	}
+	if n = nextSignificant(toks, n); n < 0 || !toks[n].is("only") {
+		return "", 0, false
+	}
+	return count, n, true
+}
+
+func onlyBlanks(toks []token) bool {
+	for _, t := range toks {
+		if !t.isBlank() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,235 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+)
+
+// schemaCacheTTL bounds how long a session remembers the tables of its database; `SELECT
+// piggo.invalidate_catalog()` makes it forget them early.
+const schemaCacheTTL = time.Minute
+
+// defaultSchema is the schema IOx resolves unqualified table names in.
+const defaultSchema = "iox"
+
+// schemaCache holds the tables a session saw in catalog snapshots, so that the RowDescriptions of its query
+// results report the same table OIDs and attribute numbers as the emulated pg_catalog, and so that the tables
+// it queries are looked up only once.
+type schemaCache struct {
+	mu sync.Mutex
+	// tables are keyed by database, schema and name: rollup rules can reroute queries to other databases.
+	tables map[[3]string]schemaEntry
+}
+
+type schemaEntry struct {
+	// table is nil for tables known not to exist.
+	table   *catalogTable
+	fetched time.Time
+}
+
+func newSchemaCache() *schemaCache {
+	return &schemaCache{tables: map[[3]string]schemaEntry{}}
+}
+
+// add remembers the tables of a snapshot of database.
+func (c *schemaCache) add(database string, tables []*catalogTable, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range tables {
+		c.tables[[3]string{database, t.schema, t.name}] = schemaEntry{table: t, fetched: now}
+	}
+}
+
+// lookup returns a table, or nil if it is known not to exist. It returns false if the table is not known.
+func (c *schemaCache) lookup(database, schema, name string, now time.Time) (*catalogTable, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := [3]string{database, schema, name}
+	e, ok := c.tables[key]
+	if ok && now.Sub(e.fetched) > schemaCacheTTL {
+		delete(c.tables, key)
+		return nil, false
+	}
+	return e.table, ok
+}
+
+// missing remembers that a table doesn't exist, unless a snapshot listed it meanwhile.
+func (c *schemaCache) missing(database, schema, name string, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key := [3]string{database, schema, name}; c.tables[key].table == nil {
+		c.tables[key] = schemaEntry{fetched: now}
+	}
+}
+
+// invalidate forgets every table.
+func (c *schemaCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tables = map[[3]string]schemaEntry{}
+}
+
+// fieldSource is the table column a result column comes from, as reported in RowDescriptions.
+type fieldSource struct {
+	tableOID  uint32
+	attribute int16
+}
+
+// fieldSources returns the table columns the result columns of a query come from, for queries selecting columns
+// of a single table, looking the table up in the schema cache, or nil if it can't tell. Lookup errors are logged,
+// not returned: the sources are only informational.
+func (p *Proxy) fieldSources(ctx context.Context, session *session, query string, fields []arrow.Field) []fieldSource {
+	src, ok := parseSourceTable(query)
+	if !ok {
+		return nil
+	}
+	if _, ok := pgCatalogRelations[src.table]; ok || src.schema == "pg_catalog" {
+		// the emulated relations are not IOx tables.
+		return nil
+	}
+	now := time.Now()
+	table, known := session.schema.lookup(session.databaseName, src.schema, src.table, now)
+	if !known {
+		filter := fmt.Sprintf("table_schema = %s AND table_name = %s", quoteString(src.schema), quoteString(src.table))
+		if _, err := p.catalogSnapshot(ctx, session, filter); err != nil {
+			p.log.Debug("cannot look up result table", "table", src.table, "err", err)
+			return nil
+		}
+		if table, known = session.schema.lookup(session.databaseName, src.schema, src.table, now); !known {
+			session.schema.missing(session.databaseName, src.schema, src.table, now)
+		}
+	}
+	if table == nil {
+		return nil
+	}
+
+	sources := make([]fieldSource, len(fields))
+	for i, f := range fields {
+		column, ok := src.columns[f.Name]
+		if !ok && src.star {
+			column, ok = f.Name, true
+		}
+		if !ok {
+			continue
+		}
+		for _, c := range table.columns {
+			if c.name == column {
+				sources[i] = fieldSource{tableOID: uint32(table.oid), attribute: int16(c.position)}
+				break
+			}
+		}
+	}
+	return sources
+}
+
+// sourceTable is the table a simple SELECT reads, with the result columns that are columns of the table.
+type sourceTable struct {
+	schema, table string
+	// columns maps the names of the result columns to the names of the table columns they select.
+	columns map[string]string
+	// star is set if the query selects all the columns of the table.
+	star bool
+}
+
+// parseSourceTable parses `SELECT [DISTINCT] items FROM [schema.]table [[AS] alias] ...` queries reading a
+// single table, without joins, subqueries in the FROM clause or set operations.
+func parseSourceTable(query string) (sourceTable, bool) {
+	sig := significant(scanSQL(query))
+	if len(sig) == 0 || !sig[0].is("select") {
+		return sourceTable{}, false
+	}
+	from, depth, inFrom := -1, 0, false
+	for i, t := range sig {
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		case depth > 0:
+		case t.is("from"):
+			if from >= 0 {
+				return sourceTable{}, false
+			}
+			from, inFrom = i, true
+		case t.is("join"), t.is("union"), t.is("intersect"), t.is("except"):
+			return sourceTable{}, false
+		case t.is(",") && inFrom:
+			return sourceTable{}, false
+		case t.is("where"), t.is("group"), t.is("having"), t.is("window"), t.is("order"), t.is("limit"), t.is("offset"), t.is("fetch"):
+			inFrom = false
+		}
+	}
+	if from < 0 || from+1 >= len(sig) || !isName(sig[from+1]) {
+		return sourceTable{}, false
+	}
+
+	src := sourceTable{schema: defaultSchema, table: sig[from+1].identName(), columns: map[string]string{}}
+	i := from + 1
+	if i+2 < len(sig) && sig[i+1].is(".") && isName(sig[i+2]) {
+		src.schema, src.table = src.table, sig[i+2].identName()
+		i += 2
+	}
+	qualifiers := map[string]bool{src.table: true}
+	if relationAliasFollows(sig, i) {
+		if i++; sig[i].is("as") && i+1 < len(sig) {
+			i++
+		}
+		qualifiers[sig[i].identName()] = true
+	}
+
+	// the select list, from the first item.
+	items, item := [][]token{}, []token{}
+	start := 1
+	if sig[start].is("distinct") || sig[start].is("all") {
+		start++
+	}
+	depth = 0
+	for _, t := range sig[start:from] {
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		case depth == 0 && t.is(","):
+			items, item = append(items, item), nil
+			continue
+		}
+		item = append(item, t)
+	}
+	items = append(items, item)
+	for _, item := range items {
+		if n := len(item); n >= 3 && isName(item[0]) && item[1].is(".") {
+			if !qualifiers[item[0].identName()] {
+				continue
+			}
+			item = item[2:]
+		}
+		switch {
+		case len(item) == 1 && item[0].is("*"):
+			src.star = true
+		case len(item) == 1 && isName(item[0]):
+			src.columns[item[0].identName()] = item[0].identName()
+		case len(item) == 2 && isName(item[0]) && isName(item[1]):
+			src.columns[item[1].identName()] = item[0].identName()
+		case len(item) == 3 && isName(item[0]) && item[1].is("as") && isName(item[2]):
+			src.columns[item[2].identName()] = item[0].identName()
+		}
+	}
+	return src, true
+}
@@ -0,0 +1,483 @@
+package pigox
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// ErrServerClosed is returned by Server.Serve after a call to Shutdown.
+var ErrServerClosed = errors.New("pigox: Server closed")
+
+// errAdminShutdown is reported to clients whose connection is closed because the server is shutting down.
+var errAdminShutdown = newPGError(pgerrcode.AdminShutdown, errors.New("terminating connection due to administrator command"))
+
+// terminateWriteTimeout bounds the time spent notifying an unresponsive client of the termination of its connection.
+const terminateWriteTimeout = 5 * time.Second
+
+// Server accepts PG connections and proxies each of them to IOx.
+type Server struct {
+	ioxAddress string
+	opts       []ProxyOption
+	warmPool   *warmPool
+	shadow     *secondaryBackend
+	mirror     *secondaryBackend
+	planner    *secondaryBackend
+	catalog    *catalogCache
+	stmtCache  *statementCache
+	flightSQL  *flightSQLCatalog
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	proxies    map[*Proxy]struct{}
+	drainStart time.Time
+	shutdown   bool
+}
+
+// NewServer creates a new PG->IOx proxy server.
+//
+// ioxAddress is the address of the IOx gRPC API endpoint; opt is applied to every proxied connection.
+func NewServer(ioxAddress string, opt ...ProxyOption) *Server {
+	s := &Server{
+		ioxAddress: ioxAddress,
+		opts:       opt,
+		listeners:  map[net.Listener]struct{}{},
+		proxies:    map[*Proxy]struct{}{},
+	}
+
+	opts := proxyOptions{mirrorPercent: 100}
+	for _, ofn := range opt {
+		ofn(&opts)
+	}
+	if opts.warmConnections > 0 {
+		s.warmPool = newWarmPool(opts.warmConnections, opts.clientConfig(ioxAddress), opts.baseLogger())
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withWarmPool(s.warmPool))
+	}
+	if opts.shadowAddress != "" {
+		s.shadow = newSecondaryBackend(opts.clientConfig(opts.shadowAddress))
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withShadow(s.shadow))
+	}
+	if opts.mirrorAddress != "" {
+		s.mirror = newSecondaryBackend(opts.clientConfig(opts.mirrorAddress))
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withMirror(newQueryMirror(s.mirror, opts.mirrorPercent)))
+	}
+	if opts.slowQueryThreshold > 0 && opts.slowQueryPlans {
+		s.planner = newSecondaryBackend(opts.clientConfig(ioxAddress))
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withPlanner(s.planner))
+	}
+	if opts.stmtCacheSize > 0 {
+		s.stmtCache = newStatementCache(opts.stmtCacheSize)
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withStatementCache(s.stmtCache))
+	}
+	if opts.queryHistorySize > 0 {
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withQueryHistory(newQueryHistory(opts.queryHistorySize)))
+	}
+	if opts.maxConcurrentQueriesPerUser > 0 {
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withUserLimiter(newConcurrencyLimiter("user", opts.maxConcurrentQueriesPerUser, nil)))
+	}
+	if l := newConcurrencyLimiter("database", opts.maxConcurrentQueriesPerDB, opts.databaseConcurrencyLimits); l != nil {
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withDatabaseLimiter(l))
+	}
+	if l := newConcurrencyLimiter("priority", 0, opts.priorityConcurrencyLimits); l != nil {
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withPriorityLimiter(l))
+	}
+	if f := newFairScheduler(opts.maxConcurrentQueries, opts.tenantWeights); f != nil {
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withFairScheduler(f))
+	}
+	if b := newMemoryBudget(opts.maxResultMemory); b != nil {
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withMemoryBudget(b))
+	}
+	if opts.flightSQLCatalog {
+		s.flightSQL = newFlightSQLCatalog(ioxAddress, opts.upstreamDialer, opts.baseLogger())
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withFlightSQL(s.flightSQL))
+	}
+	if opts.writeAddress != "" {
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withWriter(newIOxWriter(opts.writeAddress, opts.upstreamDialer)))
+	}
+	if s.catalog = newCatalogCache(opts.catalogCacheTTL); s.catalog != nil {
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withCatalogCache(s.catalog))
+	}
+	if c := newResultCache(opts.resultCacheSize, opts.resultCacheTTL); c != nil {
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withResultCache(c))
+	}
+	if l := newQueryRateLimiter(opts.maxQueriesPerSecond, opts.queryBurst); l != nil {
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withQueryRateLimiter(l))
+	}
+	if l := newUserQueryRateLimiter(opts.maxQueriesPerSecondPerUser, opts.userQueryBurst); l != nil {
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withUserQueryRateLimiter(l))
+	}
+	if l := newConnectionLimiter(opts.maxConnections, opts.maxConnectionsPerUser); l != nil {
+		s.opts = append(s.opts[:len(s.opts):len(s.opts)], withConnectionLimiter(l))
+	}
+	return s
+}
+
+// Serve accepts connections on ln and proxies them until Shutdown is called.
+// opt is applied to the connections accepted on ln in addition to the server options,
+// e.g. to require TLS on public listeners only.
+func (s *Server) Serve(ln net.Listener, opt ...ProxyOption) error {
+	opts := append(s.opts[:len(s.opts):len(s.opts)], opt...)
+	if !s.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isShutdown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		p := NewProxy(conn, s.ioxAddress, opts...)
+		p.log.Info("accepted connection")
+		if !s.trackProxy(&p, true) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.trackProxy(&p, false)
+			p.Run()
+			p.log.Info("closed connection")
+		}()
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and proxies the connections accepted until Shutdown is called;
+// see Serve.
+func (s *Server) ListenAndServe(addr string, opt ...ProxyOption) error {
+	if s.isShutdown() {
+		return ErrServerClosed
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln, opt...)
+}
+
+// ListenAndServeUnix listens on the unix socket a postgres server listening on port creates in dir, e.g.
+// /var/run/postgresql/.s.PGSQL.5432, and proxies the connections accepted until Shutdown is called; see Serve.
+func (s *Server) ListenAndServeUnix(dir string, port int, opt ...ProxyOption) error {
+	if s.isShutdown() {
+		return ErrServerClosed
+	}
+	lns, err := ListenUnix([]string{dir}, port)
+	if err != nil {
+		return err
+	}
+	return s.Serve(lns[0], opt...)
+}
+
+// ListenAndServeTLS is like ListenAndServe, but accepts the SSLRequests of clients, encrypting their connections
+// with the certificate and private key in certFile and keyFile. Unlike https, postgres clients negotiate TLS on the
+// same port as plaintext connections; see WithRequireTLS to reject the latter.
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string, opt ...ProxyOption) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	return s.ListenAndServe(addr, append(opt[:len(opt):len(opt)], WithTLSConfig(cfg))...)
+}
+
+// ServeConn proxies a single client connection established by the caller, e.g. one end of a net.Pipe, and returns
+// when the session ends. Cancelling ctx closes the connection. opt is applied in addition to the server options.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn, opt ...ProxyOption) error {
+	opts := append(s.opts[:len(s.opts):len(s.opts)], opt...)
+	p := NewProxy(conn, s.ioxAddress, opts...)
+	if !s.trackProxy(&p, true) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.trackProxy(&p, false)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	p.Run()
+	return ctx.Err()
+}
+
+// DialContext returns the client end of an in-memory connection to the server, which applications embedding the
+// proxy can use instead of a TCP port, e.g. as pgx's DialFunc or in the dialer of a database/sql driver.
+// network and address are ignored.
+func (s *Server) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if s.isShutdown() {
+		return nil, ErrServerClosed
+	}
+	client, server := net.Pipe()
+	go s.ServeConn(context.Background(), server)
+	return client, nil
+}
+
+// Ready reports whether the server should receive new connections, i.e. it is not draining.
+func (s *Server) Ready() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.drainStart.IsZero()
+}
+
+// Drain marks the server as not ready and blocks until delay has passed since draining started,
+// giving load balancers time to stop routing new connections to this instance.
+// Connections are still accepted while draining.
+func (s *Server) Drain(delay time.Duration) {
+	s.mu.Lock()
+	if s.drainStart.IsZero() {
+		s.drainStart = time.Now()
+	}
+	start := s.drainStart
+	s.mu.Unlock()
+
+	time.Sleep(time.Until(start.Add(delay)))
+}
+
+// Shutdown gracefully shuts down the server: it stops accepting connections, terminates idle sessions and
+// waits for sessions executing a query to finish it. Like postgres, sessions are terminated with an
+// admin_shutdown (57P01) error. When ctx expires the remaining sessions are closed
+// forcibly and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown = true
+	if s.drainStart.IsZero() {
+		s.drainStart = time.Now()
+	}
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
+	// draining writes to the idle connections, which must not hold up the sessions ending meanwhile, nor each
+	// other: an unresponsive client holds up its own termination only.
+	var wg sync.WaitGroup
+	for _, p := range s.activeProxyList() {
+		wg.Add(1)
+		go func(p *Proxy) {
+			defer wg.Done()
+			p.drain()
+		}(p)
+	}
+	wg.Wait()
+	if s.warmPool != nil {
+		s.warmPool.close()
+	}
+	defer s.shadow.close()
+	defer s.mirror.close()
+	defer s.planner.close()
+	defer s.flightSQL.close()
+	defer s.stmtCache.invalidate("")
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if s.activeProxies() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			for _, p := range s.activeProxyList() {
+				p.Close()
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// InvalidateCatalog drops the cached catalog query results of database (see WithCatalogCacheTTL), or of all
+// databases if database is empty, e.g. so that tables just created show up in clients right away. The queries
+// of database prepared by the backend are dropped from the statement cache too.
+func (s *Server) InvalidateCatalog(database string) {
+	s.catalog.invalidate(database)
+	s.stmtCache.invalidate(database)
+}
+
+// HealthHandler returns an http.Handler for orchestrator health checks:
+//
+//	/healthz: liveness; always succeeds.
+//	/readyz: readiness; fails with 503 once the server started draining.
+//	/drain: starts draining and returns after drainDelay; suitable as a Kubernetes preStop hook.
+func (s *Server) HealthHandler(drainDelay time.Duration) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.Ready() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		s.Drain(drainDelay)
+		w.Write([]byte("drained\n"))
+	})
+	return mux
+}
+
+func (s *Server) isShutdown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdown
+}
+
+// WriteStats writes a summary of the state of the server to w, e.g. when the process is asked to dump its state.
+func (s *Server) WriteStats(w io.Writer) error {
+	s.mu.Lock()
+	listeners, sessions, busy := len(s.listeners), len(s.proxies), 0
+	for p := range s.proxies {
+		if p.lifecycle.isBusy() {
+			busy++
+		}
+	}
+	draining := !s.drainStart.IsZero()
+	s.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "listeners: %d, draining: %t\nsessions: %d (%d running a query)\n", listeners, draining, sessions, busy); err != nil {
+		return err
+	}
+	if s.catalog != nil {
+		if _, err := fmt.Fprintf(w, "catalog cache: %d entries\n", s.catalog.len()); err != nil {
+			return err
+		}
+	}
+	if s.shadow != nil {
+		queries, divergences := s.shadow.counts()
+		if _, err := fmt.Fprintf(w, "shadow backend: %d queries compared, %d diverged\n", queries, divergences); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) activeProxies() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.proxies)
+}
+
+// activeProxyList returns the proxies of the connections being served.
+func (s *Server) activeProxyList() []*Proxy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	proxies := make([]*Proxy, 0, len(s.proxies))
+	for p := range s.proxies {
+		proxies = append(proxies, p)
+	}
+	return proxies
+}
+
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.shutdown {
+			return false
+		}
+		s.listeners[ln] = struct{}{}
+	} else {
+		delete(s.listeners, ln)
+	}
+	return true
+}
+
+func (s *Server) trackProxy(p *Proxy, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.shutdown {
+			return false
+		}
+		s.proxies[p] = struct{}{}
+	} else {
+		delete(s.proxies, p)
+	}
+	return true
+}
+
+// lifecycle tracks whether a connection is in the middle of a request, so that it can be drained
+// without aborting in-flight queries.
+type lifecycle struct {
+	mu       sync.Mutex
+	busy     bool
+	draining bool
+}
+
+// idle marks the connection as waiting for the next request.
+// It returns true if the connection is draining and should be closed instead.
+func (l *lifecycle) idle() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.busy = false
+	return l.draining
+}
+
+// begin marks the connection as handling a request.
+// It returns false if the connection is draining and the request must not be started.
+func (l *lifecycle) begin() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.busy = true
+	return !l.draining
+}
+
+// whileIdle runs fn, which writes to the client, if the connection is idle and not draining, and reports
+// whether it did. Requests don't start meanwhile.
+func (l *lifecycle) whileIdle(fn func()) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.busy || l.draining {
+		return false
+	}
+	fn()
+	return true
+}
+
+func (l *lifecycle) isBusy() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.busy
+}
+
+func (l *lifecycle) isDraining() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.draining
+}
+
+// drain asks the connection to terminate once its current request completes.
+// Idle connections are terminated right away.
+func (p *Proxy) drain() {
+	p.lifecycle.mu.Lock()
+	defer p.lifecycle.mu.Unlock()
+	p.lifecycle.draining = true
+	// the lock keeps the connection from starting a request, and writing to the client, meanwhile.
+	if !p.lifecycle.busy {
+		p.terminate()
+	}
+}
+
+// terminate sends the admin_shutdown error postgres sends on shutdown, so that drivers report a meaningful
+// error and reconnect, and closes the connection.
+func (p *Proxy) terminate() {
+	p.conn.SetWriteDeadline(time.Now().Add(terminateWriteTimeout))
+	if err := p.writeError("FATAL", errAdminShutdown); err != nil {
+		p.log.Debug("cannot send shutdown notice to client", "err", err)
+	}
+	p.Close()
+}
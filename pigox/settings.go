@@ -0,0 +1,543 @@
+package pigox
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+)
+
+const piggoSettingPrefix = "piggo."
+
+// sessionSetting is a session variable handled by the proxy: either a piggo.* variable that controls the behavior
+// of the proxy, or one of the standard run-time parameters clients keep track of.
+type sessionSetting struct {
+	// def returns the default value, derived from the proxy options.
+	def func(opts *proxyOptions) string
+	// apply validates a value and applies it to the session.
+	apply func(s *session, value string) error
+	// canonical, if set, validates a value and returns it in the form postgres reports it.
+	canonical func(value string) (string, error)
+	// report, if set, is the name under which changes are reported to the client with ParameterStatus.
+	report string
+	// admin, if set, restricts changing the setting from its default to admin users.
+	admin bool
+	// readOnly, if set, forbids changing the setting from its default.
+	readOnly bool
+	// ignored, if set, marks the settings that are accepted but have no effect; changing them from their default
+	// is answered with a notice.
+	ignored bool
+}
+
+var sessionSettings = map[string]sessionSetting{
+	"piggo.max_rows": {
+		def: func(opts *proxyOptions) string { return "0" },
+		apply: func(s *session, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("expected a non-negative integer")
+			}
+			s.maxRows = n
+			return nil
+		},
+	},
+	"piggo.priority": {
+		def: func(opts *proxyOptions) string { return "normal" },
+		canonical: func(value string) (string, error) {
+			switch value = strings.ToLower(value); value {
+			case "low", "normal", "high":
+				return value, nil
+			}
+			return "", fmt.Errorf("expected low, normal or high")
+		},
+		apply: func(s *session, value string) error { s.priority = value; return nil },
+	},
+	"piggo.timestamp_precision": {
+		def: func(opts *proxyOptions) string { return opts.TimestampPrecision.String() },
+		apply: func(s *session, value string) (err error) {
+			s.renderOptions.TimestampPrecision, err = ParseTimestampPrecision(value)
+			return err
+		},
+	},
+	"piggo.timestamp_rounding": {
+		def: func(opts *proxyOptions) string { return opts.TimestampRounding.String() },
+		apply: func(s *session, value string) (err error) {
+			s.renderOptions.TimestampRounding, err = ParseTimestampRounding(value)
+			return err
+		},
+	},
+	"piggo.timestamp_format": {
+		def: func(opts *proxyOptions) string { return opts.TimestampFormat.String() },
+		apply: func(s *session, value string) (err error) {
+			s.renderOptions.TimestampFormat, err = ParseTimestampFormat(value)
+			return err
+		},
+	},
+	"piggo.unique_column_names": {
+		def: func(opts *proxyOptions) string { return formatBool(opts.uniqueColumnNames) },
+		apply: func(s *session, value string) (err error) {
+			s.uniqueColumnNames, err = parseBool(value)
+			return err
+		},
+	},
+	"piggo.order_by_time": {
+		def: func(opts *proxyOptions) string { return formatBool(opts.orderByTime) },
+		apply: func(s *session, value string) (err error) {
+			s.orderByTime, err = parseBool(value)
+			return err
+		},
+	},
+	"piggo.rollups": {
+		def: func(opts *proxyOptions) string { return formatBool(len(opts.rollupRules) > 0) },
+		apply: func(s *session, value string) (err error) {
+			s.rollups, err = parseBool(value)
+			return err
+		},
+	},
+	"piggo.transcript": {
+		def: func(opts *proxyOptions) string { return formatBool(opts.transcriptAll) },
+		apply: func(s *session, value string) (err error) {
+			s.transcript, err = parseBool(value)
+			return err
+		},
+		admin: true,
+	},
+	"piggo.time_fanout": {
+		def: func(opts *proxyOptions) string { return strconv.Itoa(opts.timeFanout) },
+		apply: func(s *session, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("expected a non-negative integer")
+			}
+			s.timeFanout = n
+			return nil
+		},
+	},
+	"piggo.grafana_macros": {
+		def: func(opts *proxyOptions) string { return formatBool(opts.grafanaMacros) },
+		apply: func(s *session, value string) (err error) {
+			s.grafana.enabled, err = parseBool(value)
+			return err
+		},
+	},
+	"piggo.grafana_from": {
+		def: func(opts *proxyOptions) string { return "now-6h" },
+		apply: func(s *session, value string) error {
+			if _, err := resolveGrafanaTime(value, time.Now()); err != nil {
+				return fmt.Errorf("expected an RFC 3339 time, epoch milliseconds or now-<interval>")
+			}
+			s.grafana.from = value
+			return nil
+		},
+	},
+	"piggo.grafana_to": {
+		def: func(opts *proxyOptions) string { return "now" },
+		apply: func(s *session, value string) error {
+			if _, err := resolveGrafanaTime(value, time.Now()); err != nil {
+				return fmt.Errorf("expected an RFC 3339 time, epoch milliseconds or now-<interval>")
+			}
+			s.grafana.to = value
+			return nil
+		},
+	},
+	"piggo.grafana_interval": {
+		def: func(opts *proxyOptions) string { return "1m" },
+		apply: func(s *session, value string) (err error) {
+			d, err := parseGrafanaDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("expected a positive interval like 30s or 5m")
+			}
+			s.grafana.interval = d
+			return nil
+		},
+	},
+
+	// the run-time parameters postgres reports to clients when they change, which drivers cache.
+	"application_name": {
+		def:    func(opts *proxyOptions) string { return "" },
+		apply:  func(s *session, value string) error { s.applicationName = value; return nil },
+		report: "application_name",
+	},
+	"timezone": {
+		def:       func(opts *proxyOptions) string { return opts.reportedParameter("TimeZone") },
+		canonical: canonicalTimeZone,
+		report:    "TimeZone",
+	},
+	"datestyle": {
+		def:       func(opts *proxyOptions) string { return opts.reportedParameter("DateStyle") },
+		canonical: canonicalDateStyle,
+		report:    "DateStyle",
+	},
+	"intervalstyle": {
+		def:       func(opts *proxyOptions) string { return opts.reportedParameter("IntervalStyle") },
+		canonical: canonicalIntervalStyle,
+		report:    "IntervalStyle",
+	},
+	"client_encoding": {
+		def:       func(opts *proxyOptions) string { return opts.reportedParameter("client_encoding") },
+		canonical: canonicalClientEncoding,
+		report:    "client_encoding",
+	},
+	"standard_conforming_strings": {
+		def: func(opts *proxyOptions) string { return "on" },
+		canonical: func(value string) (string, error) {
+			// the proxy parses queries with standard conforming strings.
+			if b, err := parseBool(value); err != nil || !b {
+				return "", fmt.Errorf("only on is supported")
+			}
+			return "on", nil
+		},
+		report: "standard_conforming_strings",
+	},
+	"server_version":        {def: func(opts *proxyOptions) string { return opts.reportedParameter("server_version") }, readOnly: true},
+	"server_version_num":    {def: func(opts *proxyOptions) string { return serverVersionNum(opts.reportedParameter("server_version")) }, readOnly: true},
+	"server_encoding":       {def: func(opts *proxyOptions) string { return "UTF8" }, readOnly: true},
+	"integer_datetimes":     {def: func(opts *proxyOptions) string { return "on" }, readOnly: true},
+	"max_identifier_length": {def: func(opts *proxyOptions) string { return "63" }, readOnly: true},
+
+	// the parameters drivers commonly SET or SHOW after connecting, which don't affect IOx queries.
+	"extra_float_digits": {
+		def: func(opts *proxyOptions) string { return "1" },
+		canonical: func(value string) (string, error) {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < -15 || n > 3 {
+				return "", fmt.Errorf("expected an integer between -15 and 3")
+			}
+			return strconv.Itoa(n), nil
+		},
+	},
+	"transaction_isolation":         {def: func(opts *proxyOptions) string { return "read committed" }, canonical: canonicalIsolationLevel},
+	"default_transaction_isolation": {def: func(opts *proxyOptions) string { return "read committed" }, canonical: canonicalIsolationLevel},
+	"transaction_read_only":         {def: func(opts *proxyOptions) string { return "off" }, canonical: canonicalBool},
+	"default_transaction_read_only": {def: func(opts *proxyOptions) string { return "off" }, canonical: canonicalBool},
+	"search_path":                   {def: func(opts *proxyOptions) string { return `"$user", public` }},
+	"statement_timeout": {
+		def:       func(opts *proxyOptions) string { return formatTimeout(opts.queryTimeout) },
+		canonical: canonicalTimeout,
+		apply: func(s *session, value string) error {
+			d, err := parseTimeout(value)
+			s.statementTimeout = d
+			return err
+		},
+	},
+	"idle_session_timeout": {
+		def:       func(opts *proxyOptions) string { return formatTimeout(opts.idleTimeout) },
+		canonical: canonicalTimeout,
+		apply: func(s *session, value string) error {
+			d, err := parseTimeout(value)
+			s.idleSessionTimeout = d
+			return err
+		},
+	},
+	"client_min_messages":                 {def: func(opts *proxyOptions) string { return "notice" }, canonical: canonicalMessageLevel},
+	"lock_timeout":                        {def: func(opts *proxyOptions) string { return "0" }, ignored: true},
+	"idle_in_transaction_session_timeout": {def: func(opts *proxyOptions) string { return "0" }, ignored: true},
+	"bytea_output":                        {def: func(opts *proxyOptions) string { return "hex" }, ignored: true},
+	"synchronous_commit":                  {def: func(opts *proxyOptions) string { return "on" }, ignored: true},
+	"row_security":                        {def: func(opts *proxyOptions) string { return "on" }, canonical: canonicalBool, ignored: true},
+	"jit":                                 {def: func(opts *proxyOptions) string { return "off" }, canonical: canonicalBool, ignored: true},
+}
+
+// canonicalIsolationLevel accepts the transaction isolation levels of postgres, all of which IOx queries satisfy
+// since they only read.
+func canonicalIsolationLevel(value string) (string, error) {
+	switch value = strings.ToLower(strings.Join(strings.Fields(value), " ")); value {
+	case "serializable", "repeatable read", "read committed", "read uncommitted":
+		return value, nil
+	}
+	return "", fmt.Errorf("expected serializable, repeatable read, read committed or read uncommitted")
+}
+
+// timeoutUnits are the units of timeout settings, largest first; like postgres, values without a unit are in
+// milliseconds.
+var timeoutUnits = []struct {
+	name string
+	d    time.Duration
+}{
+	{"d", 24 * time.Hour},
+	{"h", time.Hour},
+	{"min", time.Minute},
+	{"s", time.Second},
+	{"ms", time.Millisecond},
+}
+
+// parseTimeout parses the value of a timeout setting, e.g. 1500, '1.5s' or '2 min'; 0 means no timeout.
+func parseTimeout(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	num := strings.TrimRightFunc(value, unicode.IsLetter)
+	unit, d := strings.TrimSpace(value[len(num):]), time.Millisecond
+	if unit != "" {
+		d = 0
+		for _, u := range timeoutUnits {
+			if strings.EqualFold(unit, u.name) {
+				d = u.d
+			}
+		}
+		if d == 0 {
+			return 0, fmt.Errorf(`valid units for this parameter are "ms", "s", "min", "h", and "d"`)
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || n < 0 || n*float64(d) > math.MaxInt64 {
+		return 0, fmt.Errorf("expected a non-negative duration")
+	}
+	return time.Duration(n * float64(d)).Round(time.Millisecond), nil
+}
+
+// formatTimeout formats a timeout the way postgres shows it, in the largest unit it is a whole number of.
+func formatTimeout(d time.Duration) string {
+	d = d.Round(time.Millisecond)
+	if d == 0 {
+		return "0"
+	}
+	for _, u := range timeoutUnits {
+		if d%u.d == 0 {
+			return fmt.Sprintf("%d%s", d/u.d, u.name)
+		}
+	}
+	return "0"
+}
+
+func canonicalTimeout(value string) (string, error) {
+	d, err := parseTimeout(value)
+	return formatTimeout(d), err
+}
+
+func canonicalBool(value string) (string, error) {
+	b, err := parseBool(value)
+	return formatBool(b), err
+}
+
+// serverVersionNum returns the server_version_num of a server_version, e.g. 140002 for 14.2.
+func serverVersionNum(version string) string {
+	var major, minor int
+	fmt.Sscanf(version, "%d.%d", &major, &minor)
+	return strconv.Itoa(major*10000 + minor)
+}
+
+// parseBool parses a boolean setting value the way postgres does.
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "true", "yes", "1", "t", "y":
+		return true, nil
+	case "off", "false", "no", "0", "f", "n":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected a boolean")
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+func isPiggoSetting(name string) bool {
+	return strings.HasPrefix(name, piggoSettingPrefix)
+}
+
+// isProxySetting reports whether a setting is handled by the proxy rather than sent to IOx.
+func isProxySetting(name string) bool {
+	_, ok := sessionSettings[name]
+	return ok || isPiggoSetting(name)
+}
+
+// initSettings sets all piggo.* settings of a session to their defaults.
+func (p *Proxy) initSettings(s *session) {
+	s.renderOptions = p.renderOptions
+	s.settings = map[string]string{}
+	for name := range sessionSettings {
+		if err := p.resetSetting(s, name); err != nil {
+			panic(fmt.Sprintf("invalid default for %q: %v", name, err))
+		}
+	}
+}
+
+func (p *Proxy) setSetting(s *session, name, value string) error {
+	if setting, ok := sessionSettings[name]; ok {
+		invalid := func(err error) error {
+			return newPGError(pgerrcode.InvalidParameterValue, fmt.Errorf("invalid value for parameter %q: %q: %v", name, value, err))
+		}
+		if setting.canonical != nil {
+			v, err := setting.canonical(value)
+			if err != nil {
+				return invalid(err)
+			}
+			value = v
+		}
+		if setting.readOnly && value != setting.def(&p.proxyOptions) {
+			return newPGError(pgerrcode.CantChangeRuntimeParam, fmt.Errorf("parameter %q cannot be changed", name))
+		}
+		if setting.admin && value != setting.def(&p.proxyOptions) && !p.isAdmin(s.userName) {
+			return newPGError(pgerrcode.InsufficientPrivilege, fmt.Errorf("permission denied to set parameter %q", name))
+		}
+		if setting.apply != nil {
+			if err := setting.apply(s, value); err != nil {
+				return invalid(err)
+			}
+		}
+	}
+	// like postgres, unknown settings with a namespace prefix are placeholders that are just stored.
+	s.settings[name] = value
+	return nil
+}
+
+func (p *Proxy) resetSetting(s *session, name string) error {
+	if setting, ok := sessionSettings[name]; ok {
+		return p.setSetting(s, name, setting.def(&p.proxyOptions))
+	}
+	delete(s.settings, name)
+	return nil
+}
+
+// settingStatement is a parsed SET, RESET or SHOW statement.
+type settingStatement struct {
+	verb string // "set", "reset" or "show"
+	name string
+	// value is the value to SET; empty if resetting to the default value.
+	value string
+}
+
+// parseSettingStatement parses `SET [SESSION | LOCAL] name {TO | =} value`, `SET name TO DEFAULT`,
+// `RESET name` and `SHOW name`, including `SHOW TRANSACTION ISOLATION LEVEL`. It returns false if the query is not one of these statements.
+func parseSettingStatement(query string) (*settingStatement, bool) {
+	toks := significant(scanSQL(query))
+	if n := len(toks); n > 0 && toks[n-1].is(";") {
+		toks = toks[:n-1]
+	}
+	if len(toks) < 2 {
+		return nil, false
+	}
+	stmt := &settingStatement{verb: strings.ToLower(toks[0].text)}
+	switch {
+	case toks[0].is("set") || toks[0].is("reset") || toks[0].is("show"):
+	default:
+		return nil, false
+	}
+	toks = toks[1:]
+	if stmt.verb == "set" && (toks[0].is("session") || toks[0].is("local")) {
+		toks = toks[1:]
+	}
+
+	var name []string
+	for len(toks) > 0 && (toks[0].kind == tokIdent || toks[0].kind == tokQuotedIdent) {
+		name = append(name, toks[0].identName())
+		toks = toks[1:]
+		if len(toks) == 0 || !toks[0].is(".") {
+			break
+		}
+		toks = toks[1:]
+	}
+	if len(name) == 0 {
+		return nil, false
+	}
+	stmt.name = strings.Join(name, ".")
+
+	// SET TIME ZONE value and SHOW TIME ZONE, where the value is not preceded by TO or =.
+	timeZone := stmt.name == "time" && len(toks) > 0 && toks[0].is("zone")
+	if timeZone {
+		stmt.name = "timezone"
+		toks = toks[1:]
+	}
+	// SHOW TRANSACTION ISOLATION LEVEL
+	if stmt.verb == "show" && stmt.name == "transaction" && len(toks) == 2 && toks[0].is("isolation") && toks[1].is("level") {
+		stmt.name, toks = "transaction_isolation", nil
+	}
+	if stmt.verb != "set" {
+		return stmt, len(toks) == 0
+	}
+	switch {
+	case timeZone && len(toks) == 1 && toks[0].is("local"):
+		return stmt, true
+	case timeZone && len(toks) > 0:
+	case len(toks) < 2 || !(toks[0].is("to") || toks[0].is("=")):
+		return nil, false
+	default:
+		toks = toks[1:]
+	}
+	if len(toks) == 1 && toks[0].is("default") {
+		return stmt, true
+	}
+	var values []string
+	for i, t := range toks {
+		switch {
+		case i%2 == 1 && t.is(","):
+			continue
+		case t.kind == tokString:
+			values = append(values, t.stringValue())
+		case t.kind == tokIdent || t.kind == tokNumber || t.kind == tokQuotedIdent:
+			values = append(values, t.text)
+		default:
+			return nil, false
+		}
+	}
+	stmt.value = strings.Join(values, ", ")
+	return stmt, true
+}
+
+// handleSettingStatement executes a SET, RESET or SHOW statement for a setting handled by the proxy.
+// Errors in the statement are reported to the client and returned, unless writing them fails too.
+func (p *Proxy) handleSettingStatement(w io.Writer, s *session, stmt *settingStatement) error {
+	msgs, err := p.execSettingStatement(s, stmt)
+	if err != nil {
+		if werr := p.writeErrorTo(w, "ERROR", err); werr != nil {
+			return werr
+		}
+		return err
+	}
+	return writeMessages(w, msgs...)
+}
+
+// execSettingStatement executes a SET, RESET or SHOW statement for a setting handled by the proxy and returns
+// the messages of its result. Like postgres, changes of reported parameters are followed by a ParameterStatus
+// message.
+func (p *Proxy) execSettingStatement(s *session, stmt *settingStatement) ([]pgproto3.Message, error) {
+	complete := func(tag string) []pgproto3.Message {
+		msgs := []pgproto3.Message{&pgproto3.CommandComplete{CommandTag: []byte(tag)}}
+		if setting := sessionSettings[stmt.name]; setting.report != "" {
+			msgs = append(msgs, &pgproto3.ParameterStatus{Name: setting.report, Value: s.settings[stmt.name]})
+		}
+		return msgs
+	}
+	switch stmt.verb {
+	case "set":
+		var err error
+		if stmt.value == "" {
+			err = p.resetSetting(s, stmt.name)
+		} else {
+			err = p.setSetting(s, stmt.name, stmt.value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		setting, known := sessionSettings[stmt.name]
+		var n *pgproto3.NoticeResponse
+		switch {
+		case !known:
+			n = notice(s, "WARNING", pgerrcode.UndefinedObject, "piggo has no setting %q: its value is stored but has no effect", stmt.name)
+		case setting.ignored && s.settings[stmt.name] != setting.def(&p.proxyOptions):
+			n = notice(s, "NOTICE", pgerrcode.FeatureNotSupported, "parameter %q has no effect on IOx queries", stmt.name)
+		}
+		if n != nil {
+			return append([]pgproto3.Message{n}, complete("SET")...), nil
+		}
+		return complete("SET"), nil
+	case "reset":
+		if err := p.resetSetting(s, stmt.name); err != nil {
+			return nil, err
+		}
+		return complete("RESET"), nil
+	}
+	value, ok := s.settings[stmt.name]
+	if !ok {
+		return nil, newPGError(pgerrcode.UndefinedObject, fmt.Errorf("unrecognized configuration parameter %q", stmt.name))
+	}
+	return textResult("SHOW", []string{stmt.name}, []string{value}), nil
+}
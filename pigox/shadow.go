@@ -0,0 +1,188 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shadowQueryTimeout bounds the time a query may run on a secondary backend.
+const shadowQueryTimeout = time.Minute
+
+// secondaryBackend is an IOx backend that receives copies of the queries sent to the primary one.
+// The client is shared by all sessions and is connected on first use.
+type secondaryBackend struct {
+	config backendConfig
+
+	once   sync.Once
+	client backend
+	err    error
+
+	// queries and divergences count the compared queries and those whose results differed.
+	queries, divergences uint64
+}
+
+func newSecondaryBackend(config backendConfig) *secondaryBackend {
+	return &secondaryBackend{config: config}
+}
+
+func (b *secondaryBackend) query(ctx context.Context, session *session, query string) (recordReader, error) {
+	b.once.Do(func() {
+		b.client, b.err = b.config.dial(context.Background())
+	})
+	if b.err != nil {
+		return nil, b.err
+	}
+	q, err := b.client.PrepareQuery(ctx, session.databaseName, query)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := q.Query(withQueryMetadata(ctx, session, query))
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (b *secondaryBackend) close() {
+	if b == nil {
+		return
+	}
+	b.once.Do(func() {})
+	if b.client != nil {
+		b.client.Close()
+	}
+}
+
+// counts returns the number of compared queries and of those whose results differed.
+func (b *secondaryBackend) counts() (queries, divergences uint64) {
+	return atomic.LoadUint64(&b.queries), atomic.LoadUint64(&b.divergences)
+}
+
+// resultDigest summarizes a query result, independently of the order of its rows.
+type resultDigest struct {
+	rows int
+	// sum is the sum of the hashes of the rendered rows.
+	sum uint64
+	// truncated is set if the result was cut by piggo.max_rows, so that it cannot be compared.
+	truncated bool
+}
+
+func (d *resultDigest) add(values [][]byte) {
+	h := fnv.New64a()
+	for _, v := range values {
+		if v == nil {
+			// NULL differs from any text value, which is valid UTF-8.
+			h.Write([]byte{0xff})
+		}
+		h.Write(v)
+		h.Write([]byte{0})
+	}
+	d.rows++
+	d.sum += h.Sum64()
+}
+
+// shadowRead compares the result of a query with the result of the same query on the shadow backend.
+type shadowRead struct {
+	primary chan shadowResult
+}
+
+type shadowResult struct {
+	digest resultDigest
+	err    error
+}
+
+// startShadowRead sends a copy of a query to the shadow backend, if one is configured.
+// The shadow query runs concurrently and doesn't delay the session; the results are compared,
+// and divergences logged, once finish reports the result of the primary query.
+func (p *Proxy) startShadowRead(session *session, query string, hints queryHints) *shadowRead {
+	if p.shadow == nil {
+		return nil
+	}
+	sr := &shadowRead{primary: make(chan shadowResult, 1)}
+	s := *session
+	logger, queryAttr := p.log, p.queryAttr(query)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shadowQueryTimeout)
+		defer cancel()
+		var shadow shadowResult
+		shadow.digest, shadow.err = p.shadow.digest(ctx, &s, query, hints)
+		p.shadow.compare(logger, query, queryAttr, <-sr.primary, shadow)
+	}()
+	return sr
+}
+
+// finish reports the result of the primary query.
+func (sr *shadowRead) finish(digest resultDigest, err error) {
+	if sr != nil {
+		sr.primary <- shadowResult{digest, err}
+	}
+}
+
+// digest runs a query and summarizes its result as processQuery would render it.
+func (b *secondaryBackend) digest(ctx context.Context, session *session, query string, hints queryHints) (resultDigest, error) {
+	var d resultDigest
+	reader, err := b.query(ctx, session, query)
+	if err != nil {
+		return d, err
+	}
+	defer reader.Release()
+
+	fields := reader.Schema().Fields()
+	colOpts := columnRenderOptions(fields, hints, session)
+	for {
+		batch, err := reader.Read()
+		if err == io.EOF {
+			return d, nil
+		} else if err != nil {
+			return d, err
+		}
+		bcols := batch.Columns()
+		for r := 0; r < int(batch.NumRows()); r++ {
+			if session.maxRows > 0 && d.rows >= session.maxRows {
+				d.truncated = true
+				return d, nil
+			}
+			values := make([][]byte, len(fields))
+			for c := range fields {
+				if values[c], err = renderBytes(bcols[c], r, colOpts[c]); err != nil {
+					return d, err
+				}
+			}
+			d.add(values)
+		}
+	}
+}
+
+// compare compares the results of a query on the primary and the shadow backend, logging divergences to logger
+// with queryAttr.
+func (b *secondaryBackend) compare(logger *slog.Logger, query string, queryAttr slog.Attr, primary, shadow shadowResult) {
+	if primary.digest.truncated || shadow.digest.truncated {
+		return
+	}
+	n := atomic.AddUint64(&b.queries, 1)
+	var diff string
+	switch {
+	case primary.err != nil && shadow.err != nil:
+		return
+	case primary.err != nil:
+		diff = "primary failed: " + primary.err.Error()
+	case shadow.err != nil:
+		diff = "shadow failed: " + shadow.err.Error()
+	case primary.digest.rows != shadow.digest.rows:
+		diff = "row counts differ"
+	case primary.digest.sum != shadow.digest.sum:
+		diff = "row checksums differ"
+	default:
+		return
+	}
+	divergences := atomic.AddUint64(&b.divergences, 1)
+	logger.Warn("shadow read divergence", "divergences", divergences, "queries", n, "fingerprint", queryFingerprint(query), "diff", diff,
+		"primary_rows", primary.digest.rows, "primary_sum", fmt.Sprintf("%016x", primary.digest.sum),
+		"shadow_rows", shadow.digest.rows, "shadow_sum", fmt.Sprintf("%016x", shadow.digest.sum), queryAttr)
+}
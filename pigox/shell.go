@@ -0,0 +1,200 @@
+package pigox
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	influxdbiox "github.com/influxdata/influxdb-iox-client-go"
+	"github.com/jackc/pgerrcode"
+)
+
+// Shell runs queries directly on IOx through the same rewriting and rendering pipeline as the proxy,
+// without the PG wire protocol in between, and prints the results as psql does.
+type Shell struct {
+	p       *Proxy
+	session *session
+	// Prompt, if set, is printed before reading each line.
+	Prompt bool
+}
+
+// NewShell creates a new Shell querying database through client.
+func NewShell(client *influxdbiox.Client, database string, opt ...ProxyOption) *Shell {
+	p, s := newInProcessProxy(client, database, opt...)
+	s.applicationName = "piggo shell"
+	return &Shell{p: p, session: s}
+}
+
+// newInProcessProxy returns a proxy and a session for running queries through client without a PG connection.
+func newInProcessProxy(client *influxdbiox.Client, database string, opt ...ProxyOption) (*Proxy, *session) {
+	opts := proxyOptions{}
+	for _, ofn := range opt {
+		ofn(&opts)
+	}
+	if opts.metrics == nil {
+		opts.metrics = noMetrics{}
+	}
+	p := &Proxy{proxyOptions: opts, upstream: &upstreamClient{client: ioxBackend{client}}, log: opts.baseLogger(), tracer: opts.newTracer()}
+	s := &session{databaseName: database, userName: "piggo", schema: newSchemaCache()}
+	p.initSettings(s)
+	return p, s
+}
+
+// Run reads statements terminated by ';' from in until EOF or \q, and writes their results to out.
+// Statement errors are printed and don't stop the shell.
+func (sh *Shell) Run(ctx context.Context, in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, DefaultMaxMessageSize)
+	var buf strings.Builder
+	for {
+		if sh.Prompt {
+			if buf.Len() == 0 {
+				fmt.Fprintf(out, "%s=> ", sh.session.databaseName)
+			} else {
+				fmt.Fprintf(out, "%s-> ", sh.session.databaseName)
+			}
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := scanner.Text()
+		if buf.Len() == 0 {
+			switch strings.TrimSpace(line) {
+			case "":
+				continue
+			case `\q`:
+				return nil
+			}
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+
+		toks := significant(scanSQL(buf.String()))
+		if len(toks) == 0 || !toks[len(toks)-1].is(";") {
+			continue
+		}
+		if err := sh.Exec(ctx, buf.String(), out); err != nil {
+			fmt.Fprintf(out, "ERROR:  %v\n", err)
+		}
+		buf.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if strings.TrimSpace(buf.String()) != "" {
+		if err := sh.Exec(ctx, buf.String(), out); err != nil {
+			fmt.Fprintf(out, "ERROR:  %v\n", err)
+		}
+	}
+	return nil
+}
+
+// Exec runs a single statement and writes its result to out.
+// The query actually sent to IOx is printed first if rewriting changed it.
+func (sh *Shell) Exec(ctx context.Context, query string, out io.Writer) error {
+	p, s := sh.p, sh.session
+	if stmt, ok := parseSettingStatement(query); ok && isProxySetting(stmt.name) {
+		return sh.execSetting(stmt, out)
+	}
+	cols, it, q, err := p.queryRows(ctx, s, query)
+	if strings.TrimSpace(q) != strings.TrimSpace(query) && q != "" {
+		fmt.Fprintf(out, "-- rewritten: %s\n", strings.TrimSpace(q))
+	}
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	if cols == nil {
+		return nil
+	}
+
+	header := make([]string, len(cols))
+	for c, col := range cols {
+		header[c] = col.Name
+	}
+	var rows [][]string
+	for it.Next() {
+		row := make([]string, len(cols))
+		for c, v := range it.Values() {
+			row[c] = string(v)
+		}
+		rows = append(rows, row)
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	printTable(out, header, rows)
+	return nil
+}
+
+func (sh *Shell) execSetting(stmt *settingStatement, out io.Writer) error {
+	p, s := sh.p, sh.session
+	switch stmt.verb {
+	case "set":
+		if stmt.value == "" {
+			return p.resetSetting(s, stmt.name)
+		}
+		return p.setSetting(s, stmt.name, stmt.value)
+	case "reset":
+		return p.resetSetting(s, stmt.name)
+	}
+	value, ok := s.settings[stmt.name]
+	if !ok {
+		return newPGError(pgerrcode.UndefinedObject, fmt.Errorf("unrecognized configuration parameter %q", stmt.name))
+	}
+	printTable(out, []string{stmt.name}, [][]string{{value}})
+	return nil
+}
+
+// printTable writes rows in psql's aligned format.
+func printTable(w io.Writer, header []string, rows [][]string) {
+	widths := make([]int, len(header))
+	for c, h := range header {
+		widths[c] = utf8.RuneCountInString(h)
+	}
+	for _, row := range rows {
+		for c, v := range row {
+			if n := utf8.RuneCountInString(v); n > widths[c] {
+				widths[c] = n
+			}
+		}
+	}
+	pad := func(s string, width int) string {
+		return s + strings.Repeat(" ", width-utf8.RuneCountInString(s))
+	}
+
+	var b strings.Builder
+	line := func(cells []string) {
+		// like psql, the last column is not padded.
+		b.WriteString(strings.TrimRight(" "+strings.Join(cells, " | "), " ") + "\n")
+	}
+	cells := make([]string, len(header))
+	for c, h := range header {
+		// psql centers the column names.
+		left := (widths[c] - utf8.RuneCountInString(h)) / 2
+		cells[c] = pad(strings.Repeat(" ", left)+h, widths[c])
+	}
+	line(cells)
+	for c := range header {
+		if c > 0 {
+			b.WriteString("+")
+		}
+		b.WriteString(strings.Repeat("-", widths[c]+2))
+	}
+	b.WriteString("\n")
+	for _, row := range rows {
+		for c, v := range row {
+			cells[c] = pad(v, widths[c])
+		}
+		line(cells)
+	}
+	if len(rows) == 1 {
+		b.WriteString("(1 row)\n\n")
+	} else {
+		fmt.Fprintf(&b, "(%d rows)\n\n", len(rows))
+	}
+	io.WriteString(w, b.String())
+}
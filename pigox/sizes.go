@@ -0,0 +1,246 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+)
+
+// sizeFunctions are the postgres relation size functions answered from IOx chunk statistics.
+var sizeFunctions = map[string]bool{
+	"pg_total_relation_size": true,
+	"pg_table_size":          true,
+	"pg_relation_size":       true,
+	"pg_indexes_size":        true,
+}
+
+// sizeQuery is a query computing table sizes or row estimates, e.g.
+//
+//	SELECT pg_size_pretty(pg_total_relation_size('cpu')) AS size
+//	SELECT reltuples FROM pg_class WHERE relname = 'cpu'
+type sizeQuery struct {
+	columns []sizeColumn
+}
+
+type sizeColumn struct {
+	name     string
+	function string
+	table    string
+	pretty   bool
+}
+
+// parseSizeQuery recognizes queries that only call relation size functions on literal table names, or read the
+// row estimate of a table from pg_class. It returns nil if the query is anything else.
+func parseSizeQuery(query string) *sizeQuery {
+	lower := strings.ToLower(query)
+	if !strings.Contains(lower, "_size") && !strings.Contains(lower, "reltuples") {
+		return nil
+	}
+	toks := significant(scanSQL(query))
+	if n := len(toks); n > 0 && toks[n-1].is(";") {
+		toks = toks[:n-1]
+	}
+	if len(toks) < 2 || !toks[0].is("select") {
+		return nil
+	}
+
+	// SELECT reltuples[::type] [[AS] alias] FROM pg_class WHERE relname = 'table'
+	if toks[1].is("reltuples") {
+		i, name := 2, "reltuples"
+		if i+1 < len(toks) && toks[i].is("::") {
+			i += 2
+		}
+		if i < len(toks) && toks[i].is("as") {
+			i++
+		}
+		if i < len(toks) && !toks[i].is("from") {
+			name = toks[i].identName()
+			i++
+		}
+		rest := toks[i:]
+		if len(rest) != 6 || !rest[0].is("from") || !rest[1].is("pg_class") || !rest[2].is("where") ||
+			!rest[3].is("relname") || !rest[4].is("=") || rest[5].kind != tokString {
+			return nil
+		}
+		return &sizeQuery{columns: []sizeColumn{{name: name, function: "reltuples", table: rest[5].stringValue()}}}
+	}
+
+	var sq sizeQuery
+	for _, item := range splitOnCommas(toks[1:]) {
+		var col sizeColumn
+		if len(item) > 2 && item[0].is("pg_size_pretty") && item[1].is("(") {
+			end := matchingParen(item[1:])
+			if end < 0 {
+				return nil
+			}
+			col.pretty = true
+			col.name = "pg_size_pretty"
+			item = append(item[2:1+end:1+end], item[end+2:]...)
+		}
+		if len(item) < 4 || item[0].kind != tokIdent || !sizeFunctions[strings.ToLower(item[0].text)] || !item[1].is("(") || item[2].kind != tokString {
+			return nil
+		}
+		col.function = strings.ToLower(item[0].text)
+		if col.name == "" {
+			col.name = col.function
+		}
+		col.table = item[2].stringValue()
+		rest := item[3:]
+		if len(rest) >= 2 && rest[0].is("::") && rest[1].is("regclass") {
+			rest = rest[2:]
+		}
+		if len(rest) == 0 || !rest[0].is(")") {
+			return nil
+		}
+		alias, ok := columnAliasTokens(rest[1:])
+		if !ok {
+			return nil
+		}
+		if alias != "" {
+			col.name = alias
+		}
+		sq.columns = append(sq.columns, col)
+	}
+	return &sq
+}
+
+// columnAliasTokens parses the significant tokens `[AS] alias`, returning the empty string if there are none.
+func columnAliasTokens(toks []token) (string, bool) {
+	if len(toks) > 0 && toks[0].is("as") {
+		toks = toks[1:]
+		if len(toks) == 0 {
+			return "", false
+		}
+	}
+	switch {
+	case len(toks) == 0:
+		return "", true
+	case len(toks) == 1 && (toks[0].kind == tokIdent || toks[0].kind == tokQuotedIdent):
+		return toks[0].identName(), true
+	}
+	return "", false
+}
+
+// tableStats are the storage statistics of a table.
+type tableStats struct {
+	bytes, rows int64
+}
+
+// handleSizeQuery answers a sizeQuery from the chunk statistics of the IOx system tables.
+// Tables whose statistics are unavailable have NULL sizes.
+func (p *Proxy) handleSizeQuery(ctx context.Context, session *session, sq *sizeQuery) error {
+	var tables []string
+	seen := map[string]bool{}
+	for _, c := range sq.columns {
+		if !seen[c.table] {
+			seen[c.table] = true
+			tables = append(tables, quoteString(c.table))
+		}
+	}
+	stats, err := p.tableStats(ctx, session, tables)
+	if err != nil {
+		p.log.Warn("cannot read table statistics", "err", err)
+	}
+
+	var rowDesc pgproto3.RowDescription
+	values := make([][]byte, len(sq.columns))
+	for i, c := range sq.columns {
+		oid := uint32(pgtype.Int8OID)
+		switch {
+		case c.pretty:
+			oid = pgtype.TextOID
+		case c.function == "reltuples":
+			oid = pgtype.Float4OID
+		}
+		rowDesc.Fields = append(rowDesc.Fields, pgproto3.FieldDescription{Name: []byte(c.name), DataTypeOID: oid, DataTypeSize: -1, TypeModifier: -1})
+
+		st, ok := stats[c.table]
+		if !ok {
+			continue
+		}
+		var n int64
+		switch c.function {
+		case "reltuples":
+			n = st.rows
+		case "pg_indexes_size":
+		default:
+			n = st.bytes
+		}
+		if c.pretty {
+			values[i] = []byte(prettySize(n))
+		} else {
+			values[i] = []byte(strconv.FormatInt(n, 10))
+		}
+	}
+	return writeMessages(p.conn, &rowDesc, &pgproto3.DataRow{Values: values}, &pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+}
+
+// tableStats returns the size in bytes, in memory and in object storage, and the number of rows of tables.
+func (p *Proxy) tableStats(ctx context.Context, session *session, quotedTables []string) (map[string]tableStats, error) {
+	reader, err := p.runQuery(ctx, session, fmt.Sprintf(
+		"SELECT table_name, CAST(sum(memory_bytes) + sum(object_store_bytes) AS BIGINT), CAST(sum(row_count) AS BIGINT) "+
+			"FROM system.chunks WHERE table_name IN (%s) GROUP BY table_name", strings.Join(quotedTables, ", ")))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Release()
+
+	stats := map[string]tableStats{}
+	for {
+		batch, err := reader.Read()
+		if err == io.EOF {
+			return stats, nil
+		} else if err != nil {
+			return stats, err
+		}
+		if batch.NumCols() != 3 {
+			return stats, fmt.Errorf("unexpected system.chunks schema: %s", batch.Schema())
+		}
+		for r := 0; r < int(batch.NumRows()); r++ {
+			var cells [3]string
+			for c := range cells {
+				if cells[c], err = renderText(batch.Column(c), r, renderOptions{}); err != nil {
+					return stats, err
+				}
+			}
+			bytes, _ := strconv.ParseInt(cells[1], 10, 64)
+			rows, _ := strconv.ParseInt(cells[2], 10, 64)
+			stats[cells[0]] = tableStats{bytes: bytes, rows: rows}
+		}
+	}
+}
+
+// prettySize formats a size in bytes like postgres' pg_size_pretty.
+func prettySize(size int64) string {
+	const limit = 10 * 1024
+	const limit2 = limit*2 - 1
+	halfRounded := func(n int64) int64 {
+		if n < 0 {
+			return (n - 1) / 2
+		}
+		return (n + 1) / 2
+	}
+	abs := func(n int64) int64 {
+		if n < 0 {
+			return -n
+		}
+		return n
+	}
+	if abs(size) < limit {
+		return fmt.Sprintf("%d bytes", size)
+	}
+	// keep one extra bit for rounding.
+	size >>= 9
+	for _, unit := range []string{"kB", "MB", "GB", "TB"} {
+		if abs(size) < limit2 {
+			return fmt.Sprintf("%d %s", halfRounded(size), unit)
+		}
+		size >>= 10
+	}
+	return fmt.Sprintf("%d PB", halfRounded(size))
+}
@@ -0,0 +1,73 @@
+package pigox
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// slowQueryPlanTimeout bounds the time spent capturing the plan of a slow query.
+const slowQueryPlanTimeout = 30 * time.Second
+
+// logSlowQuery logs a query that ran for longer than the slow query threshold.
+// source is the query as sent by the client and query is the query sent to IOx, whose physical plan is
+// logged as well if plan capture is enabled. Proxies run by a Server capture plans asynchronously on a
+// shared connection, so that the session isn't held up by a second slow query.
+func (p *Proxy) logSlowQuery(s *session, source, query string, start time.Time, rows int, err error) {
+	d := time.Since(start)
+	if p.slowQueryThreshold <= 0 || d < p.slowQueryThreshold {
+		return
+	}
+	status := "ok"
+	if err != nil {
+		status = err.Error()
+	}
+	p.log.Warn("slow query", "duration", d.Round(time.Millisecond), "rows", rows, "status", status,
+		"fingerprint", queryFingerprint(source), p.queryAttr(source))
+	if !p.slowQueryPlans {
+		return
+	}
+	logger := p.log.With("fingerprint", queryFingerprint(source))
+	capture := func(s *session, run func(context.Context, *session, string) (recordReader, error)) {
+		ctx, cancel := context.WithTimeout(context.Background(), slowQueryPlanTimeout)
+		defer cancel()
+		plan, err := explain(ctx, s, query, run)
+		if err != nil {
+			logger.Warn("cannot capture plan of slow query", "err", err)
+			return
+		}
+		logger.Warn("slow query plan", "plan", plan)
+	}
+	if p.planner == nil {
+		capture(s, p.runQuery)
+		return
+	}
+	sess := *s
+	go capture(&sess, p.planner.query)
+}
+
+// explain returns the physical plan IOx runs a query with.
+func explain(ctx context.Context, s *session, query string, run func(context.Context, *session, string) (recordReader, error)) (string, error) {
+	reader, err := run(ctx, s, "EXPLAIN "+strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	if err != nil {
+		return "", err
+	}
+	defer reader.Release()
+
+	plans, err := readPlans(reader)
+	if err != nil {
+		return "", err
+	}
+	// IOx returns the logical and the physical plans.
+	var all, physical []string
+	for _, plan := range plans {
+		all = append(all, plan.typ+": "+plan.plan)
+		if plan.typ == "physical_plan" {
+			physical = append(physical, plan.plan)
+		}
+	}
+	if physical != nil {
+		return strings.Join(physical, "\n"), nil
+	}
+	return strings.Join(all, "\n"), nil
+}
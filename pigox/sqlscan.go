@@ -0,0 +1,350 @@
+package pigox
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgerrcode"
+)
+
+type tokenKind int
+
+const (
+	tokSpace       tokenKind = iota // whitespace
+	tokComment                      // -- line or /* block */ comment
+	tokIdent                        // unquoted identifier or keyword
+	tokQuotedIdent                  // "quoted identifier"
+	tokString                       // 'string', E'string' or $$dollar quoted$$ literal
+	tokNumber                       // numeric literal
+	tokParam                        // positional parameter, e.g. $1
+	tokPunct                        // punctuation and operators
+)
+
+// token is a lexical token of a SQL query.
+// The text of a token is the verbatim slice of the original query; concatenating all tokens
+// yields back the original query.
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+	// open is set for the strings, quoted identifiers and block comments missing their closing delimiter.
+	open bool
+}
+
+// is reports whether the token is the (case insensitive) keyword or punctuation kw.
+func (t token) is(kw string) bool {
+	switch t.kind {
+	case tokIdent:
+		return strings.EqualFold(t.text, kw)
+	case tokPunct:
+		return t.text == kw
+	}
+	return false
+}
+
+// isBlank reports whether the token carries no meaning (whitespace or comment).
+func (t token) isBlank() bool {
+	return t.kind == tokSpace || t.kind == tokComment
+}
+
+// identName returns the name of an identifier, folding unquoted names to lower case like postgres does.
+func (t token) identName() string {
+	if t.kind == tokQuotedIdent {
+		return strings.ReplaceAll(t.text[1:len(t.text)-t.closerLen(1)], `""`, `"`)
+	}
+	return strings.ToLower(t.text)
+}
+
+// stringValue returns the value of a string literal token; the value of an open string runs to the end of the
+// query (see checkTerminated).
+func (t token) stringValue() string {
+	s := t.text
+	switch {
+	case strings.HasPrefix(s, "$"):
+		tag := s[:strings.Index(s[1:], "$")+2]
+		return s[len(tag) : len(s)-t.closerLen(len(tag))]
+	case s[0] == 'e' || s[0] == 'E':
+		return unescapeBackslashes(s[2 : len(s)-t.closerLen(1)])
+	default:
+		return strings.ReplaceAll(s[1:len(s)-t.closerLen(1)], "''", "'")
+	}
+}
+
+// closerLen returns n, the length of the closing delimiter of the token, or 0 if the token is open.
+func (t token) closerLen(n int) int {
+	if t.open {
+		return 0
+	}
+	return n
+}
+
+// checkTerminated returns a syntax error if query ends in a string, quoted identifier or block comment missing
+// its closing delimiter, positioned at its start like postgres does.
+func checkTerminated(query string) error {
+	toks := scanSQL(query)
+	if len(toks) == 0 || !toks[len(toks)-1].open {
+		return nil
+	}
+	t := toks[len(toks)-1]
+	what := "quoted string"
+	switch {
+	case t.kind == tokQuotedIdent:
+		what = "quoted identifier"
+	case t.kind == tokComment:
+		what = "/* comment"
+	case strings.HasPrefix(t.text, "$"):
+		what = "dollar-quoted string"
+	}
+	return newPGError(pgerrcode.SyntaxError, fmt.Errorf("unterminated %s at or near %q", what, t.text)).atPosition(query, t.pos)
+}
+
+func unescapeBackslashes(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\'' && i+1 < len(s) && s[i+1] == '\'' {
+			i++
+		} else if c == '\\' && i+1 < len(s) {
+			i++
+			switch c = s[i]; c {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case 'r':
+				c = '\r'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// quoteString renders s as a standard conforming SQL string literal.
+func quoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// quoteIdent renders s as a quoted SQL identifier.
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+const operatorChars = "+-*/<>=~!@#%^&|`?"
+
+// scanSQL splits a SQL query into tokens.
+//
+// The scanner is lenient: unterminated literals and comments extend to the end of the input.
+func scanSQL(sql string) []token {
+	var toks []token
+	for i := 0; i < len(sql); {
+		start := i
+		kind := tokPunct
+		open := false
+		c := sql[i]
+		switch {
+		case isSpace(c):
+			kind = tokSpace
+			for i < len(sql) && isSpace(sql[i]) {
+				i++
+			}
+		case strings.HasPrefix(sql[i:], "--"):
+			kind = tokComment
+			if n := strings.IndexByte(sql[i:], '\n'); n >= 0 {
+				i += n + 1
+			} else {
+				i = len(sql)
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			kind = tokComment
+			i, open = scanBlockComment(sql, i)
+		case c == '\'':
+			kind = tokString
+			i, open = scanQuoted(sql, i+1, '\'', false)
+		case (c == 'e' || c == 'E') && i+1 < len(sql) && sql[i+1] == '\'':
+			kind = tokString
+			i, open = scanQuoted(sql, i+2, '\'', true)
+		case c == '"':
+			kind = tokQuotedIdent
+			i, open = scanQuoted(sql, i+1, '"', false)
+		case c == '$' && i+1 < len(sql) && isDigit(sql[i+1]):
+			kind = tokParam
+			for i++; i < len(sql) && isDigit(sql[i]); i++ {
+			}
+		case c == '$':
+			if end, closed, ok := scanDollarQuoted(sql, i); ok {
+				kind = tokString
+				i, open = end, !closed
+			} else {
+				i++
+			}
+		case isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1])):
+			kind = tokNumber
+			i = scanNumber(sql, i)
+		case isIdentStart(c):
+			kind = tokIdent
+			for i < len(sql) && isIdentChar(sql[i]) {
+				i++
+			}
+		case c == ':' && strings.HasPrefix(sql[i:], "::"):
+			i += 2
+		case strings.IndexByte(operatorChars, c) >= 0:
+			for i < len(sql) && strings.IndexByte(operatorChars, sql[i]) >= 0 {
+				if i > start && (strings.HasPrefix(sql[i:], "--") || strings.HasPrefix(sql[i:], "/*")) {
+					break
+				}
+				i++
+			}
+		default:
+			i++
+		}
+		toks = append(toks, token{kind: kind, text: sql[start:i], pos: start, open: open})
+	}
+	return toks
+}
+
+// scanBlockComment returns the index after the end of the block comment at i, and whether the comment is open.
+func scanBlockComment(sql string, i int) (int, bool) {
+	depth := 0
+	for i < len(sql) {
+		switch {
+		case strings.HasPrefix(sql[i:], "/*"):
+			depth++
+			i += 2
+		case strings.HasPrefix(sql[i:], "*/"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return i, false
+			}
+		default:
+			i++
+		}
+	}
+	return i, true
+}
+
+// scanQuoted returns the index after the closing quote q, or the end of sql and true if the quote is open; a
+// doubled quote is an escaped quote.
+func scanQuoted(sql string, i int, q byte, backslashes bool) (int, bool) {
+	for i < len(sql) {
+		switch c := sql[i]; {
+		case backslashes && c == '\\':
+			i += 2
+		case c == q && i+1 < len(sql) && sql[i+1] == q:
+			i += 2
+		case c == q:
+			return i + 1, false
+		default:
+			i++
+		}
+	}
+	return len(sql), true
+}
+
+// scanDollarQuoted returns the index after the end of the dollar quoted string at i, and whether it is closed;
+// ok is false if there is no dollar quote at i.
+func scanDollarQuoted(sql string, i int) (end int, closed, ok bool) {
+	j := i + 1
+	for j < len(sql) && sql[j] != '$' {
+		if !isIdentChar(sql[j]) {
+			return 0, false, false
+		}
+		j++
+	}
+	if j >= len(sql) {
+		return 0, false, false
+	}
+	tag := sql[i : j+1]
+	if n := strings.Index(sql[j+1:], tag); n >= 0 {
+		return j + 1 + n + len(tag), true, true
+	}
+	return len(sql), false, true
+}
+
+func scanNumber(sql string, i int) int {
+	for i < len(sql) && (isDigit(sql[i]) || sql[i] == '.') {
+		i++
+	}
+	if i < len(sql) && (sql[i] == 'e' || sql[i] == 'E') {
+		j := i + 1
+		if j < len(sql) && (sql[j] == '+' || sql[j] == '-') {
+			j++
+		}
+		if j < len(sql) && isDigit(sql[j]) {
+			for i = j; i < len(sql) && isDigit(sql[i]); i++ {
+			}
+		}
+	}
+	return i
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c) || c == '$'
+}
+
+// significant returns the tokens that are neither whitespace nor comments.
+func significant(toks []token) []token {
+	var res []token
+	for _, t := range toks {
+		if !t.isBlank() {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// joinTokens concatenates the text of the tokens.
+func joinTokens(toks []token) string {
+	var b strings.Builder
+	for _, t := range toks {
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
+
+// trimStatement removes trailing whitespace, comments and semicolons from a statement.
+func trimStatement(query string) string {
+	toks := scanSQL(query)
+	n := len(toks)
+	for n > 0 && (toks[n-1].isBlank() || toks[n-1].is(";")) {
+		n--
+	}
+	return joinTokens(toks[:n])
+}
+
+// splitStatements splits a query on the semicolons separating its statements, e.g. `SELECT 1; SELECT 2`.
+// Statements made only of whitespace and comments are dropped.
+func splitStatements(query string) []string {
+	var stmts []string
+	var stmt []token
+	empty := true
+	for _, t := range append(scanSQL(query), token{kind: tokPunct, text: ";"}) {
+		if !t.is(";") {
+			stmt = append(stmt, t)
+			empty = empty && t.isBlank()
+			continue
+		}
+		if !empty {
+			stmts = append(stmts, strings.TrimSpace(joinTokens(stmt)))
+		}
+		stmt, empty = nil, true
+	}
+	return stmts
+}
@@ -0,0 +1,99 @@
+package pigox
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgerrcode"
+)
+
+func TestStringValue(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{`'it''s'`, "it's"},
+		{`E'a\nb\'c'`, "a\nb'c"},
+		{`$$a'b$$`, "a'b"},
+		{`$x$a$$b$x$`, "a$$b"},
+		// open strings run to the end of the query.
+		{`'`, ""},
+		{`'abc`, "abc"},
+		{`'abc''`, "abc'"},
+		{`E'`, ""},
+		{`E'a\`, `a\`},
+		{`$$`, ""},
+		{`$x$abc`, "abc"},
+	}
+	for _, tt := range tests {
+		toks := scanSQL(tt.sql)
+		if len(toks) != 1 || toks[0].kind != tokString {
+			t.Errorf("%s: got tokens %+v, want a string", tt.sql, toks)
+			continue
+		}
+		if got := toks[0].stringValue(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTerminated(t *testing.T) {
+	tests := []struct {
+		query string
+		// position is 0 if the query is terminated.
+		position int32
+	}{
+		{"SELECT 'a', \"b\", $$c$$ /* d */ -- e", 0},
+		{"INSERT INTO t(a) VALUES ('", 26},
+		{"SELECT E'abc", 8},
+		{"SELECT 'it''", 8},
+		{`SELECT "col`, 8},
+		{"SELECT $tag$abc$", 8},
+		{"SELECT 1 /* a /* b */", 10},
+		{"SELECT 'é', 'x", 13},
+	}
+	for _, tt := range tests {
+		err := checkTerminated(tt.query)
+		if tt.position == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", tt.query, err)
+			}
+			continue
+		}
+		pgErr, ok := err.(*pgError)
+		if !ok || errorCode(err) != pgerrcode.SyntaxError {
+			t.Errorf("%s: got %v, want a syntax error", tt.query, err)
+			continue
+		}
+		if pgErr.position != tt.position {
+			t.Errorf("%s: got position %d, want %d", tt.query, pgErr.position, tt.position)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT 1", []string{"SELECT 1"}},
+		{"SELECT 1; SELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{"SELECT 'a;b'; SELECT E'c\\';d'", []string{"SELECT 'a;b'", "SELECT E'c\\';d'"}},
+		{`SELECT "a;b" FROM t`, []string{`SELECT "a;b" FROM t`}},
+		{"SELECT $$a;b$$; SELECT $x$;$$;$x$", []string{"SELECT $$a;b$$", "SELECT $x$;$$;$x$"}},
+		{"SELECT 1 -- a; b\n; SELECT 2", []string{"SELECT 1 -- a; b", "SELECT 2"}},
+		{"SELECT /* a; /* b; */ c; */ 1; SELECT 2", []string{"SELECT /* a; /* b; */ c; */ 1", "SELECT 2"}},
+		{"SELECT $1; SELECT $2", []string{"SELECT $1", "SELECT $2"}},
+		// empty statements are dropped.
+		{";; SELECT 1;;\n; -- c\n;/* d */;", []string{"SELECT 1"}},
+		{"", nil},
+		{" ; ", nil},
+		// an open string runs to the end of the query.
+		{"SELECT 'a; SELECT 2", []string{"SELECT 'a; SELECT 2"}},
+	}
+	for _, tt := range tests {
+		if got := splitStatements(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package pigox
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+)
+
+// statementCache caches rewritten queries across sessions, keyed by their normalized text,
+// so that the queries repeatedly issued by dashboards are analyzed and rewritten only once.
+//
+// It also caches the queries prepared by the backend, so that repeated queries skip PrepareQuery, and the
+// statements whose parameters are bound by the backend skip the prepare round trip. A prepared query is tied to
+// the client that prepared it, so it is shared by the sessions sharing IOx clients (see WithClientPool).
+// The prepared queries of a database are dropped when its catalog is invalidated, and a prepared query is dropped
+// when running it fails, in case the backend forgot it.
+type statementCache struct {
+	mu      sync.Mutex
+	size    int
+	ll      *list.List
+	entries map[string]*list.Element
+
+	preparedLL *list.List
+	prepared   map[preparedKey]*list.Element
+}
+
+type cachedStatement struct {
+	key   string
+	query string
+	hints queryHints
+}
+
+func newStatementCache(size int) *statementCache {
+	return &statementCache{
+		size:    size,
+		ll:      list.New(),
+		entries: map[string]*list.Element{},
+
+		preparedLL: list.New(),
+		prepared:   map[preparedKey]*list.Element{},
+	}
+}
+
+func (c *statementCache) get(key string) (*cachedStatement, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*cachedStatement), true
+}
+
+func (c *statementCache) add(st *cachedStatement) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[st.key]; ok {
+		e.Value = st
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.entries[st.key] = c.ll.PushFront(st)
+	for c.ll.Len() > c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.entries, e.Value.(*cachedStatement).key)
+	}
+}
+
+// preparedKey identifies a query prepared by the backend.
+type preparedKey struct {
+	// address is the IOx endpoint the session is routed to; see WithRouter.
+	address  string
+	database string
+	token    string
+	// query is normalized; see normalizeQuery.
+	query string
+	// bound is set for the statements whose parameters are bound by the backend; see statementPreparer.
+	bound bool
+}
+
+// cachedPrepared is a query prepared by client: a preparedQuery, or a serverStatement if key.bound is set.
+type cachedPrepared struct {
+	key    preparedKey
+	client backend
+	query  preparedQuery
+	stmt   serverStatement
+
+	// refs counts the queries running the entry; evicted statements are closed once none is.
+	refs    int
+	evicted bool
+}
+
+// acquire returns the query prepared for key by client, if any; it must be released when the query ran.
+func (c *statementCache) acquire(key preparedKey, client backend) (*cachedPrepared, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.prepared[key]
+	if !ok {
+		return nil, false
+	}
+	cp := e.Value.(*cachedPrepared)
+	if cp.client != client {
+		// prepared by a client the session doesn't use, e.g. one that reconnected since.
+		c.evictLocked(cp)
+		return nil, false
+	}
+	c.preparedLL.MoveToFront(e)
+	cp.refs++
+	return cp, true
+}
+
+// put caches a query prepared by a session, which holds it until it releases it.
+func (c *statementCache) put(cp *cachedPrepared) {
+	cp.refs = 1
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.prepared[cp.key]; ok {
+		c.evictLocked(e.Value.(*cachedPrepared))
+	}
+	c.prepared[cp.key] = c.preparedLL.PushFront(cp)
+	for c.preparedLL.Len() > c.size {
+		c.evictLocked(c.preparedLL.Back().Value.(*cachedPrepared))
+	}
+}
+
+// release releases a query returned by acquire or passed to put. If the query failed, it is dropped from the
+// cache so that the next query prepares it again.
+func (c *statementCache) release(cp *cachedPrepared, failed bool) {
+	if c == nil {
+		if cp.stmt != nil {
+			closeServerStatement(cp.stmt)
+		}
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if failed {
+		c.evictLocked(cp)
+	}
+	cp.refs--
+	if cp.evicted && cp.refs == 0 && cp.stmt != nil {
+		closeServerStatement(cp.stmt)
+	}
+}
+
+// invalidate drops the prepared queries of database, or of all databases if database is empty.
+func (c *statementCache) invalidate(database string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.prepared {
+		if database == "" || k.database == database {
+			c.evictLocked(e.Value.(*cachedPrepared))
+		}
+	}
+}
+
+func (c *statementCache) evictLocked(cp *cachedPrepared) {
+	if cp.evicted {
+		return
+	}
+	cp.evicted = true
+	if e, ok := c.prepared[cp.key]; ok && e.Value == cp {
+		c.preparedLL.Remove(e)
+		delete(c.prepared, cp.key)
+	}
+	if cp.refs == 0 && cp.stmt != nil {
+		closeServerStatement(cp.stmt)
+	}
+}
+
+// preparedKey returns the key of the queries prepared for session.
+func (p *Proxy) preparedKey(session *session, query string, bound bool) preparedKey {
+	return preparedKey{
+		address:  p.ioxAddress,
+		database: session.databaseName,
+		token:    session.token,
+		query:    normalizeQuery(query),
+		bound:    bound,
+	}
+}
+
+// prepareQuery prepares query on client, unless the statement cache holds it already.
+func (p *Proxy) prepareQuery(ctx context.Context, session *session, client backend, query string) (*cachedPrepared, error) {
+	key := p.preparedKey(session, query, false)
+	if cp, ok := p.stmtCache.acquire(key, client); ok {
+		return cp, nil
+	}
+	pctx, span := p.startClientSpan(ctx, "iox.PrepareQuery")
+	q, err := client.PrepareQuery(p.withTraceContext(pctx), session.databaseName, query)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	cp := &cachedPrepared{key: key, client: client, query: q}
+	p.stmtCache.put(cp)
+	return cp, nil
+}
+
+// prepareStatement prepares query, with $n placeholders, as a statement of client, unless the statement cache
+// holds it already.
+func (p *Proxy) prepareStatement(ctx context.Context, session *session, client backend, query string) (*cachedPrepared, error) {
+	key := p.preparedKey(session, query, true)
+	if cp, ok := p.stmtCache.acquire(key, client); ok {
+		return cp, nil
+	}
+	pctx, span := p.startClientSpan(ctx, "iox.PrepareStatement")
+	stmt, err := client.(statementPreparer).PrepareStatement(p.withTraceContext(pctx), session.databaseName, query)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	cp := &cachedPrepared{key: key, client: client, stmt: stmt}
+	p.stmtCache.put(cp)
+	return cp, nil
+}
+
+// normalizeQuery returns a cache key for query that ignores comments and differences in whitespace.
+func normalizeQuery(query string) string {
+	var b strings.Builder
+	space := false
+	for _, t := range scanSQL(query) {
+		if t.isBlank() {
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
+
+// rewrite rewrites a query of session with the rewriters added with WithQueryRewriter and then the built-in
+// rewrites, using the statement cache if enabled. The privilege inquiry functions are answered for the session,
+// after the cache shared by the sessions.
+func (p *Proxy) rewrite(ctx context.Context, session *session, query string) (string, queryHints, error) {
+	query, handled, err := p.runQueryRewriters(ctx, session, query)
+	if err != nil || handled {
+		return query, queryHints{}, err
+	}
+	key := normalizeQuery(query)
+	if st, ok := p.stmtCache.get(key); ok {
+		// the key ignores comments.
+		hints := st.hints
+		hints.noCache = hasNoCacheComment(query)
+		return p.rewritePrivilegeFunctions(ctx, session, st.query), hints, nil
+	}
+	q, hints, err := rewriteQuery(query)
+	if err != nil {
+		return "", queryHints{}, err
+	}
+	p.stmtCache.add(&cachedStatement{key: key, query: q, hints: hints})
+	hints.noCache = hasNoCacheComment(query)
+	return p.rewritePrivilegeFunctions(ctx, session, q), hints, nil
+}
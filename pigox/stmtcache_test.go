@@ -0,0 +1,157 @@
+package pigox
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+)
+
+// preparingBackend counts the queries and statements it prepares.
+type preparingBackend struct {
+	*fakeBackend
+
+	mu         sync.Mutex
+	prepares   int
+	statements []*fakeStatement
+}
+
+func (b *preparingBackend) PrepareQuery(ctx context.Context, database, query string) (preparedQuery, error) {
+	b.mu.Lock()
+	b.prepares++
+	b.mu.Unlock()
+	return b.fakeBackend.PrepareQuery(ctx, database, query)
+}
+
+func (b *preparingBackend) PrepareStatement(ctx context.Context, database, query string) (serverStatement, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prepares++
+	s := &fakeStatement{b: b.fakeBackend, query: query, closed: make(chan struct{})}
+	b.statements = append(b.statements, s)
+	return s, nil
+}
+
+func (b *preparingBackend) prepared() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.prepares
+}
+
+type fakeStatement struct {
+	b      *fakeBackend
+	query  string
+	closed chan struct{}
+}
+
+func (s *fakeStatement) Query(ctx context.Context, params arrow.Record) (recordReader, error) {
+	return fakeQuery{b: s.b, query: s.query}.Query(ctx)
+}
+
+func (s *fakeStatement) Schema() *arrow.Schema { return nil }
+
+func (s *fakeStatement) Close(ctx context.Context) error {
+	close(s.closed)
+	return nil
+}
+
+func TestStatementCacheSharesPreparedQueries(t *testing.T) {
+	const query = "SELECT * FROM cpu"
+	var fail bool
+	b := &preparingBackend{fakeBackend: &fakeBackend{rows: 1, fail: func(string) bool { return fail }}}
+	cache := newStatementCache(10)
+	run := func(s *session, p *Proxy) error {
+		r, err := p.query(context.Background(), s, query)
+		if err == nil {
+			r.Release()
+		}
+		return err
+	}
+	newSession := func(pid int32, token string) (*session, *Proxy) {
+		p := newTestProxy(t, withStatementCache(cache))
+		p.upstream.set(nil, b)
+		s := newTestSession(p, pid, "a")
+		s.token = token
+		return s, p
+	}
+
+	s1, p1 := newSession(1, "t")
+	s2, p2 := newSession(2, "t")
+	for _, err := range []error{run(s1, p1), run(s2, p2), run(s1, p1)} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := b.prepared(); got != 1 {
+		t.Errorf("sessions sharing a client prepared %d times, want 1", got)
+	}
+
+	// the statements of other tokens are not shared.
+	s3, p3 := newSession(3, "u")
+	if err := run(s3, p3); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.prepared(); got != 2 {
+		t.Errorf("session with another token: prepared %d times, want 2", got)
+	}
+
+	// failed queries are prepared again.
+	fail = true
+	if err := run(s1, p1); err == nil {
+		t.Fatal("query didn't fail")
+	}
+	fail = false
+	if err := run(s1, p1); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.prepared(); got != 3 {
+		t.Errorf("after a failure: prepared %d times, want 3", got)
+	}
+
+	cache.invalidate("db")
+	if err := run(s2, p2); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.prepared(); got != 4 {
+		t.Errorf("after invalidating the catalog: prepared %d times, want 4", got)
+	}
+}
+
+func TestStatementCacheClosesEvictedStatements(t *testing.T) {
+	b := &preparingBackend{fakeBackend: &fakeBackend{rows: 1}}
+	cache := newStatementCache(1)
+	p := newTestProxy(t, withStatementCache(cache))
+	s := newTestSession(p, 1, "a")
+
+	cp, err := p.prepareStatement(context.Background(), s, b, "SELECT * FROM cpu WHERE host = $1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a second statement evicts the first one, which is closed once released.
+	other, err := p.prepareStatement(context.Background(), s, b, "SELECT * FROM mem WHERE host = $1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.release(other, false)
+	closed := b.statements[0].closed
+	select {
+	case <-closed:
+		t.Fatal("statement closed while in use")
+	case <-time.After(10 * time.Millisecond):
+	}
+	cache.release(cp, false)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("evicted statement not closed")
+	}
+
+	if _, err := p.prepareStatement(context.Background(), s, b, "SELECT * FROM mem WHERE host = $1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.prepared(); got != 2 {
+		t.Errorf("prepared %d statements, want 2", got)
+	}
+}
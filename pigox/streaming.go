@@ -0,0 +1,128 @@
+package pigox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+const (
+	// DefaultFlushRows is the number of result rows buffered before they are sent to the client.
+	DefaultFlushRows = 1000
+	// DefaultFlushBytes is the size of the result rows buffered before they are sent to the client.
+	DefaultFlushBytes = 64 << 10
+)
+
+// WithFlushSize sends result rows to the client whenever rows of them, or bytes bytes of them, are buffered,
+// rather than a whole Arrow batch at once, which bounds the memory of results with huge batches. Zero values
+// select DefaultFlushRows and DefaultFlushBytes.
+func WithFlushSize(rows, bytes int) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.flushRows = rows
+		opts.flushBytes = bytes
+	}
+}
+
+// WithWriteTimeout closes the connections of clients that don't read results for d, failing their query, so that
+// a stuck client doesn't hold the IOx result stream open forever. Zero means no limit.
+func WithWriteTimeout(d time.Duration) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.writeTimeout = d
+	}
+}
+
+// rowWriter buffers the DataRow messages of a result and sends them to the client in chunks, as configured with
+// WithFlushSize, pacing them as configured with WithMaxRowsPerSecond and WithMaxBytesPerSecond.
+type rowWriter struct {
+	p   *Proxy
+	ctx context.Context
+	// stream, if not nil, accounts for the time spent writing.
+	stream *streamSpan
+
+	buf        []byte
+	rows       int
+	maxRows    int
+	maxBufSize int
+
+	// recording, if set, keeps a copy of the rows written for the result cache in recorded, until they exceed
+	// maxCachedResultSize.
+	recording bool
+	recorded  []byte
+}
+
+func (p *Proxy) newRowWriter(ctx context.Context, stream *streamSpan) *rowWriter {
+	w := &rowWriter{p: p, ctx: ctx, stream: stream, maxRows: p.flushRows, maxBufSize: p.flushBytes}
+	if w.maxRows <= 0 {
+		w.maxRows = DefaultFlushRows
+	}
+	if w.maxBufSize <= 0 {
+		w.maxBufSize = DefaultFlushBytes
+	}
+	return w
+}
+
+// writeRow buffers a row, sending the buffered rows if they reached the flush size.
+func (w *rowWriter) writeRow(values [][]byte) error {
+	n := len(w.buf)
+	w.buf = (&pgproto3.DataRow{Values: values}).Encode(w.buf)
+	w.rows++
+	if w.recording {
+		if len(w.recorded)+len(w.buf)-n > maxCachedResultSize {
+			w.recording, w.recorded = false, nil
+		} else {
+			w.recorded = append(w.recorded, w.buf[n:]...)
+		}
+	}
+	if w.rows >= w.maxRows || len(w.buf) >= w.maxBufSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush sends the buffered rows.
+func (w *rowWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	w.p.metrics.ResultStreamed(w.rows, len(w.buf))
+	if err := w.p.throttle.wait(w.ctx, w.rows, len(w.buf)); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := w.p.writeResult(w.buf)
+	if w.stream != nil {
+		w.stream.wrote(w.rows, len(w.buf), time.Since(start))
+	}
+	if err != nil {
+		return fmt.Errorf("error writing query response: %w", err)
+	}
+	w.buf, w.rows = w.buf[:0], 0 // reset slice without deallocating memory
+	return nil
+}
+
+// size returns the memory held by the buffer.
+func (w *rowWriter) size() int64 {
+	return int64(cap(w.buf) + cap(w.recorded))
+}
+
+// writeResult writes part of a result to the client within the write timeout. A client that timed out gets its
+// connection closed: it may have received a partial message.
+func (p *Proxy) writeResult(buf []byte) error {
+	if p.writeTimeout <= 0 {
+		_, err := p.conn.Write(buf)
+		return err
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(p.writeTimeout))
+	_, err := p.conn.Write(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		p.log.Warn("closing connection of client not reading results", "timeout", p.writeTimeout)
+		p.conn.Close()
+		return err
+	}
+	p.conn.SetWriteDeadline(time.Time{})
+	return err
+}
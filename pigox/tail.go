@@ -0,0 +1,220 @@
+package pigox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/mkmik/piggo/pigox/arrowpg"
+)
+
+const (
+	// defaultTailInterval is how often TAIL polls IOx for new rows unless EVERY is given.
+	defaultTailInterval = 5 * time.Second
+	// minTailInterval bounds the polling rate of TAIL statements.
+	minTailInterval = 100 * time.Millisecond
+	// tailTimeColumn is the column TAIL tracks the rows already sent by.
+	tailTimeColumn = "time"
+)
+
+// tailStatement is a parsed `TAIL [EVERY 'interval'] query` statement.
+//
+// TAIL streams the rows of query and then keeps polling IOx, streaming the rows with a time more recent than
+// the last row sent, until the client disconnects, piggo.max_rows rows were sent or the proxy shuts down.
+// Rows sharing the timestamp of the last row sent that arrive late are not sent.
+type tailStatement struct {
+	query string
+	every time.Duration
+}
+
+// parseTailStatement parses a TAIL statement. It returns nil if query is not a TAIL statement.
+func parseTailStatement(query string) (*tailStatement, error) {
+	toks := scanSQL(query)
+	sig := significant(toks)
+	if len(sig) == 0 || !sig[0].is("tail") {
+		return nil, nil
+	}
+	stmt := &tailStatement{every: defaultTailInterval}
+	rest := sig[1:]
+	if len(rest) > 0 && rest[0].is("every") {
+		if len(rest) < 2 || rest[1].kind != tokString {
+			return nil, newPGError(pgerrcode.SyntaxError, fmt.Errorf("TAIL EVERY requires an interval string, e.g. EVERY '5s'"))
+		}
+		d, err := parseGrafanaDuration(rest[1].stringValue())
+		if err != nil || d < minTailInterval {
+			return nil, newPGError(pgerrcode.InvalidParameterValue, fmt.Errorf("invalid TAIL interval %q: expected an interval of at least %v", rest[1].stringValue(), minTailInterval))
+		}
+		stmt.every = d
+		rest = rest[2:]
+	}
+	if len(rest) == 0 {
+		return nil, newPGError(pgerrcode.SyntaxError, fmt.Errorf("TAIL requires a query"))
+	}
+	for i, t := range toks {
+		if t.pos == rest[0].pos {
+			stmt.query = trimStatement(joinTokens(toks[i:]))
+			break
+		}
+	}
+	return stmt, nil
+}
+
+// handleTail runs a TAIL statement. It returns the statement error, if any, or an error writing to the client.
+func (p *Proxy) handleTail(ctx context.Context, query string, stmt *tailStatement, session *session) error {
+	q, hints, err := p.rewrite(ctx, session, stmt.query)
+	if err != nil {
+		return p.reportError(err)
+	}
+	if hints.json != nil {
+		return p.reportError(newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("TAIL does not support JSON results")))
+	}
+
+	start := time.Now()
+	t := &tail{p: p, session: session, query: q, hints: hints}
+	err = canceledError(ctx, t.run(ctx, stmt.every))
+	p.recordQuery(session, query, q, start, t.totalRows, err)
+	if err == nil {
+		return writeMessages(p.conn, &pgproto3.CommandComplete{CommandTag: []byte(fmt.Sprintf("SELECT %d", t.totalRows))})
+	}
+	return p.reportError(err)
+}
+
+type tail struct {
+	p       *Proxy
+	session *session
+	query   string
+	hints   queryHints
+
+	// fields are the fields of the first result; the results of later polls must match them.
+	fields    []arrow.Field
+	totalRows int
+	// since is the time of the most recent row sent.
+	since time.Time
+	done  bool
+}
+
+func (t *tail) run(ctx context.Context, every time.Duration) error {
+	if err := t.poll(ctx); err != nil {
+		return err
+	}
+	timer := time.NewTimer(every)
+	defer timer.Stop()
+	for !t.done {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if t.p.lifecycle.isDraining() {
+			return nil
+		}
+		sent := t.totalRows
+		if err := t.poll(ctx); err != nil {
+			return err
+		}
+		// ParameterStatus messages may be sent at any time; they find out when the client went away.
+		if t.totalRows == sent {
+			err := writeMessages(t.p.conn, &pgproto3.ParameterStatus{Name: "application_name", Value: t.session.applicationName})
+			if err != nil {
+				return fmt.Errorf("error writing query response: %w", err)
+			}
+		}
+		timer.Reset(every)
+	}
+	return nil
+}
+
+// poll sends the rows more recent than the last one sent, preceded by the RowDescription on the first poll.
+func (t *tail) poll(ctx context.Context) error {
+	p, session := t.p, t.session
+	done, err := p.admitQuery(ctx, session)
+	if err != nil {
+		return err
+	}
+	defer done()
+	mem, err := p.memory.admit(ctx, p.concurrencyQueueTimeout)
+	if err != nil {
+		return err
+	}
+	defer mem.release()
+
+	q := fmt.Sprintf("SELECT * FROM (%s) AS piggo_tail", t.query)
+	if !t.since.IsZero() {
+		q += fmt.Sprintf(" WHERE %s > %s", quoteIdent(tailTimeColumn), timestampLiteral(t.since))
+	}
+	q += " ORDER BY " + quoteIdent(tailTimeColumn)
+	reader, err := p.runQuery(ctx, session, q)
+	if err != nil {
+		return err
+	}
+	defer reader.Release()
+
+	schema := reader.Schema()
+	idx := schema.FieldIndices(tailTimeColumn)
+	if len(idx) != 1 || schema.Field(idx[0]).Type.ID() != arrow.TIMESTAMP {
+		return newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("TAIL requires the query to return a single %q timestamp column", tailTimeColumn))
+	}
+	timeCol := idx[0]
+	fields := resultFields(schema.Fields(), session)
+	colOpts := columnRenderOptions(fields, t.hints, session)
+
+	w := p.newRowWriter(ctx, nil)
+	if t.fields == nil {
+		t.fields = fields
+		var rowDesc pgproto3.RowDescription
+		for c, f := range fields {
+			rowDesc.Fields = append(rowDesc.Fields, arrowpg.FieldDescription(f, colOpts[c]))
+		}
+		// the columns are sent with the first rows.
+		w.buf = rowDesc.Encode(w.buf)
+	} else if !arrow.NewSchema(fields, nil).Equal(arrow.NewSchema(t.fields, nil)) {
+		return newPGError(pgerrcode.DataException, fmt.Errorf("TAIL query result columns changed"))
+	}
+
+	for {
+		batch, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		nrows := int(batch.NumRows())
+		// like query results, the tail ends once a row past max_rows turns up.
+		if session.maxRows > 0 && t.totalRows+nrows > session.maxRows {
+			nrows = session.maxRows - t.totalRows
+			t.done = true
+		}
+		t.totalRows += nrows
+
+		bcols := batch.Columns()
+		times := bcols[timeCol].(*array.Timestamp)
+		unit := times.DataType().(*arrow.TimestampType).Unit
+		for r := 0; r < nrows; r++ {
+			cols := make([][]byte, len(fields))
+			for c := range fields {
+				if cols[c], err = renderBytes(bcols[c], r, colOpts[c]); err != nil {
+					return err
+				}
+			}
+			if err := w.writeRow(cols); err != nil {
+				return err
+			}
+			if !times.IsNull(r) {
+				if ts := times.Value(r).ToTime(unit); ts.After(t.since) {
+					t.since = ts
+				}
+			}
+		}
+		mem.hold(recordSize(batch) + w.size())
+		if t.done {
+			break
+		}
+	}
+	return w.flush()
+}
@@ -0,0 +1,66 @@
+package pigox
+
+import (
+	"context"
+	"time"
+)
+
+// throttle limits the rate at which a connection streams results, so that a single large export cannot
+// saturate the proxy's network bandwidth. It is not safe for concurrent use.
+type throttle struct {
+	rows, bytes pacer
+}
+
+// newThrottle returns a throttle with the given limits, or nil if both are zero (unlimited).
+func newThrottle(rowsPerSecond, bytesPerSecond float64) *throttle {
+	if rowsPerSecond <= 0 && bytesPerSecond <= 0 {
+		return nil
+	}
+	return &throttle{rows: pacer{rate: rowsPerSecond}, bytes: pacer{rate: bytesPerSecond}}
+}
+
+// wait accounts for rows and bytes just sent and blocks until sending them conforms to the limits.
+func (t *throttle) wait(ctx context.Context, rows, bytes int) error {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+	until := t.rows.add(now, rows)
+	if u := t.bytes.add(now, bytes); u.After(until) {
+		until = u
+	}
+	d := until.Sub(now)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pacer computes when a stream of items sent at a maximum rate is allowed to continue.
+type pacer struct {
+	// rate is in items per second; zero means unlimited.
+	rate float64
+	// next is when the items sent so far would have been sent at rate.
+	next time.Time
+}
+
+// maxBurst is how far an idle stream may fall behind its pace, i.e. how long it may then send at full speed.
+const maxBurst = time.Second
+
+func (p *pacer) add(now time.Time, n int) time.Time {
+	if p.rate <= 0 {
+		return now
+	}
+	if p.next.Before(now.Add(-maxBurst)) {
+		p.next = now.Add(-maxBurst)
+	}
+	p.next = p.next.Add(time.Duration(float64(n) / p.rate * float64(time.Second)))
+	return p.next
+}
@@ -0,0 +1,54 @@
+package pigox
+
+import (
+	"github.com/mkmik/piggo/pigox/arrowpg"
+)
+
+const (
+	pgTimestampMicrosFormat = arrowpg.TimestampMicrosFormatLayout
+)
+
+// TimestampPrecision selects how many fractional second digits are rendered for timestamps.
+type TimestampPrecision = arrowpg.TimestampPrecision
+
+const (
+	NanosecondPrecision  = arrowpg.NanosecondPrecision
+	MicrosecondPrecision = arrowpg.MicrosecondPrecision
+)
+
+// ParseTimestampPrecision parses "ns" or "us" into a TimestampPrecision.
+func ParseTimestampPrecision(s string) (TimestampPrecision, error) {
+	return arrowpg.ParseTimestampPrecision(s)
+}
+
+// TimestampRounding selects how digits beyond the configured TimestampPrecision are dropped.
+type TimestampRounding = arrowpg.TimestampRounding
+
+const (
+	TruncateTimestamps = arrowpg.TruncateTimestamps
+	RoundTimestamps    = arrowpg.RoundTimestamps
+)
+
+// ParseTimestampRounding parses "truncate" or "round" into a TimestampRounding.
+func ParseTimestampRounding(s string) (TimestampRounding, error) {
+	return arrowpg.ParseTimestampRounding(s)
+}
+
+// TimestampFormat selects whether timestamps are rendered as text or as integers counting from the Unix epoch.
+type TimestampFormat = arrowpg.TimestampFormat
+
+const (
+	TextTimestamps    = arrowpg.TextTimestamps
+	EpochSeconds      = arrowpg.EpochSeconds
+	EpochMilliseconds = arrowpg.EpochMilliseconds
+	EpochMicroseconds = arrowpg.EpochMicroseconds
+	EpochNanoseconds  = arrowpg.EpochNanoseconds
+)
+
+// ParseTimestampFormat parses "text", "epoch_s", "epoch_ms", "epoch_us" or "epoch_ns" into a TimestampFormat.
+func ParseTimestampFormat(s string) (TimestampFormat, error) {
+	return arrowpg.ParseTimestampFormat(s)
+}
+
+// renderOptions controls how arrow values are rendered into postgres values.
+type renderOptions = arrowpg.Options
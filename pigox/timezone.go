@@ -0,0 +1,140 @@
+package pigox
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// selectListEnd contains the keywords that terminate the select list of a SELECT query.
+var selectListEnd = map[string]bool{
+	"from": true, "where": true, "group": true, "having": true, "window": true, "order": true,
+	"limit": true, "offset": true, "fetch": true, "union": true, "intersect": true, "except": true, "into": true,
+}
+
+// selectListItems returns the [start, end) token index ranges of the top level select list items
+// of a SELECT query, or nil if the query is not a SELECT.
+func selectListItems(toks []token) [][2]int {
+	i := 0
+	for i < len(toks) && toks[i].isBlank() {
+		i++
+	}
+	if i == len(toks) || !toks[i].is("select") {
+		return nil
+	}
+	var items [][2]int
+	start, depth := i+1, 0
+	for i = start; i < len(toks); i++ {
+		t := toks[i]
+		switch {
+		case t.is("(") || t.is("["):
+			depth++
+		case t.is(")") || t.is("]"):
+			depth--
+		case depth > 0:
+		case t.is(","):
+			items = append(items, [2]int{start, i})
+			start = i + 1
+		case t.is(";") || (t.kind == tokIdent && selectListEnd[strings.ToLower(t.text)]):
+			return append(items, [2]int{start, i})
+		}
+	}
+	return append(items, [2]int{start, len(toks)})
+}
+
+// rewriteTimeZones strips `expr AT TIME ZONE 'zone'` from the select list items of a query,
+// so that the backend returns the plain UTC timestamps, and returns the time zone each affected output
+// column has to be rendered in.
+//
+// Like in postgres, applying AT TIME ZONE to a timestamp produces the wall clock time in the given zone,
+// and the resulting column is named "timezone" unless it has an alias.
+// AT TIME ZONE appearing anywhere else in the query is left alone.
+func rewriteTimeZones(query string) (string, map[string]*time.Location, error) {
+	if !strings.Contains(strings.ToLower(query), "zone") {
+		return query, nil, nil
+	}
+	toks := scanSQL(query)
+
+	var zones map[string]*time.Location
+	var res []token
+	last := 0
+	for _, item := range selectListItems(toks) {
+		var sig []int
+		depth := 0
+		for i := item[0]; i < item[1]; i++ {
+			t := toks[i]
+			if t.is("(") || t.is("[") {
+				depth++
+			} else if t.is(")") || t.is("]") {
+				depth--
+			} else if depth == 0 && !t.isBlank() {
+				sig = append(sig, i)
+			}
+		}
+
+		for k := 0; k+3 < len(sig); k++ {
+			if !toks[sig[k]].is("at") || !toks[sig[k+1]].is("time") || !toks[sig[k+2]].is("zone") || toks[sig[k+3]].kind != tokString {
+				continue
+			}
+			alias, ok := columnAlias(toks, sig[k+4:])
+			if !ok {
+				continue
+			}
+			zone := toks[sig[k+3]].stringValue()
+			loc, err := loadTimeZone(zone)
+			if err != nil {
+				return "", nil, err
+			}
+			if zones == nil {
+				zones = map[string]*time.Location{}
+			}
+			res = append(res, toks[last:sig[k]]...)
+			if alias == "" {
+				alias = "timezone"
+				res = append(res, token{kind: tokIdent, text: "AS " + quoteIdent(alias)})
+			}
+			zones[alias] = loc
+			last = sig[k+3] + 1
+			break
+		}
+	}
+	if zones == nil {
+		return query, nil, nil
+	}
+	res = append(res, toks[last:]...)
+	return joinTokens(res), zones, nil
+}
+
+// columnAlias parses the optional `[AS] alias` tokens that end a select list item.
+// It returns false if the tokens are anything else.
+func columnAlias(toks []token, sig []int) (string, bool) {
+	if len(sig) > 0 && toks[sig[0]].is("as") {
+		sig = sig[1:]
+		if len(sig) == 0 {
+			return "", false
+		}
+	}
+	switch len(sig) {
+	case 0:
+		return "", true
+	case 1:
+		if t := toks[sig[0]]; t.kind == tokIdent || t.kind == tokQuotedIdent {
+			return t.identName(), true
+		}
+	}
+	return "", false
+}
+
+func loadTimeZone(name string) (*time.Location, error) {
+	if name != "" && name != "Local" {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc, nil
+		}
+		if loc, err := time.LoadLocation(strings.ToUpper(name)); err == nil {
+			return loc, nil
+		}
+	}
+	return nil, newPGError(pgerrcode.InvalidParameterValue, fmt.Errorf("time zone %q not recognized", name))
+}
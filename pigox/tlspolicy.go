@@ -0,0 +1,126 @@
+package pigox
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a TLS version such as "1.2".
+func ParseTLSVersion(s string) (uint16, error) {
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("invalid TLS version %q (expected 1.0, 1.1, 1.2 or 1.3)", s)
+	}
+	return v, nil
+}
+
+// ParseTLSCipherSuites parses cipher suite names as listed by tls.CipherSuites, e.g. TLS_AES_128_GCM_SHA256.
+// Insecure cipher suites are rejected.
+func ParseTLSCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		found := false
+		for _, cs := range tls.CipherSuites() {
+			if strings.EqualFold(cs.Name, name) {
+				ids, found = append(ids, cs.ID), true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+		}
+	}
+	return ids, nil
+}
+
+// tlsConfig returns a copy of base that enforces the configured minimum TLS version and cipher suites.
+func (o *proxyOptions) tlsConfig(base *tls.Config) *tls.Config {
+	cfg := base.Clone()
+	if o.minTLSVersion != 0 && cfg.MinVersion < o.minTLSVersion {
+		cfg.MinVersion = o.minTLSVersion
+	}
+	if len(o.tlsCipherSuites) > 0 {
+		cfg.CipherSuites = o.tlsCipherSuites
+	}
+	return cfg
+}
+
+// checkTLSRequired rejects plaintext sessions on listeners that require TLS.
+func (p *Proxy) checkTLSRequired() error {
+	if !p.requireTLS || p.tlsConn() != nil {
+		return nil
+	}
+	return newPGError(pgerrcode.InvalidAuthorizationSpecification, errors.New("SSL connection is required; connect with sslmode=require"))
+}
+
+// tlsConn returns the TLS connection with the client, or nil if the connection is not encrypted.
+func (p *Proxy) tlsConn() *tls.Conn {
+	conn := p.conn
+	if t, ok := conn.(*transcriptConn); ok {
+		conn = t.Conn
+	}
+	c, _ := conn.(*tls.Conn)
+	return c
+}
+
+// startTLS accepts an SSLRequest and encrypts the connection; the startup continues over TLS.
+func (p *Proxy) startTLS() error {
+	if _, err := p.conn.Write([]byte("S")); err != nil {
+		return fmt.Errorf("error accepting SSL request: %w", err)
+	}
+	// the transcript records the messages, not the encrypted bytes.
+	t, _ := p.conn.(*transcriptConn)
+	raw := p.conn
+	if t != nil {
+		raw = t.Conn
+	}
+	conn := tls.Server(raw, p.tlsConfig(p.serverTLS))
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	if t != nil {
+		t.Conn = conn
+	} else {
+		p.conn = conn
+	}
+	p.backend = pgproto3.NewBackend(&limitedChunkReader{cr: pgproto3.NewChunkReader(p.conn), max: p.maxMessageSize}, p.conn)
+	p.log.Debug("TLS established", "version", tls.VersionName(conn.ConnectionState().Version))
+	return nil
+}
+
+// checkClientCert authenticates the user of a session by the verified certificate of the client, if the proxy
+// is configured so (see WithClientCertAuth).
+func (p *Proxy) checkClientCert(user string) error {
+	if !p.clientCertAuth {
+		return nil
+	}
+	var cert *x509.Certificate
+	if c := p.tlsConn(); c != nil {
+		if state := c.ConnectionState(); len(state.VerifiedChains) > 0 {
+			cert = state.VerifiedChains[0][0]
+		}
+	}
+	if cert == nil {
+		return newPGError(pgerrcode.InvalidAuthorizationSpecification, errors.New("connection requires a valid client certificate"))
+	}
+	name := cert.Subject.CommonName
+	if mapped, ok := p.clientCertUsers[name]; ok {
+		name = mapped
+	}
+	if name != user {
+		return newPGError(pgerrcode.InvalidAuthorizationSpecification, fmt.Errorf("certificate authentication failed for user %q", user))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package pigox
+
+import (
+	"strings"
+)
+
+// rewriteToChar strips `to_char(expr, 'pattern')` from the select list items of a query, so that the backend
+// returns the plain timestamps, and returns the to_char pattern each affected output column has to be rendered
+// with. Like in postgres, the resulting column is named "to_char" unless it has an alias.
+// to_char appearing anywhere else in the query is left alone.
+func rewriteToChar(query string) (string, map[string]string, error) {
+	if !strings.Contains(strings.ToLower(query), "to_char") {
+		return query, nil, nil
+	}
+	toks := scanSQL(query)
+
+	var patterns map[string]string
+	var res []token
+	last := 0
+	for _, item := range selectListItems(toks) {
+		var sig []int
+		for i := item[0]; i < item[1]; i++ {
+			if !toks[i].isBlank() {
+				sig = append(sig, i)
+			}
+		}
+		if len(sig) < 2 || !toks[sig[0]].is("to_char") || !toks[sig[1]].is("(") {
+			continue
+		}
+		end := matchingParen(toks[sig[1]:item[1]])
+		if end < 0 {
+			continue
+		}
+		closing := sig[1] + end
+		args := splitArgs(toks, sig[1]+1, closing)
+		if len(args) != 2 {
+			continue
+		}
+		pattern, ok := singleString(toks[args[1][0]:args[1][1]])
+		if !ok {
+			continue
+		}
+		var rest []int
+		for _, i := range sig {
+			if i > closing {
+				rest = append(rest, i)
+			}
+		}
+		alias, ok := columnAlias(toks, rest)
+		if !ok {
+			continue
+		}
+
+		res = append(res, toks[last:sig[0]]...)
+		res = append(res, toks[args[0][0]:args[0][1]]...)
+		if alias == "" {
+			alias = "to_char"
+			res = append(res, token{kind: tokIdent, text: " AS " + quoteIdent(alias)})
+		}
+		if patterns == nil {
+			patterns = map[string]string{}
+		}
+		patterns[alias] = pattern
+		last = closing + 1
+	}
+	if patterns == nil {
+		return query, nil, nil
+	}
+	res = append(res, toks[last:]...)
+	return joinTokens(res), patterns, nil
+}
+
+// splitArgs returns the [start, end) token ranges of the comma separated arguments between start and end.
+func splitArgs(toks []token, start, end int) [][2]int {
+	var args [][2]int
+	depth := 0
+	for i := start; i < end; i++ {
+		switch t := toks[i]; {
+		case t.is("(") || t.is("["):
+			depth++
+		case t.is(")") || t.is("]"):
+			depth--
+		case t.is(",") && depth == 0:
+			args = append(args, [2]int{start, i})
+			start = i + 1
+		}
+	}
+	return append(args, [2]int{start, end})
+}
+
+// singleString returns the value of a string literal, ignoring surrounding blanks.
+func singleString(toks []token) (string, bool) {
+	sig := significant(toks)
+	if len(sig) != 1 || sig[0].kind != tokString {
+		return "", false
+	}
+	return sig[0].stringValue(), true
+}
@@ -0,0 +1,121 @@
+package pigox
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+// tracerName is the instrumentation scope of the spans of the proxy.
+const tracerName = "github.com/mkmik/piggo/pigox"
+
+// WithTracerProvider traces client queries with the tracers of tp. Each query gets a span, with child spans for
+// the rewrite, the IOx PrepareQuery and Query calls and the streaming of the results to the client. The trace
+// context is propagated to IOx in the metadata of the gRPC calls, so that the spans of IOx join the trace.
+func WithTracerProvider(tp trace.TracerProvider) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.tracerProvider = tp
+	}
+}
+
+// WithTracePropagator sets how the trace context is propagated to IOx. Defaults to the W3C traceparent and
+// tracestate headers; e.g. IOx set up with a Jaeger trace context header needs a Jaeger propagator.
+func WithTracePropagator(p propagation.TextMapPropagator) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.tracePropagator = p
+	}
+}
+
+// newTracer returns the tracer of the proxy; without WithTracerProvider, spans are not recorded.
+func (o *proxyOptions) newTracer() trace.Tracer {
+	if o.tracerProvider == nil {
+		return trace.NewNoopTracerProvider().Tracer(tracerName)
+	}
+	return o.tracerProvider.Tracer(tracerName)
+}
+
+// startQuerySpan starts the span of a client query of a session.
+func (p *Proxy) startQuerySpan(ctx context.Context, s *session, query string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", "influxdb"),
+		attribute.String("db.name", s.databaseName),
+		attribute.String("db.user", s.userName),
+		attribute.Int("piggo.session", int(s.pid)),
+	}
+	if a := p.queryAttr(query); a.Key != "" {
+		attrs = append(attrs, attribute.String("db.statement", a.Value.String()))
+	}
+	return p.tracer.Start(ctx, "query", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// startClientSpan starts the span of a call to IOx made on behalf of the client request traced by ctx. Calls
+// made on behalf of the proxy itself, e.g. to test the connection at startup, are not traced.
+func (p *Proxy) startClientSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return p.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+}
+
+// endSpan ends span, marking it as failed with err if not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+// withTraceContext propagates the trace context of ctx to the gRPC calls made with the returned context.
+func (p *Proxy) withTraceContext(ctx context.Context) context.Context {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	propagator := p.tracePropagator
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	kv := make([]string, 0, 2*len(carrier))
+	for k, v := range carrier {
+		kv = append(kv, k, v)
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// streamSpan is the span of the streaming of a result to the client.
+type streamSpan struct {
+	trace.Span
+	batches, rows, bytes int
+	// writing is the time spent writing to the client.
+	writing time.Duration
+}
+
+func (p *Proxy) startStreamSpan(ctx context.Context) *streamSpan {
+	_, span := p.tracer.Start(ctx, "stream")
+	return &streamSpan{Span: span}
+}
+
+// wrote records a batch of rows written to the client, which took d.
+func (s *streamSpan) wrote(rows, bytes int, d time.Duration) {
+	s.batches++
+	s.rows += rows
+	s.bytes += bytes
+	s.writing += d
+}
+
+func (s *streamSpan) end(err error) {
+	s.SetAttributes(
+		attribute.Int("piggo.batches", s.batches),
+		attribute.Int("piggo.rows", s.rows),
+		attribute.Int("piggo.bytes", s.bytes),
+		attribute.Int64("piggo.write_time_us", s.writing.Microseconds()),
+	)
+	endSpan(s.Span, err)
+}
@@ -0,0 +1,157 @@
+package pigox
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// transactionState is the state of the transaction block of a session. IOx has no transactions: BEGIN and COMMIT
+// are accepted for the sake of clients that always send them, and the statements in between run right away.
+type transactionState int
+
+const (
+	txIdle transactionState = iota
+	// txOpen is the state between BEGIN and COMMIT or ROLLBACK.
+	txOpen
+	// txFailed is the state after a statement of a transaction block failed; like postgres, other statements
+	// are rejected until the block ends.
+	txFailed
+)
+
+// status returns the transaction status indicator of ReadyForQuery messages.
+func (t transactionState) status() byte {
+	switch t {
+	case txOpen:
+		return 'T'
+	case txFailed:
+		return 'E'
+	}
+	return 'I'
+}
+
+var errTransactionAborted = newPGError(pgerrcode.InFailedSQLTransaction, errors.New("current transaction is aborted, commands ignored until end of transaction block"))
+
+// transactionStatement is a parsed transaction control statement.
+type transactionStatement struct {
+	// verb is "begin", "commit", "rollback", "savepoint", "release", "rollback to" or "set transaction".
+	verb string
+}
+
+// parseTransactionStatement parses `BEGIN`, `START TRANSACTION`, `COMMIT`, `END`, `ROLLBACK`, `ABORT`,
+// `SAVEPOINT`, `RELEASE`, `ROLLBACK TO` and `SET TRANSACTION`/`SET SESSION CHARACTERISTICS AS TRANSACTION`,
+// with any transaction modes, e.g. `BEGIN ISOLATION LEVEL SERIALIZABLE READ ONLY`.
+// It returns nil if the query is not one of these statements.
+func parseTransactionStatement(query string) *transactionStatement {
+	toks := significant(scanSQL(query))
+	if n := len(toks); n > 0 && toks[n-1].is(";") {
+		toks = toks[:n-1]
+	}
+	if len(toks) == 0 {
+		return nil
+	}
+	// optional reports whether the statement continues with one of kws, and skips it.
+	rest := toks[1:]
+	optional := func(kws ...string) bool {
+		for _, kw := range kws {
+			if len(rest) > 0 && rest[0].is(kw) {
+				rest = rest[1:]
+				return true
+			}
+		}
+		return false
+	}
+
+	stmt := &transactionStatement{}
+	switch {
+	case toks[0].is("begin"):
+		stmt.verb = "begin"
+		optional("work", "transaction")
+	case toks[0].is("start") && optional("transaction"):
+		stmt.verb = "begin"
+	case toks[0].is("commit") || toks[0].is("end"):
+		stmt.verb = "commit"
+		optional("work", "transaction")
+	case toks[0].is("rollback") || toks[0].is("abort"):
+		stmt.verb = "rollback"
+		optional("work", "transaction")
+		if toks[0].is("rollback") && optional("to") {
+			stmt.verb = "rollback to"
+			optional("savepoint")
+		}
+	case toks[0].is("savepoint"):
+		stmt.verb = "savepoint"
+	case toks[0].is("release"):
+		stmt.verb = "release"
+		optional("savepoint")
+	case toks[0].is("set") && optional("transaction"):
+		stmt.verb = "set transaction"
+	case toks[0].is("set") && optional("session") && optional("characteristics") && optional("as") && optional("transaction"):
+		stmt.verb = "set transaction"
+	default:
+		return nil
+	}
+	// the rest are transaction modes or savepoint names, which are irrelevant to IOx.
+	for _, t := range rest {
+		if !isName(t) && !t.is(",") {
+			return nil
+		}
+	}
+	switch stmt.verb {
+	case "savepoint", "release", "rollback to":
+		if len(rest) != 1 {
+			return nil
+		}
+	}
+	return stmt
+}
+
+// endsFailedTransaction reports whether the statement is accepted in a failed transaction block.
+func (stmt *transactionStatement) endsFailedTransaction() bool {
+	return stmt.verb == "commit" || stmt.verb == "rollback" || stmt.verb == "rollback to"
+}
+
+// execTransactionStatement executes a transaction control statement and returns the messages of its result.
+// Like postgres, statements out of place are warned about.
+func execTransactionStatement(s *session, stmt *transactionStatement) ([]pgproto3.Message, error) {
+	var msgs []pgproto3.Message
+	warn := func(code, format string, args ...interface{}) {
+		if n := notice(s, "WARNING", code, format, args...); n != nil {
+			msgs = append(msgs, n)
+		}
+	}
+	tag := strings.ToUpper(stmt.verb)
+	switch stmt.verb {
+	case "begin":
+		if s.transaction != txIdle {
+			warn(pgerrcode.ActiveSQLTransaction, "there is already a transaction in progress")
+		}
+		s.transaction = txOpen
+	case "commit", "rollback":
+		switch s.transaction {
+		case txIdle:
+			warn(pgerrcode.NoActiveSQLTransaction, "there is no transaction in progress")
+		case txFailed:
+			// the failed transaction is rolled back.
+			tag = "ROLLBACK"
+		}
+		s.transaction = txIdle
+		s.closeCursors(false)
+	case "savepoint", "release", "rollback to":
+		if s.transaction == txIdle {
+			return nil, newPGError(pgerrcode.NoActiveSQLTransaction, fmt.Errorf("%s can only be used in transaction blocks", strings.ToUpper(stmt.verb)))
+		}
+		if stmt.verb == "rollback to" {
+			s.transaction, tag = txOpen, "ROLLBACK"
+		}
+	case "set transaction":
+		if s.transaction == txIdle {
+			warn(pgerrcode.NoActiveSQLTransaction, "SET TRANSACTION can only be used in transaction blocks")
+		}
+		tag = "SET"
+	}
+	return append(msgs, &pgproto3.CommandComplete{CommandTag: []byte(tag)}), nil
+}
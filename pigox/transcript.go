@@ -0,0 +1,206 @@
+package pigox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// redacted replaces the credentials recorded in transcripts.
+const redacted = "[redacted]"
+
+// lastTranscriptID numbers the transcript files created by the process.
+var lastTranscriptID int64
+
+// transcriptEntry is a line of a transcript file.
+type transcriptEntry struct {
+	Time time.Time `json:"time"`
+	// From is "client" or "server".
+	From string          `json:"from"`
+	Msg  json.RawMessage `json:"msg"`
+}
+
+// transcriptConn records the messages exchanged with a client to a transcript file, one JSON entry per line, while
+// capturing is on. Credentials are redacted and the values of rows and parameters are replaced by their size.
+//
+// The messages sent by the client are recorded as received, the ones sent to the client are decoded from the
+// bytes written to the connection.
+type transcriptConn struct {
+	net.Conn
+	dir string
+	log *slog.Logger
+
+	mu   sync.Mutex
+	file *os.File
+	// pending is the start of a message written partially.
+	pending []byte
+	// rawReply is set after an SSLRequest or GSSEncRequest, which are answered with a single byte.
+	rawReply bool
+}
+
+func newTranscriptConn(conn net.Conn, dir string, logger *slog.Logger) *transcriptConn {
+	if dir == "" {
+		return nil
+	}
+	return &transcriptConn{Conn: conn, dir: dir, log: logger}
+}
+
+// capture starts or stops recording the transcript.
+func (c *transcriptConn) capture(on bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case on && c.file == nil:
+		name := filepath.Join(c.dir, fmt.Sprintf("piggo-%s-%d.jsonl", time.Now().UTC().Format("20060102T150405"), atomic.AddInt64(&lastTranscriptID, 1)))
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			c.log.Error("cannot capture the protocol transcript", "err", err)
+			return
+		}
+		c.log.Info("capturing the protocol transcript", "file", name)
+		c.file = f
+	case !on && c.file != nil:
+		c.file.Close()
+		c.file, c.pending, c.rawReply = nil, nil, false
+	}
+}
+
+func (c *transcriptConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.sent(b[:n])
+	return n, err
+}
+
+func (c *transcriptConn) Close() error {
+	c.capture(false)
+	return c.Conn.Close()
+}
+
+// received records a message received from the client.
+func (c *transcriptConn) received(msg pgproto3.FrontendMessage) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return
+	}
+	switch msg.(type) {
+	case *pgproto3.SSLRequest, *pgproto3.GSSEncRequest:
+		c.rawReply = true
+	}
+	c.record("client", redactMessage(msg))
+}
+
+// sent records the messages in the bytes written to the client.
+func (c *transcriptConn) sent(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return
+	}
+	c.pending = append(c.pending, b...)
+	for len(c.pending) > 0 {
+		if c.rawReply {
+			c.record("server", map[string]string{"Type": "EncryptionResponse", "Response": string(c.pending[:1])})
+			c.pending, c.rawReply = c.pending[1:], false
+			continue
+		}
+		if len(c.pending) < 5 {
+			break
+		}
+		size := 1 + int(binary.BigEndian.Uint32(c.pending[1:5]))
+		if size < 5 || len(c.pending) < size {
+			break
+		}
+		raw := c.pending[:size]
+		c.pending = c.pending[size:]
+
+		msg, err := pgproto3.NewFrontend(pgproto3.NewChunkReader(bytes.NewReader(raw)), nil).Receive()
+		if err != nil {
+			c.record("server", map[string]interface{}{"Type": "Unknown", "Byte": string(raw[:1]), "Length": size, "Error": err.Error()})
+			continue
+		}
+		c.record("server", redactMessage(msg))
+	}
+	if len(c.pending) == 0 {
+		c.pending = nil
+	}
+}
+
+// record writes an entry to the transcript file; c.mu must be held.
+func (c *transcriptConn) record(from string, msg interface{}) {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		raw, _ = json.Marshal(map[string]string{"Type": fmt.Sprintf("%T", msg), "Error": err.Error()})
+	}
+	line, err := json.Marshal(transcriptEntry{Time: time.Now(), From: from, Msg: raw})
+	if err == nil {
+		_, err = c.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		c.log.Error("cannot write the protocol transcript, stopping it", "err", err)
+		c.file.Close()
+		c.file = nil
+	}
+}
+
+// redactMessage returns what is recorded of a message: credentials and data values are omitted.
+func redactMessage(msg pgproto3.Message) interface{} {
+	switch msg := msg.(type) {
+	case *pgproto3.PasswordMessage:
+		return map[string]string{"Type": "PasswordMessage", "Password": redacted}
+	case *pgproto3.SASLInitialResponse:
+		return map[string]string{"Type": "SASLInitialResponse", "AuthMechanism": msg.AuthMechanism, "Data": redacted}
+	case *pgproto3.SASLResponse:
+		return map[string]string{"Type": "SASLResponse", "Data": redacted}
+	case *pgproto3.DataRow:
+		return map[string]interface{}{"Type": "DataRow", "Values": valueSizes(msg.Values)}
+	case *pgproto3.Bind:
+		return map[string]interface{}{
+			"Type":                 "Bind",
+			"DestinationPortal":    msg.DestinationPortal,
+			"PreparedStatement":    msg.PreparedStatement,
+			"ParameterFormatCodes": msg.ParameterFormatCodes,
+			"Parameters":           valueSizes(msg.Parameters),
+			"ResultFormatCodes":    msg.ResultFormatCodes,
+		}
+	case *pgproto3.CopyData:
+		return map[string]interface{}{"Type": "CopyData", "Length": len(msg.Data)}
+	case json.Marshaler:
+		return msg
+	}
+	// the messages without their own JSON encoding, e.g. NoticeResponse, are recorded with their fields.
+	fields := map[string]interface{}{}
+	if raw, err := json.Marshal(msg); err == nil {
+		json.Unmarshal(raw, &fields)
+	}
+	fields["Type"] = strings.TrimPrefix(fmt.Sprintf("%T", msg), "*pgproto3.")
+	return fields
+}
+
+// valueSizes describes values by their size, e.g. "5 bytes"; NULLs are nil.
+func valueSizes(values [][]byte) []interface{} {
+	sizes := make([]interface{}, len(values))
+	for i, v := range values {
+		if v != nil {
+			sizes[i] = fmt.Sprintf("%d bytes", len(v))
+		}
+	}
+	return sizes
+}
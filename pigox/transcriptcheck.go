@@ -0,0 +1,245 @@
+package pigox
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// transcriptMessage holds the fields of the recorded messages the analyzer looks at.
+type transcriptMessage struct {
+	Type              string
+	Name              string
+	ObjectType        string
+	PreparedStatement string
+	DestinationPortal string
+	Portal            string
+	Fields            []json.RawMessage
+	Values            []json.RawMessage
+}
+
+// transcriptState is the protocol state tracked by AnalyzeTranscript.
+type transcriptState struct {
+	violations []string
+	line       int
+
+	// complete is set if the transcript starts with the startup of the connection; statements and portals
+	// created before the capture started are unknown otherwise.
+	complete   bool
+	started    bool
+	ready      bool
+	terminated bool
+	// awaiting counts the Query and Sync messages whose ReadyForQuery was not received yet.
+	awaiting int
+	// extended is set while the client sends extended query messages not followed by Sync yet.
+	extended int
+	// failed is set after an ErrorResponse to an extended query message, until ReadyForQuery.
+	failed bool
+	// simple is set while a simple Query runs; columns is the number of columns of its current result, -1 if
+	// no RowDescription was sent.
+	simple  bool
+	columns int
+	// pending counts the Parse, Bind and Close messages not acknowledged yet.
+	pending    map[string]int
+	statements map[string]bool
+	portals    map[string]bool
+}
+
+// AnalyzeTranscript reads a protocol transcript captured by the proxy (see WithTranscripts) and describes the
+// protocol state violations it finds, by either side: messages sent in the wrong phase or order, responses
+// without a request, results whose rows don't match their description, and requests left unanswered.
+func AnalyzeTranscript(r io.Reader) ([]string, error) {
+	st := &transcriptState{
+		columns:    -1,
+		pending:    map[string]int{},
+		statements: map[string]bool{},
+		portals:    map[string]bool{},
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, DefaultMaxMessageSize)
+	for sc.Scan() {
+		st.line++
+		var entry transcriptEntry
+		var msg transcriptMessage
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", st.line, err)
+		}
+		if err := json.Unmarshal(entry.Msg, &msg); err != nil {
+			return nil, fmt.Errorf("line %d: %w", st.line, err)
+		}
+		if st.line == 1 {
+			switch msg.Type {
+			case "StartupMessage", "SSLRequest", "GSSEncRequest", "CancelRequest":
+				st.complete = true
+			default:
+				st.started, st.ready = true, true
+			}
+		}
+		if entry.From == "client" {
+			st.client(&msg)
+		} else {
+			st.server(&msg)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case st.terminated:
+	case st.extended > 0:
+		st.violate("%d extended query messages were not followed by Sync", st.extended)
+	case st.awaiting > 0:
+		st.violate("the client was still waiting for ReadyForQuery")
+	case st.complete && !st.ready:
+		st.violate("the startup did not complete")
+	}
+	return st.violations, nil
+}
+
+func (st *transcriptState) violate(format string, a ...interface{}) {
+	st.violations = append(st.violations, fmt.Sprintf("line %d: ", st.line)+fmt.Sprintf(format, a...))
+}
+
+func (st *transcriptState) client(msg *transcriptMessage) {
+	if st.terminated {
+		st.violate("client sent %s after Terminate", msg.Type)
+		return
+	}
+	switch msg.Type {
+	case "StartupMessage", "SSLRequest", "GSSEncRequest", "CancelRequest":
+		if st.started {
+			st.violate("client sent %s after the startup message", msg.Type)
+		}
+		st.started = msg.Type == "StartupMessage" || msg.Type == "CancelRequest"
+		return
+	}
+	if !st.started {
+		st.violate("client sent %s before StartupMessage", msg.Type)
+		return
+	}
+	if !st.ready {
+		switch msg.Type {
+		case "PasswordMessage", "SASLInitialResponse", "SASLResponse", "GSSResponse", "Terminate":
+		default:
+			st.violate("client sent %s before the startup completed", msg.Type)
+		}
+	}
+
+	switch msg.Type {
+	case "Terminate":
+		st.terminated = true
+	case "Query":
+		if st.extended > 0 {
+			st.violate("client sent Query after %d extended query messages without Sync", st.extended)
+		}
+		st.awaiting++
+		st.simple, st.columns = true, -1
+	case "Parse":
+		st.extended++
+		st.pending["ParseComplete"]++
+		if msg.Name != "" {
+			if st.statements[msg.Name] {
+				st.violate("client parsed statement %q again without closing it", msg.Name)
+			}
+			st.statements[msg.Name] = true
+		}
+	case "Bind":
+		st.extended++
+		st.pending["BindComplete"]++
+		if st.complete && msg.PreparedStatement != "" && !st.statements[msg.PreparedStatement] {
+			st.violate("client bound unknown statement %q", msg.PreparedStatement)
+		}
+		st.portals[msg.DestinationPortal] = true
+	case "Describe", "Execute":
+		st.extended++
+		name := msg.Name
+		if msg.Type == "Execute" {
+			name = msg.Portal
+		}
+		switch {
+		case !st.complete || name == "":
+		case msg.Type == "Execute" || msg.ObjectType == "P":
+			if !st.portals[name] {
+				st.violate("client sent %s of unknown portal %q", msg.Type, name)
+			}
+		case !st.statements[name]:
+			st.violate("client sent Describe of unknown statement %q", name)
+		}
+	case "Close":
+		st.extended++
+		st.pending["CloseComplete"]++
+		if msg.ObjectType == "S" {
+			delete(st.statements, msg.Name)
+		} else {
+			delete(st.portals, msg.Name)
+		}
+	case "Sync":
+		st.extended = 0
+		st.awaiting++
+	case "Flush":
+	}
+}
+
+func (st *transcriptState) server(msg *transcriptMessage) {
+	switch msg.Type {
+	case "NoticeResponse", "ParameterStatus", "NotificationResponse", "EncryptionResponse":
+		// sent asynchronously.
+		return
+	}
+	if !st.ready {
+		switch msg.Type {
+		case "ReadyForQuery":
+			st.ready = true
+		case "AuthenticationOK", "AuthenticationCleartextPassword", "AuthenticationMD5Password", "AuthenticationSASL",
+			"AuthenticationSASLContinue", "AuthenticationSASLFinal", "AuthenticationGSS", "AuthenticationGSSContinue",
+			"BackendKeyData", "ErrorResponse":
+		default:
+			st.violate("server sent %s before ReadyForQuery ended the startup", msg.Type)
+		}
+		return
+	}
+	if st.failed && msg.Type != "ReadyForQuery" {
+		st.violate("server sent %s after an ErrorResponse, before ReadyForQuery", msg.Type)
+		return
+	}
+
+	switch msg.Type {
+	case "ReadyForQuery":
+		if st.awaiting == 0 {
+			st.violate("server sent ReadyForQuery without a pending Query or Sync")
+			return
+		}
+		st.awaiting--
+		st.failed, st.simple, st.columns = false, false, -1
+		if st.awaiting == 0 {
+			st.pending = map[string]int{}
+		}
+	case "ErrorResponse":
+		if !st.simple {
+			st.failed = true
+			st.pending = map[string]int{}
+		}
+		st.columns = -1
+	case "ParseComplete", "BindComplete", "CloseComplete":
+		if st.pending[msg.Type] == 0 {
+			st.violate("server sent %s without a pending request", msg.Type)
+			return
+		}
+		st.pending[msg.Type]--
+	case "RowDescription":
+		st.columns = len(msg.Fields)
+	case "DataRow":
+		switch {
+		case st.columns < 0 && st.simple:
+			st.violate("server sent DataRow without RowDescription")
+		case st.columns >= 0 && len(msg.Values) != st.columns:
+			st.violate("server sent DataRow with %d values for %d columns", len(msg.Values), st.columns)
+		}
+	case "CommandComplete", "EmptyQueryResponse":
+		if st.simple {
+			st.columns = -1
+		}
+	}
+}
@@ -0,0 +1,626 @@
+package pigox
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// sqlTypes maps the postgres type names queries cast to onto the DataFusion types they are translated to.
+var sqlTypes = map[string]string{
+	"smallint": "SMALLINT", "int2": "SMALLINT",
+	"integer": "INT", "int": "INT", "int4": "INT",
+	"bigint": "BIGINT", "int8": "BIGINT",
+	"real": "FLOAT", "float4": "FLOAT",
+	"double precision": "DOUBLE", "double": "DOUBLE", "float": "DOUBLE", "float8": "DOUBLE",
+	"numeric": "DECIMAL", "decimal": "DECIMAL",
+	"boolean": "BOOLEAN", "bool": "BOOLEAN",
+	"text": "VARCHAR", "varchar": "VARCHAR", "character varying": "VARCHAR", "character": "VARCHAR",
+	"char": "VARCHAR", "bpchar": "VARCHAR", "name": "VARCHAR", "string": "VARCHAR",
+	"timestamp": "TIMESTAMP", "timestamp without time zone": "TIMESTAMP",
+	"timestamptz": "TIMESTAMP", "timestamp with time zone": "TIMESTAMP",
+	"date": "DATE", "time": "TIME", "time without time zone": "TIME",
+	"bytea": "BYTEA", "interval": "INTERVAL",
+}
+
+// unsupportedTypes are postgres types with no DataFusion equivalent.
+var unsupportedTypes = map[string]bool{
+	"json": true, "jsonb": true, "uuid": true, "inet": true, "cidr": true, "macaddr": true, "xml": true,
+	"money": true, "point": true, "timetz": true, "time with time zone": true, "tsvector": true, "bit": true,
+}
+
+// intervalUnits maps the units of postgres interval literals onto the units DataFusion accepts.
+var intervalUnits = map[string]string{
+	"microsecond": "microseconds", "microseconds": "microseconds", "us": "microseconds", "usec": "microseconds", "usecs": "microseconds",
+	"millisecond": "milliseconds", "milliseconds": "milliseconds", "ms": "milliseconds", "msec": "milliseconds", "msecs": "milliseconds",
+	"second": "seconds", "seconds": "seconds", "s": "seconds", "sec": "seconds", "secs": "seconds",
+	"minute": "minutes", "minutes": "minutes", "m": "minutes", "min": "minutes", "mins": "minutes",
+	"hour": "hours", "hours": "hours", "h": "hours", "hr": "hours", "hrs": "hours",
+	"day": "days", "days": "days", "d": "days",
+	"week": "weeks", "weeks": "weeks", "w": "weeks",
+	"month": "months", "months": "months", "mon": "months", "mons": "months",
+	"year": "years", "years": "years", "y": "years", "yr": "years", "yrs": "years",
+	"decade": "decades", "decades": "decades",
+	"century": "centuries", "centuries": "centuries",
+}
+
+// intervalFields are the fields that can follow an interval literal, as in INTERVAL '5' MINUTE.
+var intervalFields = map[string]bool{"year": true, "month": true, "day": true, "hour": true, "minute": true, "second": true}
+
+// translateSQL translates the postgres constructs DataFusion does not accept into DataFusion SQL:
+//
+//	x::int4, CAST(x AS int4)      CAST(x AS INT), likewise for the other postgres type names (see sqlTypes)
+//	'5 mins'::interval            INTERVAL '5 minutes'
+//	INTERVAL '5' MINUTE           INTERVAL '5 minutes'
+//	CURRENT_TIMESTAMP             now()
+//	OFFSET m LIMIT n              LIMIT n OFFSET m
+//
+// The query is parsed into a syntax tree over its tokens (see sqlParser), which resolves the nesting of parentheses
+// and the operands and types of casts; printing the tree writes the constructs above in DataFusion SQL and copies
+// the rest of the query verbatim, for IOx to parse. ILIKE and the other pattern matching operators are translated
+// by rewriteTextOperators. Constructs that cannot be translated fail with an error pointing at their position.
+func translateSQL(query string) (string, error) {
+	p := &sqlParser{query: query, toks: scanSQL(query)}
+	nodes, err := p.parseNodes(nil)
+	if err != nil {
+		return "", err
+	}
+	return nodesSQL(nodes), nil
+}
+
+// sqlNode is a node of the syntax tree translateSQL parses queries into.
+type sqlNode interface {
+	// first returns the first token of the node.
+	first() token
+	// writeSQL writes the node in DataFusion SQL.
+	writeSQL(b *strings.Builder)
+}
+
+// tokenNode is a token copied verbatim, including whitespace and comments.
+type tokenNode struct {
+	tok token
+}
+
+// groupNode is a parenthesized list of nodes; close is the zero token if the group is never closed.
+type groupNode struct {
+	open, close token
+	nodes       []sqlNode
+}
+
+// castNode is a cast of operand to the DataFusion type typ.
+type castNode struct {
+	start   token
+	operand []sqlNode
+	typ     string
+	// operator is set for casts written as operand::type; the casts written as CAST(operand AS type) keep the
+	// text from the CAST keyword up to the operand, of the AS keyword and of what follows the type.
+	operator       bool
+	lead, as, tail string
+}
+
+// intervalNode is an interval literal; value is in the units DataFusion accepts (see normalizeInterval).
+type intervalNode struct {
+	start token
+	value string
+}
+
+// nowNode is CURRENT_TIMESTAMP or LOCALTIMESTAMP.
+type nowNode struct {
+	tok token
+}
+
+// offsetLimitNode is an OFFSET m [ROWS] LIMIT n clause.
+type offsetLimitNode struct {
+	start         token
+	offset, limit token
+}
+
+func (n tokenNode) first() token       { return n.tok }
+func (n groupNode) first() token       { return n.open }
+func (n castNode) first() token        { return n.start }
+func (n intervalNode) first() token    { return n.start }
+func (n nowNode) first() token         { return n.tok }
+func (n offsetLimitNode) first() token { return n.start }
+
+func (n tokenNode) writeSQL(b *strings.Builder) { b.WriteString(n.tok.text) }
+
+func (n groupNode) writeSQL(b *strings.Builder) {
+	b.WriteString(n.open.text)
+	writeNodes(b, n.nodes)
+	b.WriteString(n.close.text)
+}
+
+func (n castNode) writeSQL(b *strings.Builder) {
+	if n.operator {
+		b.WriteString("CAST(")
+		writeNodes(b, n.operand)
+		b.WriteString(" AS " + n.typ + ")")
+		return
+	}
+	b.WriteString(n.lead)
+	writeNodes(b, n.operand)
+	b.WriteString(n.as + " " + n.typ + n.tail)
+}
+
+func (n intervalNode) writeSQL(b *strings.Builder) { b.WriteString("INTERVAL " + quoteString(n.value)) }
+
+func (n nowNode) writeSQL(b *strings.Builder) { b.WriteString("now()") }
+
+func (n offsetLimitNode) writeSQL(b *strings.Builder) {
+	fmt.Fprintf(b, "LIMIT %s OFFSET %s", n.limit.text, n.offset.text)
+}
+
+func writeNodes(b *strings.Builder, nodes []sqlNode) {
+	for _, n := range nodes {
+		n.writeSQL(b)
+	}
+}
+
+func nodesSQL(nodes []sqlNode) string {
+	var b strings.Builder
+	writeNodes(&b, nodes)
+	return b.String()
+}
+
+// nodeIs reports whether n is the token node of the keyword or punctuation kw.
+func nodeIs(n sqlNode, kw string) bool {
+	t, ok := n.(tokenNode)
+	return ok && t.tok.is(kw)
+}
+
+// prevSignificantNode returns the index of the last node before nodes[i] that is not blank, or -1.
+func prevSignificantNode(nodes []sqlNode, i int) int {
+	for i--; i >= 0; i-- {
+		if t, ok := nodes[i].(tokenNode); !ok || !t.tok.isBlank() {
+			return i
+		}
+	}
+	return -1
+}
+
+// sqlParser parses the tokens of a query into the syntax tree translateSQL prints. The parser only tells apart
+// the constructs translateSQL translates, and keeps any other token as a tokenNode.
+type sqlParser struct {
+	query string
+	toks  []token
+	// i is the index of the next token.
+	i int
+}
+
+// parseNodes parses nodes up to the end of the query, or up to the first token matching stop that is not nested
+// in parentheses, which is left to the caller.
+func (p *sqlParser) parseNodes(stop func(token) bool) ([]sqlNode, error) {
+	var nodes []sqlNode
+	for p.i < len(p.toks) {
+		t := p.toks[p.i]
+		if stop != nil && stop(t) {
+			break
+		}
+		var (
+			n   sqlNode
+			err error
+		)
+		switch {
+		case t.is("("):
+			if c := prevSignificantNode(nodes, len(nodes)); c >= 0 && nodeIs(nodes[c], "cast") {
+				start, lead := nodes[c].first(), nodesSQL(nodes[c:])
+				nodes = nodes[:c]
+				n, err = p.parseCastCall(start, lead)
+			} else {
+				n, err = p.parseGroup()
+			}
+		case t.is("::"):
+			start := castOperandStart(nodes)
+			if start < 0 {
+				return nil, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("cannot translate the operand of ::")).
+					withHint("Use CAST(value AS type).").atPosition(p.query, t.pos)
+			}
+			operand := append([]sqlNode(nil), nodes[start:prevSignificantNode(nodes, len(nodes))+1]...)
+			nodes = nodes[:start]
+			n, err = p.parseCastOperator(operand)
+		case t.is("interval"):
+			n, err = p.parseInterval()
+		case t.is("current_timestamp") || t.is("localtimestamp"):
+			n = p.parseCurrentTimestamp(nodes)
+		case t.is("offset"):
+			n = p.parseOffsetLimit()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			n = tokenNode{tok: t}
+			p.i++
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// parseGroup parses a parenthesized group of nodes, starting at its opening parenthesis.
+func (p *sqlParser) parseGroup() (sqlNode, error) {
+	g := groupNode{open: p.toks[p.i]}
+	p.i++
+	nodes, err := p.parseNodes(func(t token) bool { return t.is(")") })
+	if err != nil {
+		return nil, err
+	}
+	g.nodes = nodes
+	if p.i < len(p.toks) {
+		g.close = p.toks[p.i]
+		p.i++
+	}
+	return g, nil
+}
+
+// parseCastCall parses the arguments of CAST(operand AS type), starting at the opening parenthesis; start is the
+// CAST keyword and lead the text up to the operand.
+func (p *sqlParser) parseCastCall(start token, lead string) (sqlNode, error) {
+	lead += p.toks[p.i].text
+	p.i++
+	operand, err := p.parseNodes(func(t token) bool { return t.is("as") || t.is(")") })
+	if err != nil {
+		return nil, err
+	}
+	if p.i >= len(p.toks) {
+		return nil, syntaxErrorAt(p.query, p.toks, -1)
+	}
+	if !p.toks[p.i].is("as") {
+		return nil, syntaxErrorAt(p.query, p.toks, p.i)
+	}
+	as := p.toks[p.i]
+	typ, end, err := parseSQLType(p.query, p.toks, nextSignificant(p.toks, p.i))
+	if err != nil {
+		return nil, err
+	}
+	closing := nextSignificant(p.toks, end)
+	if closing < 0 || !p.toks[closing].is(")") {
+		return nil, syntaxErrorAt(p.query, p.toks, closing)
+	}
+	tail := joinTokens(p.toks[end+1 : closing+1])
+	p.i = closing + 1
+	if typ == "INTERVAL" {
+		return intervalCast(p.query, operand, as)
+	}
+	return castNode{start: start, lead: lead, operand: operand, as: as.text, typ: typ, tail: tail}, nil
+}
+
+// parseCastOperator parses the type of operand::type, starting at the :: operator.
+func (p *sqlParser) parseCastOperator(operand []sqlNode) (sqlNode, error) {
+	op := p.toks[p.i]
+	typ, end, err := parseSQLType(p.query, p.toks, nextSignificant(p.toks, p.i))
+	if err != nil {
+		return nil, err
+	}
+	p.i = end + 1
+	if typ == "INTERVAL" {
+		return intervalCast(p.query, operand, op)
+	}
+	return castNode{start: operand[0].first(), operand: operand, typ: typ, operator: true}, nil
+}
+
+// parseInterval parses INTERVAL 'literal' [field], starting at the INTERVAL keyword. It returns nil if the keyword
+// is not followed by a literal.
+func (p *sqlParser) parseInterval() (sqlNode, error) {
+	j := nextSignificant(p.toks, p.i)
+	if j < 0 || p.toks[j].kind != tokString {
+		return nil, nil
+	}
+	field, end := "", j
+	if k := nextSignificant(p.toks, j); k >= 0 && p.toks[k].kind == tokIdent && intervalFields[strings.ToLower(p.toks[k].text)] {
+		field, end = strings.ToLower(p.toks[k].text), k
+	}
+	s, ok := normalizeInterval(p.toks[j].stringValue(), field)
+	if !ok {
+		return nil, invalidIntervalError(p.query, p.toks[j])
+	}
+	start := p.toks[p.i]
+	p.i = end + 1
+	return intervalNode{start: start, value: s}, nil
+}
+
+// parseCurrentTimestamp parses CURRENT_TIMESTAMP or LOCALTIMESTAMP; it returns nil for the columns and functions
+// of the same name.
+func (p *sqlParser) parseCurrentTimestamp(nodes []sqlNode) sqlNode {
+	if prev := prevSignificantNode(nodes, len(nodes)); prev >= 0 && nodeIs(nodes[prev], ".") {
+		return nil
+	}
+	if next := nextSignificant(p.toks, p.i); next >= 0 && p.toks[next].is("(") {
+		return nil
+	}
+	t := p.toks[p.i]
+	p.i++
+	return nowNode{tok: t}
+}
+
+// parseOffsetLimit parses OFFSET m [ROWS] LIMIT n; it returns nil for OFFSET clauses that are not followed by LIMIT.
+func (p *sqlParser) parseOffsetLimit() sqlNode {
+	m := nextSignificant(p.toks, p.i)
+	if m < 0 || !isRowCount(p.toks[m]) {
+		return nil
+	}
+	l := nextSignificant(p.toks, m)
+	if l >= 0 && (p.toks[l].is("row") || p.toks[l].is("rows")) {
+		l = nextSignificant(p.toks, l)
+	}
+	if l < 0 || !p.toks[l].is("limit") {
+		return nil
+	}
+	n := nextSignificant(p.toks, l)
+	if n < 0 || !(isRowCount(p.toks[n]) || p.toks[n].is("all")) {
+		return nil
+	}
+	node := offsetLimitNode{start: p.toks[p.i], offset: p.toks[m], limit: p.toks[n]}
+	p.i = n + 1
+	return node
+}
+
+// castOperandStart returns the index of the first node of the operand of a :: cast following nodes: a value,
+// a possibly qualified column, a function call, a parenthesized expression or another cast. It returns -1 if
+// nodes do not end with an operand.
+func castOperandStart(nodes []sqlNode) int {
+	start := prevSignificantNode(nodes, len(nodes))
+	if start < 0 {
+		return -1
+	}
+	switch n := nodes[start].(type) {
+	case tokenNode:
+		if n.tok.kind == tokPunct || n.tok.kind == tokIdent && nonFunctionKeywords[strings.ToLower(n.tok.text)] {
+			return -1
+		}
+	case groupNode:
+		if c := prevSignificantNode(nodes, start); c >= 0 && isFunctionName(nodes[c]) {
+			start = c
+		}
+	}
+	for {
+		t, ok := nodes[start].(tokenNode)
+		if !ok || !isName(t.tok) {
+			return start
+		}
+		dot := prevSignificantNode(nodes, start)
+		if dot < 0 || !nodeIs(nodes[dot], ".") {
+			return start
+		}
+		q := prevSignificantNode(nodes, dot)
+		if q < 0 {
+			return start
+		}
+		if t, ok := nodes[q].(tokenNode); !ok || !isName(t.tok) {
+			return start
+		}
+		start = q
+	}
+}
+
+// isFunctionName reports whether n is a name that can be called, as opposed to a keyword followed by parentheses.
+func isFunctionName(n sqlNode) bool {
+	t, ok := n.(tokenNode)
+	return ok && isName(t.tok) && !(t.tok.kind == tokIdent && nonFunctionKeywords[strings.ToLower(t.tok.text)])
+}
+
+// parseSQLType parses the type name starting at toks[i], e.g. `double precision`, `pg_catalog.int4`
+// or `numeric(10, 2)`. It returns the DataFusion type and the index of the last token of the type name.
+func parseSQLType(query string, toks []token, i int) (string, int, error) {
+	if i < 0 || !isName(toks[i]) || toks[i].kind == tokIdent && nonFunctionKeywords[strings.ToLower(toks[i].text)] {
+		return "", 0, syntaxErrorAt(query, toks, i)
+	}
+	start := i
+	if k := nextSignificant(toks, i); k >= 0 && toks[k].is(".") {
+		if j := nextSignificant(toks, k); j >= 0 && isName(toks[j]) {
+			i = j
+		}
+	}
+	name := toks[i].identName()
+	next := func(kw string) bool {
+		if j := nextSignificant(toks, i); j >= 0 && toks[j].is(kw) {
+			i = j
+			return true
+		}
+		return false
+	}
+	switch name {
+	case "double":
+		if next("precision") {
+			name += " precision"
+		}
+	case "character":
+		if next("varying") {
+			name += " varying"
+		}
+	}
+	var modifiers string
+	if j := nextSignificant(toks, i); j >= 0 && toks[j].is("(") {
+		c := closingParen(toks, j)
+		if c < 0 {
+			return "", 0, syntaxErrorAt(query, toks, j)
+		}
+		modifiers, i = strings.TrimSpace(joinTokens(toks[j+1:c])), c
+	}
+	if name == "timestamp" || name == "time" {
+		for _, zone := range []string{"with", "without"} {
+			if j := i; next(zone) {
+				if !next("time") || !next("zone") {
+					return "", 0, syntaxErrorAt(query, toks, nextSignificant(toks, j))
+				}
+				name += " " + zone + " time zone"
+				break
+			}
+		}
+	}
+	if j := nextSignificant(toks, i); j >= 0 && toks[j].is("[") {
+		return "", 0, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("array types are not supported by IOx")).atPosition(query, toks[j].pos)
+	}
+
+	typ, ok := sqlTypes[name]
+	if !ok {
+		typ, ok = catalogCastTypes[name]
+	}
+	switch {
+	case unsupportedTypes[name]:
+		return "", 0, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("type %s is not supported by IOx", name)).atPosition(query, toks[start].pos)
+	case !ok:
+		return "", 0, newPGError(pgerrcode.UndefinedObject, fmt.Errorf("type %q does not exist", name)).atPosition(query, toks[start].pos)
+	case typ == "DECIMAL" && modifiers != "":
+		typ += "(" + modifiers + ")"
+	}
+	return typ, i, nil
+}
+
+// intervalCast translates the cast of operand to an interval; only string literals can be cast. at is the token
+// errors point at for empty operands.
+func intervalCast(query string, operand []sqlNode, at token) (sqlNode, error) {
+	var sig []sqlNode
+	for _, n := range operand {
+		if t, ok := n.(tokenNode); !ok || !t.tok.isBlank() {
+			sig = append(sig, n)
+		}
+	}
+	if len(sig) == 1 {
+		switch n := sig[0].(type) {
+		case intervalNode:
+			return n, nil
+		case tokenNode:
+			if n.tok.kind == tokString {
+				s, ok := normalizeInterval(n.tok.stringValue(), "")
+				if !ok {
+					return nil, invalidIntervalError(query, n.tok)
+				}
+				return intervalNode{start: n.tok, value: s}, nil
+			}
+		}
+	}
+	if len(sig) > 0 {
+		at = sig[0].first()
+	}
+	return nil, newPGError(pgerrcode.FeatureNotSupported, fmt.Errorf("only literals can be cast to interval")).atPosition(query, at.pos)
+}
+
+// normalizeInterval rewrites a postgres interval literal, e.g. `1 day 02:30:00` or `5 mins ago`, with the units
+// DataFusion accepts: `1 days 2 hours 30 minutes`. field is the unit of a literal holding a bare number, if any.
+func normalizeInterval(s, field string) (string, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(strings.ToLower(s)), "@")
+	if field != "" {
+		s += " " + field
+	}
+	var parts []string
+	ago := false
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		if s == "ago" {
+			ago = true
+			break
+		}
+		n := 0
+		if s[0] == '+' || s[0] == '-' {
+			n++
+		}
+		digits := n
+		for n < len(s) && (isDigit(s[n]) || s[n] == '.') {
+			n++
+		}
+		if n == digits {
+			return "", false
+		}
+		number := s[:n]
+		if n < len(s) && s[n] == ':' {
+			// hh:mm[:ss]
+			end := strings.IndexByte(s, ' ')
+			if end < 0 {
+				end = len(s)
+			}
+			clock := strings.Split(s[:end], ":")
+			if len(clock) > 3 {
+				return "", false
+			}
+			for c, unit := range []string{"hours", "minutes", "seconds"}[:len(clock)] {
+				if clock[c] == "" || strings.Trim(clock[c], "+-0123456789.") != "" {
+					return "", false
+				}
+				parts = append(parts, clock[c]+" "+unit)
+			}
+			s = s[end:]
+			continue
+		}
+		s = strings.TrimSpace(s[n:])
+		u := 0
+		for u < len(s) && s[u] >= 'a' && s[u] <= 'z' {
+			u++
+		}
+		unit := "seconds"
+		if u > 0 && s[:u] != "ago" {
+			var ok bool
+			if unit, ok = intervalUnits[s[:u]]; !ok {
+				return "", false
+			}
+			s = s[u:]
+		}
+		parts = append(parts, number+" "+unit)
+	}
+	if len(parts) == 0 {
+		return "", false
+	}
+	if ago {
+		for i, p := range parts {
+			if strings.HasPrefix(p, "-") {
+				parts[i] = p[1:]
+			} else {
+				parts[i] = "-" + strings.TrimPrefix(p, "+")
+			}
+		}
+	}
+	return strings.Join(parts, " "), true
+}
+
+// intervalUnitDurations are the lengths of the units of interval literals, as normalized by normalizeInterval.
+// Months and longer units have no fixed length, and are approximated.
+var intervalUnitDurations = map[string]time.Duration{
+	"microseconds": time.Microsecond,
+	"milliseconds": time.Millisecond,
+	"seconds":      time.Second,
+	"minutes":      time.Minute,
+	"hours":        time.Hour,
+	"days":         24 * time.Hour,
+	"weeks":        7 * 24 * time.Hour,
+	"months":       30 * 24 * time.Hour,
+	"years":        365 * 24 * time.Hour,
+	"decades":      10 * 365 * 24 * time.Hour,
+	"centuries":    100 * 365 * 24 * time.Hour,
+}
+
+// intervalDuration returns the length of an interval literal, e.g. '30 days' or '1 day 02:00'.
+func intervalDuration(s string) (time.Duration, bool) {
+	s, ok := normalizeInterval(s, "")
+	if !ok {
+		return 0, false
+	}
+	fields := strings.Fields(s)
+	var d time.Duration
+	for i := 0; i+1 < len(fields); i += 2 {
+		n, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return 0, false
+		}
+		d += time.Duration(n * float64(intervalUnitDurations[fields[i+1]]))
+	}
+	return d, true
+}
+
+// isRowCount reports whether a token can be the row count of a LIMIT or OFFSET clause.
+func isRowCount(t token) bool {
+	return t.kind == tokNumber || t.kind == tokParam
+}
+
+func invalidIntervalError(query string, t token) error {
+	return newPGError(pgerrcode.InvalidDatetimeFormat, fmt.Errorf("invalid input syntax for type interval: %q", t.stringValue())).atPosition(query, t.pos)
+}
+
+// syntaxErrorAt returns a syntax error at toks[i], or at the end of the query if i is negative.
+func syntaxErrorAt(query string, toks []token, i int) error {
+	if i < 0 {
+		return newPGError(pgerrcode.SyntaxError, fmt.Errorf("syntax error at end of input")).atPosition(query, len(query))
+	}
+	return newPGError(pgerrcode.SyntaxError, fmt.Errorf("syntax error at or near %q", toks[i].text)).atPosition(query, toks[i].pos)
+}
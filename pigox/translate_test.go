@@ -0,0 +1,67 @@
+package pigox
+
+import (
+	"testing"
+
+	"github.com/jackc/pgerrcode"
+)
+
+func TestTranslateSQL(t *testing.T) {
+	tests := []struct {
+		query, want string
+	}{
+		// only the translated constructs are rewritten; the rest keeps its case and spacing.
+		{`SELECT Host, "Usage"  FROM Cpu WHERE Region = 'EU'`, `SELECT Host, "Usage"  FROM Cpu WHERE Region = 'EU'`},
+		{`SELECT usage::int4 FROM cpu`, `SELECT CAST(usage AS INT) FROM cpu`},
+		{`SELECT Cast(Usage As float8) FROM cpu`, `SELECT Cast(Usage As DOUBLE) FROM cpu`},
+		{`SELECT (a + b)::numeric(10, 2) FROM t`, `SELECT CAST((a + b) AS DECIMAL(10, 2)) FROM t`},
+		{`SELECT * FROM cpu WHERE time > NOW() - '5 mins'::interval`, `SELECT * FROM cpu WHERE time > NOW() - INTERVAL '5 minutes'`},
+		{`SELECT * FROM cpu WHERE time > now() - Interval '1' Day`, `SELECT * FROM cpu WHERE time > now() - INTERVAL '1 days'`},
+		{`SELECT CAST('1 day 02:30' AS interval)`, `SELECT INTERVAL '1 days 02 hours 30 minutes'`},
+		{`SELECT Current_Timestamp`, `SELECT now()`},
+		{`SELECT * FROM cpu Offset 5 Limit 10`, `SELECT * FROM cpu LIMIT 10 OFFSET 5`},
+		// the operands of casts are resolved in the syntax tree.
+		{`SELECT t.a::text::int, max(a) :: float8, -1::int2 FROM t`, `SELECT CAST(CAST(t.a AS VARCHAR) AS INT), CAST(max(a) AS DOUBLE), -CAST(1 AS SMALLINT) FROM t`},
+		{`SELECT CAST( CAST(a AS text) || 'x'  AS  varchar(10) ) FROM t`, `SELECT CAST( CAST(a AS VARCHAR) || 'x'  AS VARCHAR ) FROM t`},
+		{`SELECT (SELECT a AS b FROM t OFFSET 1 LIMIT 2)::bigint`, `SELECT CAST((SELECT a AS b FROM t LIMIT 2 OFFSET 1) AS BIGINT)`},
+		{`SELECT a FROM t WHERE b = 'x::int' AND t.current_timestamp < Current_Timestamp`, `SELECT a FROM t WHERE b = 'x::int' AND t.current_timestamp < now()`},
+		{`SELECT * FROM t OFFSET 5`, `SELECT * FROM t OFFSET 5`},
+	}
+	for _, tt := range tests {
+		got, err := translateSQL(tt.query)
+		if err != nil || got != tt.want {
+			t.Errorf("translateSQL(%q) = %q, %v; want %q", tt.query, got, err, tt.want)
+		}
+	}
+}
+
+func TestTranslateSQLErrors(t *testing.T) {
+	tests := []struct {
+		query, code string
+		position    int32
+	}{
+		{`SELECT x::jsonb FROM t`, pgerrcode.FeatureNotSupported, 11},
+		{`SELECT x::nosuchtype FROM t`, pgerrcode.UndefinedObject, 11},
+		{`SELECT INTERVAL '5 fortnights'`, pgerrcode.InvalidDatetimeFormat, 17},
+		{`SELECT CAST('5 fortnights' AS interval)`, pgerrcode.InvalidDatetimeFormat, 13},
+		// constructs that cannot be translated.
+		{`SELECT a + ::int FROM t`, pgerrcode.FeatureNotSupported, 12},
+		{`SELECT a::interval FROM t`, pgerrcode.FeatureNotSupported, 8},
+		{`SELECT CAST(now() - a AS interval) FROM t`, pgerrcode.FeatureNotSupported, 13},
+		{`SELECT a::int[] FROM t`, pgerrcode.FeatureNotSupported, 14},
+		{`SELECT CAST(a) FROM t`, pgerrcode.SyntaxError, 14},
+		{`SELECT CAST(a AS int FROM t`, pgerrcode.SyntaxError, 22},
+		{`SELECT CAST(a AS`, pgerrcode.SyntaxError, 17},
+		{`SELECT a:: FROM t`, pgerrcode.SyntaxError, 12},
+	}
+	for _, tt := range tests {
+		_, err := translateSQL(tt.query)
+		if code := errorCode(err); code != tt.code {
+			t.Errorf("translateSQL(%q): got %v (code %s), want code %s", tt.query, err, code, tt.code)
+			continue
+		}
+		if pos := err.(*pgError).position; pos != tt.position {
+			t.Errorf("translateSQL(%q): error at %d, want %d", tt.query, pos, tt.position)
+		}
+	}
+}
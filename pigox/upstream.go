@@ -0,0 +1,319 @@
+package pigox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/jackc/pgerrcode"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC metadata keys attached to IOx requests, so that backend operators can attribute querier load.
+const (
+	metadataUser             = "pigox-user"
+	metadataDatabase         = "pigox-database"
+	metadataApplicationName  = "pigox-application-name"
+	metadataQueryFingerprint = "pigox-query-fingerprint"
+
+	// metadataAuthorization carries the password of the client, which IOx authenticates as a bearer token.
+	metadataAuthorization = "authorization"
+)
+
+// runQuery runs a query on IOx on behalf of a session.
+// Queries referring to tables of other databases are federated; see planFederation.
+// The pg_catalog relations and the information_schema tables and columns are emulated; see expandCatalog.
+// Catalog queries are answered with the Flight SQL metadata RPCs or from the catalog cache if enabled.
+func (p *Proxy) runQuery(ctx context.Context, session *session, query string) (recordReader, error) {
+	if session.orderByTime {
+		query = injectTimeOrder(query)
+	}
+	if session.rollups {
+		if q, rule := rerouteRollup(query, p.rollupRules, time.Now()); rule != nil {
+			p.log.Debug("rerouting query to rollup table", "table", rule.Table, "rollup", rule.Target, "min_range", rule.MinRange)
+			query = q
+			if rule.Database != "" {
+				rerouted := *session
+				rerouted.databaseName = rule.Database
+				session = &rerouted
+			}
+		}
+	}
+	parts, err := planFederation(query, session.databaseName)
+	if err != nil {
+		return nil, err
+	} else if parts != nil {
+		return p.runFederated(ctx, session, parts)
+	}
+	if r, ok, err := p.flightSQL.answer(ctx, session, query, p.authorize); ok {
+		return r, err
+	}
+	if query, err = p.expandCatalog(ctx, session, query); err != nil {
+		return nil, err
+	}
+	if p.catalog != nil && isCatalogQuery(query) {
+		return p.runCatalogQuery(ctx, session, query)
+	}
+	if plan := planTimeFanout(query, session.timeFanout, p.timeFanoutMinRange); plan != nil {
+		return p.runFanout(ctx, session, query, plan)
+	}
+	return p.runQueryUpstream(ctx, session, query)
+}
+
+const (
+	// DefaultUpstreamRetries is the number of times queries failing with a transient IOx error are retried.
+	DefaultUpstreamRetries = 3
+	// DefaultUpstreamRetryBackoff is the time waited before the first retry; it doubles on every retry.
+	DefaultUpstreamRetryBackoff = 100 * time.Millisecond
+	// maxUpstreamRetryBackoff bounds the time waited between retries.
+	maxUpstreamRetryBackoff = 5 * time.Second
+)
+
+// WithUpstreamRetries retries the queries failing because IOx is unavailable or exhausted its resources up to
+// retries times, waiting backoff before the first retry and twice as long before each following one. Zero
+// values select DefaultUpstreamRetries and DefaultUpstreamRetryBackoff; negative retries disable retrying.
+func WithUpstreamRetries(retries int, backoff time.Duration) func(opts *proxyOptions) {
+	return func(opts *proxyOptions) {
+		opts.upstreamRetries = retries
+		opts.upstreamRetryBackoff = backoff
+	}
+}
+
+// runQueryUpstream runs a query on IOx.
+//
+// If the connection to IOx is broken, it is re-established. Queries failing with a transient error, e.g.
+// because IOx is restarting, are retried as configured with WithUpstreamRetries, re-establishing the
+// connection if IOx was unreachable, so that a backend restart doesn't fail the client sessions. SELECTs are
+// also retried if the result stream breaks before returning any row, e.g. because the querier running it is
+// being rolled out.
+func (p *Proxy) runQueryUpstream(ctx context.Context, session *session, query string) (recordReader, error) {
+	ctx = withQueryMetadata(ctx, session, query)
+	if err := p.ensureConnected(ctx); err != nil {
+		return nil, err
+	}
+	reader, err := p.queryWithRetries(ctx, session, query)
+	if err != nil || !isSelect(query) {
+		return reader, err
+	}
+	return &retryingReader{recordReader: reader, log: p.log, retry: func(err error) (recordReader, error) {
+		if err := p.awaitRetry(ctx, err, 0); err != nil {
+			return nil, err
+		}
+		return p.queryWithRetries(ctx, session, query)
+	}}, nil
+}
+
+// queryWithRetries runs a query on IOx, retrying it while it fails with a transient error.
+func (p *Proxy) queryWithRetries(ctx context.Context, session *session, query string) (recordReader, error) {
+	retries := p.upstreamRetries
+	if retries == 0 {
+		retries = DefaultUpstreamRetries
+	}
+	for attempt := 0; ; attempt++ {
+		reader, err := p.query(ctx, session, query)
+		if !isTransient(err) {
+			return reader, err
+		}
+		if attempt >= retries {
+			return nil, transientError(err, attempt+1)
+		}
+		p.log.Warn("IOx query failed, retrying", "err", err, "attempt", attempt+1)
+		if err := p.awaitRetry(ctx, err, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// awaitRetry waits before retrying a query that failed with a transient error for the given attempt, and
+// re-establishes the connection to IOx if it was unreachable.
+func (p *Proxy) awaitRetry(ctx context.Context, err error, attempt int) error {
+	backoff := p.upstreamRetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultUpstreamRetryBackoff
+	}
+	for i := 0; i < attempt && backoff < maxUpstreamRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxUpstreamRetryBackoff {
+		backoff = maxUpstreamRetryBackoff
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+	if grpcCode(err) == codes.Unavailable {
+		if err := p.reconnect(ctx); err != nil {
+			// the next attempt fails as well, and is retried if attempts are left.
+			p.log.Warn("cannot reconnect to IOx", "err", err)
+		}
+	}
+	return nil
+}
+
+// isTransient reports whether a query failed because IOx is temporarily unavailable or out of resources, so
+// that it may succeed if retried.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	code := grpcCode(err)
+	return code == codes.Unavailable || code == codes.ResourceExhausted
+}
+
+// transientError returns the error reported to clients for a query that failed with a transient error after the
+// given number of attempts.
+func transientError(err error, attempts int) error {
+	perr := newPGError(pgerrcode.ConnectionFailure, fmt.Errorf("IOx is unavailable: %w", err))
+	if grpcCode(err) == codes.ResourceExhausted {
+		perr = newPGError(pgerrcode.InsufficientResources, fmt.Errorf("IOx is out of resources: %w", err))
+	}
+	if attempts > 1 {
+		perr.withHint("The query was tried %d times.", attempts)
+	}
+	return perr
+}
+
+// ensureConnected re-establishes the connection to IOx if it broke while the session was idle, e.g. because
+// IOx restarted.
+func (p *Proxy) ensureConnected(ctx context.Context) error {
+	if st := p.ioxClient().GetState(); st == connectivity.TransientFailure || st == connectivity.Shutdown {
+		p.log.Warn("IOx connection broke, reconnecting", "state", st.String())
+		return p.reconnect(ctx)
+	}
+	return nil
+}
+
+// isSelect reports whether query is a SELECT, that can be run again without side effects.
+func isSelect(query string) bool {
+	toks := significant(scanSQL(query))
+	return len(toks) > 0 && (toks[0].is("select") || toks[0].is("with"))
+}
+
+// retryingReader runs its query again if the result stream fails with a transient error before returning any row.
+type retryingReader struct {
+	recordReader
+	// retry runs the query again after it failed with err; it is reset once used or once rows were returned.
+	retry func(err error) (recordReader, error)
+	log   *slog.Logger
+}
+
+func (r *retryingReader) Read() (arrow.Record, error) {
+	rec, err := r.recordReader.Read()
+	if err != nil && err != io.EOF && r.retry != nil && isTransient(err) {
+		retry := r.retry
+		r.retry = nil
+		r.log.Warn("IOx result stream broke before returning rows, retrying query", "err", err)
+		reader, rerr := retry(err)
+		if rerr != nil {
+			return nil, rerr
+		}
+		if !reader.Schema().Equal(r.recordReader.Schema()) {
+			reader.Release()
+			return nil, err
+		}
+		r.recordReader.Release()
+		r.recordReader = reader
+		rec, err = reader.Read()
+	}
+	if err == nil && rec.NumRows() > 0 {
+		r.retry = nil
+	}
+	return rec, err
+}
+
+// withQueryMetadata attaches the attribution metadata of a query, and the token of the session, to the outgoing
+// gRPC context.
+func withQueryMetadata(ctx context.Context, session *session, query string) context.Context {
+	kv := []string{
+		metadataUser, metadataValue(session.userName),
+		metadataDatabase, metadataValue(session.databaseName),
+		metadataApplicationName, metadataValue(session.applicationName),
+		metadataQueryFingerprint, queryFingerprint(query),
+	}
+	if session.token != "" {
+		kv = append(kv, metadataAuthorization, "Bearer "+session.token)
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+func (p *Proxy) query(ctx context.Context, session *session, query string) (recordReader, error) {
+	if err := p.authorize(ctx, session, query); err != nil {
+		return nil, err
+	}
+	client := p.ioxClient()
+	if b, ok := ctx.Value(boundParamsKey{}).(*boundParams); ok && b.query == query {
+		if _, ok := client.(statementPreparer); ok {
+			return p.queryBound(ctx, session, client, b)
+		}
+	}
+	q, err := p.prepareQuery(ctx, session, client, query)
+	if err != nil {
+		return nil, err
+	}
+	qctx, span := p.startClientSpan(ctx, "iox.Query")
+	reader, err := q.query.Query(p.withTraceContext(qctx))
+	endSpan(span, err)
+	p.stmtCache.release(q, err != nil)
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// queryFingerprint identifies queries that differ only in literal values, whitespace, comments or
+// keyword case.
+func queryFingerprint(query string) string {
+	h := fnv.New64a()
+	for _, t := range significant(scanSQL(query)) {
+		switch t.kind {
+		case tokString, tokNumber, tokParam:
+			h.Write([]byte("?"))
+		case tokIdent:
+			h.Write([]byte(strings.ToLower(t.text)))
+		default:
+			h.Write([]byte(t.text))
+		}
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// metadataValue escapes the bytes not allowed in gRPC metadata values (printable ASCII) as %XX.
+func metadataValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpcCode returns the gRPC status code of a possibly wrapped error.
+func grpcCode(err error) codes.Code {
+	st, _ := grpcStatus(err)
+	return st.Code()
+}
+
+// grpcStatus returns the gRPC status of a possibly wrapped error.
+func grpcStatus(err error) (*status.Status, bool) {
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus(), true
+	}
+	return status.FromError(err)
+}
@@ -0,0 +1,112 @@
+package pigox
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgerrcode"
+	"google.golang.org/grpc/codes"
+)
+
+// grpcErrorCodes are the SQLSTATE codes of the errors IOx returns with each gRPC status code, unless the message
+// tells more; see messageErrorCodes.
+var grpcErrorCodes = map[codes.Code]string{
+	codes.Canceled:           pgerrcode.QueryCanceled,
+	codes.InvalidArgument:    pgerrcode.SyntaxErrorOrAccessRuleViolation,
+	codes.DeadlineExceeded:   pgerrcode.QueryCanceled,
+	codes.NotFound:           pgerrcode.UndefinedObject,
+	codes.AlreadyExists:      pgerrcode.DuplicateObject,
+	codes.PermissionDenied:   pgerrcode.InsufficientPrivilege,
+	codes.ResourceExhausted:  pgerrcode.InsufficientResources,
+	codes.FailedPrecondition: pgerrcode.ObjectNotInPrerequisiteState,
+	codes.Aborted:            pgerrcode.TransactionRollback,
+	codes.OutOfRange:         pgerrcode.DataException,
+	codes.Unimplemented:      pgerrcode.FeatureNotSupported,
+	codes.Unavailable:        pgerrcode.ConnectionFailure,
+	codes.Unauthenticated:    pgerrcode.InvalidAuthorizationSpecification,
+}
+
+// messageErrorCodes recognize the errors of DataFusion by their message, whatever their gRPC status code.
+var messageErrorCodes = []struct {
+	re   *regexp.Regexp
+	code string
+	// hint, if set, is the hint of the error.
+	hint string
+}{
+	{regexp.MustCompile(`(?i)table '([^']+)' not found`), pgerrcode.UndefinedTable, "SELECT table_name FROM information_schema.tables lists the tables of the database."},
+	{regexp.MustCompile(`(?i)no field named '?"?([^'"\s,.]+(?:\.[^'"\s,.]+)*)`), pgerrcode.UndefinedColumn, ""},
+	{regexp.MustCompile(`(?i)invalid function '([^']+)'|no (?:built-in )?function named '?([^'\s]+)`), pgerrcode.UndefinedFunction, ""},
+	{regexp.MustCompile(`(?i)(?:database|namespace) '?([^'\s]+)'? not found`), pgerrcode.InvalidCatalogName, ""},
+	{regexp.MustCompile(`(?i)sql parser error|ParserError`), pgerrcode.SyntaxError, ""},
+	{regexp.MustCompile(`(?i)divide by zero`), pgerrcode.DivisionByZero, ""},
+}
+
+// upstreamError returns the error reported to clients for an error returned by IOx: gRPC errors get the SQLSTATE
+// code of their status and message, the first line of the message as message and the rest as detail. Other
+// errors are returned unchanged.
+func upstreamError(err error) error {
+	var perr *pgError
+	if err == nil || errors.As(err, &perr) {
+		return err
+	}
+	st, ok := grpcStatus(err)
+	if !ok || st.Code() == codes.OK {
+		return err
+	}
+	msg, detail, _ := strings.Cut(strings.TrimSpace(st.Message()), "\n")
+	if msg == "" {
+		return err
+	}
+	code, ok := grpcErrorCodes[st.Code()]
+	if !ok {
+		code = pgerrcode.InternalError
+	}
+	var hint string
+	for _, m := range messageErrorCodes {
+		if m.re.MatchString(msg) {
+			code, hint = m.code, m.hint
+			break
+		}
+	}
+	// e.g. No field named 'x'. Valid fields are 'cpu.host', 'cpu.time'.
+	if i := strings.Index(msg, ". Valid fields are "); i >= 0 {
+		msg, detail = msg[:i], strings.TrimSpace(msg[i+2:]+"\n"+detail)
+	}
+	return &pgError{error: errors.New(msg), code: code, detail: strings.TrimSpace(detail), hint: hint}
+}
+
+// clientError returns the error reported to clients for a query error: IOx errors are mapped with upstreamError
+// and, if they refer to a table, column or function by name, point at its first occurrence in source, the query
+// as sent by the client.
+func clientError(err error, source string) error {
+	err = upstreamError(err)
+	var perr *pgError
+	if !errors.As(err, &perr) || perr.position != 0 {
+		return err
+	}
+	for _, m := range messageErrorCodes {
+		if m.code != perr.code {
+			continue
+		}
+		groups := m.re.FindStringSubmatch(perr.Error())
+		if groups == nil {
+			break
+		}
+		for _, name := range groups[1:] {
+			if name == "" {
+				continue
+			}
+			// names may be qualified, e.g. iox.cpu or cpu.host.
+			name = name[strings.LastIndex(name, ".")+1:]
+			for _, t := range scanSQL(source) {
+				if isName(t) && t.identName() == name {
+					perr.atPosition(source, t.pos)
+					return err
+				}
+			}
+		}
+		break
+	}
+	return err
+}
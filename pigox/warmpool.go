@@ -0,0 +1,99 @@
+package pigox
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+const warmDialTimeout = 10 * time.Second
+
+// warmPool keeps a number of pre-dialed IOx clients whose gRPC channel is already established,
+// so that new sessions don't pay the connection (and TLS) setup latency during their startup handshake.
+//
+// Taking a client out of the pool triggers dialing a replacement in the background.
+type warmPool struct {
+	config  backendConfig
+	clients chan backend
+	stop    context.CancelFunc
+	log     *slog.Logger
+}
+
+func newWarmPool(size int, config backendConfig, logger *slog.Logger) *warmPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	config.DialOptions = append(config.DialOptions[:len(config.DialOptions):len(config.DialOptions)], grpc.WithBlock())
+	wp := &warmPool{
+		config:  config,
+		clients: make(chan backend, size),
+		stop:    cancel,
+		log:     logger,
+	}
+	go wp.run(ctx)
+	return wp
+}
+
+// run keeps the pool full until ctx is done.
+func (wp *warmPool) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		dctx, cancel := context.WithTimeout(ctx, warmDialTimeout)
+		c, err := wp.config.dial(dctx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			wp.log.Warn("cannot pre-dial IOx", "address", wp.config.Address, "err", err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+			continue
+		}
+		backoff = time.Second
+
+		select {
+		case wp.clients <- c:
+		case <-ctx.Done():
+			c.Close()
+			return
+		}
+	}
+}
+
+// get returns a warm client, or false if none is available.
+func (wp *warmPool) get() (backend, bool) {
+	if wp == nil {
+		return nil, false
+	}
+	for {
+		select {
+		case c := <-wp.clients:
+			if c.GetState() == connectivity.Shutdown {
+				continue
+			}
+			return c, true
+		default:
+			return nil, false
+		}
+	}
+}
+
+func (wp *warmPool) close() {
+	wp.stop()
+	for {
+		select {
+		case c := <-wp.clients:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
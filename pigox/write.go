@@ -0,0 +1,84 @@
+package pigox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// ioxWriter writes line protocol to the HTTP write API of an IOx router.
+type ioxWriter struct {
+	url    string
+	client *http.Client
+}
+
+// newIOxWriter returns a writer to the router at address, which is a host:port or a URL; connections are dialed
+// with dialer if not nil.
+func newIOxWriter(address string, dialer Dialer) *ioxWriter {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if dialer != nil {
+		transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer(ctx, addr)
+		}
+	}
+	return &ioxWriter{url: strings.TrimSuffix(address, "/") + "/api/v2/write", client: &http.Client{Transport: transport}}
+}
+
+// write writes lines to the namespace database with the token of the session, and returns the write token IOx
+// identifies the write with. IOx namespaces are named org_bucket after the org and bucket of the write API.
+// Writes IOx rejects fail with a *pgError.
+func (w *ioxWriter) write(ctx context.Context, database, token, lines string) (string, error) {
+	i := strings.Index(database, "_")
+	if i <= 0 || i == len(database)-1 {
+		return "", newPGError(pgerrcode.InvalidCatalogName, fmt.Errorf("cannot write to database %q: IOx namespaces written to must be named org_bucket", database))
+	}
+	query := url.Values{"org": {database[:i]}, "bucket": {database[i+1:]}, "precision": {"ns"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url+"?"+query.Encode(), strings.NewReader(lines))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return resp.Header.Get("X-IOx-Write-Token"), nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	msg := strings.TrimSpace(string(body))
+	var apiErr struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Message != "" {
+		msg = apiErr.Message
+	}
+	err = fmt.Errorf("IOx rejected the write: %s: %s", resp.Status, msg)
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		return "", newPGError(pgerrcode.DataException, err)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "", newPGError(pgerrcode.InsufficientPrivilege, err)
+	case http.StatusNotFound:
+		return "", newPGError(pgerrcode.InvalidCatalogName, err)
+	case http.StatusRequestEntityTooLarge:
+		return "", newPGError(pgerrcode.ProgramLimitExceeded, err)
+	}
+	return "", fmt.Errorf("IOx write failed: %s: %s", resp.Status, msg)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	influxdbiox "github.com/influxdata/influxdb-iox-client-go"
+	"github.com/mkmik/piggo/pigox"
+)
+
+// ShellCmd runs an interactive client querying IOx directly through piggo's rewriting and rendering.
+type ShellCmd struct {
+	IOxAddress string `name:"iox-querier-grpc-address" optional:"" default:"localhost:8082" env:"PIGOX_IOX_QUERIER_GRPC_ADDRESS"`
+	Database   string `required:"" env:"PGDATABASE"`
+}
+
+// Run reads statements from stdin until EOF or \q.
+func (cmd *ShellCmd) Run(cli *Context) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	client, err := influxdbiox.NewClient(ctx, &influxdbiox.ClientConfig{
+		Address:  cmd.IOxAddress,
+		Database: cmd.Database,
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	sh := pigox.NewShell(client, cmd.Database)
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		sh.Prompt = true
+	}
+	return sh.Run(ctx, os.Stdin, os.Stdout)
+}
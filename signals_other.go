@@ -0,0 +1,8 @@
+//go:build windows || plan9
+
+package main
+
+import "os"
+
+// there are no conventional signals to reopen logs and dump statistics on this platform.
+var reopenSignal, statsSignal os.Signal
@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// reopenSignal asks the proxy to reopen its log file.
+	reopenSignal os.Signal = syscall.SIGHUP
+	// statsSignal asks the proxy to log its statistics and a goroutine dump.
+	statsSignal os.Signal = syscall.SIGUSR1
+)
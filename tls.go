@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mkmik/piggo/pigox"
+)
+
+// certReloadInterval is how often the certificate files are checked for changes.
+const certReloadInterval = time.Minute
+
+// serverTLSConfig returns the TLS configuration of client connections, or nil if no certificate is configured.
+func (cmd *ServeCmd) serverTLSConfig() (*tls.Config, error) {
+	switch {
+	case cmd.TLSCert == "" && cmd.TLSKey == "":
+		if cmd.TLSClientCA != "" || cmd.ClientCertAuth {
+			return nil, errors.New("client certificates require --tls-cert and --tls-key")
+		}
+		return nil, nil
+	case cmd.TLSCert == "" || cmd.TLSKey == "":
+		return nil, errors.New("--tls-cert and --tls-key must be given together")
+	case cmd.ClientCertAuth && cmd.TLSClientCA == "":
+		return nil, errors.New("--client-cert-auth requires --tls-client-ca")
+	}
+
+	certs, err := pigox.NewCertReloader(cmd.TLSCert, cmd.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	go certs.Watch(context.Background(), certReloadInterval)
+	cfg := &tls.Config{GetCertificate: certs.GetCertificate}
+
+	if cmd.TLSClientCA != "" {
+		pem, err := os.ReadFile(cmd.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cmd.TLSClientCA)
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
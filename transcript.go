@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mkmik/piggo/pigox"
+)
+
+// TranscriptCmd checks protocol transcripts for protocol state violations.
+type TranscriptCmd struct {
+	Files []string `arg:"" type:"existingfile" help:"Transcript files captured with --transcript-dir."`
+}
+
+// Run prints the violations found in each transcript; it fails if there are any.
+func (cmd *TranscriptCmd) Run(cli *Context) error {
+	total := 0
+	for _, name := range cmd.Files {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		violations, err := pigox.AnalyzeTranscript(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		for _, v := range violations {
+			fmt.Printf("%s: %s\n", name, v)
+		}
+		total += len(violations)
+	}
+	if total > 0 {
+		return fmt.Errorf("%d protocol violations found", total)
+	}
+	fmt.Println("ok: no protocol violations found")
+	return nil
+}